@@ -20,6 +20,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
@@ -33,6 +34,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/wekafs/csi-wekafs/pkg/wekafs"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
@@ -107,6 +109,36 @@ var (
 	setOwnershipOnDynamicFilesystems     = flag.Bool("setownershipondynamicfilesystems", false, "Set ownership on Dynamic Filesystems (only OrgAdmin/CSI user that created the filesystem will be able to mount it")
 	allowMountOptionOverrides            = flag.Bool("allowmountoptionoverrides", false, "Allow mount option overrides via PVC and pod annotations")
 	keepThinProvisioningRatioOnExpand    = flag.Bool("keepthinprovisioningratioonexpand", true, "On filesystem expansion, scale thin-provisioning min-SSD and max-SSD to preserve their ratios to total capacity")
+	auditSinks                           = flag.String("auditsinks", "", "Comma-separated list of sinks for audit trail of mutating Weka API operations: stdout, file, event (empty disables audit)")
+	auditLogPath                         = flag.String("auditlogpath", "/var/log/weka-csi/audit.log", "Path of audit log file when file audit sink is used")
+	auditLogMaxSizeMB                    = flag.Int("auditlogmaxsizemb", 100, "Maximum size in MB of audit log file before it is rotated")
+	auditLogMaxBackups                   = flag.Int("auditlogmaxbackups", 5, "Maximum number of rotated audit log files to keep")
+	enableVolumeUsageMetrics             = flag.Bool("enablevolumeusagemetrics", false, "Export per-PVC usage and quota metrics from the leading controller")
+	volumeUsageMetricsIntervalSeconds    = flag.Int("volumeusagemetricsintervalseconds", 300, "Interval in seconds between collections of per-PVC usage metrics")
+	enableFailureEvents                  = flag.Bool("enablefailureevents", true, "Publish Kubernetes events on PVCs and pods when CSI operations fail")
+	failureEventsIntervalSeconds         = flag.Int("failureeventsintervalseconds", 300, "Interval in seconds during which identical failure events are not published again")
+	enableOtlpMetrics                    = flag.Bool("otlpmetrics", false, "Export metrics to OpenTelemetry endpoint set by tracingurl")
+	enableOtlpLogs                       = flag.Bool("otlplogs", false, "Export logs to OpenTelemetry endpoint set by tracingurl")
+	enableOrphanReconciler               = flag.Bool("enableorphanreconciler", false, "Periodically report Weka objects created by the driver that no PersistentVolume or VolumeSnapshotContent refers to")
+	orphanReconcileIntervalSeconds       = flag.Int("orphanreconcileintervalseconds", 3600, "Interval in seconds between lookups of orphaned Weka objects")
+	orphanDeletionGracePeriodSeconds     = flag.Int("orphandeletiongraceperiodseconds", 0, "Delete Weka objects that stay orphaned for this number of seconds, 0 disables deletion")
+	orphanDeletionDryRun                 = flag.Bool("orphandeletiondryrun", false, "Only report orphaned Weka objects that would be deleted")
+	garbageCollectionMaxThreads          = flag.Int("garbagecollectionmaxthreads", 32, "Maximum number of concurrent deletions during garbage collection of directory volumes data")
+	garbageCollectionOpsPerSecond        = flag.Int("garbagecollectionopspersecond", 0, "Maximum number of files and directories deleted per second during garbage collection, 0 for unlimited")
+	trashRetentionSeconds                = flag.Int("trashretentionseconds", 0, "Keep contents of deleted directory volumes in trash for this number of seconds, during which they can be undeleted. 0 purges them right away")
+	enableMountWatchdog                  = flag.Bool("enablemountwatchdog", false, "Periodically probe published volumes on the node for hung or stale mounts and remount them")
+	mountWatchdogIntervalSeconds         = flag.Int("mountwatchdogintervalseconds", 60, "Interval in seconds between probes of mounts by the mount watchdog")
+	mountWatchdogTimeoutSeconds          = flag.Int("mountwatchdogtimeoutseconds", 10, "Time in seconds after which a stat of a mount is considered hung")
+	unmountTimeoutSeconds                = flag.Int("unmounttimeoutseconds", 30, "Time in seconds after which an unmount is escalated to a forced and then to a lazy unmount")
+	nfsKerberosKeytab                    = flag.String("nfskerberoskeytab", "", "Path of node keytab used for NFS mounts with Kerberos security flavors, empty disables Kerberos")
+	nfsKerberosHostKeytab                = flag.String("nfskerberoshostkeytab", "", "Path of dedicated host keytab rpc.gssd is configured to use for NFS, where the node keytab is installed to")
+	allowPerVolumeTransport              = flag.Bool("allowpervolumetransport", false, "Serve both WekaFS and NFS transports on node and choose one per volume by StorageClass parameter or PVC annotation")
+	enableNfsClientRuleCleanup           = flag.Bool("enablenfsclientrulecleanup", false, "Periodically delete NFS client group rules of nodes that left the cluster")
+	nfsClientRuleCleanupIntervalSeconds  = flag.Int("nfsclientrulecleanupintervalseconds", 600, "Interval in seconds between cleanups of NFS client group rules")
+	nfsClientRuleGracePeriodSeconds      = flag.Int("nfsclientrulegraceperiodseconds", 3600, "Delete NFS client group rules of nodes that are gone for this number of seconds")
+	nfsClientRuleCleanupDryRun           = flag.Bool("nfsclientrulecleanupdryrun", false, "Only report NFS client group rules of departed nodes that would be deleted")
+	mountOptionProfilesDir               = flag.String("mountoptionprofilesdir", "", "Directory holding a file of mount option modifiers per mount options profile, usually a mounted ConfigMap")
+	enableOperationJournal               = flag.Bool("enableoperationjournal", false, "Journal volume and snapshot creations in ConfigMaps and replay interrupted ones when controller becomes the leader")
 	// Set by the build process
 	version = ""
 )
@@ -134,8 +166,10 @@ func main() {
 	flag.Var(&mutuallyExclusiveMountOptionsStrings, "mutuallyexclusivemountoptions", "Set list of mount options that cannot be set together")
 
 	flag.Parse()
+	var logOutput io.Writer = os.Stderr
 	if !*usejsonlogging {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339Nano}).With().Caller().Logger()
+		logOutput = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339Nano}
+		log.Logger = log.Output(logOutput).With().Caller().Logger()
 	}
 	zerolog.SetGlobalLevel(mapVerbosity(*verbosity))
 
@@ -175,6 +209,7 @@ func main() {
 		log.Error().Err(err).Msg("Failed to set up OpenTelemetry tracerProvider")
 	} else {
 		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 		log.Info().Str("tracing_url", url).Msg("OpenTelemetry tracing initialized")
 		ctx, cancel := context.WithCancel(ctx)
 		c := make(chan os.Signal, 1)
@@ -207,12 +242,43 @@ func main() {
 		}()
 	}
 
+	if *enableOtlpMetrics && url != "" {
+		mp, err := wekafs.MeterProvider(version, url, csiMode)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to set up OpenTelemetry meterProvider")
+		} else {
+			otel.SetMeterProvider(mp)
+			log.Info().Str("tracing_url", url).Msg("OpenTelemetry metrics export initialized")
+			defer func() {
+				if err := mp.Shutdown(ctx); err != nil {
+					log.Error().Err(err).Msg("Failed to shutdown metrics export")
+				}
+			}()
+		}
+	}
+
+	if *enableOtlpLogs && url != "" {
+		lp, err := wekafs.LoggerProvider(version, url, csiMode)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to set up OpenTelemetry loggerProvider")
+		} else {
+			// OpenTelemetry writer consumes the JSON log lines, console writer is fed with the same lines
+			log.Logger = log.Output(zerolog.MultiLevelWriter(logOutput, wekafs.NewOtelLogWriter(lp)))
+			log.Info().Str("tracing_url", url).Msg("OpenTelemetry logs export initialized")
+			defer func() {
+				if err := lp.Shutdown(ctx); err != nil {
+					log.Error().Err(err).Msg("Failed to shutdown logs export")
+				}
+			}()
+		}
+	}
+
 	handle(ctx)
 	os.Exit(0)
 }
 
 func handle(ctx context.Context) {
-	config := wekafs.NewDriverConfig(*dynamicSubPath,
+	config, err := wekafs.NewDriverConfig(*dynamicSubPath,
 		*newVolumePrefix,
 		*newSnapshotPrefix,
 		*seedSnapshotPrefix,
@@ -251,7 +317,39 @@ func handle(ctx context.Context) {
 		*setOwnershipOnDynamicFilesystems,
 		*allowMountOptionOverrides,
 		*keepThinProvisioningRatioOnExpand,
+		*auditSinks,
+		*auditLogPath,
+		*auditLogMaxSizeMB,
+		*auditLogMaxBackups,
+		*enableVolumeUsageMetrics,
+		*volumeUsageMetricsIntervalSeconds,
+		*enableFailureEvents,
+		*failureEventsIntervalSeconds,
+		*enableOperationJournal,
+		*enableOrphanReconciler,
+		*orphanReconcileIntervalSeconds,
+		*orphanDeletionGracePeriodSeconds,
+		*orphanDeletionDryRun,
+		*garbageCollectionMaxThreads,
+		*garbageCollectionOpsPerSecond,
+		*trashRetentionSeconds,
+		*enableMountWatchdog,
+		*mountWatchdogIntervalSeconds,
+		*mountWatchdogTimeoutSeconds,
+		*unmountTimeoutSeconds,
+		*nfsKerberosKeytab,
+		*nfsKerberosHostKeytab,
+		*allowPerVolumeTransport,
+		*enableNfsClientRuleCleanup,
+		*nfsClientRuleCleanupIntervalSeconds,
+		*nfsClientRuleGracePeriodSeconds,
+		*nfsClientRuleCleanupDryRun,
+		*mountOptionProfilesDir,
 	)
+	if err != nil {
+		fmt.Printf("Failed to initialize driver configuration: %s", err.Error())
+		os.Exit(1)
+	}
 	driver, err := wekafs.NewWekaFsDriver(*driverName, *nodeID, *endpoint, *maxVolumesPerNode, version, *debugPath, csiMode, *selinuxSupport, config)
 	if err != nil {
 		fmt.Printf("Failed to initialize driver: %s", err.Error())
@@ -53,6 +53,8 @@ type ApiClient struct {
 	containerName              string
 	NfsInterfaceGroupName      string
 	NfsClientGroupName         string
+	NfsClientIp                string // IP address of the node registered in the NFS client group
+	auditSink                  AuditSink
 
 	containers           *ContainersResponse
 	containersUpdateTime time.Time
@@ -169,6 +171,11 @@ func (a *ApiClient) generateHash() uint32 {
 		a.Credentials.Organization,
 		a.Credentials.Endpoints,
 		a.Credentials.NfsTargetIPs,
+		a.Credentials.NfsTargetIpZones,
+		a.Credentials.NfsIpSelection,
+		a.Credentials.SmbUsername,
+		a.Credentials.SmbPassword,
+		a.Credentials.SmbDomain,
 		a.Credentials.LocalContainerName,
 		a.Credentials.CaCertificate,
 		a.Credentials.KmsPreexistingCredentialsForVolumeEncryption.InsecureString(),
@@ -0,0 +1,246 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuditInfo describes the CSI-level identity of an operation that issues Weka API calls.
+// It is attached to the request context by the CSI servers and picked up by ApiClient when auditing mutating requests
+type AuditInfo struct {
+	CsiOperation string `json:"csi_operation,omitempty"`
+	VolumeId     string `json:"volume_id,omitempty"`
+	SnapshotId   string `json:"snapshot_id,omitempty"`
+	PvcNamespace string `json:"pvc_namespace,omitempty"`
+	PvcName      string `json:"pvc_name,omitempty"`
+}
+
+type auditInfoContextKey struct{}
+
+// ContextWithAuditInfo returns a copy of ctx carrying the audit info.
+// Empty fields of info are inherited from an audit info already present in ctx
+func ContextWithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	existing := AuditInfoFromContext(ctx)
+	if info.CsiOperation == "" {
+		info.CsiOperation = existing.CsiOperation
+	}
+	if info.VolumeId == "" {
+		info.VolumeId = existing.VolumeId
+	}
+	if info.SnapshotId == "" {
+		info.SnapshotId = existing.SnapshotId
+	}
+	if info.PvcNamespace == "" {
+		info.PvcNamespace = existing.PvcNamespace
+	}
+	if info.PvcName == "" {
+		info.PvcName = existing.PvcName
+	}
+	return context.WithValue(ctx, auditInfoContextKey{}, info)
+}
+
+// AuditInfoFromContext returns the audit info stored in ctx, or an empty one
+func AuditInfoFromContext(ctx context.Context) AuditInfo {
+	if ctx == nil {
+		return AuditInfo{}
+	}
+	if info, ok := ctx.Value(auditInfoContextKey{}).(AuditInfo); ok {
+		return info
+	}
+	return AuditInfo{}
+}
+
+// AuditRecord is a single entry of the audit trail, produced for every mutating Weka API request
+type AuditRecord struct {
+	AuditInfo
+	Timestamp   time.Time `json:"timestamp"`
+	ClusterGuid string    `json:"cluster_guid,omitempty"`
+	ClusterName string    `json:"cluster_name,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Payload     string    `json:"payload,omitempty"`
+	HttpStatus  int       `json:"http_status"`
+	Error       string    `json:"error,omitempty"`
+	TraceId     string    `json:"trace_id,omitempty"`
+}
+
+// AuditSink receives audit records. Implementations must be safe for concurrent use
+type AuditSink interface {
+	Write(ctx context.Context, record *AuditRecord) error
+}
+
+// isMutatingMethod returns true for HTTP methods that change state on the Weka cluster
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// SetAuditSink sets the sink receiving audit records of mutating requests, nil disables auditing
+func (a *ApiClient) SetAuditSink(sink AuditSink) {
+	a.auditSink = sink
+}
+
+// audit emits an audit record for a mutating request. Failures to write the record are logged but never fail the request
+func (a *ApiClient) audit(ctx context.Context, method, path string, payload *[]byte, endpoint string, statusCode int, reqErr error) {
+	if a.auditSink == nil || !isMutatingMethod(method) {
+		return
+	}
+	if path == ApiPathLogin || path == ApiPathRefresh {
+		// authentication does not modify cluster state
+		return
+	}
+	record := &AuditRecord{
+		AuditInfo:   AuditInfoFromContext(ctx),
+		Timestamp:   time.Now().UTC(),
+		ClusterName: a.ClusterName,
+		Endpoint:    endpoint,
+		Method:      method,
+		Path:        path,
+		HttpStatus:  statusCode,
+	}
+	if a.ClusterGuid != [16]byte{} {
+		record.ClusterGuid = a.ClusterGuid.String()
+	}
+	if payload != nil {
+		record.Payload = maskPayload(string(*payload))
+	}
+	if reqErr != nil {
+		record.Error = reqErr.Error()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		record.TraceId = sc.TraceID().String()
+	}
+	if err := a.auditSink.Write(ctx, record); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("method", method).Str("path", path).Msg("Failed to write audit record")
+	}
+}
+
+// StdoutAuditSink writes audit records as JSON lines to standard output
+type StdoutAuditSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewStdoutAuditSink() *StdoutAuditSink {
+	return &StdoutAuditSink{encoder: json.NewEncoder(os.Stdout)}
+}
+
+func (s *StdoutAuditSink) Write(_ context.Context, record *AuditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(record)
+}
+
+// FileAuditSink writes audit records as JSON lines to a file, rotating it once it exceeds maxSize.
+// Up to maxBackups rotated files are kept as <path>.1 ... <path>.N, the oldest being discarded
+type FileAuditSink struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewFileAuditSink(path string, maxSizeBytes int64, maxBackups int) (*FileAuditSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no audit log path specified")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	s := &FileAuditSink{
+		path:       path,
+		maxSize:    maxSizeBytes,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", s.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat audit log %s: %w", s.path, err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+		for i := s.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileAuditSink) Write(_ context.Context, record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.Lock()
+	defer s.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log %s: %w", s.path, err)
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the underlying audit log file
+func (s *FileAuditSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+// MultiAuditSink fans out audit records to several sinks
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Write(ctx context.Context, record *AuditRecord) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryAuditSink struct {
+	records []*AuditRecord
+}
+
+func (m *memoryAuditSink) Write(_ context.Context, record *AuditRecord) error {
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestContextWithAuditInfo(t *testing.T) {
+	ctx := ContextWithAuditInfo(context.Background(), AuditInfo{CsiOperation: "CreateVolume", PvcName: "data", PvcNamespace: "default"})
+	ctx = ContextWithAuditInfo(ctx, AuditInfo{VolumeId: "weka/v2/fs1"})
+	info := AuditInfoFromContext(ctx)
+	assert.Equal(t, "CreateVolume", info.CsiOperation)
+	assert.Equal(t, "weka/v2/fs1", info.VolumeId)
+	assert.Equal(t, "data", info.PvcName)
+	assert.Equal(t, "default", info.PvcNamespace)
+	assert.Equal(t, AuditInfo{}, AuditInfoFromContext(context.Background()))
+}
+
+func TestApiClientAudit(t *testing.T) {
+	sink := &memoryAuditSink{}
+	a := &ApiClient{ClusterName: "test"}
+	a.SetAuditSink(sink)
+	ctx := ContextWithAuditInfo(context.Background(), AuditInfo{CsiOperation: "DeleteVolume", VolumeId: "weka/v2/fs1"})
+	payload := []byte(`{"name":"fs1","password":"secret"}`)
+
+	a.audit(ctx, "GET", "fileSystems", nil, "127.0.0.1:14000", 200, nil)
+	a.audit(ctx, "POST", ApiPathLogin, &payload, "127.0.0.1:14000", 200, nil)
+	assert.Empty(t, sink.records, "non-mutating requests must not be audited")
+
+	a.audit(ctx, "DELETE", "fileSystems/uid", &payload, "127.0.0.1:14000", 200, nil)
+	require.Len(t, sink.records, 1)
+	r := sink.records[0]
+	assert.Equal(t, "DeleteVolume", r.CsiOperation)
+	assert.Equal(t, "weka/v2/fs1", r.VolumeId)
+	assert.Equal(t, "127.0.0.1:14000", r.Endpoint)
+	assert.Equal(t, 200, r.HttpStatus)
+	assert.NotContains(t, r.Payload, "secret")
+}
+
+func TestApiClientAuditFailedRequest(t *testing.T) {
+	sink := &memoryAuditSink{}
+	a := &ApiClient{ClusterName: "test"}
+	a.SetAuditSink(sink)
+	payload := []byte(`{"name":"fs1"}`)
+
+	_, err := a.do(context.Background(), "POST", "fileSystems", &payload, nil)
+	assert.Error(t, err)
+	require.Len(t, sink.records, 1, "requests failing before being sent must be audited")
+	assert.Equal(t, 0, sink.records[0].HttpStatus)
+	assert.NotEmpty(t, sink.records[0].Error)
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	sink, err := NewFileAuditSink(path, 200, 2)
+	require.NoError(t, err)
+	defer func() { _ = sink.Close() }()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.Write(context.Background(), &AuditRecord{Method: "POST", Path: "fileSystems", HttpStatus: 200}))
+	}
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := &AuditRecord{}
+		assert.NoError(t, json.Unmarshal([]byte(line), record))
+		assert.Equal(t, "POST", record.Method)
+	}
+}
@@ -24,6 +24,7 @@ type WekaCompatibilityRequiredVersions struct {
 	ResolvePathToInode               string
 	ResolvePathToInodeCsiRole        string
 	SetSelfAsFilesystemOwnerOnCreate string
+	NfsForNonRootOrganizations       string
 }
 
 var MinimumSupportedWekaVersions = &WekaCompatibilityRequiredVersions{
@@ -44,6 +45,7 @@ var MinimumSupportedWekaVersions = &WekaCompatibilityRequiredVersions{
 	ResolvePathToInode:               "v4.3",   // can resolve a path to an inode instead of doing it via mount
 	ResolvePathToInodeCsiRole:        "v4.4.7", // can resolve a path to an inode via API with CSI role
 	SetSelfAsFilesystemOwnerOnCreate: "v5.1",   // CSI can create filesystems while setting itself as explicit filesystem owner
+	NfsForNonRootOrganizations:       "v4.4",   // organization users can manage NFS client groups and permissions of their organization
 }
 
 type WekaCompatibilityMap struct {
@@ -64,6 +66,7 @@ type WekaCompatibilityMap struct {
 	ResolvePathToInode               bool
 	ResolvePathToInodeCsiRole        bool
 	SetSelfAsFilesystemOwnerOnCreate bool
+	NfsForNonRootOrganizations       bool
 }
 
 func (cm *WekaCompatibilityMap) fillIn(versionStr string) {
@@ -87,6 +90,7 @@ func (cm *WekaCompatibilityMap) fillIn(versionStr string) {
 		cm.ResolvePathToInode = false
 		cm.ResolvePathToInodeCsiRole = false
 		cm.SetSelfAsFilesystemOwnerOnCreate = false
+		cm.NfsForNonRootOrganizations = false
 
 		return
 	}
@@ -107,6 +111,7 @@ func (cm *WekaCompatibilityMap) fillIn(versionStr string) {
 	rp, _ := version.NewVersion(MinimumSupportedWekaVersions.ResolvePathToInode)
 	rpc, _ := version.NewVersion(MinimumSupportedWekaVersions.ResolvePathToInodeCsiRole)
 	sfo, _ := version.NewVersion(MinimumSupportedWekaVersions.SetSelfAsFilesystemOwnerOnCreate)
+	nfo, _ := version.NewVersion(MinimumSupportedWekaVersions.NfsForNonRootOrganizations)
 
 	cm.DirectoryAsCSIVolume = v.GreaterThanOrEqual(d)
 	cm.FilesystemAsCSIVolume = v.GreaterThanOrEqual(f)
@@ -125,6 +130,7 @@ func (cm *WekaCompatibilityMap) fillIn(versionStr string) {
 	cm.ResolvePathToInode = v.GreaterThanOrEqual(rp)
 	cm.ResolvePathToInodeCsiRole = v.GreaterThanOrEqual(rpc)
 	cm.SetSelfAsFilesystemOwnerOnCreate = v.GreaterThanOrEqual(sfo)
+	cm.NfsForNonRootOrganizations = v.GreaterThanOrEqual(nfo)
 }
 
 func (a *ApiClient) SupportsQuotaDirectoryAsVolume() bool {
@@ -199,3 +205,7 @@ func (a *ApiClient) SupportsResolvePathToInode() bool {
 func (a *ApiClient) SupportsSettingSelfAsFilesystemOwner() bool {
 	return a.CompatibilityMap.SetSelfAsFilesystemOwnerOnCreate
 }
+
+func (a *ApiClient) SupportsNfsForNonRootOrganizations() bool {
+	return a.CompatibilityMap.NfsForNonRootOrganizations
+}
@@ -84,6 +84,7 @@ func TestWekaCompatibilityMap_fillIn(t *testing.T) {
 				EncryptionWithNoKms:             true,
 				EncryptionWithClusterKey:        true,
 				EncryptionWithCustomSettings:    true,
+				NfsForNonRootOrganizations:      true,
 			},
 		},
 	}
@@ -29,6 +29,11 @@ type Credentials struct {
 	AutoUpdateEndpoints                          bool
 	CaCertificate                                string
 	NfsTargetIPs                                 []string
+	NfsTargetIpZones                             map[string]string // zone served by each NFS target IP, used by topology aware IP selection
+	NfsIpSelection                               string
+	SmbUsername                                  string // user mounting SMB shares, usually of the Active Directory joined by the cluster
+	SmbPassword                                  string
+	SmbDomain                                    string
 	KmsPreexistingCredentialsForVolumeEncryption KmsVaultCredentials // those are used as is to pass to filesystem creation
 	KmsKeyManagementCredentials                  KmsVaultCredentials // those are used by the CSI plugin to connect to vault and create new credentials //TODO: not implemented
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+
 	"github.com/google/uuid"
 )
 
@@ -223,6 +225,7 @@ func (e ApiRetriesExceeded) Error() string {
 var ObjectNotFoundError = errors.New("object not found")
 var MultipleObjectsFoundError = errors.New("ambiguous filter, multiple objects match")
 var RequestMissingParams = errors.New("request cannot be sent since some required params are missing")
+var NfsNotSupportedForOrganizationError = errors.New("NFS transport is not supported for organization")
 
 // ApiNonTransientError is internally generated when non-transient error is found
 type ApiNonTransientError struct {
@@ -236,6 +239,10 @@ func (e ApiNonTransientError) getType() string {
 	return "ApiNonTransientError"
 }
 
+func (e ApiNonTransientError) Unwrap() error {
+	return e.apiError
+}
+
 type transportError struct {
 	Err error
 }
@@ -247,3 +254,66 @@ func (e transportError) Error() string {
 func (e transportError) getType() string {
 	return "transportError"
 }
+
+var errorReasonsByType = map[string]string{
+	"ApiError":              "WekaApiError",
+	"ApiNoEndpointsError":   "WekaApiUnreachable",
+	"ApiNetworkError":       "WekaApiUnreachable",
+	"transportError":        "WekaApiUnreachable",
+	"ApiAuthorizationError": "WekaApiUnauthorized",
+	"ApiForbiddenError":     "WekaApiForbidden",
+	"ApiBadRequestError":    "WekaApiBadRequest",
+	"ApiConflictError":      "WekaApiConflict",
+	"ApiInternalError":      "WekaApiInternalError",
+	"ApiNotAvailableError":  "WekaApiUnavailable",
+	"ApiNotFoundError":      "WekaObjectNotFound",
+	"ApiRetriesExceeded":    "WekaApiRetriesExceeded",
+}
+
+var errorReasonsBySentinel = []struct {
+	err    error
+	reason string
+}{
+	{MountPermissionDenied, "MountPermissionDenied"},
+	{ObjectNotFoundError, "WekaObjectNotFound"},
+	{MultipleObjectsFoundError, "WekaObjectAmbiguous"},
+	{AsyncOperationTimedOut, "WekaOperationTimedOut"},
+	{ObjectMarkedForDeletion, "WekaObjectMarkedForDeletion"},
+}
+
+// ErrorReason returns a short CamelCase reason describing the class of an API error, e.g. "WekaApiForbidden".
+// As errors are often flattened to strings (e.g. into gRPC status messages) before reaching the caller,
+// the error text is matched against known error types when the error chain carries no typed error.
+// Empty string is returned for errors that did not originate from the API client
+func ErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var ae apiError
+	if errors.As(err, &ae) {
+		if nte, ok := ae.(ApiNonTransientError); ok {
+			return ErrorReason(nte.Unwrap())
+		}
+		if reason, ok := errorReasonsByType[ae.getType()]; ok {
+			return reason
+		}
+	}
+	for _, s := range errorReasonsBySentinel {
+		if errors.Is(err, s.err) {
+			return s.reason
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range errorReasonsBySentinel {
+		if strings.Contains(msg, strings.ToLower(s.err.Error())) {
+			return s.reason
+		}
+	}
+	for errType, reason := range errorReasonsByType {
+		if errType != "ApiError" && strings.Contains(msg, strings.ToLower(errType)+":") {
+			return reason
+		}
+	}
+	return ""
+}
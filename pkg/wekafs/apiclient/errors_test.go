@@ -0,0 +1,28 @@
+package apiclient
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorReason(t *testing.T) {
+	notFound := &ApiNotFoundError{Text: "filesystem group not found", StatusCode: 404, ApiResponse: &ApiResponse{}}
+	forbidden := ApiForbiddenError{Text: "forbidden", StatusCode: 403, ApiResponse: &ApiResponse{}}
+
+	assert.Equal(t, "", ErrorReason(nil))
+	assert.Equal(t, "", ErrorReason(errors.New("some other failure")))
+	assert.Equal(t, "WekaObjectNotFound", ErrorReason(notFound))
+	assert.Equal(t, "WekaApiForbidden", ErrorReason(fmt.Errorf("failed to create filesystem: %w", forbidden)))
+	assert.Equal(t, "WekaObjectNotFound", ErrorReason(ApiNonTransientError{notFound}))
+	assert.Equal(t, "WekaApiRetriesExceeded", ErrorReason(&ApiRetriesExceeded{Retries: 3}))
+	assert.Equal(t, "MountPermissionDenied", ErrorReason(fmt.Errorf("could not mount: %w", MountPermissionDenied)))
+
+	// errors flattened into gRPC status messages are still classified
+	assert.Equal(t, "WekaObjectNotFound", ErrorReason(status.Error(codes.Internal, "failed to create filesystem fs1: "+notFound.Error())))
+	assert.Equal(t, "MountPermissionDenied", ErrorReason(status.Error(codes.PermissionDenied, "permission denied for filesystem")))
+}
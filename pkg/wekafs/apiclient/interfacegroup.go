@@ -186,24 +186,8 @@ func (a *ApiClient) GetNfsInterfaceGroup(ctx context.Context, name string) *Inte
 	return a.NfsInterfaceGroups[igName]
 }
 
-// GetNfsMountIp returns the IP address of the NFS interface group to be used for NFS mount
-// TODO: need to do it much more sophisticated way to distribute load
+// GetNfsMountIp returns the IP address of the NFS interface group to be used for NFS mount, using the selection
+// strategy of the credentials without node hints
 func (a *ApiClient) GetNfsMountIp(ctx context.Context) (string, error) {
-	// if override is set, use it
-	if len(a.Credentials.NfsTargetIPs) > 0 && a.Credentials.NfsTargetIPs[0] != "" {
-		ips := a.Credentials.NfsTargetIPs
-		idx := rand.Intn(len(ips))
-		ip := ips[idx]
-		return ip, nil
-	}
-
-	ig := a.GetNfsInterfaceGroup(ctx, a.NfsInterfaceGroupName)
-	if ig == nil {
-		return "", errors.New("no NFS interface group found")
-	}
-	if ig.Ips == nil || len(ig.Ips) == 0 {
-		return "", errors.New("no IP addresses found for NFS interface group")
-	}
-
-	return ig.GetRandomIpAddress(ctx)
+	return a.SelectNfsMountIp(ctx, nil)
 }
@@ -0,0 +1,66 @@
+package apiclient
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "weka_csi"
+
+var (
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "Total number of requests sent to Weka API",
+	}, []string{"object_type", "method", "status", "endpoint"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests sent to Weka API",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"object_type", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(apiRequestsTotal, apiRequestDuration)
+}
+
+// apiObjectTypeFromPath returns the object type of an API path, omitting object UIDs and other variable parts,
+// e.g. "fileSystems/<uid>" -> "fileSystems", "nfs/clientGroups/<uid>/rules" -> "nfs/clientGroups/rules"
+func apiObjectTypeFromPath(path string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if _, err := uuid.Parse(part); err == nil {
+			continue
+		}
+		if _, err := strconv.Atoi(part); err == nil {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, "/")
+}
+
+// observeApiRequest updates API request metrics, statusCode of 0 denotes a transport failure
+func observeApiRequest(method, path, endpoint string, statusCode int, duration time.Duration) {
+	objectType := apiObjectTypeFromPath(path)
+	status := "transport_error"
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	apiRequestsTotal.WithLabelValues(objectType, method, status, endpoint).Inc()
+	apiRequestDuration.WithLabelValues(objectType, method).Observe(duration.Seconds())
+}
@@ -0,0 +1,25 @@
+package apiclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiObjectTypeFromPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"fileSystems", "fileSystems"},
+		{"fileSystems/8e7c6c4e-7d3b-4f57-9b6a-1f1c2e3d4a5b", "fileSystems"},
+		{"fileSystems/8e7c6c4e-7d3b-4f57-9b6a-1f1c2e3d4a5b/quota/12345", "fileSystems/quota"},
+		{"nfs/clientGroups/8e7c6c4e-7d3b-4f57-9b6a-1f1c2e3d4a5b/rules", "nfs/clientGroups/rules"},
+		{"", "unknown"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.expected, apiObjectTypeFromPath(tc.path))
+		})
+	}
+}
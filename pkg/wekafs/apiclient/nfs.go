@@ -10,6 +10,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/exp/slices"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -108,18 +109,47 @@ func (n *NfsPermission) EQ(other ApiObject) bool {
 	return ObjectsAreEqual(n, other)
 }
 
+// Matches returns true if o satisfies the permission n. Anonymous UID and GID are only compared when set on n
 func (n *NfsPermission) Matches(o NfsPermission) bool {
 	if n.SquashMode == o.SquashMode &&
 		n.Filesystem == o.Filesystem &&
 		n.Group == o.Group &&
 		n.Path == o.Path &&
 		n.PermissionType == o.PermissionType &&
+		(n.AnonUid == "" || n.AnonUid == o.AnonUid) &&
+		(n.AnonGid == "" || n.AnonGid == o.AnonGid) &&
 		n.SupportedVersions.Matches(o.SupportedVersions) {
 		return true
 	}
 	return false
 }
 
+// EnablesAuthTypes returns true if all the authentication types are enabled by the permission. A permission without
+// explicit authentication types enables the default ones
+func (n *NfsPermission) EnablesAuthTypes(authTypes []NfsAuthType) bool {
+	enabled := withNfsAuthTypes(n.EnableAuthTypes, nil)
+	for _, t := range authTypes {
+		if !slices.Contains(enabled, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// withNfsAuthTypes returns the enabled authentication types extended by the required ones
+func withNfsAuthTypes(enabled []NfsAuthType, required []NfsAuthType) []NfsAuthType {
+	ret := slices.Clone(enabled)
+	if len(ret) == 0 {
+		ret = []NfsAuthType{NfsAuthTypeNone, NfsAuthTypeSys}
+	}
+	for _, t := range required {
+		if !slices.Contains(ret, t) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
 func (n *NfsPermission) getImmutableFields() []string {
 	return []string{"Group", "Filesystem", "SupportedVersions", "PermissionType", "Path", "SquashMode"}
 }
@@ -211,6 +241,7 @@ type NfsPermissionCreateRequest struct {
 	ObsDirect         *bool                   `json:"obs_direct,omitempty"`
 	SupportedVersions *[]string               `json:"supported_versions,omitempty"`
 	Priority          int                     `json:"priority"`
+	EnableAuthTypes   []NfsAuthType           `json:"enable_auth_types,omitempty"`
 }
 
 func (qc *NfsPermissionCreateRequest) getApiUrl(a *ApiClient) string {
@@ -256,36 +287,243 @@ func (a *ApiClient) CreateNfsPermission(ctx context.Context, r *NfsPermissionCre
 	return nil
 }
 
-func EnsureNfsPermission(ctx context.Context, fsName string, group string, version NfsVersionString, apiClient *ApiClient) (created bool, err error) {
-	perm := &NfsPermission{
+// NfsExportOptions are the settings of the NFS permission exporting a filesystem to the client group
+type NfsExportOptions struct {
+	Path           string
+	PermissionType NfsPermissionType
+	SquashMode     NfsPermissionSquashMode
+	AnonUid        int
+	AnonGid        int
+}
+
+var NfsRootExportConflict = errors.New("NFS permission of filesystem root conflicts with requested export options")
+
+// DefaultNfsExportOptions exports the whole filesystem for read and write without squashing
+func DefaultNfsExportOptions() *NfsExportOptions {
+	return &NfsExportOptions{
+		Path:           "/",
+		PermissionType: NfsPermissionTypeReadWrite,
+		SquashMode:     NfsPermissionSquashModeNone,
+		AnonUid:        65534,
+		AnonGid:        65534,
+	}
+}
+
+func ParseNfsPermissionSquashMode(s string) (NfsPermissionSquashMode, error) {
+	switch mode := NfsPermissionSquashMode(s); mode {
+	case NfsPermissionSquashModeNone, NfsPermissionSquashModeRoot, NfsPermissionSquashModeAll:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported NFS squash mode %q, must be one of none, root, all", s)
+}
+
+func (o *NfsExportOptions) String() string {
+	return fmt.Sprintf("%s:%s:%s:%d:%d", o.Path, o.PermissionType, o.SquashMode, o.AnonUid, o.AnonGid)
+}
+
+// nfsExportOptionsOfPermission returns the export options an existing permission was set with
+func nfsExportOptionsOfPermission(p NfsPermission) *NfsExportOptions {
+	ret := DefaultNfsExportOptions()
+	ret.Path = p.Path
+	ret.PermissionType = p.PermissionType
+	ret.SquashMode = p.SquashMode
+	if uid, err := strconv.Atoi(p.AnonUid); err == nil {
+		ret.AnonUid = uid
+	}
+	if gid, err := strconv.Atoi(p.AnonGid); err == nil {
+		ret.AnonGid = gid
+	}
+	return ret
+}
+
+// AsPermission returns the NFS permission that satisfies the export options
+func (o *NfsExportOptions) AsPermission(fsName, group string, version NfsVersionString) *NfsPermission {
+	return &NfsPermission{
 		SupportedVersions: NfsVersionStrings{version.AsWeka()},
-		AnonUid:           strconv.Itoa(65534),
-		AnonGid:           strconv.Itoa(65534),
+		AnonUid:           strconv.Itoa(o.AnonUid),
+		AnonGid:           strconv.Itoa(o.AnonGid),
 		Filesystem:        fsName,
 		Group:             group,
-		PermissionType:    NfsPermissionTypeReadWrite,
-		Path:              "/",
-		SquashMode:        NfsPermissionSquashModeNone,
+		PermissionType:    o.PermissionType,
+		Path:              o.Path,
+		SquashMode:        o.SquashMode,
 	}
-	_, err = apiClient.GetNfsPermissionByFilter(ctx, perm)
+}
 
-	if err != nil {
-		if err == ObjectNotFoundError {
-			req := &NfsPermissionCreateRequest{
-				Filesystem:        fsName,
-				Group:             group,
-				Path:              "/",
-				PermissionType:    NfsPermissionTypeReadWrite,
-				SquashMode:        NfsPermissionSquashModeNone,
-				AnonGid:           65534,
-				AnonUid:           65534,
-				SupportedVersions: &[]string{NfsVersionV3.String(), NfsVersionV4.String()},
-			}
-			err := apiClient.CreateNfsPermission(ctx, req, perm)
-			return err == nil, err
+// findNfsPermission looks up the permission of the client group and path among the existing permissions of the
+// filesystem. Returns true if one satisfies the permission, or otherwise the permission to update, if any.
+// Only permissions of a path inside the filesystem are reconciled with the options, since the permission of the
+// filesystem root is shared by all its volumes, and a conflicting one fails with NfsRootExportConflict instead
+func findNfsPermission(existing []NfsPermission, perm *NfsPermission, reconcile bool, authTypes []NfsAuthType) (bool, *NfsPermission, error) {
+	var outdated *NfsPermission
+	for i, p := range existing {
+		if p.Group != perm.Group || p.Path != perm.Path {
+			continue
+		}
+		if reconcile && !perm.Matches(p) && perm.Path == "/" {
+			return false, nil, fmt.Errorf("%w: existing permission of client group %s has squash mode %s, anonymous UID %s and GID %s, requested %s, %s and %s",
+				NfsRootExportConflict, p.Group, p.SquashMode, p.AnonUid, p.AnonGid, perm.SquashMode, perm.AnonUid, perm.AnonGid)
 		}
+		if (perm.Matches(p) || !reconcile) && p.EnablesAuthTypes(authTypes) {
+			return true, nil, nil
+		}
+		outdated = &existing[i]
 	}
-	return false, err
+	return false, outdated, nil
+}
+
+// nfsPermissionsOfPath returns the permissions of the client group for the path inside the filesystem.
+// The permission of the filesystem root is shared by all volumes of the filesystem and is never returned
+func nfsPermissionsOfPath(permissions []NfsPermission, group, path string) []NfsPermission {
+	path = "/" + strings.Trim(path, "/")
+	if path == "/" {
+		return nil
+	}
+	var ret []NfsPermission
+	for _, p := range permissions {
+		if p.Group == group && "/"+strings.Trim(p.Path, "/") == path {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// EnsureNoNfsPermissionForPath removes the NFS permission of the CSI plugin client group for the path inside the
+// filesystem, which is created on publish of a volume exported from its own directory
+func (a *ApiClient) EnsureNoNfsPermissionForPath(ctx context.Context, fsName, clientGroupName, path string) error {
+	group := a.GetNfsClientGroupName(clientGroupName)
+	logger := log.Ctx(ctx).With().Str("filesystem", fsName).Str("path", path).Str("client_group", group).Logger()
+	permissions := &[]NfsPermission{}
+	if err := a.FindNfsPermissionsByFilesystem(ctx, fsName, permissions); err != nil {
+		logger.Error().Err(err).Msg("Failed to list NFS permissions")
+		return err
+	}
+	for _, p := range nfsPermissionsOfPath(*permissions, group, path) {
+		err := a.DeleteNfsPermission(ctx, &NfsPermissionDeleteRequest{Uid: p.Uid})
+		if err != nil && !errors.Is(err, ObjectNotFoundError) {
+			logger.Error().Err(err).Str("permission", p.Uid.String()).Msg("Failed to delete NFS permission")
+			return err
+		}
+		logger.Debug().Str("permission", p.Uid.String()).Msg("Deleted NFS permission")
+	}
+	return nil
+}
+
+// EnsureNfsPermission makes sure the filesystem is exported to the client group according to the export options.
+// An existing permission of the same filesystem, client group and path inside the filesystem which does not match
+// the options is updated rather than duplicated, since Weka evaluates permissions by order and multiple matching ones
+// may conflict. An existing permission of the filesystem root is never changed to match the options, as the other
+// volumes of the filesystem depend on it, and NfsRootExportConflict is returned if it does not match them.
+// With nil options, any existing permission of the filesystem root is used as is, and default one is created otherwise.
+// Authentication types, e.g. Kerberos, are only ever added to those enabled by the permission, never removed.
+// Returns true if NFS configuration was changed
+func EnsureNfsPermission(ctx context.Context, fsName string, group string, version NfsVersionString, opts *NfsExportOptions, authTypes []NfsAuthType, apiClient *ApiClient) (changed bool, err error) {
+	logger := log.Ctx(ctx)
+	reconcile := opts != nil
+	if opts == nil {
+		opts = DefaultNfsExportOptions()
+	}
+	perm := opts.AsPermission(fsName, group, version)
+
+	existing := &[]NfsPermission{}
+	if err := apiClient.FindNfsPermissionsByFilesystem(ctx, fsName, existing); err != nil {
+		return false, err
+	}
+	satisfied, outdated, err := findNfsPermission(*existing, perm, reconcile, authTypes)
+	if satisfied || err != nil {
+		return false, err
+	}
+
+	if outdated != nil {
+		if !reconcile {
+			opts = nfsExportOptionsOfPermission(*outdated)
+		}
+		var enableAuthTypes []NfsAuthType
+		if !outdated.EnablesAuthTypes(authTypes) {
+			enableAuthTypes = withNfsAuthTypes(outdated.EnableAuthTypes, authTypes)
+		}
+		logger.Info().Str("filesystem", fsName).Str("client_group", group).Str("path", perm.Path).
+			Str("permission_type", string(opts.PermissionType)).Str("squash_mode", string(opts.SquashMode)).
+			Interface("enable_auth_types", enableAuthTypes).
+			Msg("Updating NFS permission to match export options")
+		req := &NfsPermissionUpdateRequest{
+			Uid:               outdated.Uid,
+			PermissionType:    opts.PermissionType,
+			SquashMode:        opts.SquashMode,
+			AnonUid:           opts.AnonUid,
+			AnonGid:           opts.AnonGid,
+			SupportedVersions: &[]string{NfsVersionV3.String(), NfsVersionV4.String()},
+			EnableAuthTypes:   enableAuthTypes,
+		}
+		err := apiClient.UpdateNfsPermission(ctx, req, perm)
+		return err == nil, err
+	}
+
+	req := &NfsPermissionCreateRequest{
+		Filesystem:        fsName,
+		Group:             group,
+		Path:              opts.Path,
+		PermissionType:    opts.PermissionType,
+		SquashMode:        opts.SquashMode,
+		AnonGid:           opts.AnonGid,
+		AnonUid:           opts.AnonUid,
+		SupportedVersions: &[]string{NfsVersionV3.String(), NfsVersionV4.String()},
+	}
+	if len(authTypes) > 0 {
+		req.EnableAuthTypes = withNfsAuthTypes(nil, authTypes)
+	}
+	err = apiClient.CreateNfsPermission(ctx, req, perm)
+	return err == nil, err
+}
+
+type NfsPermissionUpdateRequest struct {
+	Uid               uuid.UUID               `json:"-"`
+	PermissionType    NfsPermissionType       `json:"permission_type"`
+	SquashMode        NfsPermissionSquashMode `json:"squash_mode"`
+	AnonUid           int                     `json:"anon_uid"`
+	AnonGid           int                     `json:"anon_gid"`
+	SupportedVersions *[]string               `json:"supported_versions,omitempty"`
+	EnableAuthTypes   []NfsAuthType           `json:"enable_auth_types,omitempty"`
+}
+
+func (pu *NfsPermissionUpdateRequest) getApiUrl(a *ApiClient) string {
+	return pu.getRelatedObject().GetApiUrl(a)
+}
+
+func (pu *NfsPermissionUpdateRequest) getRelatedObject() ApiObject {
+	return &NfsPermission{Uid: pu.Uid}
+}
+
+func (pu *NfsPermissionUpdateRequest) getRequiredFields() []string {
+	return []string{"Uid", "PermissionType", "SquashMode"}
+}
+
+func (pu *NfsPermissionUpdateRequest) hasRequiredFields() bool {
+	return ObjectRequestHasRequiredFields(pu)
+}
+
+func (pu *NfsPermissionUpdateRequest) String() string {
+	return fmt.Sprintln("NfsPermissionUpdateRequest(uid:", pu.Uid)
+}
+
+func (a *ApiClient) UpdateNfsPermission(ctx context.Context, r *NfsPermissionUpdateRequest, p *NfsPermission) error {
+	op := "UpdateNfsPermission"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	if !r.hasRequiredFields() {
+		return RequestMissingParams
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	err = a.Put(ctx, r.getApiUrl(a), &payload, nil, p)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to update NFS permission")
+		return err
+	}
+	return nil
 }
 
 type NfsPermissionDeleteRequest struct {
@@ -472,6 +710,41 @@ func (a *ApiClient) CreateNfsClientGroup(ctx context.Context, r *NfsClientGroupC
 	return err
 }
 
+// GetNfsClientGroupName returns the NFS client group to be used, which is the configured one if set.
+// Otherwise, organizations other than Root get a client group of their own, so NFS client rules
+// and exports of one organization do not grant access to the filesystems of another
+func (a *ApiClient) GetNfsClientGroupName(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if a.ApiOrgId == 0 {
+		return NfsClientGroupName
+	}
+	org := a.Credentials.Organization
+	if org == "" {
+		org = strconv.Itoa(a.ApiOrgId)
+	}
+	return fmt.Sprintf("%s-%s", NfsClientGroupName, org)
+}
+
+// ValidateNfsForOrganization checks that NFS client groups and permissions can be managed by the API user.
+// This is always the case for the Root organization, while users of other organizations require a cluster version
+// supporting it and a role that may manage NFS configuration of the organization
+func (a *ApiClient) ValidateNfsForOrganization() error {
+	if a.ApiOrgId == 0 {
+		return nil
+	}
+	if !a.SupportsNfsForNonRootOrganizations() {
+		return fmt.Errorf("%w: organization %s requires WEKA version %s or higher",
+			NfsNotSupportedForOrganizationError, a.Credentials.Organization, MinimumSupportedWekaVersions.NfsForNonRootOrganizations)
+	}
+	if a.ApiUserRole != ApiUserRoleOrgAdmin && a.ApiUserRole != ApiUserRoleCSI {
+		return fmt.Errorf("%w: user %s of organization %s has role %s, while %s or %s role is required to manage NFS client groups and permissions",
+			NfsNotSupportedForOrganizationError, a.Credentials.Username, a.Credentials.Organization, a.ApiUserRole, ApiUserRoleOrgAdmin, ApiUserRoleCSI)
+	}
+	return nil
+}
+
 func (a *ApiClient) EnsureCsiPluginNfsClientGroup(ctx context.Context) (grp *NfsClientGroup, created bool, err error) {
 	op := "EnsureCsiPluginNfsClientGroup"
 	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
@@ -480,7 +753,7 @@ func (a *ApiClient) EnsureCsiPluginNfsClientGroup(ctx context.Context) (grp *Nfs
 	logger := log.Ctx(ctx)
 	var ret *NfsClientGroup
 	if a.NfsClientGroupName == "" {
-		a.NfsClientGroupName = NfsClientGroupName
+		a.NfsClientGroupName = a.GetNfsClientGroupName("")
 	}
 	logger.Trace().Str("client_group_name", a.NfsClientGroupName).Msg("Getting client group by name")
 	ret, err = a.GetNfsClientGroupByName(ctx, a.NfsClientGroupName)
@@ -589,7 +862,7 @@ func (r *NfsClientGroupRule) GetType() string {
 }
 
 func (r *NfsClientGroupRule) GetBasePath(a *ApiClient) string {
-	ncgUrl := (&NfsClientGroup{Uid: r.Uid}).GetApiUrl(a)
+	ncgUrl := (&NfsClientGroup{Uid: r.NfsClientGroupUid}).GetApiUrl(a)
 	url, err := url.JoinPath(ncgUrl, r.GetType())
 	if err != nil {
 		return ""
@@ -599,7 +872,7 @@ func (r *NfsClientGroupRule) GetBasePath(a *ApiClient) string {
 
 func (r *NfsClientGroupRule) GetApiUrl(a *ApiClient) string {
 	url, err := url.JoinPath(r.GetBasePath(a), r.Uid.String())
-	if err != nil {
+	if err == nil {
 		return url
 	}
 	return ""
@@ -646,6 +919,22 @@ func (r *NfsClientGroupRule) GetNetwork() *Network {
 	return n
 }
 
+// GetHostIp returns the IP address of a rule matching a single host, as created upon node registration, or empty otherwise
+func (r *NfsClientGroupRule) GetHostIp() string {
+	n := r.GetNetwork()
+	if n == nil || n.IP == nil || n.Subnet == nil {
+		return ""
+	}
+	mask := net.IPMask(*n.Subnet)
+	if n.IP.To4() != nil && n.Subnet.To4() != nil {
+		mask = net.IPMask(n.Subnet.To4())
+	}
+	if ones, bits := mask.Size(); bits == 0 || ones != bits {
+		return ""
+	}
+	return n.IP.String()
+}
+
 func (r *NfsClientGroupRule) IsEligibleForIP(ip string) bool {
 	network := r.GetNetwork()
 	if network == nil {
@@ -798,6 +1087,52 @@ func (a *ApiClient) CreateNfsClientGroupRule(ctx context.Context, r *NfsClientGr
 	return err
 }
 
+type NfsClientGroupRuleDeleteRequest struct {
+	NfsClientGroupUid uuid.UUID `json:"-"`
+	Uid               uuid.UUID `json:"-"`
+}
+
+func (r *NfsClientGroupRuleDeleteRequest) getApiUrl(a *ApiClient) string {
+	return r.getRelatedObject().GetApiUrl(a)
+}
+
+func (r *NfsClientGroupRuleDeleteRequest) getRelatedObject() ApiObject {
+	return &NfsClientGroupRule{NfsClientGroupUid: r.NfsClientGroupUid, Uid: r.Uid}
+}
+
+func (r *NfsClientGroupRuleDeleteRequest) getRequiredFields() []string {
+	return []string{"NfsClientGroupUid", "Uid"}
+}
+
+func (r *NfsClientGroupRuleDeleteRequest) hasRequiredFields() bool {
+	return ObjectRequestHasRequiredFields(r)
+}
+
+func (r *NfsClientGroupRuleDeleteRequest) String() string {
+	return fmt.Sprintln("NfsClientGroupRuleDeleteRequest(NfsClientGroupUid:", r.NfsClientGroupUid, "Uid:", r.Uid)
+}
+
+func (a *ApiClient) DeleteNfsClientGroupRule(ctx context.Context, r *NfsClientGroupRuleDeleteRequest) error {
+	op := "DeleteNfsClientGroupRule"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	log.Ctx(ctx).Trace().Str("client_group_rule", r.String()).Msg("Deleting client group rule")
+	if !r.hasRequiredFields() {
+		return RequestMissingParams
+	}
+	apiResponse := &ApiResponse{}
+	err := a.Delete(ctx, r.getApiUrl(a), nil, nil, apiResponse)
+	if err != nil {
+		var notFound *ApiNotFoundError
+		if errors.As(err, &notFound) {
+			return ObjectNotFoundError
+		}
+		return err
+	}
+	return nil
+}
+
 func (a *ApiClient) EnsureNfsClientGroupRuleForIp(ctx context.Context, cg *NfsClientGroup, ip string) (created bool, err error) {
 	if cg == nil {
 		return false, errors.New("NfsClientGroup is nil")
@@ -820,19 +1155,21 @@ func (a *ApiClient) EnsureNfsClientGroupRuleForIp(ctx context.Context, cg *NfsCl
 	return false, err
 }
 
-func (a *ApiClient) EnsureNfsPermissions(ctx context.Context, fsName string, version NfsVersionString, clientGroupName string) error {
+func (a *ApiClient) EnsureNfsPermissions(ctx context.Context, fsName string, version NfsVersionString, clientGroupName string, opts *NfsExportOptions, authTypes []NfsAuthType) error {
 	op := "EnsureNfsPermissions"
 	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
 	defer span.End()
 	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
 	updateConfigRequired := false
 	logger := log.Ctx(ctx).With().Bool("update_config_required", func() bool { return updateConfigRequired }()).Logger()
-	clientGroupCaption := clientGroupName
-	if clientGroupCaption == "" {
-		clientGroupCaption = NfsClientGroupName
-	}
+	clientGroupCaption := a.GetNfsClientGroupName(clientGroupName)
 	var created bool
 
+	if err := a.ValidateNfsForOrganization(); err != nil {
+		logger.Error().Err(err).Msg("Cannot manage NFS permissions")
+		return err
+	}
+
 	cg, err := a.GetNfsClientGroupByName(ctx, clientGroupCaption)
 	if err != nil {
 		logger.Error().Err(err).Str("client_group_name", clientGroupCaption).Msg("Failed to get NFS client group by name")
@@ -841,7 +1178,7 @@ func (a *ApiClient) EnsureNfsPermissions(ctx context.Context, fsName string, ver
 
 	// Ensure NFS permission
 	logger.Trace().Str("filesystem", fsName).Str("client_group", cg.Name).Msg("Ensuring NFS Export for client group")
-	created, err = EnsureNfsPermission(ctx, fsName, cg.Name, version, a)
+	created, err = EnsureNfsPermission(ctx, fsName, cg.Name, version, opts, authTypes, a)
 	if created {
 		logger.Trace().Msg("Waiting for NFS configuration to be applied")
 		time.Sleep(5 * time.Second)
@@ -851,6 +1188,10 @@ func (a *ApiClient) EnsureNfsPermissions(ctx context.Context, fsName string, ver
 
 func (a *ApiClient) RegisterNfsClientGroup(ctx context.Context) error {
 	logger := log.Ctx(ctx)
+	if err := a.ValidateNfsForOrganization(); err != nil {
+		logger.Error().Err(err).Int("organization_id", a.ApiOrgId).Msg("Cannot register NFS client group")
+		return err
+	}
 	targetIp, err := a.GetNfsMountIp(ctx)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to get NFS mount IP")
@@ -886,6 +1227,7 @@ func (a *ApiClient) RegisterNfsClientGroup(ctx context.Context) error {
 		logger.Error().Err(err).Str("ip_address", nodeIP).Msg("Failed to ensure NFS client group rule for IP")
 		return err
 	}
+	a.NfsClientIp = nodeIP
 	updatedConfig = updatedConfig || created
 
 	if updatedConfig {
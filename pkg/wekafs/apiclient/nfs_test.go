@@ -145,7 +145,7 @@ func TestNfsEnsureNfsPermissions(t *testing.T) {
 
 	// Test EnsureNfsPermission
 	ctx := context.Background()
-	err := apiClient.EnsureNfsPermissions(ctx, "default", NfsVersionV4, NfsClientGroupName)
+	err := apiClient.EnsureNfsPermissions(ctx, "default", NfsVersionV4, NfsClientGroupName, nil, nil)
 	assert.NoError(t, err)
 }
 
@@ -212,3 +212,145 @@ func TestIsSupersetOf(t *testing.T) {
 	// Test case 4: Same rule
 	assert.True(t, rule1.IsSupersetOf(rule1))
 }
+
+func TestNfsClientGroupRuleGetHostIp(t *testing.T) {
+	for rule, expected := range map[string]string{
+		"192.168.1.1":                 "192.168.1.1",
+		"192.168.1.1/255.255.255.255": "192.168.1.1",
+		"192.168.1.1/32":              "192.168.1.1",
+		"192.168.1.0/24":              "",
+		"192.168.1.0/255.255.255.0":   "",
+		"fd00::1/128":                 "fd00::1",
+		"fd00::/64":                   "",
+	} {
+		r := &NfsClientGroupRule{Type: NfsClientGroupRuleTypeIP, Rule: rule}
+		assert.Equal(t, expected, r.GetHostIp(), "rule %s", rule)
+	}
+	assert.Empty(t, (&NfsClientGroupRule{Type: NfsClientGroupRuleTypeDNS, Rule: "host1"}).GetHostIp())
+}
+
+func TestNfsClientGroupRuleDeleteRequest(t *testing.T) {
+	cgUid, ruleUid := uuid.New(), uuid.New()
+	r := &NfsClientGroupRuleDeleteRequest{NfsClientGroupUid: cgUid, Uid: ruleUid}
+	assert.True(t, r.hasRequiredFields())
+	assert.Equal(t, "nfs/clientGroups/"+cgUid.String()+"/rules/"+ruleUid.String(), r.getApiUrl(&ApiClient{}))
+	assert.False(t, (&NfsClientGroupRuleDeleteRequest{Uid: ruleUid}).hasRequiredFields())
+}
+
+func TestGetNfsClientGroupName(t *testing.T) {
+	apiClient := &ApiClient{Credentials: Credentials{Organization: "tenant1"}}
+	assert.Equal(t, NfsClientGroupName, apiClient.GetNfsClientGroupName(""))
+	assert.Equal(t, "MyClients", apiClient.GetNfsClientGroupName("MyClients"))
+
+	apiClient.ApiOrgId = 3
+	assert.Equal(t, NfsClientGroupName+"-tenant1", apiClient.GetNfsClientGroupName(""))
+	assert.Equal(t, "MyClients", apiClient.GetNfsClientGroupName("MyClients"), "configured client group must be used as is")
+}
+
+func TestValidateNfsForOrganization(t *testing.T) {
+	apiClient := &ApiClient{Credentials: Credentials{Username: "csi", Organization: "tenant1"}, ApiUserRole: ApiUserRoleCSI, CompatibilityMap: &WekaCompatibilityMap{}}
+	apiClient.CompatibilityMap.fillIn("v4.2")
+	assert.NoError(t, apiClient.ValidateNfsForOrganization(), "Root organization is always allowed")
+
+	apiClient.ApiOrgId = 3
+	assert.ErrorIs(t, apiClient.ValidateNfsForOrganization(), NfsNotSupportedForOrganizationError)
+
+	apiClient.CompatibilityMap.fillIn(MinimumSupportedWekaVersions.NfsForNonRootOrganizations)
+	assert.NoError(t, apiClient.ValidateNfsForOrganization())
+
+	apiClient.ApiUserRole = ApiUserRoleRegular
+	assert.ErrorIs(t, apiClient.ValidateNfsForOrganization(), NfsNotSupportedForOrganizationError)
+}
+
+func TestNfsExportOptions(t *testing.T) {
+	opts := DefaultNfsExportOptions()
+	perm := opts.AsPermission("fs1", NfsClientGroupName, NfsVersionV4)
+	assert.Equal(t, "/", perm.Path)
+	assert.Equal(t, NfsPermissionTypeReadWrite, perm.PermissionType)
+	assert.Equal(t, NfsPermissionSquashModeNone, perm.SquashMode)
+	assert.Equal(t, "65534", perm.AnonUid)
+
+	existing := *perm
+	assert.True(t, perm.Matches(existing))
+
+	opts.SquashMode = NfsPermissionSquashModeAll
+	opts.AnonUid = 1000
+	assert.False(t, opts.AsPermission("fs1", NfsClientGroupName, NfsVersionV4).Matches(existing))
+
+	existing.SquashMode = NfsPermissionSquashModeAll
+	assert.False(t, opts.AsPermission("fs1", NfsClientGroupName, NfsVersionV4).Matches(existing), "anonymous UID must be compared")
+	existing.AnonUid = "1000"
+	assert.True(t, opts.AsPermission("fs1", NfsClientGroupName, NfsVersionV4).Matches(existing))
+}
+
+func TestNfsPermissionsOfPath(t *testing.T) {
+	root := NfsPermission{Group: NfsClientGroupName, Path: "/"}
+	inner := NfsPermission{Group: NfsClientGroupName, Path: "/csi-volumes/pvc-1"}
+	unslashed := NfsPermission{Group: NfsClientGroupName, Path: "csi-volumes/pvc-1/"}
+	other := NfsPermission{Group: NfsClientGroupName, Path: "/csi-volumes/pvc-2"}
+	manual := NfsPermission{Group: "manual", Path: "/csi-volumes/pvc-1"}
+	permissions := []NfsPermission{root, inner, unslashed, other, manual}
+
+	assert.Equal(t, []NfsPermission{inner, unslashed}, nfsPermissionsOfPath(permissions, NfsClientGroupName, "/csi-volumes/pvc-1"),
+		"permissions of other client groups must be kept")
+	assert.Empty(t, nfsPermissionsOfPath(permissions, NfsClientGroupName, "/"), "permission of filesystem root must be kept")
+	assert.Empty(t, nfsPermissionsOfPath(permissions, NfsClientGroupName, ""))
+	assert.Empty(t, nfsPermissionsOfPath(permissions, NfsClientGroupName, "/csi-volumes/pvc-3"))
+}
+
+func TestFindNfsPermission(t *testing.T) {
+	root := DefaultNfsExportOptions()
+	squashed := DefaultNfsExportOptions()
+	squashed.SquashMode = NfsPermissionSquashModeAll
+	existing := []NfsPermission{*root.AsPermission("fs1", NfsClientGroupName, NfsVersionV4)}
+
+	satisfied, outdated, err := findNfsPermission(existing, root.AsPermission("fs1", NfsClientGroupName, NfsVersionV4), true, nil)
+	assert.NoError(t, err)
+	assert.True(t, satisfied)
+	assert.Nil(t, outdated)
+
+	_, outdated, err = findNfsPermission(existing, squashed.AsPermission("fs1", NfsClientGroupName, NfsVersionV4), true, nil)
+	assert.ErrorIs(t, err, NfsRootExportConflict, "permission of filesystem root must not be changed to other options")
+	assert.Nil(t, outdated)
+
+	satisfied, _, err = findNfsPermission(existing, squashed.AsPermission("fs1", NfsClientGroupName, NfsVersionV4), false, nil)
+	assert.NoError(t, err)
+	assert.True(t, satisfied, "existing permission of filesystem root is used as is without export options")
+
+	_, outdated, err = findNfsPermission(existing, root.AsPermission("fs1", NfsClientGroupName, NfsVersionV4), true, []NfsAuthType{NfsAuthTypeKerberos5})
+	assert.NoError(t, err)
+	assert.Equal(t, &existing[0], outdated, "authentication types are added to permission of filesystem root")
+
+	inner := DefaultNfsExportOptions()
+	inner.Path = "/csi-volumes/pvc-1"
+	existing = append(existing, *inner.AsPermission("fs1", NfsClientGroupName, NfsVersionV4))
+	inner.SquashMode = NfsPermissionSquashModeAll
+	satisfied, outdated, err = findNfsPermission(existing, inner.AsPermission("fs1", NfsClientGroupName, NfsVersionV4), true, nil)
+	assert.NoError(t, err)
+	assert.False(t, satisfied)
+	assert.Equal(t, &existing[1], outdated, "permission of inner path is reconciled with export options")
+}
+
+func TestParseNfsPermissionSquashMode(t *testing.T) {
+	mode, err := ParseNfsPermissionSquashMode("root")
+	assert.NoError(t, err)
+	assert.Equal(t, NfsPermissionSquashModeRoot, mode)
+	_, err = ParseNfsPermissionSquashMode("")
+	assert.Error(t, err)
+	_, err = ParseNfsPermissionSquashMode("ALL")
+	assert.Error(t, err)
+}
+
+func TestNfsPermissionEnablesAuthTypes(t *testing.T) {
+	perm := &NfsPermission{}
+	assert.True(t, perm.EnablesAuthTypes(nil))
+	assert.True(t, perm.EnablesAuthTypes([]NfsAuthType{NfsAuthTypeSys}), "default authentication types must be assumed")
+	assert.False(t, perm.EnablesAuthTypes([]NfsAuthType{NfsAuthTypeKerberos5}))
+
+	perm.EnableAuthTypes = withNfsAuthTypes(perm.EnableAuthTypes, []NfsAuthType{NfsAuthTypeKerberos5})
+	assert.Equal(t, []NfsAuthType{NfsAuthTypeNone, NfsAuthTypeSys, NfsAuthTypeKerberos5}, perm.EnableAuthTypes)
+	assert.True(t, perm.EnablesAuthTypes([]NfsAuthType{NfsAuthTypeKerberos5}))
+
+	perm.EnableAuthTypes = []NfsAuthType{NfsAuthTypeKerberos5}
+	assert.Equal(t, []NfsAuthType{NfsAuthTypeKerberos5}, withNfsAuthTypes(perm.EnableAuthTypes, []NfsAuthType{NfsAuthTypeKerberos5}), "enabled authentication types must be kept")
+}
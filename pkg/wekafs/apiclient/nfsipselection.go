@@ -0,0 +1,195 @@
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+// NfsIpSelectionStrategy defines how the NFS target IP address is picked from the interface group for a mount
+type NfsIpSelectionStrategy string
+
+const (
+	// NfsIpSelectionRandom picks a random IP address for every mount
+	NfsIpSelectionRandom NfsIpSelectionStrategy = "random"
+	// NfsIpSelectionConsistentHash always picks the same IP address for the same node, and moves only the nodes
+	// of an IP address that is removed from the interface group
+	NfsIpSelectionConsistentHash NfsIpSelectionStrategy = "consistentHash"
+	// NfsIpSelectionLeastMounts picks the IP address with the least known NFS mounts
+	NfsIpSelectionLeastMounts NfsIpSelectionStrategy = "leastMounts"
+	// NfsIpSelectionTopology prefers IP addresses in the zone of the node, then in the subnets of the node
+	NfsIpSelectionTopology NfsIpSelectionStrategy = "topology"
+)
+
+func ParseNfsIpSelectionStrategy(s string) (NfsIpSelectionStrategy, error) {
+	switch strategy := NfsIpSelectionStrategy(s); strategy {
+	case NfsIpSelectionRandom, NfsIpSelectionConsistentHash, NfsIpSelectionLeastMounts, NfsIpSelectionTopology:
+		return strategy, nil
+	case "":
+		return NfsIpSelectionRandom, nil
+	}
+	return "", fmt.Errorf("unsupported NFS IP selection strategy %q", s)
+}
+
+// NfsIpSelectionHints carries the information about the node that selection strategies are based on
+type NfsIpSelectionHints struct {
+	// Strategy overrides the strategy of the credentials when set, e.g. from a StorageClass
+	Strategy NfsIpSelectionStrategy
+	NodeId   string
+	Zone     string
+	// Mounts is the number of known NFS mounts per target IP address, of this node and of the cluster
+	Mounts map[string]int
+	// LocalNetworks are the networks of the node interfaces, looked up when not set
+	LocalNetworks []*net.IPNet
+	// Excluded are IP addresses known to be unreachable, which are selected only if no other IP address is left
+	Excluded []string
+}
+
+// GetLocalNetworks returns the networks of the node interfaces
+func GetLocalNetworks() []*net.IPNet {
+	var ret []*net.IPNet
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ret
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			ret = append(ret, ipNet)
+		}
+	}
+	return ret
+}
+
+// rendezvousWeight returns the weight of an IP address for a node in highest random weight hashing
+func rendezvousWeight(nodeId, ip string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeId + "^" + ip))
+	return h.Sum64()
+}
+
+// selectByRendezvous returns the IP address with highest weight for the node, so that removal of an IP address
+// only moves the nodes that were assigned to it
+func selectByRendezvous(ips []string, nodeId string) string {
+	var ret string
+	var best uint64
+	for _, ip := range ips {
+		if w := rendezvousWeight(nodeId, ip); ret == "" || w > best {
+			ret, best = ip, w
+		}
+	}
+	return ret
+}
+
+// selectNfsIp picks an IP address out of ips according to strategy. zones maps IP addresses to the zone they serve
+func selectNfsIp(ips []string, strategy NfsIpSelectionStrategy, hints *NfsIpSelectionHints, zones map[string]string) (string, error) {
+	if len(ips) == 0 {
+		return "", errors.New("no IP addresses to select NFS target from")
+	}
+	if hints == nil {
+		hints = &NfsIpSelectionHints{}
+	}
+	if len(hints.Excluded) > 0 {
+		var healthy []string
+		for _, ip := range ips {
+			if !slices.Contains(hints.Excluded, ip) {
+				healthy = append(healthy, ip)
+			}
+		}
+		if len(healthy) > 0 {
+			ips = healthy
+		}
+	}
+	switch strategy {
+	case NfsIpSelectionConsistentHash:
+		return selectByRendezvous(ips, hints.NodeId), nil
+	case NfsIpSelectionLeastMounts:
+		var candidates []string
+		least := -1
+		for _, ip := range ips {
+			mounts := hints.Mounts[ip]
+			if least == -1 || mounts < least {
+				candidates, least = []string{ip}, mounts
+			} else if mounts == least {
+				candidates = append(candidates, ip)
+			}
+		}
+		return selectByRendezvous(candidates, hints.NodeId), nil
+	case NfsIpSelectionTopology:
+		var inZone, inSubnet []string
+		for _, ip := range ips {
+			if hints.Zone != "" && zones[ip] == hints.Zone {
+				inZone = append(inZone, ip)
+			}
+			parsed := net.ParseIP(ip)
+			for _, ipNet := range hints.LocalNetworks {
+				if parsed != nil && ipNet.Contains(parsed) {
+					inSubnet = append(inSubnet, ip)
+					break
+				}
+			}
+		}
+		if len(inZone) > 0 {
+			return selectByRendezvous(inZone, hints.NodeId), nil
+		}
+		if len(inSubnet) > 0 {
+			return selectByRendezvous(inSubnet, hints.NodeId), nil
+		}
+		return selectByRendezvous(ips, hints.NodeId), nil
+	case NfsIpSelectionRandom, "":
+		return ips[rand.Intn(len(ips))], nil
+	}
+	return "", fmt.Errorf("unsupported NFS IP selection strategy %q", strategy)
+}
+
+// ParseNfsTargetIpZones parses zones of NFS target IP addresses in form of "ip=zone,ip=zone"
+func ParseNfsTargetIpZones(s string) map[string]string {
+	ret := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		ip, zone, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && ip != "" && zone != "" {
+			ret[strings.TrimSpace(ip)] = strings.TrimSpace(zone)
+		}
+	}
+	return ret
+}
+
+// SelectNfsMountIp returns the IP address to be used for NFS mount, out of the NFS target IPs overridden in the
+// credentials or the IP addresses of the NFS interface group, according to the selection strategy
+func (a *ApiClient) SelectNfsMountIp(ctx context.Context, hints *NfsIpSelectionHints) (string, error) {
+	logger := log.Ctx(ctx)
+	ips := a.Credentials.NfsTargetIPs
+	if len(ips) == 0 || ips[0] == "" {
+		ig := a.GetNfsInterfaceGroup(ctx, a.NfsInterfaceGroupName)
+		if ig == nil {
+			return "", errors.New("no NFS interface group found")
+		}
+		if len(ig.Ips) == 0 {
+			return "", errors.New("no IP addresses found for NFS interface group")
+		}
+		ips = ig.Ips
+	}
+
+	strategy, err := ParseNfsIpSelectionStrategy(a.Credentials.NfsIpSelection)
+	if err != nil {
+		return "", err
+	}
+	if hints != nil && hints.Strategy != "" {
+		strategy = hints.Strategy
+	}
+	if strategy == NfsIpSelectionTopology && hints != nil && hints.LocalNetworks == nil {
+		hints.LocalNetworks = GetLocalNetworks()
+	}
+	ip, err := selectNfsIp(ips, strategy, hints, a.Credentials.NfsTargetIpZones)
+	if err != nil {
+		return "", err
+	}
+	logger.Debug().Str("ip", ip).Str("strategy", string(strategy)).Int("ips", len(ips)).Msg("Selected NFS target IP address")
+	return ip, nil
+}
@@ -0,0 +1,102 @@
+package apiclient
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNfsIpSelectionStrategy(t *testing.T) {
+	strategy, err := ParseNfsIpSelectionStrategy("")
+	assert.NoError(t, err)
+	assert.Equal(t, NfsIpSelectionRandom, strategy)
+
+	strategy, err = ParseNfsIpSelectionStrategy("leastMounts")
+	assert.NoError(t, err)
+	assert.Equal(t, NfsIpSelectionLeastMounts, strategy)
+
+	_, err = ParseNfsIpSelectionStrategy("roundRobin")
+	assert.Error(t, err)
+}
+
+func TestSelectNfsIpConsistentHash(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	assignments := make(map[string]string)
+	for _, node := range []string{"node-a", "node-b", "node-c", "node-d", "node-e", "node-f", "node-g", "node-h"} {
+		ip, err := selectNfsIp(ips, NfsIpSelectionConsistentHash, &NfsIpSelectionHints{NodeId: node}, nil)
+		assert.NoError(t, err)
+		again, _ := selectNfsIp(ips, NfsIpSelectionConsistentHash, &NfsIpSelectionHints{NodeId: node}, nil)
+		assert.Equal(t, ip, again, "same node must always get the same IP address")
+		assignments[node] = ip
+	}
+
+	// removing an IP address must only move the nodes that were assigned to it
+	removed := assignments["node-a"]
+	var remaining []string
+	for _, ip := range ips {
+		if ip != removed {
+			remaining = append(remaining, ip)
+		}
+	}
+	for node, ip := range assignments {
+		moved, _ := selectNfsIp(remaining, NfsIpSelectionConsistentHash, &NfsIpSelectionHints{NodeId: node}, nil)
+		if ip != removed {
+			assert.Equal(t, ip, moved, "node %s must keep its IP address", node)
+		} else {
+			assert.NotEqual(t, removed, moved)
+		}
+	}
+}
+
+func TestSelectNfsIpLeastMounts(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	hints := &NfsIpSelectionHints{NodeId: "node-a", Mounts: map[string]int{"10.0.0.1": 5, "10.0.0.2": 1, "10.0.0.3": 3}}
+	ip, err := selectNfsIp(ips, NfsIpSelectionLeastMounts, hints, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip)
+
+	hints.Mounts = map[string]int{"10.0.0.1": 2, "10.0.0.2": 2}
+	ip, _ = selectNfsIp(ips, NfsIpSelectionLeastMounts, hints, nil)
+	assert.Equal(t, "10.0.0.3", ip, "IP address without mounts must be preferred")
+}
+
+func TestSelectNfsIpTopology(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"}
+	zones := ParseNfsTargetIpZones(" 10.0.0.1=zone-a, 10.0.1.1=zone-b,malformed,10.0.2.1=")
+	assert.Equal(t, map[string]string{"10.0.0.1": "zone-a", "10.0.1.1": "zone-b"}, zones)
+
+	_, subnet, _ := net.ParseCIDR("10.0.2.0/24")
+	hints := &NfsIpSelectionHints{NodeId: "node-a", Zone: "zone-b", LocalNetworks: []*net.IPNet{subnet}}
+	ip, err := selectNfsIp(ips, NfsIpSelectionTopology, hints, zones)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.1", ip, "IP address in zone of node must be preferred")
+
+	hints.Zone = "zone-c"
+	ip, _ = selectNfsIp(ips, NfsIpSelectionTopology, hints, zones)
+	assert.Equal(t, "10.0.2.1", ip, "IP address in subnet of node must be preferred when none is in its zone")
+
+	hints.LocalNetworks = nil
+	ip, _ = selectNfsIp(ips, NfsIpSelectionTopology, hints, zones)
+	assert.Contains(t, ips, ip)
+}
+
+func TestSelectNfsIpNoAddresses(t *testing.T) {
+	_, err := selectNfsIp(nil, NfsIpSelectionRandom, nil, nil)
+	assert.Error(t, err)
+	ip, err := selectNfsIp([]string{"10.0.0.1"}, NfsIpSelectionRandom, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+}
+
+func TestSelectNfsIpExcluded(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	for _, strategy := range []NfsIpSelectionStrategy{NfsIpSelectionRandom, NfsIpSelectionConsistentHash, NfsIpSelectionLeastMounts, NfsIpSelectionTopology} {
+		ip, err := selectNfsIp(ips, strategy, &NfsIpSelectionHints{NodeId: "node-a", Excluded: []string{"10.0.0.1"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.2", ip, "excluded IP address must not be selected by %s", strategy)
+	}
+	ip, err := selectNfsIp(ips, NfsIpSelectionConsistentHash, &NfsIpSelectionHints{NodeId: "node-a", Excluded: ips}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, ips, ip, "IP address must be selected even if all are excluded")
+}
@@ -8,6 +8,10 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"net/url"
@@ -16,7 +20,26 @@ import (
 )
 
 // do Makes a basic API call to the client, returns an *ApiResponse that includes raw data, error message etc.
-func (a *ApiClient) do(ctx context.Context, Method string, Path string, Payload *[]byte, Query url.Values) (*ApiResponse, apiError) {
+func (a *ApiClient) do(ctx context.Context, Method string, Path string, Payload *[]byte, Query url.Values) (resp *ApiResponse, reqErr apiError) {
+	var endpoint *ApiEndPoint
+	var response *http.Response
+	var start time.Time
+
+	// record mutating requests in audit trail on every exit path, including requests that could not be sent,
+	// and update metrics of requests that were sent regardless of their outcome
+	defer func() {
+		statusCode := 0
+		if response != nil {
+			statusCode = response.StatusCode
+		}
+		endpointName := ""
+		if endpoint != nil {
+			endpointName = endpoint.String()
+			observeApiRequest(Method, Path, endpointName, statusCode, time.Since(start))
+		}
+		a.audit(ctx, Method, Path, Payload, endpointName, statusCode, reqErr)
+	}()
+
 	//construct URL path
 	if len(a.Credentials.Endpoints) < 1 {
 		return &ApiResponse{}, &ApiNoEndpointsError{
@@ -43,6 +66,8 @@ func (a *ApiClient) do(ctx context.Context, Method string, Path string, Payload
 		}
 	}
 	r.Header.Set("content-type", "application/json")
+	// propagate trace context so that API requests can be correlated with CSI operations on Weka backend
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
 	if a.isLoggedIn() {
 		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.apiToken))
 	}
@@ -61,10 +86,10 @@ func (a *ApiClient) do(ctx context.Context, Method string, Path string, Payload
 	logger.Trace().Str("method", Method).Str("url", r.URL.RequestURI()).Str("payload", maskPayload(payload)).Msg("")
 
 	//perform the request and update endpoint with stats
-	endpoint := a.getEndpoint(ctx)
+	endpoint = a.getEndpoint(ctx)
 	endpoint.requestCount++
-	start := time.Now()
-	response, err := a.client.Do(r)
+	start = time.Now()
+	response, err = a.client.Do(r)
 
 	if err != nil {
 		endpoint.transportErrCount++
@@ -207,7 +232,12 @@ func (a *ApiClient) do(ctx context.Context, Method string, Path string, Payload
 // request wraps do with retries and some more error handling
 func (a *ApiClient) request(ctx context.Context, Method string, Path string, Payload *[]byte, Query url.Values, v interface{}) apiError {
 	op := "ApiClientRequest"
-	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", Method),
+		attribute.String("weka.api.path", Path),
+		attribute.String("weka.cluster.guid", a.ClusterGuid.String()),
+		attribute.String("weka.cluster.name", a.ClusterName),
+	))
 	defer span.End()
 	ctx = log.With().Str("span_id", span.SpanContext().SpanID().String()).Logger().WithContext(ctx)
 	logger := log.Ctx(ctx)
@@ -259,6 +289,8 @@ func (a *ApiClient) request(ctx context.Context, Method string, Path string, Pay
 	}
 	err := a.retryBackoff(ctx, ApiRetryMaxCount, time.Second*time.Duration(ApiRetryIntervalSeconds), f)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, ErrorReason(err))
 		return err.(apiError)
 	}
 	return nil
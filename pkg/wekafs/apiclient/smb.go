@@ -0,0 +1,301 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// SmbShareCsiDescription marks the SMB shares created by the CSI plugin, only those are removed with the filesystem
+	SmbShareCsiDescription = "Created by Weka CSI Plugin"
+	smbShareNamePrefix     = "csi-"
+	smbShareNameMaxFsPart  = 40
+)
+
+var smbShareNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+type SmbShare struct {
+	Id             string    `json:"id,omitempty" url:"-"`
+	Uid            uuid.UUID `json:"uid,omitempty" url:"-"`
+	ShareName      string    `json:"share_name" url:"-"`
+	FilesystemName string    `json:"filesystem_name" url:"-"`
+	Description    string    `json:"description,omitempty" url:"-"`
+	InternalPath   string    `json:"internal_path,omitempty" url:"-"`
+	ReadOnly       bool      `json:"read_only,omitempty" url:"-"`
+}
+
+func (s *SmbShare) GetType() string {
+	return "smbShare"
+}
+
+//goland:noinspection GoUnusedParameter
+func (s *SmbShare) GetBasePath(a *ApiClient) string {
+	return "smb/shares"
+}
+
+func (s *SmbShare) GetApiUrl(a *ApiClient) string {
+	url, err := url.JoinPath(s.GetBasePath(a), s.Uid.String())
+	if err == nil {
+		return url
+	}
+	return ""
+}
+
+func (s *SmbShare) EQ(other ApiObject) bool {
+	return ObjectsAreEqual(s, other)
+}
+
+func (s *SmbShare) getImmutableFields() []string {
+	return []string{"ShareName", "FilesystemName", "InternalPath"}
+}
+
+func (s *SmbShare) String() string {
+	return fmt.Sprintln("SmbShare Uid:", s.Uid.String(), "name:", s.ShareName, "filesystem:", s.FilesystemName, "path:", s.getInternalPath())
+}
+
+// getInternalPath returns the path inside the filesystem the share points to, the filesystem root is always "/"
+func (s *SmbShare) getInternalPath() string {
+	return normalizeSmbSharePath(s.InternalPath)
+}
+
+// IsCsiManaged returns true if the share was created by the CSI plugin
+func (s *SmbShare) IsCsiManaged() bool {
+	return s.Description == SmbShareCsiDescription
+}
+
+func normalizeSmbSharePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return filepath.Clean("/" + path)
+}
+
+// SmbShareNameFor returns the name of the share created for a path inside the filesystem. Names are derived from the
+// filesystem name, with a hash of the path appended for shares of inner paths, since share names are limited in length
+func SmbShareNameFor(fsName, path string) string {
+	name := smbShareNamePrefix + smbShareNameInvalidChars.ReplaceAllString(fsName, "-")
+	if len(name) > len(smbShareNamePrefix)+smbShareNameMaxFsPart {
+		name = name[:len(smbShareNamePrefix)+smbShareNameMaxFsPart]
+	}
+	if path = normalizeSmbSharePath(path); path != "/" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(path))
+		name = fmt.Sprintf("%s-%08x", name, h.Sum32())
+	}
+	return name
+}
+
+func (a *ApiClient) GetSmbShares(ctx context.Context, shares *[]SmbShare) error {
+	s := &SmbShare{}
+	return a.Get(ctx, s.GetBasePath(a), nil, shares)
+}
+
+func (a *ApiClient) FindSmbSharesByFilesystem(ctx context.Context, fsName string, resultSet *[]SmbShare) error {
+	op := "FindSmbSharesByFilesystem"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	ret := &[]SmbShare{}
+	if err := a.GetSmbShares(ctx, ret); err != nil {
+		return err
+	}
+	for _, s := range *ret {
+		if s.FilesystemName == fsName {
+			*resultSet = append(*resultSet, s)
+		}
+	}
+	return nil
+}
+
+type SmbShareCreateRequest struct {
+	ShareName    string `json:"share_name"`
+	Filesystem   string `json:"fs_name"`
+	Description  string `json:"description,omitempty"`
+	InternalPath string `json:"internal_path,omitempty"`
+}
+
+func (sc *SmbShareCreateRequest) getApiUrl(a *ApiClient) string {
+	return sc.getRelatedObject().GetBasePath(a)
+}
+
+func (sc *SmbShareCreateRequest) getRelatedObject() ApiObject {
+	return &SmbShare{ShareName: sc.ShareName, FilesystemName: sc.Filesystem}
+}
+
+func (sc *SmbShareCreateRequest) getRequiredFields() []string {
+	return []string{"ShareName", "Filesystem"}
+}
+
+func (sc *SmbShareCreateRequest) hasRequiredFields() bool {
+	return ObjectRequestHasRequiredFields(sc)
+}
+
+func (sc *SmbShareCreateRequest) String() string {
+	return fmt.Sprintln("SmbShareCreateRequest(name:", sc.ShareName, "FS:", sc.Filesystem, "path:", sc.InternalPath)
+}
+
+func (a *ApiClient) CreateSmbShare(ctx context.Context, r *SmbShareCreateRequest, s *SmbShare) error {
+	op := "CreateSmbShare"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx).With().Str("smb_share", r.String()).Logger()
+	if !r.hasRequiredFields() {
+		return RequestMissingParams
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to marshal request")
+		return err
+	}
+	logger.Trace().Msg("Creating SMB share")
+	err = a.Post(ctx, r.getApiUrl(a), &payload, nil, s)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to create SMB share")
+		return err
+	}
+	return nil
+}
+
+type SmbShareDeleteRequest struct {
+	Uid uuid.UUID `json:"-"`
+}
+
+func (sd *SmbShareDeleteRequest) getApiUrl(a *ApiClient) string {
+	return sd.getRelatedObject().GetApiUrl(a)
+}
+
+func (sd *SmbShareDeleteRequest) getRelatedObject() ApiObject {
+	return &SmbShare{Uid: sd.Uid}
+}
+
+func (sd *SmbShareDeleteRequest) getRequiredFields() []string {
+	return []string{"Uid"}
+}
+
+func (sd *SmbShareDeleteRequest) hasRequiredFields() bool {
+	return ObjectRequestHasRequiredFields(sd)
+}
+
+func (sd *SmbShareDeleteRequest) String() string {
+	return fmt.Sprintln("SmbShareDeleteRequest(uid:", sd.Uid)
+}
+
+func (a *ApiClient) DeleteSmbShare(ctx context.Context, r *SmbShareDeleteRequest) error {
+	op := "DeleteSmbShare"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	if !r.hasRequiredFields() {
+		return RequestMissingParams
+	}
+	apiResponse := &ApiResponse{}
+	err := a.Delete(ctx, r.getApiUrl(a), nil, nil, apiResponse)
+	if err != nil {
+		var notFound *ApiNotFoundError
+		if errors.As(err, &notFound) {
+			return ObjectNotFoundError
+		}
+		return err
+	}
+	return nil
+}
+
+// EnsureSmbShare returns the share of the path inside the filesystem, creating it if missing. An existing share of the
+// same path is used as is, even if it was not created by the CSI plugin
+func (a *ApiClient) EnsureSmbShare(ctx context.Context, fsName, path string) (*SmbShare, error) {
+	logger := log.Ctx(ctx).With().Str("filesystem", fsName).Str("path", path).Logger()
+	path = normalizeSmbSharePath(path)
+	shares := &[]SmbShare{}
+	if err := a.FindSmbSharesByFilesystem(ctx, fsName, shares); err != nil {
+		logger.Error().Err(err).Msg("Failed to list SMB shares")
+		return nil, err
+	}
+	for _, s := range *shares {
+		if s.getInternalPath() == path {
+			logger.Trace().Str("share_name", s.ShareName).Msg("SMB share already exists")
+			return &s, nil
+		}
+	}
+	r := &SmbShareCreateRequest{
+		ShareName:   SmbShareNameFor(fsName, path),
+		Filesystem:  fsName,
+		Description: SmbShareCsiDescription,
+	}
+	if path != "/" {
+		r.InternalPath = path
+	}
+	share := &SmbShare{}
+	if err := a.CreateSmbShare(ctx, r, share); err != nil {
+		return nil, err
+	}
+	if share.ShareName == "" {
+		share.ShareName = r.ShareName
+	}
+	logger.Info().Str("share_name", share.ShareName).Msg("Created SMB share")
+	return share, nil
+}
+
+// csiSmbSharesOfPath returns the shares created by the CSI plugin, limited to those of the path if it is not empty
+func csiSmbSharesOfPath(shares []SmbShare, path string) []SmbShare {
+	var ret []SmbShare
+	for _, s := range shares {
+		if s.IsCsiManaged() && (path == "" || s.getInternalPath() == normalizeSmbSharePath(path)) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// EnsureNoCsiSmbSharesForFilesystem removes the SMB shares created by the CSI plugin for the filesystem
+func (a *ApiClient) EnsureNoCsiSmbSharesForFilesystem(ctx context.Context, fsName string) error {
+	return a.ensureNoCsiSmbShares(ctx, fsName, "")
+}
+
+// EnsureNoCsiSmbShareForPath removes the SMB share created by the CSI plugin for the path inside the filesystem
+func (a *ApiClient) EnsureNoCsiSmbShareForPath(ctx context.Context, fsName, path string) error {
+	return a.ensureNoCsiSmbShares(ctx, fsName, path)
+}
+
+func (a *ApiClient) ensureNoCsiSmbShares(ctx context.Context, fsName, path string) error {
+	logger := log.Ctx(ctx).With().Str("filesystem", fsName).Str("path", path).Logger()
+	shares := &[]SmbShare{}
+	if err := a.FindSmbSharesByFilesystem(ctx, fsName, shares); err != nil {
+		logger.Error().Err(err).Msg("Failed to list SMB shares")
+		return err
+	}
+	for _, s := range csiSmbSharesOfPath(*shares, path) {
+		err := a.DeleteSmbShare(ctx, &SmbShareDeleteRequest{Uid: s.Uid})
+		if err != nil && !errors.Is(err, ObjectNotFoundError) {
+			logger.Error().Err(err).Str("share_name", s.ShareName).Msg("Failed to delete SMB share")
+			return err
+		}
+		logger.Debug().Str("share_name", s.ShareName).Msg("Deleted SMB share")
+	}
+	return nil
+}
+
+// GetSmbMountIp returns the IP address of the SMB interface group to be used for CIFS mount. The same IP address is
+// returned for the same node, so its mounts are not spread across the cluster
+func (a *ApiClient) GetSmbMountIp(ctx context.Context) (string, error) {
+	igs := &[]InterfaceGroup{}
+	if err := a.GetInterfaceGroups(ctx, igs); err != nil {
+		return "", errors.Join(errors.New("failed to fetch interface groups"), err)
+	}
+	for _, ig := range *igs {
+		if ig.isSmb() && len(ig.Ips) > 0 {
+			return ig.GetIpAddress(ctx)
+		}
+	}
+	return "", errors.New("no SMB interface groups with IP addresses found")
+}
@@ -0,0 +1,41 @@
+package apiclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmbShareNameFor(t *testing.T) {
+	assert.Equal(t, "csi-fs1", SmbShareNameFor("fs1", "/"))
+	assert.Equal(t, "csi-fs1", SmbShareNameFor("fs1", ""))
+	assert.Equal(t, "csi-my-fs-1", SmbShareNameFor("my fs.1", "/"))
+
+	inner := SmbShareNameFor("fs1", "/csi-volumes/pvc-1")
+	assert.True(t, strings.HasPrefix(inner, "csi-fs1-"))
+	assert.Equal(t, inner, SmbShareNameFor("fs1", "csi-volumes/pvc-1/"), "same path must map to same share")
+	assert.NotEqual(t, inner, SmbShareNameFor("fs1", "/csi-volumes/pvc-2"))
+
+	long := SmbShareNameFor(strings.Repeat("a", 100), "/csi-volumes/pvc-1")
+	assert.LessOrEqual(t, len(long), 80)
+}
+
+func TestSmbShareInternalPath(t *testing.T) {
+	assert.Equal(t, "/", (&SmbShare{}).getInternalPath())
+	assert.Equal(t, "/csi-volumes/pvc-1", (&SmbShare{InternalPath: "csi-volumes/pvc-1/"}).getInternalPath())
+	assert.True(t, (&SmbShare{Description: SmbShareCsiDescription}).IsCsiManaged())
+	assert.False(t, (&SmbShare{Description: "manual"}).IsCsiManaged())
+}
+
+func TestCsiSmbSharesOfPath(t *testing.T) {
+	root := SmbShare{ShareName: "csi-fs1", Description: SmbShareCsiDescription}
+	inner := SmbShare{ShareName: "csi-fs1-1", InternalPath: "csi-volumes/pvc-1", Description: SmbShareCsiDescription}
+	other := SmbShare{ShareName: "csi-fs1-2", InternalPath: "/csi-volumes/pvc-2", Description: SmbShareCsiDescription}
+	manual := SmbShare{ShareName: "manual", InternalPath: "/csi-volumes/pvc-1", Description: "manual"}
+	shares := []SmbShare{root, inner, other, manual}
+
+	assert.Equal(t, []SmbShare{root, inner, other}, csiSmbSharesOfPath(shares, ""))
+	assert.Equal(t, []SmbShare{inner}, csiSmbSharesOfPath(shares, "/csi-volumes/pvc-1"), "shares not created by the plugin must be kept")
+	assert.Empty(t, csiSmbSharesOfPath(shares, "/csi-volumes/pvc-3"))
+}
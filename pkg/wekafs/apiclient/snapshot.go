@@ -164,6 +164,23 @@ func (a *ApiClient) DeleteSnapshot(ctx context.Context, r *SnapshotDeleteRequest
 	return err
 }
 
+// UploadSnapshot uploads a snapshot to the object store attached to its filesystem
+func (a *ApiClient) UploadSnapshot(ctx context.Context, r *SnapshotUploadRequest) error {
+	op := "UploadWekaSnapshot"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	if !r.hasRequiredFields() {
+		return RequestMissingParams
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	apiResponse := &ApiResponse{}
+	return a.Post(ctx, r.getApiUrl(a), &payload, nil, apiResponse)
+}
+
 func (snap *Snapshot) GetType() string {
 	return "snapshot"
 }
@@ -319,3 +336,32 @@ func (snapr *SnapshotRestoreRequest) getRequiredFields() []string {
 func (snapr *SnapshotRestoreRequest) hasRequiredFields() bool {
 	return ObjectRequestHasRequiredFields(snapr)
 }
+
+type SnapshotUploadRequest struct {
+	Uid  uuid.UUID `json:"-"`
+	Site string    `json:"site,omitempty"`
+}
+
+func (snapu *SnapshotUploadRequest) String() string {
+	return fmt.Sprintln("SnapshotUploadRequest(Uid:", snapu.Uid, "site:", snapu.Site, ")")
+}
+
+func (snapu *SnapshotUploadRequest) getApiUrl(a *ApiClient) string {
+	url, err := url.JoinPath(snapu.getRelatedObject().GetBasePath(a), snapu.Uid.String(), "upload")
+	if err != nil {
+		return ""
+	}
+	return url
+}
+
+func (snapu *SnapshotUploadRequest) getRelatedObject() ApiObject {
+	return &Snapshot{}
+}
+
+func (snapu *SnapshotUploadRequest) getRequiredFields() []string {
+	return []string{"Uid"}
+}
+
+func (snapu *SnapshotUploadRequest) hasRequiredFields() bool {
+	return ObjectRequestHasRequiredFields(snapu)
+}
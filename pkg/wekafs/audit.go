@@ -0,0 +1,113 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkEvent  = "event"
+
+	auditEventReasonSucceeded = "WekaApiOperationSucceeded"
+	auditEventReasonFailed    = "WekaApiOperationFailed"
+)
+
+// pvcEventAuditSink publishes audit records as Kubernetes events on the PVC the operation was performed for, a Normal
+// event for every successful operation and a Warning event for every failed one. Records that cannot be attributed to
+// a PVC (e.g. DeleteVolume, which runs after the PVC is gone) are skipped, so the sink is not a complete audit trail
+// on its own and is configured along with the stdout or file sink
+type pvcEventAuditSink struct {
+	recorder record.EventRecorder
+}
+
+func newPvcEventAuditSink(recorder record.EventRecorder) *pvcEventAuditSink {
+	return &pvcEventAuditSink{recorder: recorder}
+}
+
+func (s *pvcEventAuditSink) Write(_ context.Context, r *apiclient.AuditRecord) error {
+	if r.PvcName == "" || r.PvcNamespace == "" {
+		return nil
+	}
+	ref := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  r.PvcNamespace,
+		Name:       r.PvcName,
+	}
+	eventType := v1.EventTypeNormal
+	reason := auditEventReasonSucceeded
+	if r.Error != "" {
+		eventType = v1.EventTypeWarning
+		reason = auditEventReasonFailed
+	}
+	s.recorder.Eventf(ref, eventType, reason, "%s: %s %s on cluster %s returned HTTP %d (volume_id=%s, trace_id=%s)",
+		r.CsiOperation, r.Method, r.Path, r.ClusterGuid, r.HttpStatus, r.VolumeId, r.TraceId)
+	return nil
+}
+
+// validateAuditSinks checks the configured audit sinks, which must include a sink recording every operation
+// if the event sink is configured
+func validateAuditSinks(auditSinks string) error {
+	var hasEvent, hasComplete bool
+	for _, sinkType := range strings.Split(auditSinks, ",") {
+		switch strings.TrimSpace(sinkType) {
+		case AuditSinkStdout, AuditSinkFile:
+			hasComplete = true
+		case AuditSinkEvent:
+			hasEvent = true
+		case "":
+		default:
+			return fmt.Errorf("unsupported audit sink %q", strings.TrimSpace(sinkType))
+		}
+	}
+	if hasEvent && !hasComplete {
+		return fmt.Errorf("audit sink %q records only operations of PVCs and must be configured along with %q or %q", AuditSinkEvent, AuditSinkStdout, AuditSinkFile)
+	}
+	return nil
+}
+
+// initAuditSink builds the audit sink from driver configuration and attaches it to the API store,
+// so every API client created afterward records its mutating requests
+func (driver *WekaFsDriver) initAuditSink(ctx context.Context) error {
+	logger := log.Ctx(ctx)
+	if driver.config.auditSinks == "" {
+		return nil
+	}
+	var sinks apiclient.MultiAuditSink
+	for _, sinkType := range strings.Split(driver.config.auditSinks, ",") {
+		switch strings.TrimSpace(sinkType) {
+		case AuditSinkStdout:
+			sinks = append(sinks, apiclient.NewStdoutAuditSink())
+		case AuditSinkFile:
+			sink, err := apiclient.NewFileAuditSink(driver.config.auditLogPath, int64(driver.config.auditLogMaxSizeMB)*1024*1024, driver.config.auditLogMaxBackups)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		case AuditSinkEvent:
+			if driver.manager == nil {
+				logger.Warn().Msg("Kubernetes client is not available, audit events will not be published")
+				continue
+			}
+			sinks = append(sinks, newPvcEventAuditSink(driver.manager.GetEventRecorderFor(driver.name)))
+		case "":
+			continue
+		default:
+			return fmt.Errorf("unsupported audit sink %q", sinkType)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	driver.api.auditSink = sinks
+	logger.Info().Str("audit_sinks", driver.config.auditSinks).Msg("Audit trail of Weka API operations enabled")
+	return nil
+}
@@ -0,0 +1,48 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPvcEventAuditSink(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	s := newPvcEventAuditSink(fake)
+	ctx := context.Background()
+	r := &apiclient.AuditRecord{
+		AuditInfo: apiclient.AuditInfo{CsiOperation: "ControllerExpandVolume", PvcNamespace: "default", PvcName: "data"},
+		Method:    "PUT",
+		Path:      "fileSystems/uid",
+	}
+
+	r.HttpStatus = 200
+	assert.NoError(t, s.Write(ctx, r))
+	assert.Contains(t, <-fake.Events, "Normal "+auditEventReasonSucceeded)
+
+	r.HttpStatus, r.Error = 400, "Operation failed"
+	assert.NoError(t, s.Write(ctx, r))
+	assert.Contains(t, <-fake.Events, "Warning "+auditEventReasonFailed)
+
+	r.HttpStatus, r.Error = 200, ""
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, s.Write(ctx, r))
+		assert.Contains(t, <-fake.Events, "Normal "+auditEventReasonSucceeded, "every successful operation is published")
+	}
+
+	deleted := &apiclient.AuditRecord{AuditInfo: apiclient.AuditInfo{CsiOperation: "DeleteVolume"}, Method: "DELETE", Path: "fileSystems/uid", HttpStatus: 200}
+	assert.NoError(t, s.Write(ctx, deleted))
+	assert.Empty(t, fake.Events, "operations without PVC are not published")
+}
+
+func TestValidateAuditSinks(t *testing.T) {
+	for _, sinks := range []string{"", "stdout", "file, event", "event,stdout", "stdout,"} {
+		assert.NoError(t, validateAuditSinks(sinks), "sinks %q", sinks)
+	}
+	for _, sinks := range []string{"event", "syslog", "stdout,kafka"} {
+		assert.Error(t, validateAuditSinks(sinks), "sinks %q", sinks)
+	}
+}
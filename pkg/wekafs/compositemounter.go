@@ -0,0 +1,232 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// TransportParam is the StorageClass parameter choosing the data transport of a volume, one of wekafs, nfs, smb
+	TransportParam = "transport"
+	// PvcTransportAnnotation overrides the data transport of a volume per PVC
+	PvcTransportAnnotation = "weka.io/transport"
+)
+
+var ErrTransportUnavailable = errors.New("requested data transport is not available on node")
+
+func ParseDataTransport(s string) (DataTransport, error) {
+	switch t := DataTransport(s); t {
+	case "", dataTransportWekafs, dataTransportNfs, dataTransportSmb:
+		return t, nil
+	}
+	return "", fmt.Errorf("unsupported %s %q, must be one of %s, %s, %s", TransportParam, s, dataTransportWekafs, dataTransportNfs, dataTransportSmb)
+}
+
+type dataTransportCtxKey struct{}
+
+// withDataTransport passes the data transport requested by a volume down to the mounter
+func withDataTransport(ctx context.Context, transport DataTransport) context.Context {
+	if transport == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, dataTransportCtxKey{}, transport)
+}
+
+func dataTransportFromContext(ctx context.Context) DataTransport {
+	if t, ok := ctx.Value(dataTransportCtxKey{}).(DataTransport); ok {
+		return t
+	}
+	return ""
+}
+
+// getPvcTransportOverride returns the data transport requested by the PVC annotation, or empty if the annotation is absent
+func getPvcTransportOverride(ctx context.Context, crclient runtimeclient.Reader, pvcNamespace, pvcName string) (DataTransport, error) {
+	claim := &v1.PersistentVolumeClaim{}
+	if err := crclient.Get(ctx, types.NamespacedName{Namespace: pvcNamespace, Name: pvcName}, claim); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("pvc_namespace", pvcNamespace).Str("pvc_name", pvcName).
+			Msg("Failed to fetch PVC for data transport annotation, skipping")
+		return "", nil
+	}
+	transport, err := ParseDataTransport(claim.Annotations[PvcTransportAnnotation])
+	if err != nil {
+		return "", fmt.Errorf("invalid %s annotation on PVC %s/%s: %w", PvcTransportAnnotation, pvcNamespace, pvcName, err)
+	}
+	return transport, nil
+}
+
+// compositeMounter holds the native WekaFS, NFS and SMB transports and picks one of them per volume,
+// so latency-sensitive volumes can use the Weka client while others are served over NFS or SMB from the same node
+type compositeMounter struct {
+	wekafs        *wekafsMounter
+	nfs           *nfsMounter
+	smb           *smbMounter
+	config        *DriverConfig
+	isWekaRunning func(ctx context.Context) bool
+}
+
+func newCompositeMounter(ctx context.Context, driver *WekaFsDriver) *compositeMounter {
+	return &compositeMounter{
+		wekafs:        newWekafsMounter(ctx, driver),
+		nfs:           newNfsMounter(ctx, driver),
+		smb:           newSmbMounter(ctx, driver),
+		config:        driver.config,
+		isWekaRunning: isWekaRunning,
+	}
+}
+
+func (m *compositeMounter) isWekafsAvailable(ctx context.Context) bool {
+	return m.config.isInDevMode() || m.isWekaRunning(ctx)
+}
+
+// defaultTransport is the transport of volumes that do not request one, chosen the same way as for the whole node
+// when per-volume transport is not allowed
+func (m *compositeMounter) defaultTransport(ctx context.Context) DataTransport {
+	if m.config.useNfs {
+		return dataTransportNfs
+	}
+	if !m.isWekafsAvailable(ctx) && m.config.allowNfsFailback {
+		return dataTransportNfs
+	}
+	return dataTransportWekafs
+}
+
+// selectTransport picks the transport for a volume. NFS and SMB are always served, while a volume requesting WekaFS
+// falls back to NFS only if NFS failback is allowed and the Weka client is not running on the node
+func (m *compositeMounter) selectTransport(ctx context.Context, requested DataTransport) (DataTransport, error) {
+	switch requested {
+	case dataTransportNfs, dataTransportSmb:
+		return requested, nil
+	case dataTransportWekafs:
+		if m.isWekafsAvailable(ctx) {
+			return dataTransportWekafs, nil
+		}
+		if m.config.allowNfsFailback {
+			log.Ctx(ctx).Warn().Msg("Weka client is not running on node, failing back to NFS transport")
+			return dataTransportNfs, nil
+		}
+		return dataTransportWekafs, fmt.Errorf("%w: %s, Weka client is not running", ErrTransportUnavailable, requested)
+	}
+	return m.defaultTransport(ctx), nil
+}
+
+func (m *compositeMounter) resolveTransport(ctx context.Context, requested DataTransport) DataTransport {
+	transport, _ := m.selectTransport(ctx, requested)
+	return transport
+}
+
+func (m *compositeMounter) mounterFor(transport DataTransport) AnyMounter {
+	switch transport {
+	case dataTransportNfs:
+		return m.nfs
+	case dataTransportSmb:
+		return m.smb
+	}
+	return m.wekafs
+}
+
+func (m *compositeMounter) mounters() []AnyMounter {
+	return []AnyMounter{m.wekafs, m.nfs, m.smb}
+}
+
+func (m *compositeMounter) NewMount(fsName string, options MountOptions) AnyMount {
+	return m.mounterFor(m.getTransport()).NewMount(fsName, options)
+}
+
+func (m *compositeMounter) mountWithOptions(ctx context.Context, fsName string, mountOptions MountOptions, apiClient *apiclient.ApiClient) (string, error, UnmountFunc) {
+	transport, err := m.selectTransport(ctx, dataTransportFromContext(ctx))
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("filesystem", fsName).Msg("Cannot mount filesystem")
+		return "", err, NoOpUnmount
+	}
+	log.Ctx(ctx).Debug().Str("transport", string(transport)).Str("filesystem", fsName).Msg("Selected data transport for mount")
+	return m.mounterFor(transport).mountWithOptions(ctx, fsName, mountOptions, apiClient)
+}
+
+func (m *compositeMounter) Mount(ctx context.Context, fs string, apiClient *apiclient.ApiClient) (string, error, UnmountFunc) {
+	return m.mountWithOptions(ctx, fs, getDefaultMountOptions(), apiClient)
+}
+
+func (m *compositeMounter) unmountWithOptions(ctx context.Context, fsName string, options MountOptions) error {
+	return m.mounterFor(m.resolveTransport(ctx, dataTransportFromContext(ctx))).unmountWithOptions(ctx, fsName, options)
+}
+
+func (m *compositeMounter) LogActiveMounts(ctx context.Context) {
+	for _, mounter := range m.mounters() {
+		mounter.LogActiveMounts(ctx)
+	}
+}
+
+func (m *compositeMounter) gcInactiveMounts(ctx context.Context) {
+	for _, mounter := range m.mounters() {
+		mounter.gcInactiveMounts(ctx)
+	}
+}
+
+func (m *compositeMounter) schedulePeriodicMountGc(ctx context.Context) {
+	for _, mounter := range m.mounters() {
+		mounter.schedulePeriodicMountGc(ctx)
+	}
+}
+
+func (m *compositeMounter) getGarbageCollector() *innerPathVolGc {
+	return m.mounterFor(m.getTransport()).getGarbageCollector()
+}
+
+// getTransport returns the transport of volumes that do not request one
+func (m *compositeMounter) getTransport() DataTransport {
+	return m.defaultTransport(context.Background())
+}
+
+func (m *compositeMounter) getMountStats() (mounts int, references int) {
+	for _, mounter := range m.mounters() {
+		mnts, refs := mounter.getMountStats()
+		mounts += mnts
+		references += refs
+	}
+	return mounts, references
+}
+
+func (m *compositeMounter) releaseRecoveredTarget(ctx context.Context, targetPath string) {
+	for _, mounter := range m.mounters() {
+		mounter.releaseRecoveredTarget(ctx, targetPath)
+	}
+}
+
+func (m *compositeMounter) holdPublishTarget(ctx context.Context, mountPoint, targetPath string) {
+	for _, mounter := range m.mounters() {
+		mounter.holdPublishTarget(ctx, mountPoint, targetPath)
+	}
+}
+
+func (m *compositeMounter) releasePublishTarget(ctx context.Context, targetPath string) {
+	for _, mounter := range m.mounters() {
+		mounter.releasePublishTarget(ctx, targetPath)
+	}
+}
+
+func (m *compositeMounter) getMountBaseDir() string {
+	return m.wekafs.getMountBaseDir()
+}
+
+// servedTransports returns the data transports the node can serve volumes with
+func (driver *WekaFsDriver) servedTransports(ctx context.Context) []DataTransport {
+	var ret []DataTransport
+	if isWekaRunning(ctx) && (!driver.config.useNfs || driver.config.allowPerVolumeTransport) {
+		ret = append(ret, dataTransportWekafs)
+	}
+	if driver.config.useNfs || driver.config.allowNfsFailback || driver.config.allowPerVolumeTransport {
+		ret = append(ret, dataTransportNfs)
+	}
+	// SMB is served only as a per-volume transport
+	if driver.config.allowPerVolumeTransport {
+		ret = append(ret, dataTransportSmb)
+	}
+	return ret
+}
@@ -0,0 +1,119 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeClient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseDataTransport(t *testing.T) {
+	for _, s := range []string{"", "wekafs", "nfs", "smb"} {
+		transport, err := ParseDataTransport(s)
+		assert.NoError(t, err)
+		assert.Equal(t, DataTransport(s), transport)
+	}
+	_, err := ParseDataTransport("iscsi")
+	assert.Error(t, err)
+}
+
+func TestDataTransportContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, DataTransport(""), dataTransportFromContext(ctx))
+	assert.Equal(t, dataTransportNfs, dataTransportFromContext(withDataTransport(ctx, dataTransportNfs)))
+	assert.Equal(t, ctx, withDataTransport(ctx, ""), "empty transport must not be stored")
+}
+
+func TestCompositeMounterSelectTransport(t *testing.T) {
+	newMounter := func(wekaRunning bool, config *DriverConfig) *compositeMounter {
+		return &compositeMounter{
+			wekafs:        &wekafsMounter{},
+			nfs:           &nfsMounter{},
+			smb:           &smbMounter{},
+			config:        config,
+			isWekaRunning: func(ctx context.Context) bool { return wekaRunning },
+		}
+	}
+	ctx := context.Background()
+
+	m := newMounter(true, &DriverConfig{})
+	for requested, expected := range map[DataTransport]DataTransport{"": dataTransportWekafs, dataTransportWekafs: dataTransportWekafs, dataTransportNfs: dataTransportNfs} {
+		transport, err := m.selectTransport(ctx, requested)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, transport, "requested %q", requested)
+	}
+	assert.Equal(t, m.nfs, m.mounterFor(dataTransportNfs))
+	assert.Equal(t, m.wekafs, m.mounterFor(dataTransportWekafs))
+	assert.Equal(t, m.smb, m.mounterFor(dataTransportSmb))
+
+	// volumes without explicit transport follow the node-wide settings
+	m = newMounter(true, &DriverConfig{useNfs: true})
+	transport, err := m.selectTransport(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, dataTransportNfs, transport)
+	transport, err = m.selectTransport(ctx, dataTransportWekafs)
+	assert.NoError(t, err)
+	assert.Equal(t, dataTransportWekafs, transport)
+
+	m = newMounter(false, &DriverConfig{})
+	_, err = m.selectTransport(ctx, dataTransportWekafs)
+	assert.ErrorIs(t, err, ErrTransportUnavailable)
+	for _, requested := range []DataTransport{dataTransportNfs, dataTransportSmb} {
+		transport, err = m.selectTransport(ctx, requested)
+		assert.NoError(t, err)
+		assert.Equal(t, requested, transport)
+	}
+
+	m = newMounter(false, &DriverConfig{allowNfsFailback: true})
+	for _, requested := range []DataTransport{"", dataTransportWekafs} {
+		transport, err = m.selectTransport(ctx, requested)
+		assert.NoError(t, err)
+		assert.Equal(t, dataTransportNfs, transport, "requested %q", requested)
+	}
+}
+
+func TestGetPvcTransportOverride(t *testing.T) {
+	pvc := func(name, transport string) *v1.PersistentVolumeClaim {
+		ret := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		if transport != "" {
+			ret.Annotations = map[string]string{PvcTransportAnnotation: transport}
+		}
+		return ret
+	}
+	client := fakeClient.NewClientBuilder().WithObjects(pvc("plain", ""), pvc("nfs", "nfs"), pvc("bad", "iscsi")).Build()
+	ctx := context.Background()
+
+	transport, err := getPvcTransportOverride(ctx, client, "default", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, DataTransport(""), transport)
+
+	transport, err = getPvcTransportOverride(ctx, client, "default", "nfs")
+	assert.NoError(t, err)
+	assert.Equal(t, dataTransportNfs, transport)
+
+	_, err = getPvcTransportOverride(ctx, client, "default", "bad")
+	assert.Error(t, err)
+
+	transport, err = getPvcTransportOverride(ctx, client, "default", "missing")
+	assert.NoError(t, err, "missing PVC must not fail the mount")
+	assert.Equal(t, DataTransport(""), transport)
+}
+
+func TestGenerateAccessibleTopologyTransport(t *testing.T) {
+	config := &DriverConfig{manageNodeTopologyLabels: true, driverRef: &WekaFsDriver{name: "csi.weka.io"}}
+	cs := &ControllerServer{config: config}
+	transportLabel := fmt.Sprintf(TopologyLabelTransportServedPattern, "csi.weka.io", dataTransportSmb)
+
+	segments := cs.generateAccessibleTopology(nil, dataTransportSmb)[0].Segments
+	assert.NotContains(t, segments, transportLabel, "transport must not constrain nodes that do not allow per-volume transport")
+	assert.Equal(t, "true", segments[TopologyLabelWekaGlobal])
+
+	config.allowPerVolumeTransport = true
+	segments = cs.generateAccessibleTopology(nil, dataTransportSmb)[0].Segments
+	assert.Equal(t, "true", segments[transportLabel])
+	assert.Len(t, cs.generateAccessibleTopology(nil, "")[0].Segments, 2)
+}
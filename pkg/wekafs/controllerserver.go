@@ -30,6 +30,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -72,8 +73,11 @@ type ControllerServer struct {
 	api             *ApiStore
 	config          *DriverConfig
 	semaphores      map[string]*semaphore.Weighted
-	manager         ctrl.Manager     // For listing PVs via K8s client
-	capacityTracker *CapacityTracker // Tracks confirmed + pending capacity
+	locks           *operationLocks   // Volume and snapshot operations in flight
+	journal         *operationJournal // Persists multi-step creations for replay after restart
+	tombstones      *tombstonePurger  // Deletes filesystems tombstoned upon volume deletion after retention period
+	manager         ctrl.Manager      // For listing PVs via K8s client
+	capacityTracker *CapacityTracker  // Tracks confirmed + pending capacity
 	sync.Mutex
 }
 
@@ -153,6 +157,7 @@ func NewControllerServer(nodeID string, api *ApiStore, mounter AnyMounter, confi
 		api:        api,
 		config:     config,
 		semaphores: make(map[string]*semaphore.Weighted),
+		locks:      newOperationLocks(),
 		manager:    manager,
 	}
 
@@ -163,6 +168,15 @@ func NewControllerServer(nodeID string, api *ApiStore, mounter AnyMounter, confi
 			pendingReservations: make(map[string]CapacityReservation),
 			manager:             manager,
 		}
+		capacityMetrics.setTracker(cs.capacityTracker)
+
+		if config.enableOperationJournal {
+			if namespace, err := getOwnNamespace(); err != nil {
+				log.Warn().Err(err).Msg("Failed to detect own namespace, operation journal is disabled")
+			} else {
+				cs.journal = newOperationJournal(manager.GetClient(), manager.GetAPIReader(), namespace)
+			}
+		}
 	}
 
 	return cs
@@ -220,6 +234,7 @@ func (cs *ControllerServer) acquireSemaphore(ctx context.Context, op string) (er
 	start := time.Now()
 	err := sem.Acquire(ctx, 1)
 	elapsed := time.Since(start)
+	observeSemaphoreWait(op, err, elapsed)
 	if err == nil {
 		logger.Trace().Dur("acquire_duration", elapsed).Str("op", op).Msg("Successfully acquired semaphore")
 		return nil, func() {
@@ -259,6 +274,11 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	result := "FAILURE"
 	logger := log.Ctx(ctx)
 	logger.Info().Str("name", req.GetName()).Fields(params).Msg(">>>> Received request")
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{
+		CsiOperation: op,
+		PvcNamespace: params[VolumeContextPvcNamespaceKey],
+		PvcName:      params[VolumeContextPvcNameKey],
+	})
 
 	defer func() {
 		level := zerolog.InfoLevel
@@ -290,6 +310,14 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if volume == nil {
 		return CreateVolumeError(ctx, codes.Internal, "Could not initialize volume representation object from request")
 	}
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{VolumeId: volume.GetId()})
+	setVolumeSpanAttributes(ctx, volume)
+
+	releaseLock, err := cs.locks.tryAcquire(ctx, op, volumeLockKey(volume.GetId()))
+	defer releaseLock()
+	if err != nil {
+		return CreateVolumeError(ctx, codes.Aborted, err.Error())
+	}
 
 	// check if with current API client state we can modify this volume or not
 	// (basically only legacy dirVolume with xAttr fallback can be operated without API client)
@@ -319,6 +347,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	if volExists && volMatchesCapacity {
+		cs.journal.discard(ctx, journalKindVolume, volume.GetId())
 		result = "SUCCESS"
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
@@ -326,7 +355,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 				CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
 				VolumeContext:      params,
 				ContentSource:      volume.getCsiContentSource(ctx),
-				AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements()),
+				AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements(), DataTransport(params[TransportParam])),
 			},
 		}, nil
 	} else if volExists && err == nil {
@@ -344,6 +373,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			return CreateVolumeError(ctx, codes.Internal, err.Error())
 		}
 
+		cs.journal.discard(ctx, journalKindVolume, volume.GetId())
 		result = "SUCCESS"
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
@@ -351,7 +381,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 				CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
 				VolumeContext:      params,
 				ContentSource:      volume.getCsiContentSource(ctx),
-				AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements()),
+				AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements(), DataTransport(params[TransportParam])),
 			},
 		}, nil
 
@@ -366,13 +396,19 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	// Actually try to create the volume here
 	logger.Info().Int64("capacity", capacity).Str("volume_id", volume.GetId()).Msg("Creating volume")
-	if err := volume.Create(ctx, capacity); err != nil {
+	journal := cs.beginVolumeCreateJournal(ctx, req, volume)
+	if err := volume.Create(contextWithJournal(ctx, journal), capacity); err != nil {
+		journal.fail(ctx, err)
 		if errors.Is(err, apiclient.MountPermissionDenied) {
 			return CreateVolumeError(ctx, codes.PermissionDenied, err.Error())
 		}
+		if errors.Is(err, apiclient.NfsRootExportConflict) {
+			return CreateVolumeError(ctx, codes.FailedPrecondition, err.Error())
+		}
 		return CreateVolumeError(ctx, codes.Internal, err.Error())
 	}
 
+	journal.complete(ctx)
 	result = "SUCCESS"
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -380,7 +416,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
 			VolumeContext:      params,
 			ContentSource:      volume.getCsiContentSource(ctx),
-			AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements()),
+			AccessibleTopology: cs.generateAccessibleTopology(req.GetAccessibilityRequirements(), DataTransport(params[TransportParam])),
 		},
 	}, nil
 }
@@ -621,7 +657,7 @@ func (ct *CapacityTracker) deleteReservationLocked(volumeID string) {
 	delete(ct.pendingReservations, volumeID)
 }
 
-func (cs *ControllerServer) generateAccessibleTopology(topologyRequirements *csi.TopologyRequirement) []*csi.Topology {
+func (cs *ControllerServer) generateAccessibleTopology(topologyRequirements *csi.TopologyRequirement, transport DataTransport) []*csi.Topology {
 	driverName := cs.getConfig().GetDriver().name
 	localWekaLabel := fmt.Sprintf(TopologyLabelWekaLocalPattern, driverName)
 
@@ -629,6 +665,11 @@ func (cs *ControllerServer) generateAccessibleTopology(topologyRequirements *csi
 		TopologyLabelWekaGlobal: "true",
 		localWekaLabel:          "true",
 	}
+	// a volume requesting a specific transport is only accessible from nodes serving it. Nodes are labeled by transport
+	// only if they allow per-volume transport, otherwise the parameter is ignored by nodes and must not constrain them
+	if transport != "" && cs.getConfig().manageNodeTopologyLabels && cs.getConfig().allowPerVolumeTransport {
+		baseSegments[fmt.Sprintf(TopologyLabelTransportServedPattern, driverName, transport)] = "true"
+	}
 
 	// If no topology requirements were provided (no allowedTopologies on StorageClass),
 	// return the base driver segments only — preserves existing behavior.
@@ -687,6 +728,7 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	logger := log.Ctx(ctx)
 	result := "FAILURE"
 	logger.Info().Str("volume_id", volumeID).Msg(">>>> Received request")
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{CsiOperation: op, VolumeId: volumeID})
 	defer func() {
 		level := zerolog.InfoLevel
 		if result != "SUCCESS" {
@@ -695,6 +737,12 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	releaseLock, err := cs.locks.tryAcquire(ctx, op, volumeLockKey(volumeID))
+	defer releaseLock()
+	if err != nil {
+		return DeleteVolumeError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, cs.config.grpcRequestTimeout)
 	err, dec := cs.acquireSemaphore(ctx, op)
 	defer dec()
@@ -718,12 +766,19 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		result = "SUCCESS"
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	setVolumeSpanAttributes(ctx, volume)
 
 	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		logger.Warn().Err(err).Msg("invalid delete volume request")
 		return DeleteVolumeError(ctx, codes.Internal, err.Error())
 	}
 
+	if cs.config.trashRetention > 0 && volume.requiresGc() {
+		ctx = cs.contextWithClaimOfVolume(ctx, volumeID)
+	}
+	if err := cs.obtainDeletionParams(ctx, volume); err != nil {
+		return DeleteVolumeError(ctx, codes.Internal, fmt.Sprintln("Failed to obtain deletion parameters of volume", err))
+	}
 	err = volume.Trash(ctx)
 	if os.IsNotExist(err) {
 		logger.Debug().Str("volume_id", volume.GetId()).Msg("Volume not found, but returning success for idempotence")
@@ -742,6 +797,12 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 
 	// Release capacity reservation after successful delete
 	cs.releaseCapacityReservation(volumeID)
+	if volume.isFilesystem() {
+		cs.tombstones.addClient(client)
+	} else if volume.isOnSnapshot() {
+		// the volume might have been the last one to prevent deletion of a tombstoned filesystem
+		cs.tombstones.trigger(client)
+	}
 
 	result = "SUCCESS"
 	return &csi.DeleteVolumeResponse{}, nil
@@ -770,6 +831,7 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		capacity = capRange.GetRequiredBytes()
 	}
 	logger.Info().Int64("capacity", capacity).Msg(">>>> Received request")
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{CsiOperation: op, VolumeId: volumeID})
 	defer func() {
 		level := zerolog.InfoLevel
 		if result != "SUCCESS" {
@@ -778,6 +840,12 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	releaseLock, err := cs.locks.tryAcquire(ctx, op, volumeLockKey(volumeID))
+	defer releaseLock()
+	if err != nil {
+		return ExpandVolumeError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, cs.config.grpcRequestTimeout)
 	err, dec := cs.acquireSemaphore(ctx, op)
 	defer dec()
@@ -804,6 +872,7 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	if err != nil {
 		return ExpandVolumeError(ctx, codes.NotFound, fmt.Sprintf("Volume with id %s does not exist", req.GetVolumeId()))
 	}
+	setVolumeSpanAttributes(ctx, volume)
 
 	maxStorageCapacity, err := volume.getMaxCapacity(ctx)
 	if err != nil {
@@ -865,6 +934,7 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	logger := log.Ctx(ctx)
 	result := "FAILURE"
 	logger.Info().Str("src_volume_id", srcVolumeId).Str("name", snapName).Msg(">>>> Received request")
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{CsiOperation: op, VolumeId: srcVolumeId})
 	defer func() {
 		level := zerolog.InfoLevel
 		if result != "SUCCESS" {
@@ -873,6 +943,16 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	snapshotLock := ""
+	if srcVolumeId != "" && snapName != "" {
+		snapshotLock = snapshotLockKey(generateSnapshotIdForVolume(snapName, srcVolumeId))
+	}
+	releaseLock, err := cs.locks.tryAcquire(ctx, op, volumeLockKey(srcVolumeId), snapshotLock)
+	defer releaseLock()
+	if err != nil {
+		return CreateSnapshotError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, cs.config.grpcRequestTimeout)
 	err, dec := cs.acquireSemaphore(ctx, op)
 	defer dec()
@@ -898,6 +978,7 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	if err != nil {
 		return CreateSnapshotError(ctx, codes.InvalidArgument, fmt.Sprintln("Invalid sourceVolumeId", srcVolumeId))
 	}
+	setVolumeSpanAttributes(ctx, srcVolume)
 
 	srcVolExists, err := srcVolume.Exists(ctx)
 	if err != nil {
@@ -907,11 +988,14 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return CreateSnapshotError(ctx, codes.FailedPrecondition, fmt.Sprintf("Could not find source volume %s", srcVolume.GetId()))
 	}
 
-	s, err := srcVolume.CreateSnapshot(ctx, snapName)
+	journal := cs.beginSnapshotCreateJournal(ctx, generateSnapshotIdForVolume(snapName, srcVolumeId), snapName, srcVolume)
+	s, err := srcVolume.CreateSnapshot(contextWithJournal(ctx, journal), snapName)
 	if err != nil {
+		journal.fail(ctx, err)
 		return &csi.CreateSnapshotResponse{}, err
 
 	}
+	journal.complete(ctx)
 
 	ret := &csi.CreateSnapshotResponse{
 		Snapshot: s.getCsiSnapshot(ctx),
@@ -937,6 +1021,8 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	logger := log.Ctx(ctx)
 	result := "FAILURE"
 	logger.Info().Str("snapshot_id", snapshotID).Msg(">>>> Received request")
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{CsiOperation: op, SnapshotId: snapshotID})
+	span.SetAttributes(attribute.String(SpanAttributeSnapshotId, snapshotID))
 	defer func() {
 		level := zerolog.InfoLevel
 		if result != "SUCCESS" {
@@ -945,6 +1031,12 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	releaseLock, err := cs.locks.tryAcquire(ctx, op, snapshotLockKey(snapshotID))
+	defer releaseLock()
+	if err != nil {
+		return DeleteSnapshotError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, cs.config.grpcRequestTimeout)
 	err, dec := cs.acquireSemaphore(ctx, op)
 	defer dec()
@@ -975,6 +1067,7 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	if err != nil {
 		return DeleteSnapshotError(ctx, codes.Internal, fmt.Sprintln("Failed to delete snapshot", snapshotID, err))
 	}
+	cs.tombstones.trigger(client)
 	result = "SUCCESS"
 	return &csi.DeleteSnapshotResponse{}, err
 }
@@ -1,6 +1,7 @@
 package wekafs
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -52,6 +53,34 @@ type DriverConfig struct {
 	setOwnershipOnDynamicFilesystems  bool
 	allowMountOptionOverrides         bool
 	keepThinProvisioningRatioOnExpand bool
+	auditSinks                        string
+	auditLogPath                      string
+	auditLogMaxSizeMB                 int
+	auditLogMaxBackups                int
+	enableVolumeUsageMetrics          bool
+	volumeUsageMetricsInterval        time.Duration
+	enableFailureEvents               bool
+	failureEventsInterval             time.Duration
+	enableOperationJournal            bool
+	enableOrphanReconciler            bool
+	orphanReconcileInterval           time.Duration
+	orphanDeletionGracePeriod         time.Duration
+	orphanDeletionDryRun              bool
+	garbageCollectionMaxThreads       int
+	garbageCollectionOpsPerSecond     int
+	trashRetention                    time.Duration
+	enableMountWatchdog               bool
+	mountWatchdogInterval             time.Duration
+	mountWatchdogTimeout              time.Duration
+	unmountTimeout                    time.Duration
+	nfsKerberosKeytab                 string
+	nfsKerberosHostKeytab             string
+	allowPerVolumeTransport           bool
+	enableNfsClientRuleCleanup        bool
+	nfsClientRuleCleanupInterval      time.Duration
+	nfsClientRuleGracePeriod          time.Duration
+	nfsClientRuleCleanupDryRun        bool
+	mountOptionProfilesDir            string
 }
 
 func (dc *DriverConfig) Log() {
@@ -84,6 +113,34 @@ func (dc *DriverConfig) Log() {
 		Bool("set_ownership_on_dynamic_filesystems", dc.setOwnershipOnDynamicFilesystems).
 		Bool("allow_mount_option_overrides", dc.allowMountOptionOverrides).
 		Bool("keep_thin_provisioning_ratio_on_expand", dc.keepThinProvisioningRatioOnExpand).
+		Str("audit_sinks", dc.auditSinks).
+		Str("audit_log_path", dc.auditLogPath).
+		Int("audit_log_max_size_mb", dc.auditLogMaxSizeMB).
+		Int("audit_log_max_backups", dc.auditLogMaxBackups).
+		Bool("enable_volume_usage_metrics", dc.enableVolumeUsageMetrics).
+		Int("volume_usage_metrics_interval_seconds", int(dc.volumeUsageMetricsInterval.Seconds())).
+		Bool("enable_failure_events", dc.enableFailureEvents).
+		Int("failure_events_interval_seconds", int(dc.failureEventsInterval.Seconds())).
+		Bool("enable_operation_journal", dc.enableOperationJournal).
+		Bool("enable_orphan_reconciler", dc.enableOrphanReconciler).
+		Int("orphan_reconcile_interval_seconds", int(dc.orphanReconcileInterval.Seconds())).
+		Int("orphan_deletion_grace_period_seconds", int(dc.orphanDeletionGracePeriod.Seconds())).
+		Bool("orphan_deletion_dry_run", dc.orphanDeletionDryRun).
+		Int("garbage_collection_max_threads", dc.garbageCollectionMaxThreads).
+		Int("garbage_collection_ops_per_second", dc.garbageCollectionOpsPerSecond).
+		Int("trash_retention_seconds", int(dc.trashRetention.Seconds())).
+		Bool("enable_mount_watchdog", dc.enableMountWatchdog).
+		Int("mount_watchdog_interval_seconds", int(dc.mountWatchdogInterval.Seconds())).
+		Int("mount_watchdog_timeout_seconds", int(dc.mountWatchdogTimeout.Seconds())).
+		Int("unmount_timeout_seconds", int(dc.unmountTimeout.Seconds())).
+		Str("nfs_kerberos_keytab", dc.nfsKerberosKeytab).
+		Str("nfs_kerberos_host_keytab", dc.nfsKerberosHostKeytab).
+		Bool("allow_per_volume_transport", dc.allowPerVolumeTransport).
+		Bool("enable_nfs_client_rule_cleanup", dc.enableNfsClientRuleCleanup).
+		Int("nfs_client_rule_cleanup_interval_seconds", int(dc.nfsClientRuleCleanupInterval.Seconds())).
+		Int("nfs_client_rule_grace_period_seconds", int(dc.nfsClientRuleGracePeriod.Seconds())).
+		Bool("nfs_client_rule_cleanup_dry_run", dc.nfsClientRuleCleanupDryRun).
+		Str("mount_option_profiles_dir", dc.mountOptionProfilesDir).
 		Msg("Starting driver with the following configuration")
 
 }
@@ -107,7 +164,28 @@ func NewDriverConfig(dynamicVolPath, VolumePrefix, SnapshotPrefix, SeedSnapshotP
 	setOwnershipOnDynamicFilesystems bool,
 	allowMountOptionOverrides bool,
 	keepThinProvisioningRatioOnExpand bool,
-) *DriverConfig {
+	auditSinks, auditLogPath string,
+	auditLogMaxSizeMB, auditLogMaxBackups int,
+	enableVolumeUsageMetrics bool,
+	volumeUsageMetricsIntervalSeconds int,
+	enableFailureEvents bool,
+	failureEventsIntervalSeconds int,
+	enableOperationJournal bool,
+	enableOrphanReconciler bool,
+	orphanReconcileIntervalSeconds, orphanDeletionGracePeriodSeconds int,
+	orphanDeletionDryRun bool,
+	garbageCollectionMaxThreads, garbageCollectionOpsPerSecond int,
+	trashRetentionSeconds int,
+	enableMountWatchdog bool,
+	mountWatchdogIntervalSeconds, mountWatchdogTimeoutSeconds int,
+	unmountTimeoutSeconds int,
+	nfsKerberosKeytab, nfsKerberosHostKeytab string,
+	allowPerVolumeTransport bool,
+	enableNfsClientRuleCleanup bool,
+	nfsClientRuleCleanupIntervalSeconds, nfsClientRuleGracePeriodSeconds int,
+	nfsClientRuleCleanupDryRun bool,
+	mountOptionProfilesDir string,
+) (*DriverConfig, error) {
 
 	var MutuallyExclusiveMountOptions []mutuallyExclusiveMountOptionSet
 	for _, exclusiveSet := range mutuallyExclusiveMountOptions {
@@ -130,7 +208,7 @@ func NewDriverConfig(dynamicVolPath, VolumePrefix, SnapshotPrefix, SeedSnapshotP
 	concurrency["NodePublishVolume"] = maxNodePublishVolumeReqs
 	concurrency["NodeUnpublishVolume"] = maxNodeUnpublishVolumeReqs
 
-	return &DriverConfig{
+	dc := &DriverConfig{
 		DynamicVolPath:                    dynamicVolPath,
 		VolumePrefix:                      VolumePrefix,
 		SnapshotPrefix:                    SnapshotPrefix,
@@ -164,7 +242,59 @@ func NewDriverConfig(dynamicVolPath, VolumePrefix, SnapshotPrefix, SeedSnapshotP
 		setOwnershipOnDynamicFilesystems:  setOwnershipOnDynamicFilesystems,
 		allowMountOptionOverrides:         allowMountOptionOverrides,
 		keepThinProvisioningRatioOnExpand: keepThinProvisioningRatioOnExpand,
+		auditSinks:                        auditSinks,
+		auditLogPath:                      auditLogPath,
+		auditLogMaxSizeMB:                 auditLogMaxSizeMB,
+		auditLogMaxBackups:                auditLogMaxBackups,
+		enableVolumeUsageMetrics:          enableVolumeUsageMetrics,
+		volumeUsageMetricsInterval:        time.Duration(volumeUsageMetricsIntervalSeconds) * time.Second,
+		enableFailureEvents:               enableFailureEvents,
+		failureEventsInterval:             time.Duration(failureEventsIntervalSeconds) * time.Second,
+		enableOperationJournal:            enableOperationJournal,
+		enableOrphanReconciler:            enableOrphanReconciler,
+		orphanReconcileInterval:           time.Duration(orphanReconcileIntervalSeconds) * time.Second,
+		orphanDeletionGracePeriod:         time.Duration(orphanDeletionGracePeriodSeconds) * time.Second,
+		orphanDeletionDryRun:              orphanDeletionDryRun,
+		garbageCollectionMaxThreads:       garbageCollectionMaxThreads,
+		garbageCollectionOpsPerSecond:     garbageCollectionOpsPerSecond,
+		trashRetention:                    time.Duration(trashRetentionSeconds) * time.Second,
+		enableMountWatchdog:               enableMountWatchdog,
+		mountWatchdogInterval:             time.Duration(mountWatchdogIntervalSeconds) * time.Second,
+		mountWatchdogTimeout:              time.Duration(mountWatchdogTimeoutSeconds) * time.Second,
+		unmountTimeout:                    time.Duration(unmountTimeoutSeconds) * time.Second,
+		nfsKerberosKeytab:                 nfsKerberosKeytab,
+		nfsKerberosHostKeytab:             nfsKerberosHostKeytab,
+		allowPerVolumeTransport:           allowPerVolumeTransport,
+		enableNfsClientRuleCleanup:        enableNfsClientRuleCleanup,
+		nfsClientRuleCleanupInterval:      time.Duration(nfsClientRuleCleanupIntervalSeconds) * time.Second,
+		nfsClientRuleGracePeriod:          time.Duration(nfsClientRuleGracePeriodSeconds) * time.Second,
+		nfsClientRuleCleanupDryRun:        nfsClientRuleCleanupDryRun,
+		mountOptionProfilesDir:            mountOptionProfilesDir,
 	}
+	if err := dc.validate(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// validate rejects settings the driver cannot run with, e.g. zero intervals of periodic tasks, which would busy-loop
+func (dc *DriverConfig) validate() error {
+	if err := validateAuditSinks(dc.auditSinks); err != nil {
+		return err
+	}
+	if dc.enableVolumeUsageMetrics && dc.volumeUsageMetricsInterval <= 0 {
+		return fmt.Errorf("volume usage metrics interval must be positive, got %s", dc.volumeUsageMetricsInterval)
+	}
+	if dc.enableMountWatchdog && dc.mountWatchdogInterval <= 0 {
+		return fmt.Errorf("mount watchdog interval must be positive, got %s", dc.mountWatchdogInterval)
+	}
+	if dc.enableOrphanReconciler && dc.orphanReconcileInterval <= 0 {
+		return fmt.Errorf("orphan reconcile interval must be positive, got %s", dc.orphanReconcileInterval)
+	}
+	if dc.enableNfsClientRuleCleanup && dc.nfsClientRuleCleanupInterval <= 0 {
+		return fmt.Errorf("NFS client rule cleanup interval must be positive, got %s", dc.nfsClientRuleCleanupInterval)
+	}
+	return nil
 }
 
 func (dc *DriverConfig) isInDevMode() bool {
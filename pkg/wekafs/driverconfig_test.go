@@ -0,0 +1,20 @@
+package wekafs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriverConfigValidate(t *testing.T) {
+	assert.NoError(t, (&DriverConfig{}).validate(), "intervals of disabled features are not validated")
+	assert.NoError(t, (&DriverConfig{enableVolumeUsageMetrics: true, volumeUsageMetricsInterval: time.Minute}).validate())
+	assert.Error(t, (&DriverConfig{enableVolumeUsageMetrics: true}).validate())
+	assert.NoError(t, (&DriverConfig{enableMountWatchdog: true, mountWatchdogInterval: time.Minute}).validate())
+	assert.Error(t, (&DriverConfig{enableMountWatchdog: true}).validate())
+	assert.NoError(t, (&DriverConfig{enableOrphanReconciler: true, orphanReconcileInterval: time.Hour}).validate())
+	assert.Error(t, (&DriverConfig{enableOrphanReconciler: true}).validate())
+	assert.NoError(t, (&DriverConfig{enableNfsClientRuleCleanup: true, nfsClientRuleCleanupInterval: time.Minute}).validate())
+	assert.Error(t, (&DriverConfig{enableNfsClientRuleCleanup: true, nfsClientRuleCleanupInterval: -time.Second}).validate())
+}
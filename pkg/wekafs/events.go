@@ -0,0 +1,239 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	eventReasonFilesystemGroupNotFound = "FilesystemGroupNotFound"
+	eventReasonInsufficientCapacity    = "InsufficientCapacity"
+	eventReasonKmsNotConfigured        = "KmsNotConfigured"
+	eventReasonTooManyRequests         = "TooManyConcurrentRequests"
+
+	// failureEventsBurst is the number of distinct failure events allowed per object within the deduplication interval
+	failureEventsBurst = 5
+	// maxEventMessageLength is the limit of event message length enforced by Kubernetes API
+	maxEventMessageLength = 1024
+)
+
+// failureEventRecorder publishes Kubernetes events for failed CSI operations: controller operations are reported
+// on the PVC, node operations on the pod that consumes the volume.
+// Identical events are suppressed for the configured interval and events per object are rate limited
+type failureEventRecorder struct {
+	recorder record.EventRecorder
+	reader   runtimeclient.Reader
+	interval time.Duration
+
+	sync.Mutex
+	lastEmitted map[string]time.Time
+	limiters    map[string]*rate.Limiter
+	lastPruned  time.Time
+	// pods that volumes were published for, by target path, so unpublish failures can be attributed to a pod
+	publishedPods map[string]*v1.ObjectReference
+}
+
+func newFailureEventRecorder(recorder record.EventRecorder, reader runtimeclient.Reader, interval time.Duration) *failureEventRecorder {
+	return &failureEventRecorder{
+		recorder:      recorder,
+		reader:        reader,
+		interval:      interval,
+		lastEmitted:   make(map[string]time.Time),
+		limiters:      make(map[string]*rate.Limiter),
+		publishedPods: make(map[string]*v1.ObjectReference),
+	}
+}
+
+// intercept is a gRPC unary interceptor reporting failed CSI operations as Kubernetes events
+func (r *failureEventRecorder) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	r.observe(ctx, info.FullMethod, req, err)
+	return resp, err
+}
+
+func (r *failureEventRecorder) observe(ctx context.Context, fullMethod string, req interface{}, err error) {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	var objectKey string
+	var resolve func() *v1.ObjectReference
+
+	switch req := req.(type) {
+	case *csi.CreateVolumeRequest:
+		params := req.GetParameters()
+		ref := pvcReference(params[VolumeContextPvcNamespaceKey], params[VolumeContextPvcNameKey])
+		objectKey, resolve = objectKeyOf(ref), func() *v1.ObjectReference { return ref }
+	case *csi.DeleteVolumeRequest:
+		objectKey, resolve = r.pvcOfVolume(ctx, req.GetVolumeId())
+	case *csi.ControllerExpandVolumeRequest:
+		objectKey, resolve = r.pvcOfVolume(ctx, req.GetVolumeId())
+	case *csi.CreateSnapshotRequest:
+		objectKey, resolve = r.pvcOfVolume(ctx, req.GetSourceVolumeId())
+	case *csi.NodePublishVolumeRequest:
+		volumeContext := req.GetVolumeContext()
+		ref := podReference(volumeContext[VolumeContextPodNamespaceKey], volumeContext[VolumeContextPodNameKey], volumeContext[VolumeContextPodUidKey])
+		if err == nil {
+			r.rememberPod(req.GetTargetPath(), ref)
+			return
+		}
+		objectKey, resolve = objectKeyOf(ref), func() *v1.ObjectReference { return ref }
+	case *csi.NodeUnpublishVolumeRequest:
+		ref := r.podOfTargetPath(req.GetTargetPath(), err == nil)
+		objectKey, resolve = objectKeyOf(ref), func() *v1.ObjectReference { return ref }
+	default:
+		return
+	}
+
+	if err == nil || objectKey == "" {
+		return
+	}
+	reason := failureEventReason(method, err)
+	message := fmt.Sprintf("%s failed: %s", method, status.Convert(err).Message())
+	if len(message) > maxEventMessageLength {
+		message = message[:maxEventMessageLength-3] + "..."
+	}
+	if !r.allow(objectKey, reason, message, time.Now()) {
+		return
+	}
+	ref := resolve()
+	if ref == nil {
+		return
+	}
+	log.Ctx(ctx).Debug().Str("object", objectKey).Str("reason", reason).Msg("Publishing failure event")
+	r.recorder.Event(ref, v1.EventTypeWarning, reason, message)
+}
+
+// allow returns true if an event should be published, i.e. the same event was not published for the object
+// within the interval and the object did not exceed its rate limit
+func (r *failureEventRecorder) allow(objectKey, reason, message string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if now.Sub(r.lastPruned) > r.interval {
+		for key, t := range r.lastEmitted {
+			if now.Sub(t) > r.interval {
+				delete(r.lastEmitted, key)
+			}
+		}
+		for key, limiter := range r.limiters {
+			if limiter.TokensAt(now) >= failureEventsBurst {
+				delete(r.limiters, key)
+			}
+		}
+		r.lastPruned = now
+	}
+
+	eventKey := objectKey + "/" + reason + "/" + message
+	if t, ok := r.lastEmitted[eventKey]; ok && now.Sub(t) < r.interval {
+		return false
+	}
+	limiter, ok := r.limiters[objectKey]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Every(r.interval/failureEventsBurst), failureEventsBurst)
+		r.limiters[objectKey] = limiter
+	}
+	if !limiter.AllowN(now, 1) {
+		return false
+	}
+	r.lastEmitted[eventKey] = now
+	return true
+}
+
+func (r *failureEventRecorder) rememberPod(targetPath string, ref *v1.ObjectReference) {
+	if ref == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.publishedPods[targetPath] = ref
+}
+
+// podOfTargetPath returns the pod a volume was published for, forgetting it once the volume is unpublished
+func (r *failureEventRecorder) podOfTargetPath(targetPath string, unpublished bool) *v1.ObjectReference {
+	r.Lock()
+	defer r.Unlock()
+	ref := r.publishedPods[targetPath]
+	if unpublished {
+		delete(r.publishedPods, targetPath)
+	}
+	return ref
+}
+
+// pvcOfVolume returns the object key of a volume and a function resolving the PVC bound to its PV.
+// The PV is looked up only when an event is actually about to be published
+func (r *failureEventRecorder) pvcOfVolume(ctx context.Context, volumeId string) (string, func() *v1.ObjectReference) {
+	if volumeId == "" {
+		return "", nil
+	}
+	return "volume/" + volumeId, func() *v1.ObjectReference {
+		pvList := &v1.PersistentVolumeList{}
+		if err := r.reader.List(ctx, pvList); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("volume_id", volumeId).Msg("Failed to list persistent volumes for event publishing")
+			return nil
+		}
+		for _, pv := range pvList.Items {
+			if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volumeId && pv.Spec.ClaimRef != nil {
+				ref := pvcReference(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+				ref.UID = pv.Spec.ClaimRef.UID
+				return ref
+			}
+		}
+		return nil
+	}
+}
+
+func pvcReference(namespace, name string) *v1.ObjectReference {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	return &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: namespace, Name: name}
+}
+
+func podReference(namespace, name, uid string) *v1.ObjectReference {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	return &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: name, UID: types.UID(uid)}
+}
+
+func objectKeyOf(ref *v1.ObjectReference) string {
+	if ref == nil {
+		return ""
+	}
+	return strings.ToLower(ref.Kind) + "/" + ref.Namespace + "/" + ref.Name
+}
+
+// failureEventReason returns the reason of a failure event. Reasons of Weka API errors are preferred,
+// followed by well known provisioning failures and finally a generic reason derived from the method
+func failureEventReason(method string, err error) string {
+	if reason := apiclient.ErrorReason(err); reason != "" {
+		return reason
+	}
+	st := status.Convert(err)
+	msg := strings.ToLower(st.Message())
+	switch {
+	case strings.Contains(msg, "too many concurrent requests"):
+		return eventReasonTooManyRequests
+	case strings.Contains(msg, "kms"):
+		return eventReasonKmsNotConfigured
+	case strings.Contains(msg, "group") && (strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist")):
+		return eventReasonFilesystemGroupNotFound
+	case st.Code() == codes.OutOfRange || st.Code() == codes.ResourceExhausted,
+		strings.Contains(msg, "capacity") && (strings.Contains(msg, "exceeds") || strings.Contains(msg, "insufficient") || strings.Contains(msg, "not enough")):
+		return eventReasonInsufficientCapacity
+	}
+	return method + "Failed"
+}
@@ -0,0 +1,63 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFailureEventRecorderAllow(t *testing.T) {
+	r := newFailureEventRecorder(nil, nil, time.Minute)
+	now := time.Now()
+
+	assert.True(t, r.allow("pod/default/app", "WekaApiForbidden", "denied", now))
+	assert.False(t, r.allow("pod/default/app", "WekaApiForbidden", "denied", now.Add(time.Second)), "duplicate event must be suppressed")
+	assert.True(t, r.allow("pod/default/app", "WekaApiForbidden", "denied", now.Add(2*time.Minute)), "duplicate event is published again after interval")
+
+	later := now.Add(10 * time.Minute)
+	for i := 0; i < failureEventsBurst; i++ {
+		assert.True(t, r.allow("pvc/default/data", "CreateVolumeFailed", string(rune('a'+i)), later))
+	}
+	assert.False(t, r.allow("pvc/default/data", "CreateVolumeFailed", "z", later), "events per object must be rate limited")
+	assert.True(t, r.allow("pvc/default/other", "CreateVolumeFailed", "z", later))
+}
+
+func TestFailureEventReason(t *testing.T) {
+	assert.Equal(t, eventReasonInsufficientCapacity, failureEventReason("CreateVolume", status.Error(codes.OutOfRange, "requested capacity 10 exceeds maximum allowed 5")))
+	assert.Equal(t, eventReasonKmsNotConfigured, failureEventReason("CreateVolume", status.Error(codes.InvalidArgument, "creating encrypted filesystems without kms server configuration is prohibited")))
+	assert.Equal(t, "MountPermissionDenied", failureEventReason("NodePublishVolume", status.Error(codes.PermissionDenied, "permission denied for filesystem")))
+	assert.Equal(t, "DeleteVolumeFailed", failureEventReason("DeleteVolume", status.Error(codes.Internal, "timeout deleting volume")))
+}
+
+func TestFailureEventRecorderObserve(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	r := newFailureEventRecorder(fake, nil, time.Minute)
+	ctx := context.Background()
+	req := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{
+		VolumeContextPvcNamespaceKey: "default",
+		VolumeContextPvcNameKey:      "data",
+	}}
+	err := status.Error(codes.OutOfRange, "requested capacity 10 exceeds maximum allowed 5")
+
+	r.observe(ctx, "/csi.v1.Controller/CreateVolume", req, err)
+	r.observe(ctx, "/csi.v1.Controller/CreateVolume", req, err)
+	r.observe(ctx, "/csi.v1.Controller/CreateVolume", req, nil)
+	assert.Len(t, fake.Events, 1)
+	assert.Contains(t, <-fake.Events, "Warning InsufficientCapacity CreateVolume failed")
+
+	publish := &csi.NodePublishVolumeRequest{TargetPath: "/var/lib/kubelet/pods/uid/volumes/mnt", VolumeContext: map[string]string{
+		VolumeContextPodNamespaceKey: "default",
+		VolumeContextPodNameKey:      "app",
+	}}
+	r.observe(ctx, "/csi.v1.Node/NodePublishVolume", publish, nil)
+	unpublish := &csi.NodeUnpublishVolumeRequest{TargetPath: publish.TargetPath}
+	r.observe(ctx, "/csi.v1.Node/NodeUnpublishVolume", unpublish, status.Error(codes.Internal, "device busy"))
+	assert.Len(t, fake.Events, 1)
+	assert.Contains(t, <-fake.Events, "Warning NodeUnpublishVolumeFailed")
+}
@@ -2,20 +2,29 @@ package wekafs
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/time/rate"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const garbagePath = ".__internal__wekafs-async-delete"
 
+// garbageInfoPath holds a trashInfo file per volume in trash, named after the volume directory
+const garbageInfoPath = ".__internal__wekafs-async-delete-info"
+
 const (
 	// garbageCollectionTimeout bounds a single purge cycle so a hung mount cannot
 	// block the detached GC goroutine indefinitely.
@@ -24,20 +33,33 @@ const (
 	garbageCollectionRetryBackoff = time.Minute
 )
 
-//const garbageCollectionMaxThreads = 32
+// garbageCollectionMaxThreads is the default number of concurrent deletions of a purge cycle
+const garbageCollectionMaxThreads = 32
+
+// ErrGarbageCollectionRunning is returned when trash of a filesystem cannot be accessed as it is being purged
+var ErrGarbageCollectionRunning = errors.New("garbage collection of filesystem is running")
+
+// garbageCollectionReadDirBatch bounds the number of directory entries read at once, so huge directories are
+// deleted while being listed
+const garbageCollectionReadDirBatch = 1024
 
 type innerPathVolGc struct {
 	isRunning  map[string]bool
 	isDeferred map[string]bool
+	// retentionTimers start garbage collection of filesystems once a retained volume expires
+	retentionTimers map[string]*time.Timer
 	sync.Mutex
 	mounter AnyMounter
 	config  *DriverConfig
+	limiter *rate.Limiter // shared by all filesystems to bound the load on the cluster, nil if not throttled
+	once    sync.Once
 }
 
 func initInnerPathVolumeGc(mounter AnyMounter) *innerPathVolGc {
 	gc := innerPathVolGc{mounter: mounter}
 	gc.isRunning = make(map[string]bool)
 	gc.isDeferred = make(map[string]bool)
+	gc.retentionTimers = make(map[string]*time.Timer)
 	return &gc
 }
 
@@ -86,6 +108,16 @@ func (gc *innerPathVolGc) moveVolumeToTrash(ctx context.Context, volume *Volume)
 		logger.Debug().Str("full_path", fullPath).Msg("Volume contents not found, maybe already moved to trash, skipping")
 		return nil
 	}
+	if gc.config.trashRetention > 0 {
+		// written before the move, so a volume in trash is never purged before its retention period expires
+		info := gc.newTrashInfo(ctx, volume)
+		if err := writeTrashInfo(path, filepath.Base(fullPath), info); err != nil {
+			logger.Error().Err(err).Msg("Failed to record trash info of volume")
+			return err
+		}
+		logger.Info().Str("pvc_namespace", info.PvcNamespace).Str("pvc_name", info.PvcName).
+			Time("retained_until", info.DeletedAt.Add(gc.config.trashRetention)).Msg("Volume is retained in trash and can be undeleted until retention period expires")
+	}
 	if err := os.Rename(fullPath, newPath); err != nil {
 		logger.Error().Err(err).Str("full_path", fullPath).
 			Str("volume_trash_location", volumeTrashLoc).Msg("Failed to move volume contents to volumeTrashLoc")
@@ -102,6 +134,136 @@ func (gc *innerPathVolGc) moveVolumeToTrash(ctx context.Context, volume *Volume)
 	return nil
 }
 
+// trashInfo describes a volume moved to trash, so it can be undeleted during the retention period
+type trashInfo struct {
+	VolumeId        string    `json:"volumeId"`
+	InnerPath       string    `json:"innerPath"`
+	PvcNamespace    string    `json:"pvcNamespace,omitempty"`
+	PvcName         string    `json:"pvcName,omitempty"`
+	DeletedAt       time.Time `json:"deletedAt"`
+	Capacity        int64     `json:"capacity,omitempty"`
+	EnforceCapacity bool      `json:"enforceCapacity,omitempty"`
+}
+
+// isRetained returns true if the volume must not be purged yet
+func (i *trashInfo) isRetained(now time.Time, retention time.Duration) bool {
+	return retention > 0 && now.Before(i.DeletedAt.Add(retention))
+}
+
+// newTrashInfo collects the info of a volume about to be moved to trash. PVC is taken from the audit info of
+// the request, capacity from the quota of the volume, both are omitted if unknown
+func (gc *innerPathVolGc) newTrashInfo(ctx context.Context, volume *Volume) *trashInfo {
+	audit := apiclient.AuditInfoFromContext(ctx)
+	info := &trashInfo{
+		VolumeId:     volume.GetId(),
+		InnerPath:    volume.getInnerPath(),
+		PvcNamespace: audit.PvcNamespace,
+		PvcName:      audit.PvcName,
+		DeletedAt:    time.Now().UTC(),
+	}
+	if volume.apiClient != nil {
+		if q, err := volume.getQuota(ctx); err == nil && q != nil {
+			info.Capacity = int64(q.GetCapacityLimit())
+			info.EnforceCapacity = q.GetQuotaType() == apiclient.QuotaTypeHard
+		} else {
+			log.Ctx(ctx).Debug().Err(err).Msg("Could not get quota of volume, it will be undeleted without quota")
+		}
+	}
+	return info
+}
+
+func trashInfoPath(fsRoot, name string) string {
+	return filepath.Join(fsRoot, garbageInfoPath, name+".json")
+}
+
+func writeTrashInfo(fsRoot, name string, info *trashInfo) error {
+	if err := os.MkdirAll(filepath.Join(fsRoot, garbageInfoPath), DefaultVolumePermissions); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	path := trashInfoPath(fsRoot, name)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readTrashInfo returns the info of a volume in trash, or nil if the volume was moved to trash without retention
+func readTrashInfo(fsRoot, name string) (*trashInfo, error) {
+	data, err := os.ReadFile(trashInfoPath(fsRoot, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &trashInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func removeTrashInfo(fsRoot, name string) error {
+	if err := os.Remove(trashInfoPath(fsRoot, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// listTrash returns the names of volumes in trash and their info, nil for volumes moved without retention
+func listTrash(fsRoot string) ([]string, map[string]*trashInfo, error) {
+	names, err := listDirNames(filepath.Join(fsRoot, garbagePath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	infos := make(map[string]*trashInfo)
+	for _, name := range names {
+		info, err := readTrashInfo(fsRoot, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read trash info of %s: %w", name, err)
+		}
+		infos[name] = info
+	}
+	return names, infos, nil
+}
+
+// pausePurge prevents garbage collection of a filesystem until resume is called, so volumes can be taken out of
+// its trash safely. Garbage collection requested meanwhile is started on resume
+func (gc *innerPathVolGc) pausePurge(ctx context.Context, fs string, apiClient *apiclient.ApiClient) (resume func(), err error) {
+	gc.Lock()
+	defer gc.Unlock()
+	if gc.isRunning[fs] {
+		return nil, ErrGarbageCollectionRunning
+	}
+	gc.isRunning[fs] = true
+	return func() {
+		gc.Lock()
+		defer gc.Unlock()
+		gc.isRunning[fs] = false
+		if gc.isDeferred[fs] {
+			gc.isDeferred[fs] = false
+			go gc.purgeLeftovers(context.WithoutCancel(ctx), fs, apiClient)
+		}
+	}, nil
+}
+
+// scheduleRetentionExpiry starts garbage collection of the filesystem when the next retained volume expires
+func (gc *innerPathVolGc) scheduleRetentionExpiry(ctx context.Context, fs string, apiClient *apiclient.ApiClient, at time.Time) {
+	gc.Lock()
+	defer gc.Unlock()
+	if t := gc.retentionTimers[fs]; t != nil {
+		t.Stop()
+	}
+	gc.retentionTimers[fs] = time.AfterFunc(max(time.Until(at), time.Second), func() {
+		gc.initiateGarbageCollection(ctx, fs, apiClient)
+	})
+}
+
 func (gc *innerPathVolGc) purgeLeftovers(ctx context.Context, fs string, apiClient *apiclient.ApiClient) {
 	op := "purgeLeftovers"
 	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
@@ -114,6 +276,8 @@ func (gc *innerPathVolGc) purgeLeftovers(ctx context.Context, fs string, apiClie
 	gc.Unlock()
 
 	succeeded := false
+	// set when the cycle timed out while making progress, so it continues right away
+	resume := false
 	// Always clear the running flag on every exit path. Chain another run if one
 	// was deferred while we ran, or retry (after a backoff) if this run failed, so
 	// failures are retried instead of silently stranding the trash and wedging GC.
@@ -121,7 +285,7 @@ func (gc *innerPathVolGc) purgeLeftovers(ctx context.Context, fs string, apiClie
 		gc.Lock()
 		defer gc.Unlock()
 		gc.isRunning[fs] = false
-		if gc.isDeferred[fs] {
+		if gc.isDeferred[fs] || resume {
 			gc.isDeferred[fs] = false
 			go gc.purgeLeftovers(ctx, fs, apiClient)
 			return
@@ -151,26 +315,237 @@ func (gc *innerPathVolGc) purgeLeftovers(ctx context.Context, fs string, apiClie
 	}
 	volumeTrashLoc := filepath.Join(path, garbagePath)
 
-	if fileExists("/locar") {
-		logger.Debug().Msg("Using locar for fast deletion")
-		deleteCmd := exec.CommandContext(opCtx, "bash", "-c",
-			fmt.Sprintf("/locar --type file %s | xargs -P128 -n128 rm -f 2>&1 | wc -l; /locar --type dir %s | /usr/bin/xargs -P128 -n128 rm -rf 2>&1 | wc -l", volumeTrashLoc, volumeTrashLoc),
-		)
-		output, err := deleteCmd.CombinedOutput()
-		if err != nil {
-			logger.Error().Err(err).Msg("Error running locar")
-			return
+	// every volume moved to trash is purged separately, so a cycle interrupted by timeout or restart
+	// resumes with the volumes that are left
+	names, infos, err := listTrash(path)
+	if err != nil {
+		logger.Error().Err(err).Str("path", volumeTrashLoc).Msg("Failed to list trash contents")
+		return
+	}
+	purger := gc.newTrashPurger(fs)
+	now := time.Now()
+	var nextExpiry time.Time
+	purged := 0
+	for _, name := range names {
+		volumePath := filepath.Join(volumeTrashLoc, name)
+		if info := infos[name]; info != nil && info.isRetained(now, gc.config.trashRetention) {
+			logger.Trace().Str("path", volumePath).Str("volume_id", info.VolumeId).Msg("Volume is retained in trash")
+			if expiry := info.DeletedAt.Add(gc.config.trashRetention); nextExpiry.IsZero() || expiry.Before(nextExpiry) {
+				nextExpiry = expiry
+			}
+			continue
 		}
-		logger.Trace().Str("output", string(output)).Msg("Locar output")
-	} else {
-		logger.Debug().Msg("Using default deletion method")
-		if err := os.RemoveAll(volumeTrashLoc); err != nil {
-			logger.Error().Err(err).Str("path", volumeTrashLoc).Msg("Failed to perform garbage collection")
+		start := time.Now()
+		bytes, inodes := purger.bytes.Load(), purger.inodes.Load()
+		if err := purger.removeTree(opCtx, volumePath); err != nil {
+			logger.Error().Err(err).Str("path", volumePath).Msg("Failed to perform garbage collection")
+			resume = purger.inodes.Load() > 0 && errors.Is(err, context.DeadlineExceeded)
 			return
 		}
+		if err := removeTrashInfo(path, name); err != nil {
+			logger.Warn().Err(err).Str("path", volumePath).Msg("Failed to remove trash info of purged volume")
+		}
+		purged++
+		gcPurgedVolumesTotal.WithLabelValues(fs).Inc()
+		logger.Debug().Str("path", volumePath).Int64("bytes", purger.bytes.Load()-bytes).
+			Int64("inodes", purger.inodes.Load()-inodes).Dur("duration", time.Since(start)).Msg("Purged volume from trash")
 	}
 	succeeded = true
-	logger.Debug().Msg("Garbage collection completed")
+	if !nextExpiry.IsZero() {
+		gc.scheduleRetentionExpiry(ctx, fs, apiClient, nextExpiry)
+	}
+	logger.Debug().Int("volumes", purged).Int("retained_volumes", len(names)-purged).Int64("bytes", purger.bytes.Load()).
+		Int64("inodes", purger.inodes.Load()).Msg("Garbage collection completed")
+}
+
+// getLimiter returns the limiter of deletion operations per second, nil if deletions are not throttled
+func (gc *innerPathVolGc) getLimiter() *rate.Limiter {
+	gc.once.Do(func() {
+		if gc.config != nil && gc.config.garbageCollectionOpsPerSecond > 0 {
+			gc.limiter = rate.NewLimiter(rate.Limit(gc.config.garbageCollectionOpsPerSecond), gc.getMaxThreads())
+		}
+	})
+	return gc.limiter
+}
+
+func (gc *innerPathVolGc) getMaxThreads() int {
+	if gc.config != nil && gc.config.garbageCollectionMaxThreads > 0 {
+		return gc.config.garbageCollectionMaxThreads
+	}
+	return garbageCollectionMaxThreads
+}
+
+func (gc *innerPathVolGc) newTrashPurger(fs string) *trashPurger {
+	return &trashPurger{
+		slots:          make(chan struct{}, gc.getMaxThreads()),
+		limiter:        gc.getLimiter(),
+		reclaimedBytes: gcReclaimedBytesTotal.WithLabelValues(fs),
+		reclaimedInode: gcReclaimedInodesTotal.WithLabelValues(fs),
+	}
+}
+
+// trashPurger deletes directory trees using a bounded number of concurrent workers.
+// Subdirectories and files are handed over to a free worker, or processed inline when all workers are busy
+type trashPurger struct {
+	slots          chan struct{}
+	limiter        *rate.Limiter
+	bytes          atomic.Int64
+	inodes         atomic.Int64
+	reclaimedBytes prometheus.Counter
+	reclaimedInode prometheus.Counter
+}
+
+// spawn runs fn on a free worker, or inline if none is available
+func (p *trashPurger) spawn(wg *sync.WaitGroup, fn func()) {
+	select {
+	case p.slots <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-p.slots }()
+			fn()
+		}()
+	default:
+		fn()
+	}
+}
+
+// remove deletes a single file or an empty directory, accounting the reclaimed capacity
+func (p *trashPurger) remove(ctx context.Context, path string, size int64) error {
+	if p.limiter != nil {
+		if err := p.limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// the limiter refuses to wait beyond the deadline of the cycle
+			return context.DeadlineExceeded
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	p.bytes.Add(size)
+	p.inodes.Add(1)
+	p.reclaimedBytes.Add(float64(size))
+	p.reclaimedInode.Inc()
+	return nil
+}
+
+// removeTree deletes a directory tree, the directory is removed after all of its contents
+func (p *trashPurger) removeTree(ctx context.Context, dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return p.remove(ctx, dir, info.Size())
+	}
+	var errMu sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// entries deleted while the directory is being read might cause others to be skipped, hence another pass
+	for pass := 0; pass < 3; pass++ {
+		f, err := os.Open(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		wg := &sync.WaitGroup{}
+		for {
+			if err := ctx.Err(); err != nil {
+				setErr(err)
+				break
+			}
+			entries, err := f.ReadDir(garbageCollectionReadDirBatch)
+			for _, entry := range entries {
+				path := filepath.Join(dir, entry.Name())
+				if entry.IsDir() {
+					p.spawn(wg, func() {
+						if err := p.removeTree(ctx, path); err != nil {
+							setErr(err)
+						}
+					})
+					continue
+				}
+				var size int64
+				if entry.Type().IsRegular() {
+					if info, err := entry.Info(); err == nil {
+						size = info.Size()
+					}
+				}
+				p.spawn(wg, func() {
+					if err := p.remove(ctx, path, size); err != nil {
+						setErr(err)
+					}
+				})
+			}
+			if err != nil {
+				if err != io.EOF {
+					setErr(err)
+				}
+				break
+			}
+		}
+		wg.Wait()
+		_ = f.Close()
+		if firstErr != nil {
+			return firstErr
+		}
+		err = p.remove(ctx, dir, 0)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	return p.remove(ctx, dir, 0)
+}
+
+// listDirNames returns sorted names of directory entries
+func listDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getBacklog returns the number of filesystems with garbage collection running and deferred
+func (gc *innerPathVolGc) getBacklog() (running int, deferred int) {
+	gc.Lock()
+	defer gc.Unlock()
+	for _, isRunning := range gc.isRunning {
+		if isRunning {
+			running++
+		}
+	}
+	for _, isDeferred := range gc.isDeferred {
+		if isDeferred {
+			deferred++
+		}
+	}
+	return running, deferred
 }
 
 func (gc *innerPathVolGc) initiateGarbageCollection(ctx context.Context, fs string, apiClient *apiclient.ApiClient) {
@@ -0,0 +1,90 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTrashTree(t *testing.T, root string, dirs, filesPerDir int) {
+	for d := 0; d < dirs; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir-%d", d), "nested")
+		require.NoError(t, os.MkdirAll(dir, 0750))
+		for f := 0; f < filesPerDir; f++ {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", f)), []byte("0123456789"), 0640))
+		}
+	}
+}
+
+func TestTrashPurgerRemoveTree(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "volume")
+	makeTrashTree(t, root, 5, 20)
+
+	gc := &innerPathVolGc{config: &DriverConfig{garbageCollectionMaxThreads: 4}}
+	purger := gc.newTrashPurger("fs")
+	require.NoError(t, purger.removeTree(context.Background(), root))
+
+	_, err := os.Stat(root)
+	assert.True(t, os.IsNotExist(err))
+	// 100 files, 5*2 directories and the root
+	assert.Equal(t, int64(111), purger.inodes.Load())
+	assert.Equal(t, int64(1000), purger.bytes.Load())
+	assert.NoError(t, purger.removeTree(context.Background(), root), "removal must be idempotent")
+}
+
+func TestTrashPurgerCancelled(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "volume")
+	makeTrashTree(t, root, 2, 10)
+
+	gc := &innerPathVolGc{config: &DriverConfig{garbageCollectionMaxThreads: 2, garbageCollectionOpsPerSecond: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	purger := gc.newTrashPurger("fs")
+	assert.ErrorIs(t, purger.removeTree(ctx, root), context.Canceled)
+	_, err := os.Stat(root)
+	assert.NoError(t, err, "interrupted purge must leave the rest of the tree for the next cycle")
+}
+
+func TestTrashInfo(t *testing.T) {
+	root := t.TempDir()
+	deletedAt := time.Now().Add(-time.Hour).UTC()
+	makeTrashTree(t, filepath.Join(root, garbagePath, "vol-a"), 1, 1)
+	makeTrashTree(t, filepath.Join(root, garbagePath, "vol-b"), 1, 1)
+	makeTrashTree(t, filepath.Join(root, garbagePath, "legacy"), 1, 1)
+	require.NoError(t, writeTrashInfo(root, "vol-a", &trashInfo{VolumeId: "dir/v1/default/csi-volumes/vol-a", InnerPath: "/csi-volumes/vol-a",
+		PvcNamespace: "ns", PvcName: "data", DeletedAt: deletedAt, Capacity: 1024, EnforceCapacity: true}))
+	require.NoError(t, writeTrashInfo(root, "vol-b", &trashInfo{VolumeId: "dir/v1/default/csi-volumes/vol-b", InnerPath: "/csi-volumes/vol-b",
+		PvcNamespace: "ns", PvcName: "data", DeletedAt: deletedAt.Add(time.Minute)}))
+
+	names, infos, err := listTrash(root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy", "vol-a", "vol-b"}, names)
+	assert.Nil(t, infos["legacy"], "volumes moved to trash without retention have no info")
+	assert.Equal(t, int64(1024), infos["vol-a"].Capacity)
+	assert.Equal(t, deletedAt.Unix(), infos["vol-a"].DeletedAt.Unix())
+
+	now := time.Now()
+	assert.True(t, infos["vol-a"].isRetained(now, 2*time.Hour))
+	assert.False(t, infos["vol-a"].isRetained(now, 30*time.Minute))
+	assert.False(t, infos["vol-a"].isRetained(now, 0))
+
+	name, info := findTrashedVolume(names, infos, &volumeUndeleteSpec{VolumeId: "dir/v1/default/csi-volumes/vol-a"})
+	assert.Equal(t, "vol-a", name)
+	assert.Equal(t, "/csi-volumes/vol-a", info.InnerPath)
+	name, _ = findTrashedVolume(names, infos, &volumeUndeleteSpec{FilesystemName: "default", PvcNamespace: "ns", PvcName: "data"})
+	assert.Equal(t, "vol-b", name, "the latest deleted volume of the PVC is undeleted")
+	_, info = findTrashedVolume(names, infos, &volumeUndeleteSpec{FilesystemName: "default", PvcNamespace: "other", PvcName: "data"})
+	assert.Nil(t, info)
+
+	require.NoError(t, removeTrashInfo(root, "vol-a"))
+	require.NoError(t, removeTrashInfo(root, "vol-a"), "removal must be idempotent")
+	info, err = readTrashInfo(root, "vol-a")
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+}
@@ -92,6 +92,14 @@ func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*c
 			isReady = true
 		}
 	}
+	// a node configured for NFS Kerberos cannot serve Kerberos volumes without keytab and rpc.gssd
+	var kerberosErr error
+	if isReady && ids.getConfig().GetDriver().servesNfsKerberos() {
+		if kerberosErr = checkNfsKerberos(ids.getConfig()); kerberosErr != nil {
+			logger.Error().Err(kerberosErr).Msg("CSI Probe FAILED: NFS Kerberos is configured but node is not ready for it")
+			isReady = false
+		}
+	}
 	// manage node topology labels only if set by configuration
 	if ids.config.manageNodeTopologyLabels {
 		if !isReady {
@@ -104,6 +112,9 @@ func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*c
 		}
 	}
 	logger.Trace().Bool("ready", isReady).Msg("CSI Probe completed")
+	if kerberosErr != nil {
+		return nil, status.Error(codes.FailedPrecondition, kerberosErr.Error())
+	}
 	return &csi.ProbeResponse{
 		Ready: &wrapperspb.BoolValue{
 			Value: isReady,
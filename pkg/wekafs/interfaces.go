@@ -9,8 +9,12 @@ import (
 const (
 	dataTransportNfs    DataTransport = "nfs"
 	dataTransportWekafs DataTransport = "wekafs"
+	dataTransportSmb    DataTransport = "smb"
 )
 
+// dataTransports lists all the data transports a node may serve
+var dataTransports = []DataTransport{dataTransportWekafs, dataTransportNfs, dataTransportSmb}
+
 type AnyServer interface {
 	getMounter() AnyMounter
 	getApiStore() *ApiStore
@@ -30,10 +34,17 @@ type AnyMounter interface {
 	schedulePeriodicMountGc(ctx context.Context)
 	getGarbageCollector() *innerPathVolGc
 	getTransport() DataTransport
+	resolveTransport(ctx context.Context, requested DataTransport) DataTransport
+	getMountStats() (mounts int, references int)
+	releaseRecoveredTarget(ctx context.Context, targetPath string)
+	holdPublishTarget(ctx context.Context, mountPoint, targetPath string)
+	releasePublishTarget(ctx context.Context, targetPath string)
+	getMountBaseDir() string
 }
 
 type nfsMountsMap map[string]int // we only follow the mountPath and number of references
 type wekafsMountsMap map[string]int
+type smbMountsMap map[string]int
 type DataTransport string
 type UnmountFunc func() error
 
@@ -0,0 +1,604 @@
+package wekafs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	journalLabelKey     = "csi.weka.io/operation-journal"
+	journalKindLabelKey = "csi.weka.io/journal-kind"
+	journalDataKey      = "entry"
+	journalNamePrefix   = "weka-csi-journal-"
+
+	journalKindVolume   = "volume"
+	journalKindSnapshot = "snapshot"
+
+	journalStepFilesystemCreated   = "FilesystemCreated"
+	journalStepSnapshotCreated     = "SnapshotCreated"
+	journalStepDirectoryCreated    = "DirectoryCreated"
+	journalStepSeedSnapshotCreated = "SeedSnapshotCreated"
+	journalStepCapacitySet         = "CapacitySet"
+	journalStepParamsSet           = "ParamsSet"
+
+	// journalReplayRetryInterval is the interval between replays of journal entries that could not be resolved
+	journalReplayRetryInterval = time.Minute
+
+	// StorageClass parameters consumed by external-provisioner, pointing to the provisioning secret
+	storageClassProvisionerSecretName      = "csi.storage.k8s.io/provisioner-secret-name"
+	storageClassProvisionerSecretNamespace = "csi.storage.k8s.io/provisioner-secret-namespace"
+
+	csiPvNamePrefix            = "pvc-"
+	csiSnapshotNamePrefix      = "snapshot-"
+	snapshotContentNamePrefix  = "snapcontent-"
+	journalReplayOperationName = "ReplayJournal"
+)
+
+var volumeSnapshotContentGvk = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshotContent"}
+
+var journalReplaysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "journal",
+	Name:      "replays_total",
+	Help:      "Total number of replayed operation journal entries of interrupted volume and snapshot creations",
+}, []string{"kind", "action", "result"})
+
+func init() {
+	prometheus.MustRegister(journalReplaysTotal)
+}
+
+// journalStep is a step of a multi-step operation that completed on Weka cluster
+type journalStep struct {
+	Name        string    `json:"name"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// journalEntry describes an in-progress creation of a volume or a snapshot. It is persisted before any Weka object
+// is created and removed once the operation completes, so an entry that survives a controller restart points to
+// objects that might have been left half-built
+type journalEntry struct {
+	Kind         string              `json:"kind"`
+	Id           string              `json:"id"`
+	Name         string              `json:"name"`
+	Operation    string              `json:"operation"`
+	SourceId     string              `json:"sourceId,omitempty"`
+	PvcNamespace string              `json:"pvcNamespace,omitempty"`
+	PvcName      string              `json:"pvcName,omitempty"`
+	SecretRef    *v1.SecretReference `json:"secretRef,omitempty"`
+	// Request is the CreateVolumeRequest in protobuf JSON encoding, stripped of secrets
+	Request   json.RawMessage `json:"request,omitempty"`
+	StartedAt time.Time       `json:"startedAt"`
+	Steps     []journalStep   `json:"steps,omitempty"`
+	LastError string          `json:"lastError,omitempty"`
+}
+
+func (e *journalEntry) hasStep(name string) bool {
+	for _, s := range e.Steps {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// journalEntryName returns the name of ConfigMap holding the journal entry of an object
+func journalEntryName(kind, id string) string {
+	h := sha1.Sum([]byte(kind + "/" + id))
+	return journalNamePrefix + kind + "-" + hex.EncodeToString(h[:])[:20]
+}
+
+// operationJournal persists journal entries as ConfigMaps in the namespace of the controller.
+// Reads bypass the manager cache to avoid watching all ConfigMaps of the namespace
+type operationJournal struct {
+	client    runtimeclient.Client
+	reader    runtimeclient.Reader
+	namespace string
+}
+
+func newOperationJournal(client runtimeclient.Client, reader runtimeclient.Reader, namespace string) *operationJournal {
+	return &operationJournal{
+		client:    client,
+		reader:    reader,
+		namespace: namespace,
+	}
+}
+
+// journalHandle is a journal entry of an operation in progress
+type journalHandle struct {
+	journal *operationJournal
+	entry   *journalEntry
+	cm      *v1.ConfigMap
+}
+
+type journalHandleKey struct{}
+
+func contextWithJournal(ctx context.Context, h *journalHandle) context.Context {
+	if h == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, journalHandleKey{}, h)
+}
+
+func journalFromContext(ctx context.Context) *journalHandle {
+	h, _ := ctx.Value(journalHandleKey{}).(*journalHandle)
+	return h
+}
+
+// recordJournalStep records a completed step in the journal entry carried by the context, if any
+func recordJournalStep(ctx context.Context, step string) {
+	if h := journalFromContext(ctx); h != nil {
+		h.step(ctx, step)
+	}
+}
+
+// begin persists a journal entry of a starting operation. An entry left by a previous attempt of the same operation
+// is taken over together with its steps. Failures are logged only, as the journal must not block provisioning
+func (j *operationJournal) begin(ctx context.Context, entry *journalEntry) *journalHandle {
+	if j == nil {
+		return nil
+	}
+	logger := log.Ctx(ctx).With().Str("journal_kind", entry.Kind).Str("journal_id", entry.Id).Logger()
+	h := &journalHandle{journal: j, entry: entry}
+	cm := &v1.ConfigMap{}
+	err := j.reader.Get(ctx, types.NamespacedName{Namespace: j.namespace, Name: journalEntryName(entry.Kind, entry.Id)}, cm)
+	switch {
+	case err == nil:
+		previous := &journalEntry{}
+		if err := json.Unmarshal([]byte(cm.Data[journalDataKey]), previous); err == nil {
+			entry.StartedAt = previous.StartedAt
+			entry.Steps = previous.Steps
+		}
+		h.cm = cm
+	case apierrors.IsNotFound(err):
+		h.cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      journalEntryName(entry.Kind, entry.Id),
+				Namespace: j.namespace,
+				Labels: map[string]string{
+					journalLabelKey:     "true",
+					journalKindLabelKey: entry.Kind,
+				},
+			},
+		}
+	default:
+		logger.Error().Err(err).Msg("Failed to fetch operation journal entry, proceeding without journal")
+		return nil
+	}
+	if entry.StartedAt.IsZero() {
+		entry.StartedAt = time.Now().UTC()
+	}
+	if err := h.save(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to persist operation journal entry, proceeding without journal")
+		return nil
+	}
+	logger.Trace().Str("journal_entry", h.cm.Name).Msg("Persisted operation journal entry")
+	return h
+}
+
+func (h *journalHandle) save(ctx context.Context) error {
+	data, err := json.Marshal(h.entry)
+	if err != nil {
+		return err
+	}
+	h.cm.Data = map[string]string{journalDataKey: string(data)}
+	if h.cm.ResourceVersion == "" {
+		return h.journal.client.Create(ctx, h.cm)
+	}
+	return h.journal.client.Update(ctx, h.cm)
+}
+
+func (h *journalHandle) step(ctx context.Context, name string) {
+	if h == nil || h.entry.hasStep(name) {
+		return
+	}
+	h.entry.Steps = append(h.entry.Steps, journalStep{Name: name, CompletedAt: time.Now().UTC()})
+	if err := h.save(ctx); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("step", name).Msg("Failed to record step in operation journal")
+	}
+}
+
+// fail keeps the journal entry and records the error, so the operation is resolved upon retry or replay
+func (h *journalHandle) fail(ctx context.Context, err error) {
+	if h == nil || err == nil {
+		return
+	}
+	h.entry.LastError = err.Error()
+	if err := h.save(ctx); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to record error in operation journal")
+	}
+}
+
+// complete removes the journal entry of a finished operation
+func (h *journalHandle) complete(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	if err := h.journal.remove(ctx, h.cm); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("journal_entry", h.cm.Name).Msg("Failed to remove operation journal entry")
+	}
+}
+
+// discard removes the journal entry of an object, if any, e.g. once a retried operation found the object complete
+func (j *operationJournal) discard(ctx context.Context, kind, id string) {
+	if j == nil {
+		return
+	}
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: j.namespace, Name: journalEntryName(kind, id)}}
+	if err := j.remove(ctx, cm); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("journal_entry", cm.Name).Msg("Failed to remove operation journal entry")
+	}
+}
+
+func (j *operationJournal) remove(ctx context.Context, cm *v1.ConfigMap) error {
+	if err := j.client.Delete(ctx, cm); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// list returns all journal entries along with their ConfigMaps
+func (j *operationJournal) list(ctx context.Context) ([]*journalEntry, []*v1.ConfigMap, error) {
+	cmList := &v1.ConfigMapList{}
+	if err := j.reader.List(ctx, cmList, runtimeclient.InNamespace(j.namespace), runtimeclient.MatchingLabels{journalLabelKey: "true"}); err != nil {
+		return nil, nil, err
+	}
+	var entries []*journalEntry
+	var cms []*v1.ConfigMap
+	for i := range cmList.Items {
+		cm := &cmList.Items[i]
+		entry := &journalEntry{}
+		if err := json.Unmarshal([]byte(cm.Data[journalDataKey]), entry); err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("journal_entry", cm.Name).Msg("Failed to parse operation journal entry, skipping")
+			continue
+		}
+		entries = append(entries, entry)
+		cms = append(cms, cm)
+	}
+	return entries, cms, nil
+}
+
+// beginVolumeCreateJournal persists a journal entry for creation of a volume
+func (cs *ControllerServer) beginVolumeCreateJournal(ctx context.Context, req *csi.CreateVolumeRequest, volume *Volume) *journalHandle {
+	if cs.journal == nil {
+		return nil
+	}
+	logger := log.Ctx(ctx)
+	stripped := proto.Clone(req).(*csi.CreateVolumeRequest)
+	stripped.Secrets = nil
+	request, err := protojson.Marshal(stripped)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to serialize request for operation journal")
+		return nil
+	}
+	params := req.GetParameters()
+	entry := &journalEntry{
+		Kind:         journalKindVolume,
+		Id:           volume.GetId(),
+		Name:         req.GetName(),
+		Operation:    "CreateVolume",
+		PvcNamespace: params[VolumeContextPvcNamespaceKey],
+		PvcName:      params[VolumeContextPvcNameKey],
+		Request:      request,
+	}
+	if entry.PvcName != "" {
+		entry.SecretRef, err = cs.getProvisionerSecretRef(ctx, entry.PvcNamespace, entry.PvcName, entry.Name)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to resolve provisioner secret of volume for operation journal")
+		}
+	}
+	return cs.journal.begin(ctx, entry)
+}
+
+// beginSnapshotCreateJournal persists a journal entry for creation of a snapshot
+func (cs *ControllerServer) beginSnapshotCreateJournal(ctx context.Context, snapshotId, name string, srcVolume *Volume) *journalHandle {
+	if cs.journal == nil {
+		return nil
+	}
+	entry := &journalEntry{
+		Kind:      journalKindSnapshot,
+		Id:        snapshotId,
+		Name:      name,
+		Operation: "CreateSnapshot",
+		SourceId:  srcVolume.GetId(),
+	}
+	pv, err := cs.getPvByVolumeHandle(ctx, srcVolume.GetId())
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to resolve secret of source volume for operation journal")
+	} else if pv != nil {
+		entry.SecretRef = secretRefOfPv(pv)
+	}
+	return cs.journal.begin(ctx, entry)
+}
+
+// getProvisionerSecretRef resolves the provisioner secret of a PVC from its StorageClass parameters
+func (cs *ControllerServer) getProvisionerSecretRef(ctx context.Context, pvcNamespace, pvcName, pvName string) (*v1.SecretReference, error) {
+	reader := cs.manager.GetAPIReader()
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: pvcNamespace, Name: pvcName}, pvc); err != nil {
+		return nil, err
+	}
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return nil, nil
+	}
+	sc := &storagev1.StorageClass{}
+	if err := reader.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, sc); err != nil {
+		return nil, err
+	}
+	name := sc.Parameters[storageClassProvisionerSecretName]
+	if name == "" {
+		return nil, nil
+	}
+	replacer := strings.NewReplacer("${pvc.name}", pvcName, "${pvc.namespace}", pvcNamespace, "${pv.name}", pvName)
+	return &v1.SecretReference{
+		Name:      replacer.Replace(name),
+		Namespace: replacer.Replace(sc.Parameters[storageClassProvisionerSecretNamespace]),
+	}, nil
+}
+
+// getPvByVolumeHandle returns the PV of a volume provisioned by the driver, nil if no such PV exists
+func (cs *ControllerServer) getPvByVolumeHandle(ctx context.Context, volumeId string) (*v1.PersistentVolume, error) {
+	pvList := &v1.PersistentVolumeList{}
+	if err := cs.manager.GetAPIReader().List(ctx, pvList); err != nil {
+		return nil, err
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volumeId {
+			return pv, nil
+		}
+	}
+	return nil, nil
+}
+
+// journalReplayer resolves operations interrupted by a controller restart. It is added as a leader election
+// runnable, so entries are replayed once the controller becomes the leader. Creations still wanted by Kubernetes are
+// completed idempotently, while Weka objects of abandoned creations are rolled back
+type journalReplayer struct {
+	cs      *ControllerServer
+	journal *operationJournal
+}
+
+func newJournalReplayer(cs *ControllerServer) *journalReplayer {
+	return &journalReplayer{cs: cs, journal: cs.journal}
+}
+
+// Start implements manager.Runnable
+func (r *journalReplayer) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "journal-replayer").Logger()
+	ctx = logger.WithContext(ctx)
+	for {
+		pending := r.replay(ctx)
+		if pending == 0 {
+			logger.Info().Msg("Operation journal replay completed")
+			return nil
+		}
+		logger.Warn().Int("pending", pending).Dur("retry_interval", journalReplayRetryInterval).Msg("Some operation journal entries could not be resolved, retrying later")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(journalReplayRetryInterval):
+		}
+	}
+}
+
+// replay resolves all journal entries and returns the number of entries left unresolved
+func (r *journalReplayer) replay(ctx context.Context) int {
+	op := journalReplayOperationName
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	entries, cms, err := r.journal.list(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list operation journal entries")
+		return 1
+	}
+	pending := 0
+	for i, entry := range entries {
+		entryLogger := logger.With().Str("journal_kind", entry.Kind).Str("journal_id", entry.Id).
+			Str("operation", entry.Operation).Strs("steps", entryStepNames(entry)).Logger()
+		entryCtx := entryLogger.WithContext(ctx)
+		action, err := r.replayEntry(entryCtx, entry)
+		result := "success"
+		if err == nil {
+			err = r.journal.remove(entryCtx, cms[i])
+		}
+		if err != nil {
+			result = "failure"
+			pending++
+			entryLogger.Error().Err(err).Str("action", action).Msg("Failed to replay operation journal entry")
+		} else {
+			entryLogger.Info().Str("action", action).Msg("Replayed operation journal entry")
+		}
+		journalReplaysTotal.WithLabelValues(entry.Kind, action, result).Inc()
+	}
+	return pending
+}
+
+func entryStepNames(entry *journalEntry) []string {
+	names := make([]string, 0, len(entry.Steps))
+	for _, s := range entry.Steps {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// replayEntry completes or rolls back a single operation, returning the action taken
+func (r *journalReplayer) replayEntry(ctx context.Context, entry *journalEntry) (string, error) {
+	var lockKey string
+	switch entry.Kind {
+	case journalKindVolume:
+		lockKey = volumeLockKey(entry.Id)
+	case journalKindSnapshot:
+		lockKey = snapshotLockKey(entry.Id)
+	default:
+		// cannot be resolved by this version, drop it
+		return "discard", nil
+	}
+	releaseLock, err := r.cs.locks.tryAcquire(ctx, journalReplayOperationName, lockKey)
+	defer releaseLock()
+	if err != nil {
+		return "skip", err
+	}
+
+	secrets, err := r.getSecrets(ctx, entry.SecretRef)
+	if err != nil {
+		return "skip", err
+	}
+	client, err := r.cs.api.GetClientFromSecrets(ctx, secrets)
+	if err != nil {
+		return "skip", err
+	}
+
+	if entry.Kind == journalKindSnapshot {
+		return r.replaySnapshot(ctx, entry, client)
+	}
+	return r.replayVolume(ctx, entry, secrets)
+}
+
+func (r *journalReplayer) replayVolume(ctx context.Context, entry *journalEntry, secrets map[string]string) (string, error) {
+	logger := log.Ctx(ctx)
+	req := &csi.CreateVolumeRequest{}
+	if err := protojson.Unmarshal(entry.Request, req); err != nil {
+		return "discard", nil
+	}
+	req.Secrets = secrets
+	volume, err := NewVolumeFromControllerCreateRequest(ctx, req, r.cs)
+	if err != nil {
+		return "skip", err
+	}
+	wanted, err := r.isVolumeWanted(ctx, entry)
+	if err != nil {
+		return "skip", err
+	}
+	exists, err := volume.Exists(ctx)
+	if err != nil {
+		return "skip", err
+	}
+	if !wanted {
+		if !exists {
+			return "rollback", nil
+		}
+		logger.Info().Msg("Rolling back volume whose creation was abandoned")
+		if err := volume.Trash(ctx); err != nil && !errors.Is(err, ErrFilesystemHasUnderlyingSnapshots) {
+			return "rollback", err
+		}
+		return "rollback", nil
+	}
+	if !exists {
+		// nothing was created, provisioner retries the creation from scratch
+		return "complete", nil
+	}
+	logger.Info().Msg("Completing interrupted creation of volume")
+	if !entry.hasStep(journalStepCapacitySet) {
+		if err := volume.UpdateCapacity(ctx, &volume.enforceCapacity, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+			return "complete", err
+		}
+	}
+	if !entry.hasStep(journalStepParamsSet) {
+		if err := volume.UpdateParams(ctx); err != nil {
+			return "complete", err
+		}
+	}
+	return "complete", nil
+}
+
+// isVolumeWanted checks whether Kubernetes still waits for the volume: its PVC exists, is not being deleted and
+// is not bound to another PV
+func (r *journalReplayer) isVolumeWanted(ctx context.Context, entry *journalEntry) (bool, error) {
+	reader := r.cs.manager.GetAPIReader()
+	pv := &v1.PersistentVolume{}
+	err := reader.Get(ctx, types.NamespacedName{Name: entry.Name}, pv)
+	if err == nil {
+		return true, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	var pvc *v1.PersistentVolumeClaim
+	if entry.PvcName != "" {
+		pvc = &v1.PersistentVolumeClaim{}
+		if err := reader.Get(ctx, types.NamespacedName{Namespace: entry.PvcNamespace, Name: entry.PvcName}, pvc); err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	} else {
+		// PVC metadata was not passed by provisioner, the PV name embeds the UID of the PVC
+		pvcList := &v1.PersistentVolumeClaimList{}
+		if err := reader.List(ctx, pvcList); err != nil {
+			return false, err
+		}
+		for i := range pvcList.Items {
+			if csiPvNamePrefix+string(pvcList.Items[i].UID) == entry.Name {
+				pvc = &pvcList.Items[i]
+				break
+			}
+		}
+		if pvc == nil {
+			return false, nil
+		}
+	}
+	if pvc.DeletionTimestamp != nil {
+		return false, nil
+	}
+	if pvc.Spec.VolumeName != "" && pvc.Spec.VolumeName != entry.Name {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r *journalReplayer) replaySnapshot(ctx context.Context, entry *journalEntry, client *apiclient.ApiClient) (string, error) {
+	content := &unstructured.Unstructured{}
+	content.SetGroupVersionKind(volumeSnapshotContentGvk)
+	contentName := snapshotContentNamePrefix + strings.TrimPrefix(entry.Name, csiSnapshotNamePrefix)
+	err := r.cs.manager.GetAPIReader().Get(ctx, types.NamespacedName{Name: contentName}, content)
+	if err == nil && content.GetDeletionTimestamp() == nil {
+		// snapshotter retries the creation, which is idempotent
+		return "complete", nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "skip", err
+	}
+	snapshot, err := NewSnapshotFromId(ctx, entry.Id, client, r.cs)
+	if err != nil {
+		return "discard", nil
+	}
+	log.Ctx(ctx).Info().Msg("Rolling back snapshot whose creation was abandoned")
+	if err := snapshot.Delete(ctx); err != nil {
+		return "rollback", err
+	}
+	return "rollback", nil
+}
+
+func (r *journalReplayer) getSecrets(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	secrets := make(map[string]string)
+	if ref == nil {
+		return secrets, nil
+	}
+	return r.cs.getSecretsByRef(ctx, ref)
+}
@@ -0,0 +1,65 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestJournalEntryName(t *testing.T) {
+	name := journalEntryName(journalKindVolume, "weka/v2/csivol-pvc-1234")
+	assert.Equal(t, name, journalEntryName(journalKindVolume, "weka/v2/csivol-pvc-1234"))
+	assert.NotEqual(t, name, journalEntryName(journalKindSnapshot, "weka/v2/csivol-pvc-1234"))
+	assert.Contains(t, name, journalNamePrefix+journalKindVolume+"-")
+	assert.LessOrEqual(t, len(name), 63)
+}
+
+func TestOperationJournalLifecycle(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	j := newOperationJournal(c, c, "csi-wekafs")
+	key := types.NamespacedName{Namespace: "csi-wekafs", Name: journalEntryName(journalKindVolume, "weka/v2/fs1")}
+
+	h := j.begin(ctx, &journalEntry{Kind: journalKindVolume, Id: "weka/v2/fs1", Operation: "CreateVolume"})
+	require.NotNil(t, h)
+	jctx := contextWithJournal(ctx, h)
+	recordJournalStep(jctx, journalStepFilesystemCreated)
+	recordJournalStep(jctx, journalStepFilesystemCreated)
+	h.fail(ctx, errors.New("capacity update failed"))
+
+	cm := &v1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, key, cm))
+	assert.Equal(t, "true", cm.Labels[journalLabelKey])
+	entry := &journalEntry{}
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[journalDataKey]), entry))
+	assert.Equal(t, []string{journalStepFilesystemCreated}, entryStepNames(entry))
+	assert.Equal(t, "capacity update failed", entry.LastError)
+
+	// a retry takes over steps of the previous attempt
+	h = j.begin(ctx, &journalEntry{Kind: journalKindVolume, Id: "weka/v2/fs1", Operation: "CreateVolume"})
+	require.NotNil(t, h)
+	assert.True(t, h.entry.hasStep(journalStepFilesystemCreated))
+	assert.Equal(t, entry.StartedAt.Unix(), h.entry.StartedAt.Unix())
+
+	entries, _, err := j.list(ctx)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	h.complete(ctx)
+	entries, _, err = j.list(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// journal is optional, nil handles and journals are no-ops
+	var nj *operationJournal
+	assert.Nil(t, nj.begin(ctx, &journalEntry{Kind: journalKindVolume, Id: "weka/v2/fs2"}))
+	nj.discard(ctx, journalKindVolume, "weka/v2/fs2")
+	recordJournalStep(ctx, journalStepParamsSet)
+}
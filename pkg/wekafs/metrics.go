@@ -0,0 +1,256 @@
+package wekafs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "weka_csi"
+
+var (
+	csiRpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rpc",
+		Name:      "requests_total",
+		Help:      "Total number of CSI RPC requests served",
+	}, []string{"method", "grpc_code"})
+
+	csiRpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "rpc",
+		Name:      "duration_seconds",
+		Help:      "Duration of CSI RPC requests",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{"method", "grpc_code"})
+
+	semaphoreWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "semaphore",
+		Name:      "wait_duration_seconds",
+		Help:      "Time spent waiting for a concurrency slot of a CSI operation",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"operation", "result"})
+
+	operationLockConflictsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "operation_lock",
+		Name:      "conflicts_total",
+		Help:      "Total number of CSI operations rejected since another operation was in progress for the same volume or snapshot",
+	}, []string{"operation", "holder_operation"})
+
+	gcReclaimedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "reclaimed_bytes_total",
+		Help:      "Total size of files deleted by garbage collection of directory-backed volumes",
+	}, []string{"filesystem"})
+
+	gcReclaimedInodesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "reclaimed_inodes_total",
+		Help:      "Total number of files and directories deleted by garbage collection of directory-backed volumes",
+	}, []string{"filesystem"})
+
+	gcPurgedVolumesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "gc",
+		Name:      "purged_volumes_total",
+		Help:      "Total number of directory-backed volumes completely purged from trash",
+	}, []string{"filesystem"})
+
+	unmountsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mounts",
+		Name:      "unmounts_total",
+		Help:      "Total number of unmount attempts, by method of escalation from normal to forced and lazy unmount",
+	}, []string{"transport", "method", "result"})
+
+	unmountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mounts",
+		Name:      "unmount_duration_seconds",
+		Help:      "Duration of unmount attempts, by method of escalation",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{"transport", "method"})
+)
+
+// collectors of driver state are registered once, the drivers attach their mounters, garbage collectors and
+// capacity tracker to them upon creation
+var (
+	mountsMetrics   = newMountsCollector()
+	gcMetrics       = newGcCollector()
+	capacityMetrics = newCapacityTrackerCollector()
+)
+
+func init() {
+	prometheus.MustRegister(csiRpcRequestsTotal, csiRpcDuration, semaphoreWaitDuration, operationLockConflictsTotal,
+		gcReclaimedBytesTotal, gcReclaimedInodesTotal, gcPurgedVolumesTotal, unmountsTotal, unmountDuration,
+		mountsMetrics, gcMetrics, capacityMetrics)
+}
+
+// observeRpc updates CSI RPC metrics. fullMethod is in form of "/csi.v1.Controller/CreateVolume"
+func observeRpc(fullMethod string, err error, duration time.Duration) {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	code := status.Code(err).String()
+	csiRpcRequestsTotal.WithLabelValues(method, code).Inc()
+	csiRpcDuration.WithLabelValues(method, code).Observe(duration.Seconds())
+}
+
+// observeSemaphoreWait updates semaphore wait metrics of a CSI operation
+func observeSemaphoreWait(op string, err error, duration time.Duration) {
+	result := "acquired"
+	if err != nil {
+		result = "timeout"
+	}
+	semaphoreWaitDuration.WithLabelValues(op, result).Observe(duration.Seconds())
+}
+
+// observeOperationLockConflict counts an operation rejected due to another operation holding its lock
+func observeOperationLockConflict(op, holderOp string) {
+	operationLockConflictsTotal.WithLabelValues(op, holderOp).Inc()
+}
+
+// observeUnmount updates metrics of an unmount attempt
+func observeUnmount(transport DataTransport, method string, err error, duration time.Duration) {
+	result := "success"
+	if errors.Is(err, ErrUnmountTimeout) {
+		result = "timeout"
+	} else if err != nil {
+		result = "failure"
+	}
+	unmountsTotal.WithLabelValues(string(transport), method, result).Inc()
+	unmountDuration.WithLabelValues(string(transport), method).Observe(duration.Seconds())
+}
+
+// mountsCollector exposes the number of active mounts and their reference counts of the mounters per transport
+type mountsCollector struct {
+	mounters   map[DataTransport]AnyMounter
+	mounts     *prometheus.Desc
+	references *prometheus.Desc
+	sync.Mutex
+}
+
+func newMountsCollector() *mountsCollector {
+	return &mountsCollector{
+		mounters: make(map[DataTransport]AnyMounter),
+		mounts: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mounts", "active"),
+			"Number of filesystem mounts with positive reference count", []string{"transport"}, nil),
+		references: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mounts", "references"),
+			"Total reference count of filesystem mounts", []string{"transport"}, nil),
+	}
+}
+
+// setMounters replaces the mounters of their transports
+func (c *mountsCollector) setMounters(mounters ...AnyMounter) {
+	c.Lock()
+	defer c.Unlock()
+	for _, mounter := range mounters {
+		c.mounters[mounter.getTransport()] = mounter
+	}
+}
+
+func (c *mountsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.mounts
+	ch <- c.references
+}
+
+func (c *mountsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for transport, mounter := range c.mounters {
+		mounts, references := mounter.getMountStats()
+		ch <- prometheus.MustNewConstMetric(c.mounts, prometheus.GaugeValue, float64(mounts), string(transport))
+		ch <- prometheus.MustNewConstMetric(c.references, prometheus.GaugeValue, float64(references), string(transport))
+	}
+}
+
+// gcCollector exposes the backlog of directory volume garbage collection of the mounters per transport
+type gcCollector struct {
+	gcs     map[DataTransport]*innerPathVolGc
+	backlog *prometheus.Desc
+	sync.Mutex
+}
+
+func newGcCollector() *gcCollector {
+	return &gcCollector{
+		gcs: make(map[DataTransport]*innerPathVolGc),
+		backlog: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "gc", "backlog_filesystems"),
+			"Number of filesystems with garbage collection running or pending", []string{"transport", "state"}, nil),
+	}
+}
+
+// setGc replaces the garbage collector of the mounter transport
+func (c *gcCollector) setGc(transport DataTransport, gc *innerPathVolGc) {
+	c.Lock()
+	defer c.Unlock()
+	c.gcs[transport] = gc
+}
+
+func (c *gcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.backlog
+}
+
+func (c *gcCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for transport, gc := range c.gcs {
+		running, deferred := gc.getBacklog()
+		ch <- prometheus.MustNewConstMetric(c.backlog, prometheus.GaugeValue, float64(running), string(transport), "running")
+		ch <- prometheus.MustNewConstMetric(c.backlog, prometheus.GaugeValue, float64(deferred), string(transport), "deferred")
+	}
+}
+
+// capacityTrackerCollector exposes pending capacity reservations of directory-backed volumes
+type capacityTrackerCollector struct {
+	tracker      *CapacityTracker
+	reservations *prometheus.Desc
+	bytes        *prometheus.Desc
+	sync.Mutex
+}
+
+func newCapacityTrackerCollector() *capacityTrackerCollector {
+	return &capacityTrackerCollector{
+		reservations: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "capacity", "pending_reservations"),
+			"Number of capacity reservations not yet confirmed in Kubernetes", []string{"filesystem"}, nil),
+		bytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "capacity", "pending_reserved_bytes"),
+			"Capacity reserved by pending reservations", []string{"filesystem"}, nil),
+	}
+}
+
+func (c *capacityTrackerCollector) setTracker(tracker *CapacityTracker) {
+	c.Lock()
+	defer c.Unlock()
+	c.tracker = tracker
+}
+
+func (c *capacityTrackerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.reservations
+	ch <- c.bytes
+}
+
+func (c *capacityTrackerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	tracker := c.tracker
+	c.Unlock()
+	if tracker == nil {
+		return
+	}
+	tracker.mu.Lock()
+	counts := make(map[string]int)
+	reserved := make(map[string]int64)
+	for _, reservation := range tracker.pendingReservations {
+		counts[reservation.Filesystem]++
+		reserved[reservation.Filesystem] += reservation.TargetCapacity - reservation.SourceCapacity
+	}
+	tracker.mu.Unlock()
+	for fs, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.reservations, prometheus.GaugeValue, float64(count), fs)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(reserved[fs]), fs)
+	}
+}
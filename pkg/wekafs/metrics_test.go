@@ -0,0 +1,58 @@
+package wekafs
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectGauges returns the gauge values of the collector by their label values joined by ","
+func collectGauges(t *testing.T, c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	ret := make(map[string]float64)
+	for m := range ch {
+		pb := &dto.Metric{}
+		require.NoError(t, m.Write(pb))
+		key := ""
+		for i, l := range pb.GetLabel() {
+			if i > 0 {
+				key += ","
+			}
+			key += l.GetValue()
+		}
+		ret[key] = pb.GetGauge().GetValue()
+	}
+	return ret
+}
+
+func TestDriverStateCollectorsRegisteredOnce(t *testing.T) {
+	for _, c := range []prometheus.Collector{mountsMetrics, gcMetrics, capacityMetrics} {
+		err := prometheus.Register(c)
+		assert.ErrorAs(t, err, &prometheus.AlreadyRegisteredError{})
+	}
+	assert.Error(t, prometheus.Register(newGcCollector()), "collectors with the same metrics must not be registered silently")
+}
+
+func TestGcCollector(t *testing.T) {
+	c := newGcCollector()
+	assert.Empty(t, collectGauges(t, c))
+
+	wekafsGc := initInnerPathVolumeGc(nil)
+	wekafsGc.isRunning["fs1"] = true
+	nfsGc := initInnerPathVolumeGc(nil)
+	nfsGc.isRunning["fs2"] = true
+	nfsGc.isDeferred["fs3"] = true
+	c.setGc(dataTransportWekafs, wekafsGc)
+	c.setGc(dataTransportNfs, nfsGc)
+	assert.Equal(t, map[string]float64{
+		"running,wekafs":  1,
+		"deferred,wekafs": 0,
+		"running,nfs":     1,
+		"deferred,nfs":    1,
+	}, collectGauges(t, c))
+}
@@ -10,6 +10,7 @@ import (
 const (
 	selinuxContextWekaFs     = "wekafs_csi_volume_t"
 	selinuxContextNfs        = "nfs_t"
+	selinuxContextSmb        = "cifs_t"
 	MountOptionSyncOnClose   = "sync_on_close"
 	MountOptionReadOnly      = "ro"
 	MountOptionWriteCache    = "writecache"
@@ -23,10 +24,16 @@ const (
 	MountOptionNfsNoac       = "noac"
 	MountOptionNfsAc         = "ac"
 	MountOptionNfsRdirPlus   = "rdirplus"
+	MountOptionNfsSec        = "sec"
 	MountOptionReadCache     = "readcache"
 	MountProtocolWekafs      = "wekafs"
 	MountProtocolNfs         = "nfs"
+	MountProtocolSmb         = "smb"
 	DefaultNfsMountOptions   = MountOptionNfsHard + "," + MountOptionNfsAsync + "," + MountOptionNfsRdirPlus
+	MountOptionSmbVersion    = "vers"
+	MountOptionSmbCache      = "cache"
+	MountOptionSmbContext    = "context"
+	DefaultSmbMountOptions   = MountOptionSmbVersion + "=3.0"
 )
 
 type mountOption struct {
@@ -218,6 +225,8 @@ func (opts MountOptions) setSelinux(selinuxSupport bool, mountProtocol string) {
 			o = newMountOptionFromString(fmt.Sprintf("fscontext=\"system_u:object_r:%s:s0\"", selinuxContextWekaFs))
 		} else if mountProtocol == MountProtocolNfs {
 			o = newMountOptionFromString(fmt.Sprintf("context=\"system_u:object_r:%s:s0\"", selinuxContextNfs))
+		} else if mountProtocol == MountProtocolSmb {
+			o = newMountOptionFromString(fmt.Sprintf("context=\"system_u:object_r:%s:s0\"", selinuxContextSmb))
 		}
 		if o.option != "" {
 			opts.customOptions[o.option] = o
@@ -228,7 +237,7 @@ func (opts MountOptions) setSelinux(selinuxSupport bool, mountProtocol string) {
 		if mountProtocol == MountProtocolWekafs {
 			delete(opts.customOptions, "fscontext")
 		}
-		if mountProtocol == MountProtocolNfs {
+		if mountProtocol == MountProtocolNfs || mountProtocol == MountProtocolSmb {
 			delete(opts.customOptions, "context")
 		}
 	}
@@ -253,6 +262,29 @@ func (opts MountOptions) AsNfs() MountOptions {
 		case "dentry_max_age_positive":
 			ret.setOption(fmt.Sprintf("acdirmax=%s", o.value))
 			ret.setOption(fmt.Sprintf("acregmax=%s", o.value))
+		case MountOptionNfsSec:
+			if isValidNfsSecurityFlavor(o.value) {
+				ret.setOption(o.String())
+			}
+		case MountOptionNfsNconnect, MountOptionNfsMaxConnect:
+			ret.setOption(o.String())
+		default:
+			continue
+		}
+	}
+	return ret
+}
+
+// AsSmb translates the mount options to CIFS ones. Options bypassing the page cache map to cache=none,
+// as CIFS has no separate attribute cache to disable
+func (opts MountOptions) AsSmb() MountOptions {
+	ret := NewMountOptionsFromString(DefaultSmbMountOptions)
+	for _, o := range opts.getOpts() {
+		switch o.option {
+		case MountOptionCoherent, MountOptionForceDirect:
+			ret.setOption(MountOptionSmbCache + "=none")
+		case MountOptionReadOnly, MountOptionSmbContext:
+			ret.setOption(o.String())
 		default:
 			continue
 		}
@@ -17,6 +17,8 @@ const (
 	VolumeContextPodNameKey = "csi.storage.k8s.io/pod.name"
 	// VolumeContextPodNamespaceKey is the key in VolumeContext that describes the pod namespace
 	VolumeContextPodNamespaceKey = "csi.storage.k8s.io/pod.namespace"
+	// VolumeContextPodUidKey is the key in VolumeContext that describes the pod UID
+	VolumeContextPodUidKey = "csi.storage.k8s.io/pod.uid"
 	// VolumeContextPvcNameKey is the key in VolumeContext that describes the PVC name
 	VolumeContextPvcNameKey = "csi.storage.k8s.io/pvc/name"
 	// VolumeContextPvcNamespaceKey is the key in VolumeContext that describes the PVC namespace
@@ -39,10 +41,11 @@ const (
 	PvcMountOptionOverrideAnnotation = "weka.io/mount-options-override"
 
 	// Order of application:
-	// 1. StorageClass default options
-	// 2. Node Publish default options
-	// 3. PvcMountOptionOverrideAnnotation
-	// 4. PodMountOptionOverrideAnnotation (first matching pattern wins)
+	// 1. Node Publish default options
+	// 2. Mount options profile (MountOptionsProfileParam, or PvcMountOptionsProfileAnnotation)
+	// 3. StorageClass default options
+	// 4. PvcMountOptionOverrideAnnotation
+	// 5. PodMountOptionOverrideAnnotation (first matching pattern wins)
 )
 
 type podMountEntry struct {
@@ -0,0 +1,143 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// MountOptionsProfileParam is the StorageClass parameter naming the mount option profile of a volume
+	MountOptionsProfileParam = "mountOptionsProfile"
+	// PvcMountOptionsProfileAnnotation is the annotation key on PVCs overriding the mount option profile set by StorageClass
+	PvcMountOptionsProfileAnnotation = "weka.io/mount-options-profile"
+)
+
+var ErrMountOptionsProfileNotFound = errors.New("mount options profile not found")
+
+// mountOptionProfiles holds named sets of mount option modifiers, in the format of MountOptionOverride, read from
+// a directory with a file per profile, i.e. a mounted ConfigMap. The directory is read again once its modification
+// time changes, which happens when kubelet swaps the ConfigMap contents, so profile changes apply to new mounts
+type mountOptionProfiles struct {
+	dir      string
+	modTime  time.Time
+	profiles map[string]MountOptionOverride
+	sync.Mutex
+}
+
+func newMountOptionProfiles(dir string) *mountOptionProfiles {
+	if dir == "" {
+		return nil
+	}
+	return &mountOptionProfiles{dir: dir}
+}
+
+// parseMountOptionsProfile returns the profile as mount option modifiers, allowing one modifier per line
+func parseMountOptionsProfile(data string) MountOptionOverride {
+	var parts []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts = append(parts, line)
+	}
+	return MountOptionOverride(strings.Join(parts, ","))
+}
+
+func (p *mountOptionProfiles) reload(ctx context.Context) error {
+	info, err := os.Stat(p.dir)
+	if err != nil {
+		return err
+	}
+	if p.profiles != nil && info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	profiles := make(map[string]MountOptionOverride)
+	for _, entry := range entries {
+		// kubelet keeps the actual contents in hidden directories, the profiles are symlinks to them
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(p.dir, entry.Name()))
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("profile", entry.Name()).Msg("Failed to read mount options profile, skipping")
+			continue
+		}
+		profiles[entry.Name()] = parseMountOptionsProfile(string(data))
+	}
+	p.profiles = profiles
+	p.modTime = info.ModTime()
+	log.Ctx(ctx).Info().Int("profiles", len(profiles)).Str("dir", p.dir).Msg("Loaded mount options profiles")
+	return nil
+}
+
+// get returns the mount option modifiers of the profile
+func (p *mountOptionProfiles) get(ctx context.Context, name string) (MountOptionOverride, error) {
+	if p == nil {
+		return "", fmt.Errorf("%w: %s, no mount options profiles are configured", ErrMountOptionsProfileNotFound, name)
+	}
+	p.Lock()
+	defer p.Unlock()
+	if err := p.reload(ctx); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("dir", p.dir).Msg("Failed to load mount options profiles, using previously loaded ones")
+	}
+	profile, ok := p.profiles[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrMountOptionsProfileNotFound, name)
+	}
+	return profile, nil
+}
+
+// getPvcMountOptionsProfile fetches the PVC and returns the profile named by PvcMountOptionsProfileAnnotation,
+// or "" if the annotation is absent
+func getPvcMountOptionsProfile(ctx context.Context, crclient runtimeclient.Reader, pvcNamespace, pvcName string) string {
+	claim := &v1.PersistentVolumeClaim{}
+	if err := crclient.Get(ctx, types.NamespacedName{Namespace: pvcNamespace, Name: pvcName}, claim); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("pvc_namespace", pvcNamespace).Str("pvc_name", pvcName).
+			Msg("Failed to fetch PVC for mount options profile annotation, skipping")
+		return ""
+	}
+	return strings.TrimSpace(claim.Annotations[PvcMountOptionsProfileAnnotation])
+}
+
+// applyMountOptionsProfileToVolume applies the mount options profile requested by StorageClass, or by PVC annotation
+// when mount option overrides are allowed. Unknown profiles fail the publish, rather than mounting with options the
+// volume was not meant to have
+func (ns *NodeServer) applyMountOptionsProfileToVolume(ctx context.Context, params map[string]string, volume *Volume, apireader runtimeclient.Reader) error {
+	logger := log.Ctx(ctx)
+	name := strings.TrimSpace(params[MountOptionsProfileParam])
+	if apireader != nil && ns.config.allowMountOptionOverrides {
+		pvcName, pvcNameOk := params[VolumeContextPvcNameKey]
+		pvcNamespace, pvcNamespaceOk := params[VolumeContextPvcNamespaceKey]
+		if pvcNameOk && pvcNamespaceOk {
+			if pvcProfile := getPvcMountOptionsProfile(ctx, apireader, pvcNamespace, pvcName); pvcProfile != "" {
+				name = pvcProfile
+			}
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	profile, err := ns.optionProfiles.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	logger.Debug().Str("profile", name).Str("opts", profile.String()).Msg("Applying mount options profile")
+	volume.mountOptions = profile.ApplyToOptions(volume.mountOptions, ns.config.mutuallyExclusiveOptions)
+	return nil
+}
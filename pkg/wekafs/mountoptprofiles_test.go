@@ -0,0 +1,98 @@
+package wekafs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeClient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseMountOptionsProfile(t *testing.T) {
+	assert.Equal(t, MountOptionOverride("readcache,-forcedirect"), parseMountOptionsProfile("readcache,-forcedirect\n"))
+	assert.Equal(t, MountOptionOverride("coherent,sync_on_close"), parseMountOptionsProfile("# database\ncoherent\n\n  sync_on_close  \n"))
+	assert.Equal(t, MountOptionOverride(""), parseMountOptionsProfile(""))
+}
+
+func TestMountOptionProfilesReload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ml-training"), []byte("readcache,-forcedirect"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..data"), 0755))
+	p := newMountOptionProfiles(dir)
+
+	profile, err := p.get(ctx, "ml-training")
+	assert.NoError(t, err)
+	assert.Equal(t, MountOptionOverride("readcache,-forcedirect"), profile)
+	_, err = p.get(ctx, "database")
+	assert.ErrorIs(t, err, ErrMountOptionsProfileNotFound)
+	_, err = p.get(ctx, "..data")
+	assert.ErrorIs(t, err, ErrMountOptionsProfileNotFound, "hidden entries are not profiles")
+
+	// profiles added to the ConfigMap are picked up once the directory changes
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "database"), []byte("coherent,sync_on_close"), 0644))
+	require.NoError(t, os.Chtimes(dir, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	profile, err = p.get(ctx, "database")
+	assert.NoError(t, err)
+	assert.Equal(t, MountOptionOverride("coherent,sync_on_close"), profile)
+
+	// previously loaded profiles are kept if the directory is gone
+	require.NoError(t, os.RemoveAll(dir))
+	_, err = p.get(ctx, "database")
+	assert.NoError(t, err)
+
+	var none *mountOptionProfiles
+	assert.Nil(t, newMountOptionProfiles(""))
+	_, err = none.get(ctx, "database")
+	assert.ErrorIs(t, err, ErrMountOptionsProfileNotFound)
+}
+
+func TestApplyMountOptionsProfileToVolume(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ml-training"), []byte("readcache\n-forcedirect"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "database"), []byte("coherent,sync_on_close"), 0644))
+	exclusives := []mutuallyExclusiveMountOptionSet{{"readcache", "writecache", "coherent", "forcedirect"}}
+	ns := &NodeServer{
+		config:         &DriverConfig{mutuallyExclusiveOptions: exclusives},
+		optionProfiles: newMountOptionProfiles(dir),
+	}
+	pvc := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name:        "db-pvc",
+		Namespace:   "default",
+		Annotations: map[string]string{PvcMountOptionsProfileAnnotation: "database"},
+	}}
+	client := fakeClient.NewClientBuilder().WithObjects(pvc).Build()
+
+	volume := &Volume{mountOptions: NewMountOptionsFromString("writecache,forcedirect")}
+	assert.NoError(t, ns.applyMountOptionsProfileToVolume(ctx, map[string]string{MountOptionsProfileParam: "ml-training"}, volume, client))
+	assert.True(t, volume.mountOptions.hasOption("readcache"))
+	assert.False(t, volume.mountOptions.hasOption("writecache"), "profile options follow mutually exclusive sets")
+	assert.False(t, volume.mountOptions.hasOption("forcedirect"))
+
+	volume = &Volume{mountOptions: NewMountOptionsFromString("writecache")}
+	assert.NoError(t, ns.applyMountOptionsProfileToVolume(ctx, map[string]string{}, volume, client))
+	assert.Equal(t, "writecache", volume.mountOptions.String(), "volumes without profile are left as is")
+
+	err := ns.applyMountOptionsProfileToVolume(ctx, map[string]string{MountOptionsProfileParam: "missing"}, volume, client)
+	assert.ErrorIs(t, err, ErrMountOptionsProfileNotFound)
+
+	// PVC annotation is honored only if mount option overrides are allowed
+	params := map[string]string{MountOptionsProfileParam: "ml-training", VolumeContextPvcNameKey: "db-pvc", VolumeContextPvcNamespaceKey: "default"}
+	volume = &Volume{mountOptions: NewMountOptionsFromString("writecache")}
+	assert.NoError(t, ns.applyMountOptionsProfileToVolume(ctx, params, volume, client))
+	assert.True(t, volume.mountOptions.hasOption("readcache"))
+
+	ns.config.allowMountOptionOverrides = true
+	volume = &Volume{mountOptions: NewMountOptionsFromString("writecache")}
+	assert.NoError(t, ns.applyMountOptionsProfileToVolume(ctx, params, volume, client))
+	assert.True(t, volume.mountOptions.hasOption("coherent"))
+	assert.True(t, volume.mountOptions.hasOption("sync_on_close"))
+	assert.False(t, volume.mountOptions.hasOption("writecache"))
+}
@@ -0,0 +1,272 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/mount-utils"
+)
+
+const (
+	mountRecordsDir = ".mount-records"
+	// kubeletCsiTargetPathPart is contained in every publish target path kubelet passes to NodePublishVolume,
+	// regardless of the kubelet root directory, e.g. /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount
+	kubeletCsiTargetPathPart = "/volumes/kubernetes.io~csi/"
+)
+
+var ProcMountInfoPath = "/proc/self/mountinfo"
+
+// mountRecord is persisted in the mount base directory for every filesystem mount the plugin makes,
+// so the refcount index of the mount can be restored after the plugin is restarted.
+// The mounters of all transports share the mount base directory, each of them recovers the records of its own transport
+type mountRecord struct {
+	Filesystem  string        `json:"filesystem"`
+	RefcountIdx string        `json:"refcountIdx"`
+	Transport   DataTransport `json:"transport,omitempty"`
+}
+
+// isOf returns true if the record belongs to the transport. Records written without transport are attributed by
+// the filesystem type of their mount, and may be removed by any transport once they are not mounted anymore
+func (r *mountRecord) isOf(transport DataTransport, fsType string) bool {
+	if r.Transport != "" {
+		return r.Transport == transport
+	}
+	mountTransport, ok := transportOfFsType(fsType)
+	return !ok || mountTransport == transport
+}
+
+func mountRecordPath(mountBaseDir, mountPoint string) string {
+	return filepath.Join(mountBaseDir, mountRecordsDir, filepath.Base(mountPoint)+".json")
+}
+
+func writeMountRecord(mountBaseDir, mountPoint string, record *mountRecord) error {
+	if err := os.MkdirAll(filepath.Join(mountBaseDir, mountRecordsDir), DefaultVolumePermissions); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path := mountRecordPath(mountBaseDir, mountPoint)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func removeMountRecord(mountBaseDir, mountPoint string) error {
+	if err := os.Remove(mountRecordPath(mountBaseDir, mountPoint)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readMountRecords returns the mount records found in the mount base directory, keyed by mount point
+func readMountRecords(mountBaseDir string) (map[string]*mountRecord, error) {
+	ret := make(map[string]*mountRecord)
+	entries, err := os.ReadDir(filepath.Join(mountBaseDir, mountRecordsDir))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(mountBaseDir, mountRecordsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		record := &mountRecord{}
+		if err := json.Unmarshal(data, record); err != nil || record.RefcountIdx == "" {
+			log.Warn().Err(err).Str("mount_record", entry.Name()).Msg("Ignoring malformed mount record")
+			continue
+		}
+		ret[filepath.Join(mountBaseDir, name)] = record
+	}
+	return ret, nil
+}
+
+// mountRefsRecovery is the outcome of matching the mounts found on plugin startup against the mount records
+type mountRefsRecovery struct {
+	// refs holds the number of publish targets depending on each recorded mount, keyed by refcount index
+	refs map[string]int
+	// targets maps each publish target path to the refcount index of the mount it was bind mounted from
+	targets map[string]string
+	// unused are mount points of recorded mounts no publish target depends on
+	unused []string
+	// unknown are mount points in the mount base directory that have no record and are left intact
+	unknown []string
+	// stale are mount points of records which are not mounted anymore
+	stale []string
+}
+
+func isMountRecoveryTarget(mountPoint string) bool {
+	return strings.Contains(mountPoint, kubeletCsiTargetPathPart) && filepath.Base(mountPoint) == "mount"
+}
+
+func isTransportFsType(transport DataTransport, fsType string) bool {
+	mountTransport, ok := transportOfFsType(fsType)
+	return ok && mountTransport == transport
+}
+
+// recoverMountRefs maps the mounts of the transport in the mount base directory back to their refcount index,
+// and counts the publish targets that were bind mounted from each of them, based on the device of the mount.
+// A publish target that shares a device with several mounts is accounted to the first of them only.
+// Records and mounts of other transports are left to their own mounters
+func recoverMountRefs(transport DataTransport, mountBaseDir string, mounts []mount.MountInfo, records map[string]*mountRecord) *mountRefsRecovery {
+	ret := &mountRefsRecovery{refs: make(map[string]int), targets: make(map[string]string)}
+	devices := make(map[string][]string)
+	// mounted holds the filesystem type of every mount point in the mount base directory, regardless of transport
+	mounted := make(map[string]string)
+	for _, m := range mounts {
+		if filepath.Dir(m.MountPoint) != mountBaseDir {
+			continue
+		}
+		if _, ok := mounted[m.MountPoint]; ok {
+			continue
+		}
+		mounted[m.MountPoint] = m.FsType
+		if !isTransportFsType(transport, m.FsType) {
+			continue
+		}
+		record, ok := records[m.MountPoint]
+		if !ok || !record.isOf(transport, m.FsType) {
+			ret.unknown = append(ret.unknown, m.MountPoint)
+			continue
+		}
+		ret.refs[record.RefcountIdx] = 0
+		device := fmt.Sprintf("%d:%d", m.Major, m.Minor)
+		devices[device] = append(devices[device], m.MountPoint)
+	}
+	for _, mountPoints := range devices {
+		sort.Strings(mountPoints)
+	}
+
+	for _, m := range mounts {
+		if !isTransportFsType(transport, m.FsType) || !isMountRecoveryTarget(m.MountPoint) {
+			continue
+		}
+		if _, ok := ret.targets[m.MountPoint]; ok {
+			continue
+		}
+		mountPoints := devices[fmt.Sprintf("%d:%d", m.Major, m.Minor)]
+		if len(mountPoints) == 0 {
+			continue
+		}
+		idx := records[mountPoints[0]].RefcountIdx
+		ret.targets[m.MountPoint] = idx
+		ret.refs[idx]++
+	}
+
+	for mountPoint, record := range records {
+		fsType, isMounted := mounted[mountPoint]
+		if !record.isOf(transport, fsType) {
+			continue
+		}
+		if !isMounted {
+			ret.stale = append(ret.stale, mountPoint)
+		} else if ret.refs[record.RefcountIdx] == 0 {
+			ret.unused = append(ret.unused, mountPoint)
+			delete(ret.refs, record.RefcountIdx)
+		}
+	}
+	sort.Strings(ret.unknown)
+	sort.Strings(ret.stale)
+	sort.Strings(ret.unused)
+	return ret
+}
+
+// rebuildMountRefs restores the references of mounts made by a previous instance of the plugin.
+// Recorded mounts that publish targets still depend on are adopted with a reference per target, which is released
+// on NodeUnpublishVolume of that target. Recorded mounts nothing depends on are unmounted, and records of mounts
+// which are gone are removed along with their mount point directories. Mounts without record are never touched.
+// Returns the recovered refcounts and the publish targets holding them.
+//
+// NodePublishVolume releases the filesystem mount right after bind mounting the publish target, so a completed
+// publish leaves no record behind and its target holds no reference. Recorded mounts are left over only if the
+// plugin stopped while holding a reference, i.e. in the middle of a publish, a garbage collection or a remount by
+// the mount watchdog. Mounts of plugin versions that wrote no records, including versions keeping the filesystem
+// mounted for as long as its publish targets exist, are reported as unknown and left intact, and their publish
+// targets are unmounted by NodeUnpublishVolume as usual
+func rebuildMountRefs(ctx context.Context, transport DataTransport, mountBaseDir string, kMounter mount.Interface, unmountTimeout time.Duration) (map[string]int, map[string]string) {
+	logger := log.Ctx(ctx).With().Str("transport", string(transport)).Str("mount_base_dir", mountBaseDir).Logger()
+	records, err := readMountRecords(mountBaseDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read mount records, mount references will not be recovered")
+		return nil, nil
+	}
+	mounts, err := mount.ParseMountInfo(ProcMountInfoPath)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to parse mount info, mount references will not be recovered")
+		return nil, nil
+	}
+	recovery := recoverMountRefs(transport, mountBaseDir, mounts, records)
+
+	for _, mountPoint := range recovery.unknown {
+		logger.Warn().Str("mount_point", mountPoint).Msg("Found mount without record, leaving it intact")
+	}
+	for _, mountPoint := range recovery.unused {
+		logger.Info().Str("mount_point", mountPoint).Msg("Unmounting leftover mount no publish target depends on")
+		if err := unmountWithEscalation(ctx, kMounter, mountPoint, transport, unmountTimeout); err != nil {
+			logger.Error().Err(err).Str("mount_point", mountPoint).Msg("Failed to unmount leftover mount")
+			continue
+		}
+		recovery.stale = append(recovery.stale, mountPoint)
+	}
+	for _, mountPoint := range recovery.stale {
+		if err := removeMountRecord(mountBaseDir, mountPoint); err != nil {
+			logger.Warn().Err(err).Str("mount_point", mountPoint).Msg("Failed to remove stale mount record")
+		}
+		// a non-empty directory is not a mount point of ours anymore and must not be removed
+		if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+			logger.Warn().Err(err).Str("mount_point", mountPoint).Msg("Failed to remove stale mount point directory")
+		}
+	}
+	for idx, refCount := range recovery.refs {
+		logger.Info().Str("mount_point", strings.Split(idx, "^")[0]).Int("refcount", refCount).Msg("Recovered mount references of publish targets")
+	}
+	return recovery.refs, recovery.targets
+}
+
+// releaseRecoveredTarget releases the reference a publish target holds on a mount adopted on plugin startup,
+// unmounting it once the last reference is gone. Targets that did not hold a reference upon startup, which is the
+// case for every target whose publish completed, are ignored. Must be called with the mounter lock held
+func releaseRecoveredTarget(ctx context.Context, mountMap map[string]int, targets map[string]string, kMounter mount.Interface, transport DataTransport, unmountTimeout time.Duration, mountBaseDir, targetPath string) {
+	idx, ok := targets[targetPath]
+	if !ok {
+		return
+	}
+	delete(targets, targetPath)
+	mountPoint := strings.Split(idx, "^")[0]
+	logger := log.Ctx(ctx).With().Str("mount_point", mountPoint).Str("target_path", targetPath).Logger()
+	refCount := mountMap[idx]
+	if refCount == 1 && PathIsWekaMount(ctx, mountPoint) {
+		logger.Debug().Msg("Last recovered reference released, unmounting filesystem")
+		if err := unmountWithEscalation(ctx, kMounter, mountPoint, transport, unmountTimeout); err != nil {
+			logger.Error().Err(err).Msg("Failed to unmount filesystem")
+		} else {
+			if err := removeMountRecord(mountBaseDir, mountPoint); err != nil {
+				logger.Warn().Err(err).Msg("Failed to remove mount record")
+			}
+			if err := os.Remove(mountPoint); err != nil {
+				logger.Warn().Err(err).Msg("Failed to remove mount point directory, will be cleaned up on next use")
+			}
+		}
+	}
+	if refCount > 0 {
+		mountMap[idx] = refCount - 1
+		logger.Debug().Int("refcount", refCount-1).Msg("Recovered mount reference released")
+	}
+}
@@ -0,0 +1,154 @@
+package wekafs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+)
+
+func TestMountRecords(t *testing.T) {
+	baseDir := t.TempDir()
+	mountPoint := filepath.Join(baseDir, "fs1-abc-client")
+	record := &mountRecord{Filesystem: "fs1", RefcountIdx: mountPoint + "^rw,readcache", Transport: dataTransportWekafs}
+	require.NoError(t, writeMountRecord(baseDir, mountPoint, record))
+	require.NoError(t, os.WriteFile(filepath.Join(baseDir, mountRecordsDir, "broken.json"), []byte("{"), 0600))
+
+	records, err := readMountRecords(baseDir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*mountRecord{mountPoint: record}, records)
+
+	require.NoError(t, removeMountRecord(baseDir, mountPoint))
+	require.NoError(t, removeMountRecord(baseDir, mountPoint), "removal must be idempotent")
+	records, err = readMountRecords(t.TempDir())
+	assert.NoError(t, err, "missing records directory means no records")
+	assert.Empty(t, records)
+}
+
+func TestRecoverMountRefs(t *testing.T) {
+	baseDir := "/run/weka-fs-mounts-node"
+	used := baseDir + "/fs1-aaa-client"
+	unused := baseDir + "/fs2-bbb-client"
+	gone := baseDir + "/fs3-ccc-client"
+	unknown := baseDir + "/fs4-ddd-client"
+	target := func(pod string) string {
+		return "/var/lib/kubelet/pods/" + pod + "/volumes/kubernetes.io~csi/pvc-1/mount"
+	}
+	records := map[string]*mountRecord{
+		used:   {Filesystem: "fs1", RefcountIdx: used + "^rw"},
+		unused: {Filesystem: "fs2", RefcountIdx: unused + "^rw"},
+		gone:   {Filesystem: "fs3", RefcountIdx: gone + "^rw"},
+	}
+	mounts := []mount.MountInfo{
+		{MountPoint: used, FsType: "wekafs", Major: 0, Minor: 51},
+		{MountPoint: unused, FsType: "wekafs", Major: 0, Minor: 52},
+		{MountPoint: unknown, FsType: "wekafs", Major: 0, Minor: 53},
+		{MountPoint: baseDir + "/nfs-eee-10.0.0.1", FsType: "nfs4", Major: 0, Minor: 54},
+		{MountPoint: target("pod-a"), FsType: "wekafs", Major: 0, Minor: 51, Root: "/csi-volumes/pvc-1"},
+		{MountPoint: target("pod-b"), FsType: "wekafs", Major: 0, Minor: 51, Root: "/csi-volumes/pvc-2"},
+		{MountPoint: target("pod-c"), FsType: "wekafs", Major: 0, Minor: 53},
+		{MountPoint: "/var/lib/kubelet/pods/pod-d/volumes/kubernetes.io~empty-dir/cache", FsType: "wekafs", Major: 0, Minor: 51},
+	}
+
+	recovery := recoverMountRefs(dataTransportWekafs, baseDir, mounts, records)
+	assert.Equal(t, map[string]int{used + "^rw": 2}, recovery.refs)
+	assert.Equal(t, map[string]string{target("pod-a"): used + "^rw", target("pod-b"): used + "^rw"}, recovery.targets)
+	assert.Equal(t, []string{unused}, recovery.unused)
+	assert.Equal(t, []string{gone}, recovery.stale)
+	assert.Equal(t, []string{unknown}, recovery.unknown, "mounts without record must be left intact")
+}
+
+func TestRecoverMountRefsMixedTransports(t *testing.T) {
+	baseDir := "/run/weka-fs-mounts-node"
+	wekafsMount := baseDir + "/fs1-aaa-client"
+	nfsMount := baseDir + "/fs1-bbb-10.0.0.1"
+	nfsGone := baseDir + "/fs2-ccc-10.0.0.1"
+	legacyNfsMount := baseDir + "/fs3-ddd-10.0.0.1"
+	target := func(pod string) string {
+		return "/var/lib/kubelet/pods/" + pod + "/volumes/kubernetes.io~csi/pvc-1/mount"
+	}
+	records := map[string]*mountRecord{
+		wekafsMount:    {Filesystem: "fs1", RefcountIdx: wekafsMount + "^rw", Transport: dataTransportWekafs},
+		nfsMount:       {Filesystem: "fs1", RefcountIdx: nfsMount + "^vers=4.1", Transport: dataTransportNfs},
+		nfsGone:        {Filesystem: "fs2", RefcountIdx: nfsGone + "^vers=4.1", Transport: dataTransportNfs},
+		legacyNfsMount: {Filesystem: "fs3", RefcountIdx: legacyNfsMount + "^vers=4.1"},
+	}
+	mounts := []mount.MountInfo{
+		{MountPoint: wekafsMount, FsType: "wekafs", Major: 0, Minor: 51},
+		{MountPoint: nfsMount, FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: legacyNfsMount, FsType: "nfs4", Major: 0, Minor: 62},
+		{MountPoint: target("pod-a"), FsType: "wekafs", Major: 0, Minor: 51},
+		{MountPoint: target("pod-b"), FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: target("pod-c"), FsType: "nfs4", Major: 0, Minor: 62},
+	}
+
+	wekafs := recoverMountRefs(dataTransportWekafs, baseDir, mounts, records)
+	assert.Equal(t, map[string]int{wekafsMount + "^rw": 1}, wekafs.refs)
+	assert.Equal(t, map[string]string{target("pod-a"): wekafsMount + "^rw"}, wekafs.targets)
+	assert.Empty(t, wekafs.stale, "records of other transports must not be removed")
+	assert.Empty(t, wekafs.unused)
+	assert.Empty(t, wekafs.unknown)
+
+	nfs := recoverMountRefs(dataTransportNfs, baseDir, mounts, records)
+	assert.Equal(t, map[string]int{nfsMount + "^vers=4.1": 1, legacyNfsMount + "^vers=4.1": 1}, nfs.refs)
+	assert.Equal(t, map[string]string{target("pod-b"): nfsMount + "^vers=4.1", target("pod-c"): legacyNfsMount + "^vers=4.1"}, nfs.targets)
+	assert.Equal(t, []string{nfsGone}, nfs.stale)
+	assert.Empty(t, nfs.unused)
+	assert.Empty(t, nfs.unknown)
+}
+
+func TestReleaseRecoveredTarget(t *testing.T) {
+	baseDir := t.TempDir()
+	mountPoint := filepath.Join(baseDir, "fs1-aaa-client")
+	idx := mountPoint + "^rw"
+	mountMap := map[string]int{idx: 2}
+	targets := map[string]string{"/target-a": idx, "/target-b": idx}
+	fake := mount.NewFakeMounter(nil)
+
+	releaseRecoveredTarget(context.Background(), mountMap, targets, fake, dataTransportWekafs, time.Second, baseDir, "/target-a")
+	releaseRecoveredTarget(context.Background(), mountMap, targets, fake, dataTransportWekafs, time.Second, baseDir, "/target-a")
+	assert.Equal(t, 1, mountMap[idx], "a target must release its reference only once")
+	releaseRecoveredTarget(context.Background(), mountMap, targets, fake, dataTransportWekafs, time.Second, baseDir, "/unrelated")
+	assert.Equal(t, 1, mountMap[idx])
+	releaseRecoveredTarget(context.Background(), mountMap, targets, fake, dataTransportWekafs, time.Second, baseDir, "/target-b")
+	assert.Equal(t, 0, mountMap[idx])
+	assert.Empty(t, targets)
+}
+
+// TestRecoverMountRefsAfterPublishCycle follows the records and mounts NodePublishVolume leaves behind: the filesystem
+// mount is recorded while the publish target is bind mounted from it, and released with its record once publish completes
+func TestRecoverMountRefsAfterPublishCycle(t *testing.T) {
+	baseDir := t.TempDir()
+	mountPoint := filepath.Join(baseDir, "fs1-aaa-client")
+	idx := mountPoint + "^rw"
+	target := "/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~csi/pvc-1/mount"
+	base := mount.MountInfo{MountPoint: mountPoint, FsType: "wekafs", Major: 0, Minor: 51}
+	bind := mount.MountInfo{MountPoint: target, FsType: "wekafs", Major: 0, Minor: 51, Root: "/csi-volumes/pvc-1"}
+
+	// plugin stopped after the bind mount, before the filesystem mount was released
+	require.NoError(t, writeMountRecord(baseDir, mountPoint, &mountRecord{Filesystem: "fs1", RefcountIdx: idx}))
+	records, err := readMountRecords(baseDir)
+	require.NoError(t, err)
+	recovery := recoverMountRefs(dataTransportWekafs, baseDir, []mount.MountInfo{base, bind}, records)
+	assert.Equal(t, map[string]int{idx: 1}, recovery.refs)
+	assert.Equal(t, map[string]string{target: idx}, recovery.targets)
+
+	// completed publish: the filesystem mount and its record are gone, only the publish target is left
+	require.NoError(t, removeMountRecord(baseDir, mountPoint))
+	records, err = readMountRecords(baseDir)
+	require.NoError(t, err)
+	recovery = recoverMountRefs(dataTransportWekafs, baseDir, []mount.MountInfo{bind}, records)
+	assert.Empty(t, recovery.refs)
+	assert.Empty(t, recovery.targets, "targets of completed publishes hold no reference")
+	assert.Empty(t, recovery.stale)
+	assert.Empty(t, recovery.unknown)
+
+	mountMap := map[string]int{}
+	releaseRecoveredTarget(context.Background(), mountMap, recovery.targets, mount.NewFakeMounter(nil), dataTransportWekafs, time.Second, baseDir, target)
+	assert.Empty(t, mountMap, "unpublish of a completed publish must not touch refcounts")
+}
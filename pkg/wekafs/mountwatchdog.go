@@ -0,0 +1,446 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/mount-utils"
+)
+
+const (
+	eventReasonMountStale          = "MountStale"
+	eventReasonMountRecovered      = "MountRecovered"
+	eventReasonMountRecoveryFailed = "MountRecoveryFailed"
+
+	defaultMountProbeTimeout = 10 * time.Second
+)
+
+var ErrMountProbeTimeout = errors.New("stat of mount point timed out")
+
+var (
+	mountWatchdogStaleTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mount_watchdog",
+		Name:      "stale_mounts_total",
+		Help:      "Number of hung or stale mounts detected by the mount watchdog, by kind of mount",
+	}, []string{"kind"})
+	mountWatchdogRemountsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mount_watchdog",
+		Name:      "remounts_total",
+		Help:      "Number of remounts of published volumes performed by the mount watchdog, by result",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(mountWatchdogStaleTotal, mountWatchdogRemountsTotal)
+}
+
+// isMountAbnormal returns true if the error of a mount probe means the mount is hung or stale
+func isMountAbnormal(err error) bool {
+	return errors.Is(err, ErrMountProbeTimeout) || errors.Is(err, ErrNfsTargetUnreachable) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.ENOTCONN) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EHOSTDOWN)
+}
+
+type mountProbe struct {
+	done chan struct{}
+	stat syscall.Statfs_t
+	err  error
+}
+
+// mountProber runs statfs bounded by a timeout. Statfs of a hung mount may block in kernel indefinitely, so a probe
+// of a path which is still in progress is joined rather than started again, and the path is reported as hung until it returns
+type mountProber struct {
+	timeout  time.Duration
+	statfs   func(path string, stat *syscall.Statfs_t) error
+	lock     sync.Mutex
+	inFlight map[string]*mountProbe
+}
+
+func newMountProber(timeout time.Duration) *mountProber {
+	if timeout <= 0 {
+		timeout = defaultMountProbeTimeout
+	}
+	return &mountProber{timeout: timeout, statfs: syscall.Statfs, inFlight: make(map[string]*mountProbe)}
+}
+
+func (p *mountProber) probe(path string) (*syscall.Statfs_t, error) {
+	p.lock.Lock()
+	probe, ok := p.inFlight[path]
+	if !ok {
+		probe = &mountProbe{done: make(chan struct{})}
+		p.inFlight[path] = probe
+		go func() {
+			probe.err = p.statfs(path, &probe.stat)
+			p.lock.Lock()
+			delete(p.inFlight, path)
+			p.lock.Unlock()
+			close(probe.done)
+		}()
+	}
+	p.lock.Unlock()
+
+	select {
+	case <-probe.done:
+		if probe.err != nil {
+			return nil, probe.err
+		}
+		return &probe.stat, nil
+	case <-time.After(p.timeout):
+		return nil, fmt.Errorf("%w after %s", ErrMountProbeTimeout, p.timeout)
+	}
+}
+
+// lazyUnmount detaches a mount even if it is busy or hung, the filesystem is released once it is not used anymore
+func lazyUnmount(path string) error {
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
+
+// publishedVolume is what is needed to publish a volume to its target path again
+type publishedVolume struct {
+	volume         *Volume
+	innerMountOpts []string
+	pod            *v1.ObjectReference
+}
+
+// mountWatchdog periodically probes the volumes published on the node and the underlying mounts they are shared from.
+// Hung or stale publish targets are reported as abnormal volume condition and are remounted, while stale underlying
+// mounts are lazily detached, so they are mounted again on next use
+type mountWatchdog struct {
+	ns       *NodeServer
+	recorder record.EventRecorder
+	interval time.Duration
+
+	lock      sync.Mutex
+	published map[string]*publishedVolume
+	// abnormal holds the volume condition message of publish targets found hung or stale
+	abnormal map[string]string
+}
+
+func newMountWatchdog(ns *NodeServer, recorder record.EventRecorder, interval time.Duration) *mountWatchdog {
+	return &mountWatchdog{
+		ns:        ns,
+		recorder:  recorder,
+		interval:  interval,
+		published: make(map[string]*publishedVolume),
+		abnormal:  make(map[string]string),
+	}
+}
+
+func (w *mountWatchdog) track(targetPath string, p *publishedVolume) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.published[targetPath] = p
+}
+
+func (w *mountWatchdog) untrack(targetPath string) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.published, targetPath)
+	delete(w.abnormal, targetPath)
+}
+
+// condition returns the message of the abnormal condition of a publish target, if it was found hung or stale
+func (w *mountWatchdog) condition(targetPath string) (string, bool) {
+	if w == nil {
+		return "", false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	message, ok := w.abnormal[targetPath]
+	return message, ok
+}
+
+// setCondition records the condition of a publish target and returns true if it has just turned abnormal
+func (w *mountWatchdog) setCondition(targetPath string, err error) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err == nil {
+		delete(w.abnormal, targetPath)
+		return false
+	}
+	_, wasAbnormal := w.abnormal[targetPath]
+	w.abnormal[targetPath] = fmt.Sprintf("mount is hung or stale: %s", err)
+	return !wasAbnormal
+}
+
+func (w *mountWatchdog) run(ctx context.Context) {
+	logger := log.Ctx(ctx).With().Str("component", "mount-watchdog").Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Dur("interval", w.interval).Dur("timeout", w.ns.prober.timeout).Msg("Starting mount watchdog")
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug().Msg("Stopping mount watchdog")
+			return
+		case <-time.After(w.interval):
+		}
+		w.check(ctx)
+	}
+}
+
+func (w *mountWatchdog) check(ctx context.Context) {
+	logger := log.Ctx(ctx)
+	mountBaseDir := w.ns.getMounter().getMountBaseDir()
+	nfsHealth := w.nfsTargetHealth()
+
+	w.lock.Lock()
+	published := make(map[string]*publishedVolume, len(w.published))
+	for targetPath, p := range w.published {
+		published[targetPath] = p
+	}
+	w.lock.Unlock()
+
+	// publish targets shared from a mount of an unreachable NFS target are failed over without waiting for them to hang
+	failover := make(map[string]error)
+	if mounts, err := mount.ParseMountInfo(ProcMountInfoPath); err != nil {
+		logger.Error().Err(err).Msg("Failed to parse mount info, skipping probe of underlying mounts")
+	} else {
+		unreachable := make(map[string]error)
+		if nfsHealth != nil {
+			unreachable = nfsHealth.checkNfsTargets(ctx, mounts, mountBaseDir, w.ns.prober.timeout)
+		}
+		for targetPath := range published {
+			if err, ok := unreachable[targetPath]; ok {
+				failover[targetPath] = err
+			}
+			for _, underlying := range findUnderlyingMounts(mounts, targetPath, mountBaseDir) {
+				if err, ok := unreachable[underlying.MountPoint]; ok {
+					failover[targetPath] = err
+				}
+			}
+		}
+		for _, m := range mounts {
+			if filepath.Dir(m.MountPoint) != mountBaseDir || !isWatchedFsType(m.FsType) {
+				continue
+			}
+			err, ok := unreachable[m.MountPoint]
+			if !ok {
+				if _, err = w.ns.prober.probe(m.MountPoint); !isMountAbnormal(err) {
+					continue
+				}
+				if ip := nfsMountIp(m); ip != "" && nfsHealth != nil {
+					nfsHealth.markUnhealthy(ip)
+				}
+			}
+			mountWatchdogStaleTotal.WithLabelValues("underlying").Inc()
+			logger.Warn().Err(err).Str("mount_point", m.MountPoint).Msg("Underlying mount is hung or stale, detaching it")
+			detached, err := w.mounterOf(m.FsType).detachStaleMount(ctx, m.MountPoint)
+			if err != nil {
+				logger.Error().Err(err).Str("mount_point", m.MountPoint).Msg("Failed to detach underlying mount")
+			} else if !detached {
+				logger.Warn().Str("mount_point", m.MountPoint).Msg("Underlying mount is in use by an operation in progress, will detach it on next check")
+			}
+		}
+	}
+
+	for targetPath, p := range published {
+		err, ok := failover[targetPath]
+		if !ok {
+			_, err = w.ns.prober.probe(targetPath)
+		}
+		if err != nil && !isMountAbnormal(err) {
+			logger.Debug().Err(err).Str("target_path", targetPath).Msg("Failed to probe publish target")
+			continue
+		}
+		if err == nil {
+			w.setCondition(targetPath, nil)
+			continue
+		}
+		if w.setCondition(targetPath, err) {
+			mountWatchdogStaleTotal.WithLabelValues("target").Inc()
+			logger.Warn().Err(err).Str("target_path", targetPath).Str("volume_id", p.volume.GetId()).Msg("Publish target is hung or stale")
+			w.event(p, v1.EventTypeWarning, eventReasonMountStale, fmt.Sprintf("Mount of volume %s is hung or stale: %s", p.volume.GetId(), err))
+		}
+
+		if err := w.remount(ctx, targetPath, p); err != nil {
+			mountWatchdogRemountsTotal.WithLabelValues("failure").Inc()
+			logger.Error().Err(err).Str("target_path", targetPath).Msg("Failed to remount publish target")
+			w.event(p, v1.EventTypeWarning, eventReasonMountRecoveryFailed, fmt.Sprintf("Failed to remount volume %s: %s", p.volume.GetId(), err))
+			continue
+		}
+		mountWatchdogRemountsTotal.WithLabelValues("success").Inc()
+		w.event(p, v1.EventTypeNormal, eventReasonMountRecovered,
+			fmt.Sprintf("Volume %s was remounted, containers must be restarted to access it again", p.volume.GetId()))
+		_, err = w.ns.prober.probe(targetPath)
+		w.setCondition(targetPath, err)
+	}
+}
+
+// remount lazily detaches the publish target and the underlying mounts it was bind mounted from,
+// and publishes the volume to the target path again
+func (w *mountWatchdog) remount(ctx context.Context, targetPath string, p *publishedVolume) (retErr error) {
+	op := "RemountVolume"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Str("volume_id", p.volume.GetId()).Str("target_path", targetPath).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	releaseLock, err := w.ns.locks.tryAcquire(ctx, op, publishLockKey(p.volume.GetId(), targetPath))
+	defer releaseLock()
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	_, stillPublished := w.published[targetPath]
+	w.lock.Unlock()
+	if !stillPublished {
+		return nil
+	}
+
+	mounts, err := mount.ParseMountInfo(ProcMountInfoPath)
+	if err != nil {
+		return err
+	}
+	for _, underlying := range findUnderlyingMounts(mounts, targetPath, w.ns.getMounter().getMountBaseDir()) {
+		logger.Info().Str("mount_point", underlying.MountPoint).Msg("Detaching underlying mount of stale publish target")
+		detached, err := w.mounterOf(underlying.FsType).detachStaleMount(ctx, underlying.MountPoint)
+		if err != nil {
+			return err
+		}
+		if !detached {
+			return fmt.Errorf("underlying mount %s is in use by an operation in progress", underlying.MountPoint)
+		}
+	}
+	logger.Info().Msg("Detaching stale publish target")
+	if err := lazyUnmount(targetPath); err != nil && !isNotMountedErr(err) {
+		return err
+	}
+
+	err, unmount := p.volume.MountUnderlyingFS(ctx)
+	if err != nil {
+		return err
+	}
+	defer deferUmount(unmount, &retErr)
+	fullPath := p.volume.GetFullPath(ctx)
+	logger.Info().Str("full_path", fullPath).Msg("Bind mounting volume to publish target again")
+	return mount.New("").Mount(fullPath, targetPath, "", p.innerMountOpts)
+}
+
+// nfsTargetHealth returns the health of NFS target IP addresses when volumes are mounted over NFS
+func (w *mountWatchdog) nfsTargetHealth() *nfsTargetHealth {
+	switch m := w.ns.getMounter().(type) {
+	case *nfsMounter:
+		return m.targetHealth
+	case *compositeMounter:
+		return m.nfs.targetHealth
+	}
+	return nil
+}
+
+// staleMountDetacher is implemented by the mounters of each data transport
+type staleMountDetacher interface {
+	detachStaleMount(ctx context.Context, mountPoint string) (bool, error)
+}
+
+// mounterOf returns the mounter which owns the filesystem mounts of the filesystem type
+func (w *mountWatchdog) mounterOf(fsType string) staleMountDetacher {
+	mounter := w.ns.getMounter()
+	if m, ok := mounter.(*compositeMounter); ok {
+		transport, _ := transportOfFsType(fsType)
+		mounter = m.mounterFor(transport)
+	}
+	return mounter.(staleMountDetacher)
+}
+
+func (w *mountWatchdog) event(p *publishedVolume, eventType, reason, message string) {
+	if w.recorder == nil || p.pod == nil {
+		return
+	}
+	w.recorder.Event(p.pod, eventType, reason, message)
+}
+
+func isWatchedFsType(fsType string) bool {
+	_, ok := transportOfFsType(fsType)
+	return ok
+}
+
+// transportOfFsType returns the data transport filesystems of the filesystem type are mounted with
+func transportOfFsType(fsType string) (DataTransport, bool) {
+	switch {
+	case fsType == "wekafs":
+		return dataTransportWekafs, true
+	case strings.HasPrefix(fsType, "nfs"):
+		return dataTransportNfs, true
+	case isSmbFsType(fsType):
+		return dataTransportSmb, true
+	}
+	return "", false
+}
+
+// detachStaleMount lazily detaches a hung or stale filesystem mount, unless an operation in progress holds a reference
+// to it, and forgets its refcount, its record and the recovered publish targets it was adopted for, so the filesystem
+// is mounted again on next use. Returns false if the mount is in use. Must be called with the mounter lock held
+func detachStaleMount(ctx context.Context, mountMap map[string]int, targets map[string]string, mountBaseDir, mountPoint string, detach func(path string) error) (bool, error) {
+	recovered := make(map[string]int)
+	for _, idx := range targets {
+		recovered[idx]++
+	}
+	var indexes []string
+	for idx, refCount := range mountMap {
+		if strings.Split(idx, "^")[0] != mountPoint {
+			continue
+		}
+		if refCount > recovered[idx] {
+			return false, nil
+		}
+		indexes = append(indexes, idx)
+	}
+	if err := detach(mountPoint); err != nil && !isNotMountedErr(err) {
+		return false, err
+	}
+	for _, idx := range indexes {
+		delete(mountMap, idx)
+	}
+	for targetPath, idx := range targets {
+		if strings.Split(idx, "^")[0] == mountPoint {
+			delete(targets, targetPath)
+		}
+	}
+	logger := log.Ctx(ctx).With().Str("mount_point", mountPoint).Logger()
+	if err := removeMountRecord(mountBaseDir, mountPoint); err != nil {
+		logger.Warn().Err(err).Msg("Failed to remove mount record")
+	}
+	if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+		logger.Warn().Err(err).Msg("Failed to remove mount point directory, will be cleaned up on next use")
+	}
+	return true, nil
+}
+
+// findUnderlyingMounts returns the mounts in the mount base directory that share a device with the target path
+func findUnderlyingMounts(mounts []mount.MountInfo, targetPath, mountBaseDir string) []mount.MountInfo {
+	device := ""
+	for _, m := range mounts {
+		if m.MountPoint == targetPath && isWatchedFsType(m.FsType) {
+			device = fmt.Sprintf("%d:%d", m.Major, m.Minor)
+		}
+	}
+	var ret []mount.MountInfo
+	if device == "" {
+		return ret
+	}
+	for _, m := range mounts {
+		if filepath.Dir(m.MountPoint) == mountBaseDir && isWatchedFsType(m.FsType) && fmt.Sprintf("%d:%d", m.Major, m.Minor) == device {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
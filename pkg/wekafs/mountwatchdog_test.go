@@ -0,0 +1,140 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+)
+
+func TestMountProberTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	p := newMountProber(50 * time.Millisecond)
+	p.statfs = func(path string, stat *syscall.Statfs_t) error {
+		calls.Add(1)
+		if path == "/hung" {
+			<-release
+		}
+		stat.Blocks = 10
+		return nil
+	}
+
+	_, err := p.probe("/hung")
+	assert.ErrorIs(t, err, ErrMountProbeTimeout)
+	assert.True(t, isMountAbnormal(err))
+	_, err = p.probe("/hung")
+	assert.ErrorIs(t, err, ErrMountProbeTimeout)
+	stat, err := p.probe("/healthy")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), stat.Blocks)
+	assert.Equal(t, int32(2), calls.Load(), "probe of a hung path must be joined rather than started again")
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		_, err := p.probe("/hung")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestIsMountAbnormal(t *testing.T) {
+	assert.True(t, isMountAbnormal(&mountErr{syscall.ESTALE}))
+	assert.True(t, isMountAbnormal(syscall.ENOTCONN))
+	assert.False(t, isMountAbnormal(syscall.ENOENT))
+	assert.False(t, isMountAbnormal(nil))
+}
+
+type mountErr struct{ errno syscall.Errno }
+
+func (e *mountErr) Error() string { return "statfs: " + e.errno.Error() }
+func (e *mountErr) Unwrap() error { return e.errno }
+
+func TestMountWatchdogCondition(t *testing.T) {
+	var w *mountWatchdog
+	_, abnormal := w.condition("/target")
+	assert.False(t, abnormal, "disabled watchdog reports no condition")
+
+	w = newMountWatchdog(nil, nil, time.Minute)
+	w.track("/target", &publishedVolume{})
+	assert.True(t, w.setCondition("/target", errors.New("stale")))
+	assert.False(t, w.setCondition("/target", errors.New("stale")), "condition turns abnormal only once")
+	message, abnormal := w.condition("/target")
+	assert.True(t, abnormal)
+	assert.Contains(t, message, "stale")
+	w.setCondition("/target", nil)
+	_, abnormal = w.condition("/target")
+	assert.False(t, abnormal)
+
+	w.setCondition("/target", errors.New("stale"))
+	w.untrack("/target")
+	_, abnormal = w.condition("/target")
+	assert.False(t, abnormal, "condition is forgotten once the volume is unpublished")
+}
+
+func TestFindUnderlyingMounts(t *testing.T) {
+	baseDir := "/run/weka-fs-mounts-node"
+	target := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount"
+	mounts := []mount.MountInfo{
+		{MountPoint: baseDir + "/fs1-aaa", FsType: "wekafs", Major: 0, Minor: 51},
+		{MountPoint: baseDir + "/fs2-bbb", FsType: "wekafs", Major: 0, Minor: 52},
+		{MountPoint: "/elsewhere", FsType: "wekafs", Major: 0, Minor: 51},
+		{MountPoint: target, FsType: "wekafs", Major: 0, Minor: 51},
+	}
+	assert.Equal(t, []mount.MountInfo{mounts[0]}, findUnderlyingMounts(mounts, target, baseDir))
+	assert.Empty(t, findUnderlyingMounts(mounts, "/not-mounted", baseDir))
+}
+
+func TestIsWatchedFsType(t *testing.T) {
+	for _, fsType := range []string{"wekafs", "nfs", "nfs4", "cifs", "smb3"} {
+		assert.True(t, isWatchedFsType(fsType), fsType)
+	}
+	assert.False(t, isWatchedFsType("ext4"))
+}
+
+func TestDetachStaleMount(t *testing.T) {
+	baseDir := t.TempDir()
+	mountPoint := filepath.Join(baseDir, "fs1-aaa")
+	idx := mountPoint + "^rw"
+	other := filepath.Join(baseDir, "fs2-bbb") + "^rw"
+	target := "/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~csi/pvc-1/mount"
+	var detached []string
+	detach := func(path string) error {
+		detached = append(detached, path)
+		return nil
+	}
+
+	require.NoError(t, os.Mkdir(mountPoint, 0750))
+	require.NoError(t, writeMountRecord(baseDir, mountPoint, &mountRecord{Filesystem: "fs1", RefcountIdx: idx}))
+	mountMap := map[string]int{idx: 2, other: 1}
+	targets := map[string]string{target: idx}
+
+	ok, err := detachStaleMount(context.Background(), mountMap, targets, baseDir, mountPoint, detach)
+	require.NoError(t, err)
+	assert.False(t, ok, "mount referenced by an operation in progress must not be detached")
+	assert.Empty(t, detached)
+	assert.Equal(t, 2, mountMap[idx])
+
+	mountMap[idx] = 1
+	ok, err = detachStaleMount(context.Background(), mountMap, targets, baseDir, mountPoint, detach)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{mountPoint}, detached)
+	assert.Equal(t, map[string]int{other: 1}, mountMap, "refcount of the detached mount is forgotten so it is mounted again on next use")
+	assert.Empty(t, targets)
+	records, err := readMountRecords(baseDir)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	assert.NoDirExists(t, mountPoint)
+
+	ok, err = detachStaleMount(context.Background(), mountMap, targets, baseDir, mountPoint, func(string) error { return syscall.EPERM })
+	assert.ErrorIs(t, err, syscall.EPERM)
+	assert.False(t, ok)
+}
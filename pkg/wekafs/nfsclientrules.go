@@ -0,0 +1,357 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"go.opentelemetry.io/otel"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// nfsClientIpLedgerName is the ConfigMap recording when each node IP address was last seen, so rules of departed
+	// nodes are told apart from manually created ones across restarts of the controller
+	nfsClientIpLedgerName    = "weka-csi-nfs-client-ips"
+	nfsClientIpLedgerDataKey = "lastSeen"
+	// nfsClientIpsAnnotationPattern is the node annotation holding the IP addresses the node registered in NFS client
+	// groups. Those are routed towards the interface group, and differ from the node InternalIP on data networks
+	nfsClientIpsAnnotationPattern = "%s/nfs-client-ips"
+
+	nfsClientRuleStateActive    = "active"
+	nfsClientRuleStateDeparted  = "departed"
+	nfsClientRuleStateStale     = "stale"
+	nfsClientRuleStateProtected = "protected"
+
+	nfsClientRuleReconcileOperationName = "ReconcileNfsClientRules"
+)
+
+var (
+	nfsClientRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "nfs",
+		Name:      "client_rules",
+		Help:      "Number of rules in the NFS client group by state: active for current nodes, departed for nodes gone within grace period, stale for nodes gone longer, protected for rules not created for nodes",
+	}, []string{"state", "cluster"})
+
+	nfsClientRuleDeletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "nfs",
+		Name:      "client_rule_deletions_total",
+		Help:      "Total number of NFS client group rules of departed nodes deleted after grace period, dry_run result denotes deletions that were only reported",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(nfsClientRules, nfsClientRuleDeletionsTotal)
+}
+
+// nodeInternalIps returns the InternalIP addresses of the nodes
+func nodeInternalIps(nodes []v1.Node) map[string]bool {
+	ret := make(map[string]bool)
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == v1.NodeInternalIP && addr.Address != "" {
+				ret[addr.Address] = true
+			}
+		}
+	}
+	return ret
+}
+
+// nodeNfsClientIps returns the IP addresses the nodes registered in NFS client groups, as published by their node plugins
+func nodeNfsClientIps(ctx context.Context, nodes []v1.Node, driverName string) map[string]bool {
+	annotation := fmt.Sprintf(nfsClientIpsAnnotationPattern, driverName)
+	ret := make(map[string]bool)
+	for _, node := range nodes {
+		value, ok := node.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		var ips []string
+		if err := json.Unmarshal([]byte(value), &ips); err != nil {
+			log.Ctx(ctx).Debug().Err(err).Str("node", node.Name).Msg("Ignoring malformed NFS client IPs annotation")
+			continue
+		}
+		for _, ip := range ips {
+			if ip != "" {
+				ret[ip] = true
+			}
+		}
+	}
+	return ret
+}
+
+// nfsClientIpsTracker keeps the IP addresses this node registered in NFS client groups, and publishes them in an
+// annotation of the node for the cleanup of client group rules of departed nodes
+type nfsClientIpsTracker struct {
+	sync.Mutex
+	ips       []string
+	published string
+}
+
+func (t *nfsClientIpsTracker) add(ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if ip != "" && !slices.Contains(t.ips, ip) {
+		t.ips = append(t.ips, ip)
+		slices.Sort(t.ips)
+	}
+}
+
+// publish updates the annotation of this node with the IP addresses it registered, if they changed. Only node
+// plugins publish, as the IP addresses registered by the controller are not those of the node it runs on
+func (t *nfsClientIpsTracker) publish(ctx context.Context, driver *WekaFsDriver) {
+	if driver == nil || driver.manager == nil || driver.nodeID == "" || (driver.csiMode != CsiModeNode && driver.csiMode != CsiModeAll) {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if len(t.ips) == 0 {
+		return
+	}
+	data, err := json.Marshal(t.ips)
+	if err != nil || string(data) == t.published {
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{fmt.Sprintf(nfsClientIpsAnnotationPattern, driver.name): string(data)},
+		},
+	})
+	if err != nil {
+		return
+	}
+	node := &v1.Node{}
+	node.Name = driver.nodeID
+	if err := driver.manager.GetClient().Patch(ctx, node, runtimeclient.RawPatch(types.MergePatchType, patch)); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to publish NFS client IPs of node")
+		return
+	}
+	t.published = string(data)
+}
+
+// classifyNfsClientRule returns the state of a client group rule. Only rules of a single IP address that was seen as
+// InternalIP of a node, or registered by a node, are considered created for nodes, any other rule is protected from deletion
+func classifyNfsClientRule(rule *apiclient.NfsClientGroupRule, nodeIps map[string]bool, lastSeen map[string]time.Time, now time.Time, gracePeriod time.Duration) string {
+	ip := rule.GetHostIp()
+	if ip == "" {
+		return nfsClientRuleStateProtected
+	}
+	if nodeIps[ip] {
+		return nfsClientRuleStateActive
+	}
+	seen, ok := lastSeen[ip]
+	if !ok {
+		return nfsClientRuleStateProtected
+	}
+	if now.Sub(seen) < gracePeriod {
+		return nfsClientRuleStateDeparted
+	}
+	return nfsClientRuleStateStale
+}
+
+// nfsClientRuleReconciler periodically removes the rules added to the NFS client group upon node registration
+// for nodes that have left the cluster longer than the grace period ago, so recycled IP addresses are not granted
+// access to the filesystems. It is added as a leader election runnable to the manager
+type nfsClientRuleReconciler struct {
+	cs          *ControllerServer
+	driverName  string
+	client      runtimeclient.Client
+	reader      runtimeclient.Reader
+	namespace   string
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	ledger      *v1.ConfigMap
+	lastSeen    map[string]time.Time
+}
+
+func newNfsClientRuleReconciler(cs *ControllerServer, driverName string) (*nfsClientRuleReconciler, error) {
+	namespace, err := getOwnNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return &nfsClientRuleReconciler{
+		cs:          cs,
+		driverName:  driverName,
+		client:      cs.manager.GetClient(),
+		reader:      cs.manager.GetAPIReader(),
+		namespace:   namespace,
+		interval:    cs.config.nfsClientRuleCleanupInterval,
+		gracePeriod: cs.config.nfsClientRuleGracePeriod,
+		dryRun:      cs.config.nfsClientRuleCleanupDryRun,
+	}, nil
+}
+
+// Start implements manager.Runnable
+func (r *nfsClientRuleReconciler) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "nfs-client-rule-reconciler").Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Dur("interval", r.interval).Dur("grace_period", r.gracePeriod).Bool("dry_run", r.dryRun).Msg("Starting cleanup of NFS client group rules of departed nodes")
+	for {
+		r.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Stopping cleanup of NFS client group rules of departed nodes")
+			return nil
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *nfsClientRuleReconciler) reconcile(ctx context.Context) {
+	op := nfsClientRuleReconcileOperationName
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	nodes := &v1.NodeList{}
+	if err := r.reader.List(ctx, nodes); err != nil {
+		logger.Error().Err(err).Msg("Failed to list nodes, skipping cleanup of NFS client group rules")
+		return
+	}
+	nodeIps := nodeInternalIps(nodes.Items)
+	if len(nodeIps) == 0 {
+		// never take all rules for departed nodes, e.g. while node objects are not populated yet
+		logger.Warn().Msg("No node InternalIP addresses found, skipping cleanup of NFS client group rules")
+		return
+	}
+	for ip := range nodeNfsClientIps(ctx, nodes.Items, r.driverName) {
+		nodeIps[ip] = true
+	}
+	if err := r.loadLedger(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to load NFS client IP ledger, skipping cleanup of NFS client group rules")
+		return
+	}
+	now := time.Now().UTC()
+	for ip := range nodeIps {
+		r.lastSeen[ip] = now
+	}
+
+	nfsClientRules.Reset()
+	complete := true
+	remaining := make(map[string]bool)
+	for client := range r.cs.collectApiClients(ctx, r.driverName) {
+		ips, err := r.reconcileClient(ctx, client, nodeIps, now)
+		if err != nil {
+			logger.Error().Err(err).Str("cluster", client.ClusterName).Msg("Failed to clean up NFS client group rules")
+			complete = false
+			continue
+		}
+		for ip := range ips {
+			remaining[ip] = true
+		}
+	}
+	// IP addresses are forgotten only once no cluster has a rule for them anymore
+	if complete {
+		for ip, seen := range r.lastSeen {
+			if !nodeIps[ip] && !remaining[ip] && now.Sub(seen) >= r.gracePeriod {
+				delete(r.lastSeen, ip)
+			}
+		}
+	}
+	if err := r.saveLedger(ctx); err != nil {
+		logger.Error().Err(err).Msg("Failed to save NFS client IP ledger")
+	}
+}
+
+// reconcileClient deletes stale rules of the client group of the cluster, and returns the IP addresses of rules left
+func (r *nfsClientRuleReconciler) reconcileClient(ctx context.Context, client *apiclient.ApiClient, nodeIps map[string]bool, now time.Time) (map[string]bool, error) {
+	name := client.GetNfsClientGroupName(r.cs.config.clientGroupName)
+	found, err := client.GetNfsClientGroupByName(ctx, name)
+	if errors.Is(err, apiclient.ObjectNotFoundError) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cg := &apiclient.NfsClientGroup{}
+	if err := client.GetNfsClientGroupByUid(ctx, found.Uid, cg); err != nil {
+		return nil, err
+	}
+	remaining := make(map[string]bool)
+	for i := range cg.Rules {
+		rule := &cg.Rules[i]
+		state := classifyNfsClientRule(rule, nodeIps, r.lastSeen, now, r.gracePeriod)
+		nfsClientRules.WithLabelValues(state, client.ClusterName).Inc()
+		ip := rule.GetHostIp()
+		if state != nfsClientRuleStateStale || !r.deleteRule(ctx, client, cg, rule) {
+			remaining[ip] = true
+		}
+	}
+	return remaining, nil
+}
+
+// deleteRule deletes a stale rule, returning true if it is gone
+func (r *nfsClientRuleReconciler) deleteRule(ctx context.Context, client *apiclient.ApiClient, cg *apiclient.NfsClientGroup, rule *apiclient.NfsClientGroupRule) bool {
+	logger := log.Ctx(ctx).With().Str("cluster", client.ClusterName).Str("client_group", cg.Name).Str("rule", rule.Rule).Bool("dry_run", r.dryRun).Logger()
+	if r.dryRun {
+		logger.Info().Msg("NFS client group rule of departed node would be deleted, skipping due to dry run")
+		nfsClientRuleDeletionsTotal.WithLabelValues("dry_run").Inc()
+		return false
+	}
+	err := client.DeleteNfsClientGroupRule(ctx, &apiclient.NfsClientGroupRuleDeleteRequest{NfsClientGroupUid: cg.Uid, Uid: rule.Uid})
+	if err != nil && !errors.Is(err, apiclient.ObjectNotFoundError) {
+		logger.Error().Err(err).Msg("Failed to delete NFS client group rule of departed node")
+		nfsClientRuleDeletionsTotal.WithLabelValues("failure").Inc()
+		return false
+	}
+	logger.Info().Msg("Deleted NFS client group rule of departed node")
+	nfsClientRuleDeletionsTotal.WithLabelValues("success").Inc()
+	return true
+}
+
+// loadLedger reads the ledger once, later reconciliations keep it in memory as the reconciler is its only writer
+func (r *nfsClientRuleReconciler) loadLedger(ctx context.Context) error {
+	if r.ledger != nil {
+		return nil
+	}
+	cm := &v1.ConfigMap{}
+	err := r.reader.Get(ctx, types.NamespacedName{Namespace: r.namespace, Name: nfsClientIpLedgerName}, cm)
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace, Name: nfsClientIpLedgerName}}
+	case err != nil:
+		return err
+	}
+	lastSeen := make(map[string]time.Time)
+	if data, ok := cm.Data[nfsClientIpLedgerDataKey]; ok {
+		if err := json.Unmarshal([]byte(data), &lastSeen); err != nil {
+			return err
+		}
+	}
+	r.ledger = cm
+	r.lastSeen = lastSeen
+	return nil
+}
+
+func (r *nfsClientRuleReconciler) saveLedger(ctx context.Context) error {
+	data, err := json.Marshal(r.lastSeen)
+	if err != nil {
+		return err
+	}
+	r.ledger.Data = map[string]string{nfsClientIpLedgerDataKey: string(data)}
+	if r.ledger.ResourceVersion == "" {
+		err = r.client.Create(ctx, r.ledger)
+	} else {
+		err = r.client.Update(ctx, r.ledger)
+	}
+	if err != nil {
+		// reload on next reconciliation, e.g. if the ConfigMap was modified meanwhile
+		r.ledger = nil
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNodeInternalIps(t *testing.T) {
+	nodes := []v1.Node{
+		{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+			{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+			{Type: v1.NodeHostName, Address: "node1"},
+		}}},
+		{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "10.0.0.2"},
+			{Type: v1.NodeInternalIP, Address: "fd00::2"},
+		}}},
+		{},
+	}
+	assert.Equal(t, map[string]bool{"10.0.0.1": true, "10.0.0.2": true, "fd00::2": true}, nodeInternalIps(nodes))
+}
+
+func TestNodeNfsClientIps(t *testing.T) {
+	annotation := fmt.Sprintf(nfsClientIpsAnnotationPattern, "csi.weka.io")
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{annotation: `["192.168.10.1","192.168.20.1"]`}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2", Annotations: map[string]string{annotation: "192.168.10.2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3", Annotations: map[string]string{"other.csi.io/nfs-client-ips": `["192.168.10.3"]`}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node4"}},
+	}
+	assert.Equal(t, map[string]bool{"192.168.10.1": true, "192.168.20.1": true}, nodeNfsClientIps(context.Background(), nodes, "csi.weka.io"),
+		"malformed annotations and annotations of other drivers must be ignored")
+
+	tracker := &nfsClientIpsTracker{}
+	for _, ip := range []string{"192.168.20.1", "", "192.168.10.1", "192.168.20.1"} {
+		tracker.add(ip)
+	}
+	assert.Equal(t, []string{"192.168.10.1", "192.168.20.1"}, tracker.ips)
+	tracker.publish(context.Background(), &WekaFsDriver{nodeID: "node1", csiMode: CsiModeController})
+	assert.Empty(t, tracker.published, "controller must not publish the IP addresses it registered")
+}
+
+func TestClassifyNfsClientRule(t *testing.T) {
+	now := time.Now()
+	grace := time.Hour
+	nodeIps := map[string]bool{"10.0.0.1": true}
+	lastSeen := map[string]time.Time{
+		"10.0.0.1": now,
+		"10.0.0.2": now.Add(-10 * time.Minute),
+		"10.0.0.3": now.Add(-2 * time.Hour),
+	}
+	for rule, expected := range map[string]string{
+		"10.0.0.1/255.255.255.255": nfsClientRuleStateActive,
+		"10.0.0.2/255.255.255.255": nfsClientRuleStateDeparted,
+		"10.0.0.3/255.255.255.255": nfsClientRuleStateStale,
+		// never seen as node IP address, e.g. added manually
+		"10.0.0.4/255.255.255.255": nfsClientRuleStateProtected,
+		"10.0.0.0/255.255.255.0":   nfsClientRuleStateProtected,
+	} {
+		r := &apiclient.NfsClientGroupRule{Type: apiclient.NfsClientGroupRuleTypeIP, Rule: rule}
+		assert.Equal(t, expected, classifyNfsClientRule(r, nodeIps, lastSeen, now, grace), "rule %s", rule)
+	}
+	dns := &apiclient.NfsClientGroupRule{Type: apiclient.NfsClientGroupRuleTypeDNS, Rule: "node3"}
+	assert.Equal(t, nfsClientRuleStateProtected, classifyNfsClientRule(dns, nodeIps, lastSeen, now, grace))
+}
+
+func TestNfsClientIpLedger(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	r := &nfsClientRuleReconciler{client: c, reader: c, namespace: "csi-wekafs"}
+
+	require.NoError(t, r.loadLedger(ctx))
+	assert.Empty(t, r.lastSeen)
+	seen := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	r.lastSeen["10.0.0.1"] = seen
+	require.NoError(t, r.saveLedger(ctx))
+	r.lastSeen["10.0.0.2"] = seen
+	require.NoError(t, r.saveLedger(ctx), "existing ledger must be updated")
+
+	// a restarted controller remembers the nodes seen before
+	restarted := &nfsClientRuleReconciler{client: c, reader: c, namespace: "csi-wekafs"}
+	require.NoError(t, restarted.loadLedger(ctx))
+	assert.Len(t, restarted.lastSeen, 2)
+	assert.True(t, seen.Equal(restarted.lastSeen["10.0.0.1"]))
+}
@@ -0,0 +1,127 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+const (
+	// NfsSquashModeParam is the StorageClass parameter setting the squash mode of the NFS export, one of none, root, all
+	NfsSquashModeParam = "nfsSquashMode"
+	// NfsAnonUidParam and NfsAnonGidParam set the UID and GID squashed users are mapped to
+	NfsAnonUidParam = "nfsAnonUid"
+	NfsAnonGidParam = "nfsAnonGid"
+	// NfsExportInnerPathParam narrows the NFS export of directory-backed volumes to the volume directory
+	NfsExportInnerPathParam = "nfsExportInnerPath"
+)
+
+// nfsExportParams are the NFS export settings requested by StorageClass parameters
+type nfsExportParams struct {
+	squashMode apiclient.NfsPermissionSquashMode
+	anonUid    int
+	anonGid    int
+	innerPath  bool
+	// readOnly is set on NodePublishVolume of volumes with a read-only access mode
+	readOnly bool
+}
+
+func newNfsExportParams() *nfsExportParams {
+	defaults := apiclient.DefaultNfsExportOptions()
+	return &nfsExportParams{squashMode: defaults.SquashMode, anonUid: defaults.AnonUid, anonGid: defaults.AnonGid}
+}
+
+// parseNfsExportParams returns the NFS export settings of the StorageClass parameters, or nil if none is set
+func parseNfsExportParams(params map[string]string) (*nfsExportParams, error) {
+	ret := newNfsExportParams()
+	found := false
+	if val, ok := params[NfsSquashModeParam]; ok {
+		mode, err := apiclient.ParseNfsPermissionSquashMode(val)
+		if err != nil {
+			return nil, err
+		}
+		ret.squashMode = mode
+		found = true
+	}
+	for param, target := range map[string]*int{NfsAnonUidParam: &ret.anonUid, NfsAnonGidParam: &ret.anonGid} {
+		if val, ok := params[param]; ok {
+			id, err := strconv.Atoi(val)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", param, val)
+			}
+			*target = id
+			found = true
+		}
+	}
+	if val, ok := params[NfsExportInnerPathParam]; ok {
+		innerPath, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, must be true or false", NfsExportInnerPathParam, val)
+		}
+		ret.innerPath = innerPath
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+func isReadOnlyAccessMode(capability *csi.VolumeCapability) bool {
+	mode := capability.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
+
+// isNfsExportNarrowed returns true if the volume is mounted over NFS from an export of its own directory,
+// rather than from the filesystem root. Volumes on snapshots are always exported from the filesystem root
+func (v *Volume) isNfsExportNarrowed(ctx context.Context) bool {
+	return v.nfsExport != nil && v.nfsExport.innerPath && v.hasInnerPath() && !v.isOnSnapshot() &&
+		v.server.getMounter().resolveTransport(ctx, v.transport) == dataTransportNfs
+}
+
+// getNfsExportOptions returns the NFS export the volume is mounted from, or nil if no export settings were requested,
+// in which case any existing export of the filesystem root is used
+func (v *Volume) getNfsExportOptions(ctx context.Context) *apiclient.NfsExportOptions {
+	if v.nfsExport == nil {
+		return nil
+	}
+	ret := apiclient.DefaultNfsExportOptions()
+	ret.SquashMode = v.nfsExport.squashMode
+	ret.AnonUid = v.nfsExport.anonUid
+	ret.AnonGid = v.nfsExport.anonGid
+	if v.isNfsExportNarrowed(ctx) {
+		ret.Path = v.GetRelativePath(ctx)
+	}
+	// a read-only export of the filesystem root would also apply to other volumes of the filesystem and to the controller
+	if v.nfsExport.readOnly && v.isNfsExportNarrowed(ctx) {
+		ret.PermissionType = apiclient.NfsPermissionTypeReadOnly
+	}
+	return ret
+}
+
+// deleteNfsPermission removes the NFS permission of the directory of a directory-backed volume, which is created on
+// publish with nfsExportInnerPath. StorageClass parameters are not known on volume deletion, so the permission is looked
+// up by path. Organizations that may not manage NFS permissions never have one created
+func (v *Volume) deleteNfsPermission(ctx context.Context) error {
+	if !v.requiresGc() || v.apiClient == nil || v.apiClient.ValidateNfsForOrganization() != nil {
+		return nil
+	}
+	return v.apiClient.EnsureNoNfsPermissionForPath(ctx, v.FilesystemName, v.server.getConfig().clientGroupName, v.GetRelativePath(ctx))
+}
+
+type nfsExportCtxKey struct{}
+
+// withNfsExport passes the NFS export of a volume down to the NFS mounter
+func withNfsExport(ctx context.Context, opts *apiclient.NfsExportOptions) context.Context {
+	return context.WithValue(ctx, nfsExportCtxKey{}, opts)
+}
+
+func nfsExportFromContext(ctx context.Context) *apiclient.NfsExportOptions {
+	if opts, ok := ctx.Value(nfsExportCtxKey{}).(*apiclient.NfsExportOptions); ok {
+		return opts
+	}
+	return nil
+}
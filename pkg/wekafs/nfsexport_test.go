@@ -0,0 +1,72 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+func TestParseNfsExportParams(t *testing.T) {
+	export, err := parseNfsExportParams(map[string]string{"volumeType": "dir/v1"})
+	assert.NoError(t, err)
+	assert.Nil(t, export, "no export settings must be returned when none is set")
+
+	export, err = parseNfsExportParams(map[string]string{NfsSquashModeParam: "all", NfsAnonUidParam: "1000", NfsExportInnerPathParam: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, apiclient.NfsPermissionSquashModeAll, export.squashMode)
+	assert.Equal(t, 1000, export.anonUid)
+	assert.Equal(t, 65534, export.anonGid)
+	assert.True(t, export.innerPath)
+	assert.False(t, export.readOnly)
+
+	for _, params := range []map[string]string{
+		{NfsSquashModeParam: "everyone"},
+		{NfsAnonUidParam: "-1"},
+		{NfsAnonGidParam: "nobody"},
+		{NfsExportInnerPathParam: "maybe"},
+	} {
+		_, err = parseNfsExportParams(params)
+		assert.Error(t, err, "%v must be rejected", params)
+	}
+}
+
+func TestIsReadOnlyAccessMode(t *testing.T) {
+	capability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+	}
+	assert.True(t, isReadOnlyAccessMode(capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)))
+	assert.True(t, isReadOnlyAccessMode(capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)))
+	assert.False(t, isReadOnlyAccessMode(capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)))
+	assert.False(t, isReadOnlyAccessMode(nil))
+}
+
+func TestNfsMountExport(t *testing.T) {
+	mounter := &nfsMounter{mountBaseDir: "/run/weka-fs-mounts", mountMap: make(nfsMountsMap)}
+	ctx := context.Background()
+	assert.Nil(t, nfsExportFromContext(ctx))
+
+	root := mounter.NewMount("fs1", getDefaultMountOptions()).(*nfsMount)
+	root.mountIpAddress = "10.0.0.1"
+	root.setExport(nfsExportFromContext(withNfsExport(ctx, apiclient.DefaultNfsExportOptions())))
+	assert.Equal(t, "10.0.0.1:/fs1", root.getMountTarget())
+
+	narrowed := mounter.NewMount("fs1", getDefaultMountOptions()).(*nfsMount)
+	narrowed.mountIpAddress = "10.0.0.1"
+	export := apiclient.DefaultNfsExportOptions()
+	export.Path = "/csi-volumes/pvc-1"
+	narrowed.setExport(export)
+	assert.Equal(t, "10.0.0.1:/fs1/csi-volumes/pvc-1", narrowed.getMountTarget())
+	assert.NotEqual(t, root.getMountPoint(), narrowed.getMountPoint(), "narrowed export must be mounted separately")
+
+	squashed := mounter.NewMount("fs1", getDefaultMountOptions()).(*nfsMount)
+	squashed.mountIpAddress = "10.0.0.1"
+	export = apiclient.DefaultNfsExportOptions()
+	export.SquashMode = apiclient.NfsPermissionSquashModeAll
+	squashed.setExport(export)
+	assert.Equal(t, "10.0.0.1:/fs1", squashed.getMountTarget())
+	assert.NotEqual(t, root.getMountPoint(), squashed.getMountPoint(), "exports with different options must be mounted separately")
+	assert.NotEqual(t, root.getRefcountIdx(), squashed.getRefcountIdx(), "exports with different options must not share a refcount")
+}
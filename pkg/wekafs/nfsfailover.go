@@ -0,0 +1,180 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"k8s.io/mount-utils"
+)
+
+const (
+	nfsPort    = 2049
+	nfsProgram = 100003
+	nfsVersion = 4
+
+	nfsTargetPingTimeout = 5 * time.Second
+	// nfsTargetUnhealthyPeriod is how long an unreachable NFS target IP address is not selected for new mounts,
+	// unless it responds to a ping in the meantime
+	nfsTargetUnhealthyPeriod = 5 * time.Minute
+)
+
+var ErrNfsTargetUnreachable = errors.New("NFS target is unreachable")
+
+var nfsTargetUnreachableTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "nfs",
+	Name:      "target_unreachable_total",
+	Help:      "Number of times an NFS target IP address was found unreachable and failed over from",
+}, []string{"ip"})
+
+func init() {
+	prometheus.MustRegister(nfsTargetUnreachableTotal)
+}
+
+// nfsNullPing calls the NULL procedure of the NFS program over TCP, which the NFS server answers without touching
+// any filesystem, so it tells an unresponsive server apart from a slow filesystem
+func nfsNullPing(ip string, timeout time.Duration) error {
+	return rpcNullPing(net.JoinHostPort(ip, fmt.Sprint(nfsPort)), timeout)
+}
+
+func rpcNullPing(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	xid := rand.Uint32()
+	// record marking header of a single last fragment, followed by call header with AUTH_NONE credentials and verifier
+	call := []uint32{0x80000000 | 40, xid, 0, 2, nfsProgram, nfsVersion, 0, 0, 0, 0, 0}
+	if err := binary.Write(conn, binary.BigEndian, call); err != nil {
+		return err
+	}
+	// record marking header, xid, message type, reply status, verifier flavor and length
+	reply := make([]uint32, 6)
+	if err := binary.Read(conn, binary.BigEndian, reply); err != nil {
+		return err
+	}
+	if reply[1] != xid || reply[2] != 1 {
+		return errors.New("unexpected NFS NULL reply")
+	}
+	if reply[3] != 0 {
+		return fmt.Errorf("NFS NULL call denied with status %d", reply[3])
+	}
+	verifierLen := (reply[5] + 3) &^ 3
+	if _, err := io.CopyN(io.Discard, conn, int64(verifierLen)); err != nil {
+		return err
+	}
+	var acceptStatus uint32
+	if err := binary.Read(conn, binary.BigEndian, &acceptStatus); err != nil {
+		return err
+	}
+	if acceptStatus != 0 {
+		return fmt.Errorf("NFS NULL call failed with status %d", acceptStatus)
+	}
+	return nil
+}
+
+// nfsTargetHealth keeps track of NFS target IP addresses found unreachable, so they are excluded from selection
+// for new mounts and mounts against them are failed over to other IP addresses of the interface group
+type nfsTargetHealth struct {
+	lock      sync.Mutex
+	unhealthy map[string]time.Time
+	ping      func(ip string, timeout time.Duration) error
+}
+
+func newNfsTargetHealth() *nfsTargetHealth {
+	return &nfsTargetHealth{unhealthy: make(map[string]time.Time), ping: nfsNullPing}
+}
+
+func (h *nfsTargetHealth) markUnhealthy(ip string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.unhealthy[ip] = time.Now()
+}
+
+// unhealthyIps returns the IP addresses found unreachable within the unhealthy period
+func (h *nfsTargetHealth) unhealthyIps() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var ret []string
+	for ip, since := range h.unhealthy {
+		if time.Since(since) > nfsTargetUnhealthyPeriod {
+			delete(h.unhealthy, ip)
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// check pings the IP address and records whether it is reachable
+func (h *nfsTargetHealth) check(ctx context.Context, ip string, timeout time.Duration) error {
+	err := h.ping(ip, timeout)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		delete(h.unhealthy, ip)
+		return nil
+	}
+	if _, ok := h.unhealthy[ip]; !ok {
+		nfsTargetUnreachableTotal.WithLabelValues(ip).Inc()
+		log.Ctx(ctx).Warn().Err(err).Str("mount_ip_address", ip).Msg("NFS target IP address is unreachable, excluding it from selection")
+	}
+	h.unhealthy[ip] = time.Now()
+	return err
+}
+
+// nfsMountIp returns the target IP address of an NFS mount, which has a source in form of ip:/path
+func nfsMountIp(m mount.MountInfo) string {
+	if !strings.HasPrefix(m.FsType, "nfs") {
+		return ""
+	}
+	ip, _, ok := strings.Cut(m.Source, ":/")
+	if !ok {
+		return ""
+	}
+	return strings.Trim(ip, "[]")
+}
+
+// checkNfsTargets pings the target IP addresses of the NFS mounts in the mount base directory and of the publish
+// targets bind mounted from them, and returns the mount points of those whose target is unreachable, which must be
+// failed over to another IP address. Filesystem mounts only exist while an operation is in progress, so in steady
+// state the target IP addresses are known from the sources of the publish targets alone
+func (h *nfsTargetHealth) checkNfsTargets(ctx context.Context, mounts []mount.MountInfo, mountBaseDir string, timeout time.Duration) map[string]error {
+	byIp := make(map[string][]string)
+	for _, m := range mounts {
+		if ip := nfsMountIp(m); ip != "" && (isNfsBaseMount(m, mountBaseDir) || isMountRecoveryTarget(m.MountPoint)) {
+			byIp[ip] = append(byIp[ip], m.MountPoint)
+		}
+	}
+	ret := make(map[string]error)
+	for ip, mountPoints := range byIp {
+		err := h.check(ctx, ip, timeout)
+		if err == nil {
+			continue
+		}
+		for _, mountPoint := range mountPoints {
+			ret[mountPoint] = fmt.Errorf("%w: %s: %s", ErrNfsTargetUnreachable, ip, err)
+		}
+	}
+	return ret
+}
+
+func isNfsBaseMount(m mount.MountInfo, mountBaseDir string) bool {
+	return strings.HasPrefix(m.FsType, "nfs") && filepath.Dir(m.MountPoint) == mountBaseDir
+}
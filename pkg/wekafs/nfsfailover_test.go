@@ -0,0 +1,106 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+)
+
+// serveRpcNull answers a single RPC call on the listener with the given accept status
+func serveRpcNull(t *testing.T, listener net.Listener, acceptStatus uint32) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	call := make([]uint32, 11)
+	if err := binary.Read(conn, binary.BigEndian, call); err != nil {
+		t.Errorf("failed to read RPC call: %v", err)
+		return
+	}
+	assert.Equal(t, []uint32{2, nfsProgram, nfsVersion, 0}, call[3:7])
+	_ = binary.Write(conn, binary.BigEndian, []uint32{0x80000000 | 24, call[1], 1, 0, 0, 0, acceptStatus})
+}
+
+func TestRpcNullPing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	go serveRpcNull(t, listener, 0)
+	assert.NoError(t, rpcNullPing(listener.Addr().String(), time.Second))
+
+	go serveRpcNull(t, listener, 1)
+	assert.Error(t, rpcNullPing(listener.Addr().String(), time.Second), "unavailable program must fail the ping")
+
+	// a server which accepts connections but never replies
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+			time.Sleep(time.Second)
+		}
+	}()
+	assert.Error(t, rpcNullPing(listener.Addr().String(), 50*time.Millisecond))
+}
+
+func TestNfsTargetHealth(t *testing.T) {
+	h := newNfsTargetHealth()
+	down := map[string]bool{"10.0.0.1": true}
+	h.ping = func(ip string, timeout time.Duration) error {
+		if down[ip] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	baseDir := "/run/weka-fs-mounts"
+	mounts := []mount.MountInfo{
+		{MountPoint: baseDir + "/fs1-aaa-10.0.0.1", FsType: "nfs4", Source: "10.0.0.1:/fs1"},
+		{MountPoint: baseDir + "/fs2-bbb-10.0.0.1", FsType: "nfs4", Source: "10.0.0.1:/fs2"},
+		{MountPoint: baseDir + "/fs1-ccc-10.0.0.2", FsType: "nfs4", Source: "10.0.0.2:/fs1"},
+		{MountPoint: "/mnt/other", FsType: "nfs4", Source: "10.0.0.3:/fs1"},
+	}
+	unreachable := h.checkNfsTargets(context.Background(), mounts, baseDir, time.Second)
+	assert.Len(t, unreachable, 2)
+	assert.ErrorIs(t, unreachable[baseDir+"/fs1-aaa-10.0.0.1"], ErrNfsTargetUnreachable)
+	assert.True(t, isMountAbnormal(unreachable[baseDir+"/fs2-bbb-10.0.0.1"]))
+	assert.Equal(t, []string{"10.0.0.1"}, h.unhealthyIps())
+
+	delete(down, "10.0.0.1")
+	assert.NoError(t, h.check(context.Background(), "10.0.0.1", time.Second))
+	assert.Empty(t, h.unhealthyIps(), "IP address responding again must be selectable")
+
+	h.markUnhealthy("10.0.0.2")
+	h.unhealthy["10.0.0.2"] = time.Now().Add(-nfsTargetUnhealthyPeriod - time.Second)
+	assert.Empty(t, h.unhealthyIps(), "IP address must be selectable again after unhealthy period")
+}
+
+func TestNfsTargetHealthOfPublishTargets(t *testing.T) {
+	h := newNfsTargetHealth()
+	h.ping = func(ip string, timeout time.Duration) error {
+		if ip == "10.0.0.1" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	// steady state after publish: the filesystem mount is released, only the publish targets are left
+	target1 := "/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~csi/pvc-1/mount"
+	target2 := "/var/lib/kubelet/pods/pod-b/volumes/kubernetes.io~csi/pvc-2/mount"
+	mounts := []mount.MountInfo{
+		{MountPoint: target1, FsType: "nfs4", Source: "10.0.0.1:/fs1", Root: "/csi-volumes/pvc-1"},
+		{MountPoint: target2, FsType: "nfs4", Source: "10.0.0.2:/fs1", Root: "/csi-volumes/pvc-2"},
+	}
+	unreachable := h.checkNfsTargets(context.Background(), mounts, "/run/weka-fs-mounts", time.Second)
+	assert.Len(t, unreachable, 1)
+	assert.ErrorIs(t, unreachable[target1], ErrNfsTargetUnreachable)
+	assert.Equal(t, []string{"10.0.0.1"}, h.unhealthyIps())
+}
@@ -0,0 +1,187 @@
+package wekafs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/mount-utils"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// NfsIpSelectionParam is the StorageClass parameter which overrides the NFS target IP selection strategy of the secret
+	NfsIpSelectionParam = "nfsIpSelection"
+	// nfsTargetIpsAnnotationPattern is the node annotation holding the number of NFS mounts of the node per target IP,
+	// so nodes selecting by least mounts take the mounts of the whole cluster into account
+	nfsTargetIpsAnnotationPattern = "%s/nfs-target-ips"
+	nfsClusterMountsCacheTtl      = 30 * time.Second
+)
+
+var nfsTargetIpSelectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "nfs",
+	Name:      "target_ip_selections_total",
+	Help:      "Total number of NFS target IP addresses selected for mounts, by selection strategy",
+}, []string{"strategy", "ip"})
+
+func init() {
+	prometheus.MustRegister(nfsTargetIpSelectionsTotal)
+}
+
+type nfsIpSelectionCtxKey struct{}
+
+// withNfsIpSelection passes the NFS target IP selection strategy of a volume down to the NFS mounter
+func withNfsIpSelection(ctx context.Context, strategy apiclient.NfsIpSelectionStrategy) context.Context {
+	if strategy == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, nfsIpSelectionCtxKey{}, strategy)
+}
+
+func nfsIpSelectionFromContext(ctx context.Context) apiclient.NfsIpSelectionStrategy {
+	if strategy, ok := ctx.Value(nfsIpSelectionCtxKey{}).(apiclient.NfsIpSelectionStrategy); ok {
+		return strategy
+	}
+	return ""
+}
+
+// countNfsMountsByIp returns the number of NFS mounts per target IP address, where mount source is in form of ip:/path.
+// Bind mounts of publish targets share the device of the mount they were made from and are not counted
+func countNfsMountsByIp(mounts []mount.MountInfo) map[string]int {
+	ret := make(map[string]int)
+	devices := make(map[string]bool)
+	for _, m := range mounts {
+		device := fmt.Sprintf("%d:%d", m.Major, m.Minor)
+		if !strings.HasPrefix(m.FsType, "nfs") || devices[device] {
+			continue
+		}
+		devices[device] = true
+		if ip := nfsMountIp(m); ip != "" {
+			ret[ip]++
+		}
+	}
+	return ret
+}
+
+// nfsTargetIpsTracker keeps track of the NFS mounts per target IP address of this node and of the cluster
+type nfsTargetIpsTracker struct {
+	sync.Mutex
+	cluster        map[string]int
+	clusterUpdated time.Time
+	published      string
+}
+
+func (t *nfsTargetIpsTracker) localMounts(ctx context.Context) map[string]int {
+	mounts, err := mount.ParseMountInfo(ProcMountInfoPath)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to parse mount info, NFS mounts of the node will not be counted")
+		return make(map[string]int)
+	}
+	return countNfsMountsByIp(mounts)
+}
+
+// clusterMounts returns the NFS mounts per target IP address published by other nodes, refreshed once per cache TTL
+func (t *nfsTargetIpsTracker) clusterMounts(ctx context.Context, driver *WekaFsDriver) map[string]int {
+	t.Lock()
+	defer t.Unlock()
+	if t.cluster != nil && time.Since(t.clusterUpdated) < nfsClusterMountsCacheTtl {
+		return t.cluster
+	}
+	nodes := &v1.NodeList{}
+	if err := driver.manager.GetAPIReader().List(ctx, nodes); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to list nodes, NFS mounts of the cluster will not be counted")
+		return t.cluster
+	}
+	annotation := fmt.Sprintf(nfsTargetIpsAnnotationPattern, driver.name)
+	cluster := make(map[string]int)
+	for _, node := range nodes.Items {
+		value, ok := node.Annotations[annotation]
+		if !ok || node.Name == driver.nodeID {
+			continue
+		}
+		counts := make(map[string]int)
+		if err := json.Unmarshal([]byte(value), &counts); err != nil {
+			log.Ctx(ctx).Debug().Err(err).Str("node", node.Name).Msg("Ignoring malformed NFS target IPs annotation")
+			continue
+		}
+		for ip, count := range counts {
+			cluster[ip] += count
+		}
+	}
+	t.cluster = cluster
+	t.clusterUpdated = time.Now()
+	return cluster
+}
+
+// mounts returns the number of known NFS mounts per target IP address, of this node and of the cluster if available
+func (t *nfsTargetIpsTracker) mounts(ctx context.Context, driver *WekaFsDriver) map[string]int {
+	ret := t.localMounts(ctx)
+	if driver == nil || driver.manager == nil {
+		return ret
+	}
+	for ip, count := range t.clusterMounts(ctx, driver) {
+		ret[ip] += count
+	}
+	return ret
+}
+
+// publish updates the annotation of this node with its NFS mounts per target IP address, if they changed
+func (t *nfsTargetIpsTracker) publish(ctx context.Context, driver *WekaFsDriver) {
+	if driver == nil || driver.manager == nil || driver.nodeID == "" {
+		return
+	}
+	data, err := json.Marshal(t.localMounts(ctx))
+	if err != nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if string(data) == t.published {
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{fmt.Sprintf(nfsTargetIpsAnnotationPattern, driver.name): string(data)},
+		},
+	})
+	if err != nil {
+		return
+	}
+	node := &v1.Node{}
+	node.Name = driver.nodeID
+	if err := driver.manager.GetClient().Patch(ctx, node, runtimeclient.RawPatch(types.MergePatchType, patch)); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to publish NFS target IPs of node")
+		return
+	}
+	t.published = string(data)
+}
+
+// nfsIpSelectionHints collects the information about this node the NFS target IP selection strategies rely on.
+// Mounts are only counted for the least mounts strategy, since it requires listing the nodes of the cluster
+func (t *nfsTargetIpsTracker) nfsIpSelectionHints(ctx context.Context, driver *WekaFsDriver, apiClient *apiclient.ApiClient) *apiclient.NfsIpSelectionHints {
+	hints := &apiclient.NfsIpSelectionHints{Strategy: nfsIpSelectionFromContext(ctx)}
+	if driver == nil {
+		return hints
+	}
+	hints.NodeId = driver.nodeID
+	if driver.ns != nil {
+		hints.Zone = driver.ns.zone
+	}
+	strategy := hints.Strategy
+	if strategy == "" {
+		strategy = apiclient.NfsIpSelectionStrategy(apiClient.Credentials.NfsIpSelection)
+	}
+	if strategy == apiclient.NfsIpSelectionLeastMounts {
+		hints.Mounts = t.mounts(ctx, driver)
+	}
+	return hints
+}
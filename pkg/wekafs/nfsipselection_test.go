@@ -0,0 +1,30 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"k8s.io/mount-utils"
+)
+
+func TestCountNfsMountsByIp(t *testing.T) {
+	mounts := []mount.MountInfo{
+		{MountPoint: "/run/weka-fs-mounts/fs1-aaa-10.0.0.1", FsType: "nfs4", Source: "10.0.0.1:/fs1", Minor: 61},
+		{MountPoint: "/run/weka-fs-mounts/fs2-bbb-10.0.0.1", FsType: "nfs4", Source: "10.0.0.1:/fs2", Minor: 62},
+		{MountPoint: "/run/weka-fs-mounts/fs1-ccc-10.0.0.2", FsType: "nfs", Source: "10.0.0.2:/fs1", Minor: 63},
+		{MountPoint: "/mnt/v6", FsType: "nfs4", Source: "[fd00::1]:/fs1", Minor: 64},
+		{MountPoint: "/run/weka-fs-mounts/fs1-ddd-client", FsType: "wekafs", Source: "fs1", Minor: 65},
+		{MountPoint: "/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~csi/pvc-1/mount", FsType: "nfs4", Source: "10.0.0.1:/fs1/csi-volumes/pvc-1", Minor: 61},
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 2, "10.0.0.2": 1, "fd00::1": 1}, countNfsMountsByIp(mounts))
+}
+
+func TestNfsIpSelectionContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Empty(t, nfsIpSelectionFromContext(ctx))
+	assert.Equal(t, ctx, withNfsIpSelection(ctx, ""))
+	ctx = withNfsIpSelection(ctx, apiclient.NfsIpSelectionTopology)
+	assert.Equal(t, apiclient.NfsIpSelectionTopology, nfsIpSelectionFromContext(ctx))
+}
@@ -0,0 +1,158 @@
+package wekafs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+const (
+	NfsSecurityFlavorSys   = "sys"
+	NfsSecurityFlavorKrb5  = "krb5"
+	NfsSecurityFlavorKrb5i = "krb5i"
+	NfsSecurityFlavorKrb5p = "krb5p"
+
+	// hostProcDir is where the procfs of the host is mounted in the node plugin container, used for locating rpc.gssd
+	hostProcDir     = "/host/proc"
+	gssdProcessName = "rpc.gssd"
+)
+
+var (
+	ErrNfsKerberosNotConfigured = errors.New("NFS Kerberos security flavor requested but no keytab is configured")
+	ErrNfsKerberosNotReady      = errors.New("node is not ready for NFS mounts with Kerberos security flavors")
+)
+
+func isValidNfsSecurityFlavor(flavor string) bool {
+	return flavor == NfsSecurityFlavorSys || isNfsKerberosFlavor(flavor)
+}
+
+func isNfsKerberosFlavor(flavor string) bool {
+	switch flavor {
+	case NfsSecurityFlavorKrb5, NfsSecurityFlavorKrb5i, NfsSecurityFlavorKrb5p:
+		return true
+	}
+	return false
+}
+
+// nfsAuthTypesForFlavor returns the authentication types the NFS permission must enable for the security flavor
+func nfsAuthTypesForFlavor(flavor string) []apiclient.NfsAuthType {
+	if isNfsKerberosFlavor(flavor) {
+		return []apiclient.NfsAuthType{apiclient.NfsAuthTypeKerberos5}
+	}
+	return nil
+}
+
+func (dc *DriverConfig) nfsKerberosEnabled() bool {
+	return dc != nil && dc.nfsKerberosKeytab != ""
+}
+
+// applyNfsSecurity validates the security flavor of the NFS mount options against the plugin configuration.
+// The controller only performs metadata operations on volumes and is not provided a keytab, so it mounts using sec=sys
+func (m *nfsMounter) applyNfsSecurity(opts MountOptions) (MountOptions, error) {
+	flavor := opts.getOptionValue(MountOptionNfsSec)
+	if !isNfsKerberosFlavor(flavor) || m.config.nfsKerberosEnabled() {
+		return opts, nil
+	}
+	if m.csiMode == CsiModeController {
+		return opts.RemoveOption(MountOptionNfsSec), nil
+	}
+	return opts, fmt.Errorf("%w: sec=%s", ErrNfsKerberosNotConfigured, flavor)
+}
+
+// installNfsKerberosKeytab copies the node keytab, which is mounted from a secret, to the dedicated keytab rpc.gssd is
+// configured to use for NFS, so the default keytab of the host and its other Kerberos consumers are left intact.
+// The keytab is overwritten in place since it is bind-mounted into the container as a single file, which the kubelet
+// creates world-readable if missing
+func installNfsKerberosKeytab(src, dst string) (changed bool, err error) {
+	keytab, err := os.ReadFile(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to read keytab: %w", err)
+	}
+	if len(keytab) == 0 {
+		return false, fmt.Errorf("keytab %s is empty", src)
+	}
+	if dst == "" || dst == src {
+		return false, nil
+	}
+	if err := os.Chmod(dst, 0600); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to restrict permissions of keytab %s: %w", dst, err)
+	}
+	if current, err := os.ReadFile(dst); err == nil && bytes.Equal(current, keytab) {
+		return false, nil
+	}
+	if err := os.WriteFile(dst, keytab, 0600); err != nil {
+		return false, fmt.Errorf("failed to install keytab to %s: %w", dst, err)
+	}
+	return true, nil
+}
+
+// isProcessRunning returns true if a process with the given name is found in procfs
+func isProcessRunning(procDir, name string) bool {
+	comms, err := filepath.Glob(filepath.Join(procDir, "[0-9]*", "comm"))
+	if err != nil {
+		return false
+	}
+	for _, comm := range comms {
+		if data, err := os.ReadFile(comm); err == nil && strings.TrimSpace(string(data)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// servesNfsKerberos returns true if the node plugin may mount volumes over NFS with Kerberos security flavors
+func (driver *WekaFsDriver) servesNfsKerberos() bool {
+	config := driver.config
+	return config.nfsKerberosEnabled() && !config.isInDevMode() &&
+		(config.useNfs || config.allowNfsFailback || config.allowPerVolumeTransport) &&
+		(driver.csiMode == CsiModeNode || driver.csiMode == CsiModeAll)
+}
+
+// nfsKerberosInstalledKeytab returns the keytab rpc.gssd uses for NFS, where the node keytab is installed to
+func (dc *DriverConfig) nfsKerberosInstalledKeytab() string {
+	if dc.nfsKerberosHostKeytab != "" {
+		return dc.nfsKerberosHostKeytab
+	}
+	return dc.nfsKerberosKeytab
+}
+
+// setupNfsKerberos installs the node keytab on the host upon node plugin startup, before any volume is published
+func setupNfsKerberos(ctx context.Context, config *DriverConfig) error {
+	changed, err := installNfsKerberosKeytab(config.nfsKerberosKeytab, config.nfsKerberosHostKeytab)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Ctx(ctx).Info().Str("keytab", config.nfsKerberosHostKeytab).Msg("Installed NFS Kerberos keytab on host")
+	}
+	return nil
+}
+
+// checkNfsKerberos makes sure the node keytab is installed and rpc.gssd runs on the host,
+// which the kernel NFS client requires for establishing Kerberos security contexts
+func checkNfsKerberos(config *DriverConfig) error {
+	if !config.nfsKerberosEnabled() {
+		return nil
+	}
+	keytab := config.nfsKerberosInstalledKeytab()
+	if info, err := os.Stat(keytab); err != nil {
+		return fmt.Errorf("%w: keytab is not installed: %w", ErrNfsKerberosNotReady, err)
+	} else if info.Size() == 0 {
+		return fmt.Errorf("%w: keytab %s is empty", ErrNfsKerberosNotReady, keytab)
+	}
+	procDir := hostProcDir
+	if _, err := os.Stat(procDir); err != nil {
+		procDir = "/proc"
+	}
+	if !isProcessRunning(procDir, gssdProcessName) {
+		return fmt.Errorf("%w: %s is not running on host", ErrNfsKerberosNotReady, gssdProcessName)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package wekafs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+func TestMountOptions_AsNfsSecurityFlavor(t *testing.T) {
+	nfs := NewMountOptionsFromString("writecache,sec=krb5p").AsNfs()
+	assert.Equal(t, NfsSecurityFlavorKrb5p, nfs.getOptionValue(MountOptionNfsSec))
+
+	nfs = NewMountOptionsFromString("sec=none").AsNfs()
+	assert.False(t, nfs.hasOption(MountOptionNfsSec), "unsupported security flavor must be dropped")
+
+	assert.Equal(t, []apiclient.NfsAuthType{apiclient.NfsAuthTypeKerberos5}, nfsAuthTypesForFlavor(NfsSecurityFlavorKrb5i))
+	assert.Nil(t, nfsAuthTypesForFlavor(NfsSecurityFlavorSys))
+}
+
+func TestApplyNfsSecurity(t *testing.T) {
+	opts := NewMountOptionsFromString("hard,sec=krb5")
+	m := &nfsMounter{csiMode: CsiModeNode, config: &DriverConfig{}}
+	_, err := m.applyNfsSecurity(opts)
+	assert.ErrorIs(t, err, ErrNfsKerberosNotConfigured)
+
+	m.config.nfsKerberosKeytab = "/etc/csi-wekafs-krb5/krb5.keytab"
+	ret, err := m.applyNfsSecurity(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, opts.String(), ret.String())
+
+	m = &nfsMounter{csiMode: CsiModeController, config: &DriverConfig{}}
+	ret, err = m.applyNfsSecurity(opts)
+	assert.NoError(t, err)
+	assert.False(t, ret.hasOption(MountOptionNfsSec), "controller must mount using default security flavor")
+
+	ret, err = m.applyNfsSecurity(NewMountOptionsFromString("hard,sec=sys"))
+	assert.NoError(t, err)
+	assert.Equal(t, NfsSecurityFlavorSys, ret.getOptionValue(MountOptionNfsSec))
+}
+
+func TestInstallNfsKerberosKeytab(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "secret.keytab")
+	dst := filepath.Join(dir, "krb5.keytab")
+
+	_, err := installNfsKerberosKeytab(src, dst)
+	assert.Error(t, err, "missing keytab must fail")
+
+	require.NoError(t, os.WriteFile(src, []byte("keytab-v1"), 0600))
+	changed, err := installNfsKerberosKeytab(src, dst)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	installed, _ := os.ReadFile(dst)
+	assert.Equal(t, "keytab-v1", string(installed))
+
+	require.NoError(t, os.Chmod(dst, 0644))
+	changed, err = installNfsKerberosKeytab(src, dst)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	info, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "keytab created by kubelet must not be left world-readable")
+
+	changed, err = installNfsKerberosKeytab(src, dst)
+	assert.NoError(t, err)
+	assert.False(t, changed, "unchanged keytab must not be rewritten")
+
+	require.NoError(t, os.WriteFile(src, []byte("keytab-v2"), 0600))
+	changed, _ = installNfsKerberosKeytab(src, dst)
+	assert.True(t, changed, "rotated keytab must be installed")
+}
+
+func TestIsProcessRunning(t *testing.T) {
+	procDir := t.TempDir()
+	for pid, comm := range map[string]string{"1": "systemd\n", "812": "rpc.gssd\n"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(procDir, pid), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(procDir, pid, "comm"), []byte(comm), 0644))
+	}
+	assert.True(t, isProcessRunning(procDir, gssdProcessName))
+	assert.False(t, isProcessRunning(procDir, "rpc.svcgssd"))
+}
+
+func TestCheckNfsKerberos(t *testing.T) {
+	assert.NoError(t, checkNfsKerberos(&DriverConfig{}), "check must pass when Kerberos is not configured")
+
+	config := &DriverConfig{nfsKerberosKeytab: filepath.Join(t.TempDir(), "krb5.keytab")}
+	assert.ErrorIs(t, checkNfsKerberos(config), ErrNfsKerberosNotReady)
+
+	// the check only inspects the installed keytab, which is installed upon startup
+	dir := t.TempDir()
+	config = &DriverConfig{nfsKerberosKeytab: filepath.Join(dir, "secret.keytab"), nfsKerberosHostKeytab: filepath.Join(dir, "host.keytab")}
+	require.NoError(t, os.WriteFile(config.nfsKerberosKeytab, []byte("keytab"), 0600))
+	assert.ErrorIs(t, checkNfsKerberos(config), ErrNfsKerberosNotReady)
+	assert.NoFileExists(t, config.nfsKerberosHostKeytab, "check must not install the keytab")
+
+	require.NoError(t, setupNfsKerberos(context.Background(), config))
+	assert.FileExists(t, config.nfsKerberosHostKeytab)
+	if !isProcessRunning("/proc", gssdProcessName) {
+		assert.ErrorContains(t, checkNfsKerberos(config), gssdProcessName, "installed keytab passes the check")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"k8s.io/mount-utils"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -24,12 +25,33 @@ type nfsMount struct {
 	mountIpAddress  string
 	clientGroupName string
 	protocolVersion apiclient.NfsVersionString
+	export          *apiclient.NfsExportOptions
 }
 
 func (m *nfsMount) getMountPoint() string {
 	return fmt.Sprintf("%s-%s", m.mountPoint, m.mountIpAddress)
 }
 
+// setExport sets the NFS export the filesystem is mounted from. Each export, i.e. a path inside the filesystem and
+// the options it is exported with, gets a mount point of its own
+func (m *nfsMount) setExport(export *apiclient.NfsExportOptions) {
+	m.export = export
+	if export != nil {
+		m.mountPoint = m.mounter.mountBaseDir + "/" + getAsciiPart(m.fsName, 64) + "-" + getStringSha1AsB32(m.fsName+":"+m.mountOptions.String()+":"+export.String())
+	}
+}
+
+func (m *nfsMount) getMountTarget() string {
+	return m.getMountTargetOf(m.mountIpAddress)
+}
+
+func (m *nfsMount) getMountTargetOf(ip string) string {
+	if m.export == nil || m.export.Path == "/" {
+		return ip + ":/" + m.fsName
+	}
+	return ip + ":/" + m.fsName + m.export.Path
+}
+
 func (m *nfsMount) getRefCount() int {
 	return 0
 }
@@ -51,6 +73,9 @@ func (m *nfsMount) isMounted(ctx context.Context) bool {
 }
 
 func (m *nfsMount) getRefcountIdx() string {
+	if m.export != nil {
+		return m.getMountPoint() + "^" + m.getMountOptions().AsNfs().String() + "^" + m.export.String()
+	}
 	return m.getMountPoint() + "^" + m.getMountOptions().AsNfs().String()
 }
 
@@ -71,6 +96,7 @@ func (m *nfsMount) incRef(ctx context.Context, apiClient *apiclient.ApiClient) e
 		if err := m.doMount(ctx, apiClient, m.getMountOptions()); err != nil {
 			return err
 		}
+		m.recordMount(ctx)
 	}
 	if refCount > 0 && !m.isMounted(ctx) {
 		logger.Warn().Str("mount_point", m.getMountPoint()).Int("refcount", refCount).Msg("Mount not exists although should!")
@@ -121,6 +147,16 @@ func (m *nfsMount) decRef(ctx context.Context) error {
 	return nil
 }
 
+// recordMount writes the refcount index of the NFS mount to the mount base directory for recovery on plugin restart
+func (m *nfsMount) recordMount(ctx context.Context) {
+	if m.isInDevMode() {
+		return
+	}
+	if err := writeMountRecord(m.mounter.mountBaseDir, m.getMountPoint(), &mountRecord{Filesystem: m.fsName, RefcountIdx: m.getRefcountIdx(), Transport: dataTransportNfs}); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("mount_point", m.getMountPoint()).Msg("Failed to write mount record, mount references will not be recovered after restart")
+	}
+}
+
 func (m *nfsMount) locateMountIP() error {
 	if m.mountIpAddress == "" {
 		ipAddr, err := GetMountIpFromActualMountPoint(m.mountPoint)
@@ -135,12 +171,16 @@ func (m *nfsMount) locateMountIP() error {
 func (m *nfsMount) doUnmount(ctx context.Context) error {
 	logger := log.Ctx(ctx).With().Str("mount_point", m.getMountPoint()).Str("filesystem", m.fsName).Logger()
 	logger.Trace().Strs("mount_options", m.getMountOptions().Strings()).Msg("Performing umount via k8s native mounter")
-	err := m.kMounter.Unmount(m.getMountPoint())
+	m.unmountTrunks(ctx)
+	err := unmountWithEscalation(ctx, m.kMounter, m.getMountPoint(), dataTransportNfs, m.mounter.unmountTimeout)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to unmount")
 		return err
 	}
 	logger.Trace().Msg("Unmounted successfully")
+	if err := removeMountRecord(m.mounter.mountBaseDir, m.getMountPoint()); err != nil {
+		logger.Warn().Err(err).Msg("Failed to remove mount record")
+	}
 	if err := os.Remove(m.getMountPoint()); err != nil {
 		logger.Warn().Err(err).Msg("Failed to remove mount point directory, will be cleaned up on next use")
 	} else {
@@ -151,10 +191,36 @@ func (m *nfsMount) doUnmount(ctx context.Context) error {
 
 func (m *nfsMount) ensureMountIpAddress(ctx context.Context, apiClient *apiclient.ApiClient) error {
 	if m.mountIpAddress == "" {
-		ip, err := apiClient.GetNfsMountIp(ctx)
-		if err != nil {
-			return err
+		var driver *WekaFsDriver
+		if m.mounter.config != nil {
+			driver = m.mounter.config.GetDriver()
+		}
+		hints := m.mounter.targetIps.nfsIpSelectionHints(ctx, driver, apiClient)
+		if m.mounter.targetHealth != nil {
+			hints.Excluded = m.mounter.targetHealth.unhealthyIps()
+		}
+		var ip string
+		for {
+			var err error
+			ip, err = apiClient.SelectNfsMountIp(ctx, hints)
+			if err != nil {
+				return err
+			}
+			// when all IP addresses are excluded, the mount is attempted anyway
+			if m.isInDevMode() || m.mounter.targetHealth == nil || slices.Contains(hints.Excluded, ip) {
+				break
+			}
+			if err := m.mounter.targetHealth.check(ctx, ip, nfsTargetPingTimeout); err == nil {
+				break
+			}
+			hints.Excluded = append(hints.Excluded, ip)
 		}
+		strategy := hints.Strategy
+		if strategy == "" {
+			strategy, _ = apiclient.ParseNfsIpSelectionStrategy(apiClient.Credentials.NfsIpSelection)
+		}
+		nfsTargetIpSelectionsTotal.WithLabelValues(string(strategy), ip).Inc()
+		log.Ctx(ctx).Info().Str("filesystem", m.fsName).Str("mount_ip_address", ip).Str("strategy", string(strategy)).Msg("Selected NFS target IP address for mount")
 		m.mountIpAddress = ip
 	}
 	return nil
@@ -168,21 +234,24 @@ func (m *nfsMount) doMount(ctx context.Context, apiClient *apiclient.ApiClient,
 		logger.Trace().Msg("No API client for mount, cannot proceed")
 		return errors.New("no API client for mount, cannot do NFS mount")
 	}
-	// to validate that the organization is root, otherwise cannot mount NFS volumes
-	if apiClient.ApiOrgId != 0 {
-		err := errors.New("cannot mount NFS volumes with non-Root organization")
-		logger.Error().Err(err).Int("organization_id", apiClient.ApiOrgId).Msg("Cannot mount NFS volumes with non-Root organization")
+	// organizations other than Root can mount NFS volumes only if they may manage their NFS client group and permissions
+	if err := apiClient.ValidateNfsForOrganization(); err != nil {
+		logger.Error().Err(err).Int("organization_id", apiClient.ApiOrgId).Msg("Cannot mount NFS volumes with organization")
 		return err
 	}
 
 	if !m.isInDevMode() {
-		err := apiClient.EnsureNfsPermissions(ctx, m.fsName, apiclient.NfsVersionV4, m.clientGroupName)
+		authTypes := nfsAuthTypesForFlavor(mountOptions.getOptionValue(MountOptionNfsSec))
+		err := apiClient.EnsureNfsPermissions(ctx, m.fsName, apiclient.NfsVersionV4, m.clientGroupName, m.export, authTypes)
 		if err != nil {
 			logger.Error().Err(err).Msg("Failed to ensure NFS permissions")
+			if errors.Is(err, apiclient.NfsRootExportConflict) {
+				return err
+			}
 			return errors.New("failed to ensure NFS permissions")
 		}
 
-		mountTarget := m.mountIpAddress + ":/" + m.fsName
+		mountTarget := m.getMountTarget()
 		logger.Trace().
 			Strs("mount_options", m.getMountOptions().Strings()).
 			Str("mount_target", mountTarget).
@@ -199,6 +268,7 @@ func (m *nfsMount) doMount(ctx context.Context, apiClient *apiclient.ApiClient,
 			err = m.kMounter.MountSensitive(mountTarget, m.getMountPoint(), "nfs", mountOptions.Strings(), mountOptionsSensitive)
 			if err == nil {
 				logger.Trace().Msg("Mounted successfully")
+				m.mountTrunks(ctx, apiClient, mountOptions)
 				return nil
 			}
 			if os.IsNotExist(err) || strings.Contains(strings.ToLower(err.Error()), "no such file or directory") {
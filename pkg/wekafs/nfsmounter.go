@@ -6,6 +6,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
 	"k8s.io/mount-utils"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,14 @@ type nfsMounter struct {
 	nfsProtocolVersion    string
 	exclusiveMountOptions []mutuallyExclusiveMountOptionSet
 	mountBaseDir          string
+	recoveredTargets      map[string]string
+	trunkTargets          map[string]map[string]bool // publish targets holding the NFS trunks of each filesystem mount point
+	unmountTimeout        time.Duration
+	config                *DriverConfig
+	targetIps             nfsTargetIpsTracker
+	targetHealth          *nfsTargetHealth
+	csiMode               CsiPluginMode
+	kernelVersion         kernelVersion
 }
 
 func (m *nfsMounter) getGarbageCollector() *innerPathVolGc {
@@ -34,12 +43,16 @@ func newNfsMounter(ctx context.Context, driver *WekaFsDriver) *nfsMounter {
 		log.Debug().Msg("SELinux support is forced")
 		selinuxSupport = &[]bool{true}[0]
 	}
-	mounter := &nfsMounter{mountMap: make(nfsMountsMap), debugPath: driver.debugPath, selinuxSupport: selinuxSupport, exclusiveMountOptions: driver.config.mutuallyExclusiveOptions, mountBaseDir: mountBaseDirForRole(driver.csiMode)}
+	mounter := &nfsMounter{mountMap: make(nfsMountsMap), debugPath: driver.debugPath, selinuxSupport: selinuxSupport, exclusiveMountOptions: driver.config.mutuallyExclusiveOptions, mountBaseDir: mountBaseDirForRole(driver.csiMode), unmountTimeout: driver.config.unmountTimeout, config: driver.config, targetHealth: newNfsTargetHealth(), csiMode: driver.csiMode}
 	mounter.gc = initInnerPathVolumeGc(mounter)
 	mounter.gc.config = driver.config
+	mounter.rebuildMountMap(ctx)
 	mounter.schedulePeriodicMountGc(ctx)
+	mounter.schedulePeriodicTargetIpsPublish(ctx)
 	mounter.clientGroupName = driver.config.clientGroupName
 	mounter.nfsProtocolVersion = driver.config.nfsProtocolVersion
+	mounter.kernelVersion = getKernelVersion(ctx)
+	gcMetrics.setGc(mounter.getTransport(), mounter.gc)
 
 	return mounter
 }
@@ -75,7 +88,14 @@ func (m *nfsMounter) mountWithOptions(ctx context.Context, fsName string, mountO
 	mountOptions.setSelinux(m.getSelinuxStatus(ctx), MountProtocolNfs)
 	mountOptions = mountOptions.AsNfs()
 	mountOptions.Merge(mountOptions, m.exclusiveMountOptions)
+	mountOptions, err := m.applyNfsSecurity(mountOptions)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Cannot mount filesystem")
+		return "", err, NoOpUnmount
+	}
+	mountOptions = m.applyNfsMultipath(ctx, mountOptions, nfsMultipathFromContext(ctx))
 	mountObj := m.NewMount(fsName, mountOptions).(*nfsMount)
+	mountObj.setExport(nfsExportFromContext(ctx))
 
 	if err := mountObj.ensureMountIpAddress(ctx, apiClient); err != nil {
 		return "", err, NoOpUnmount
@@ -103,8 +123,11 @@ func (m *nfsMounter) unmountWithOptions(ctx context.Context, fsName string, opti
 	options.setSelinux(m.getSelinuxStatus(ctx), MountProtocolNfs)
 	options = options.AsNfs()
 	options.Merge(options, m.exclusiveMountOptions)
+	options, _ = m.applyNfsSecurity(options)
+	options = m.applyNfsMultipath(ctx, options, nfsMultipathFromContext(ctx))
 	log.Ctx(ctx).Trace().Strs("mount_options", options.Strings()).Str("filesystem", fsName).Msg("Received an unmount request")
 	mnt := m.NewMount(fsName, options).(*nfsMount)
+	mnt.setExport(nfsExportFromContext(ctx))
 	// since we are not aware of the IP address of the mount, we need to find the mount point by listing the mounts
 	err := mnt.locateMountIP()
 	if err != nil {
@@ -171,6 +194,102 @@ func (m *nfsMounter) schedulePeriodicMountGc(ctx context.Context) {
 	}()
 }
 
+// schedulePeriodicTargetIpsPublish publishes the NFS mounts of the node per target IP address for other nodes
+// selecting NFS target IP addresses by least mounts. IP addresses registered in NFS client groups that failed
+// to be published upon registration are retried along
+func (m *nfsMounter) schedulePeriodicTargetIpsPublish(ctx context.Context) {
+	if m.debugPath != "" || m.config == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(nfsClusterMountsCacheTtl):
+			}
+			driver := m.config.GetDriver()
+			m.targetIps.publish(ctx, driver)
+			if driver != nil && driver.api != nil {
+				driver.api.nfsClientIps.publish(ctx, driver)
+			}
+		}
+	}()
+}
+
+func (m *nfsMounter) getMountBaseDir() string {
+	return m.mountBaseDir
+}
+
 func (m *nfsMounter) getTransport() DataTransport {
 	return dataTransportNfs
 }
+
+// resolveTransport returns NFS regardless of the requested transport, as the node serves only NFS
+//
+//goland:noinspection GoUnusedParameter
+func (m *nfsMounter) resolveTransport(ctx context.Context, requested DataTransport) DataTransport {
+	return m.getTransport()
+}
+
+func (m *nfsMounter) getMountStats() (mounts int, references int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, refCount := range m.mountMap {
+		if refCount > 0 {
+			mounts++
+			references += refCount
+		}
+	}
+	return mounts, references
+}
+
+// rebuildMountMap restores refcounts of NFS mounts made before the plugin was restarted
+func (m *nfsMounter) rebuildMountMap(ctx context.Context) {
+	if m.debugPath != "" {
+		return
+	}
+	if m.kMounter == nil {
+		m.kMounter = mount.New("")
+	}
+	refs, targets := rebuildMountRefs(ctx, m.getTransport(), m.mountBaseDir, m.kMounter, m.unmountTimeout)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for refIndex, refCount := range refs {
+		m.mountMap[refIndex] = refCount
+	}
+	m.recoveredTargets = targets
+	m.rebuildTrunkTargets(ctx)
+}
+
+// rebuildTrunkTargets restores the publish targets holding NFS trunks, and unmounts trunks nothing depends on.
+// Must be called with the mounter lock held
+func (m *nfsMounter) rebuildTrunkTargets(ctx context.Context) {
+	mounts, err := mount.ParseMountInfo(ProcMountInfoPath)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to parse mount info, NFS trunks will not be recovered")
+		return
+	}
+	trunkTargets, orphans := recoverTrunkTargets(m.mountBaseDir, mounts)
+	m.trunkTargets = trunkTargets
+	for _, trunkMountPoint := range orphans {
+		log.Ctx(ctx).Info().Str("trunk_mount_point", trunkMountPoint).Msg("Unmounting leftover NFS trunk no publish target depends on")
+		if err := unmountWithEscalation(ctx, m.kMounter, trunkMountPoint, dataTransportNfs, m.unmountTimeout); err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("trunk_mount_point", trunkMountPoint).Msg("Failed to unmount leftover NFS trunk")
+			continue
+		}
+		_ = os.Remove(trunkMountPoint)
+	}
+}
+
+func (m *nfsMounter) releaseRecoveredTarget(ctx context.Context, targetPath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	releaseRecoveredTarget(ctx, m.mountMap, m.recoveredTargets, m.kMounter, m.getTransport(), m.unmountTimeout, m.mountBaseDir, targetPath)
+}
+
+func (m *nfsMounter) detachStaleMount(ctx context.Context, mountPoint string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return detachStaleMount(ctx, m.mountMap, m.recoveredTargets, m.mountBaseDir, mountPoint, lazyUnmount)
+}
@@ -0,0 +1,379 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// NfsNconnectParam is the StorageClass parameter setting the number of TCP connections of an NFS mount
+	NfsNconnectParam = "nfsNconnect"
+	// NfsTrunkingParam is the StorageClass parameter setting the number of interface group IP addresses
+	// an NFS mount is trunked across, using NFSv4.1 session trunking
+	NfsTrunkingParam = "nfsTrunking"
+
+	MountOptionNfsNconnect   = "nconnect"
+	MountOptionNfsMaxConnect = "max_connect"
+	// nfsMaxConnections is the limit of both nconnect and max_connect in the Linux NFS client
+	nfsMaxConnections = 16
+	// nfsTrunksDir holds the mount points of the additional IP addresses of trunked mounts. Those are kept out of
+	// the mount base directory, so they are never taken for filesystem mounts by recovery or watchdog
+	nfsTrunksDir = ".nfs-trunks"
+
+	kernelReleasePath = "/proc/sys/kernel/osrelease"
+)
+
+var (
+	nfsNconnectMinKernel = kernelVersion{major: 5, minor: 3}
+	nfsTrunkingMinKernel = kernelVersion{major: 5, minor: 18}
+)
+
+// nfsMultipathParams are the NFS multipath settings requested by StorageClass parameters
+type nfsMultipathParams struct {
+	nconnect int
+	trunkIps int
+}
+
+// parseNfsMultipathParams returns the NFS multipath settings of the StorageClass parameters, or nil if none is set
+func parseNfsMultipathParams(params map[string]string) (*nfsMultipathParams, error) {
+	ret := &nfsMultipathParams{}
+	found := false
+	for param, target := range map[string]*int{NfsNconnectParam: &ret.nconnect, NfsTrunkingParam: &ret.trunkIps} {
+		if val, ok := params[param]; ok {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > nfsMaxConnections {
+				return nil, fmt.Errorf("invalid %s %q, must be an integer between 1 and %d", param, val, nfsMaxConnections)
+			}
+			*target = n
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+type nfsMultipathCtxKey struct{}
+
+// withNfsMultipath passes the NFS multipath settings of a volume down to the NFS mounter
+func withNfsMultipath(ctx context.Context, params *nfsMultipathParams) context.Context {
+	if params == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, nfsMultipathCtxKey{}, params)
+}
+
+func nfsMultipathFromContext(ctx context.Context) *nfsMultipathParams {
+	if params, ok := ctx.Value(nfsMultipathCtxKey{}).(*nfsMultipathParams); ok {
+		return params
+	}
+	return nil
+}
+
+type kernelVersion struct {
+	major int
+	minor int
+}
+
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+func (v kernelVersion) atLeast(other kernelVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+// parseKernelVersion parses the major and minor version of a kernel release, e.g. 5.14.0-362.el9.x86_64
+func parseKernelVersion(release string) (kernelVersion, error) {
+	parts := strings.SplitN(strings.TrimSpace(release), ".", 3)
+	if len(parts) < 2 {
+		return kernelVersion{}, fmt.Errorf("invalid kernel release %q", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kernelVersion{}, fmt.Errorf("invalid kernel release %q", release)
+	}
+	// the minor version of releases without patch level may be followed by a suffix, e.g. 6.1rc2
+	minorStr := parts[1]
+	if i := strings.IndexFunc(minorStr, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorStr = minorStr[:i]
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return kernelVersion{}, fmt.Errorf("invalid kernel release %q", release)
+	}
+	return kernelVersion{major: major, minor: minor}, nil
+}
+
+// getKernelVersion returns the version of the node kernel, which is shared with the plugin container.
+// An unknown version supports no optional NFS features
+func getKernelVersion(ctx context.Context) kernelVersion {
+	release, err := os.ReadFile(kernelReleasePath)
+	if err == nil {
+		var ret kernelVersion
+		if ret, err = parseKernelVersion(string(release)); err == nil {
+			return ret
+		}
+	}
+	log.Ctx(ctx).Warn().Err(err).Msg("Failed to determine kernel version, NFS nconnect and trunking will not be used")
+	return kernelVersion{}
+}
+
+// nfsVersionSupportsTrunking returns true for NFS protocol versions with sessions, i.e. 4.1 and later
+func nfsVersionSupportsTrunking(version string) bool {
+	majorStr, minorStr, _ := strings.Cut(version, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return false
+	}
+	minor, _ := strconv.Atoi(minorStr)
+	return major > 4 || (major == 4 && minor >= 1)
+}
+
+// applyNfsMultipath sets the multipath mount options requested by the volume, and drops those the node kernel
+// or the NFS protocol version do not support, so the mount falls back to a single connection rather than failing.
+// Since the options are part of the refcount index, mounts with different multipath settings never share a mount
+func (m *nfsMounter) applyNfsMultipath(ctx context.Context, opts MountOptions, params *nfsMultipathParams) MountOptions {
+	logger := log.Ctx(ctx)
+	if params != nil {
+		if params.nconnect > 1 {
+			opts = opts.AddOption(fmt.Sprintf("%s=%d", MountOptionNfsNconnect, params.nconnect))
+		}
+		if params.trunkIps > 1 {
+			opts = opts.AddOption(fmt.Sprintf("%s=%d", MountOptionNfsMaxConnect, params.trunkIps))
+		}
+	}
+	if m.isInDevMode() {
+		return opts
+	}
+	if opts.hasOption(MountOptionNfsNconnect) && !m.kernelVersion.atLeast(nfsNconnectMinKernel) {
+		logger.Warn().Str("kernel_version", m.kernelVersion.String()).Msg("NFS nconnect is not supported by node kernel, mounting with single connection")
+		opts = opts.RemoveOption(MountOptionNfsNconnect)
+	}
+	if opts.hasOption(MountOptionNfsMaxConnect) {
+		if !m.kernelVersion.atLeast(nfsTrunkingMinKernel) {
+			logger.Warn().Str("kernel_version", m.kernelVersion.String()).Msg("NFS session trunking is not supported by node kernel, mounting from single IP address")
+			opts = opts.RemoveOption(MountOptionNfsMaxConnect)
+		} else if !nfsVersionSupportsTrunking(m.nfsProtocolVersion) {
+			logger.Warn().Str("nfs_version", m.nfsProtocolVersion).Msg("NFS session trunking requires NFSv4.1 or later, mounting from single IP address")
+			opts = opts.RemoveOption(MountOptionNfsMaxConnect)
+		}
+	}
+	return opts
+}
+
+func (m *nfsMounter) isInDevMode() bool {
+	return m.debugPath != ""
+}
+
+// getTrunkCount returns the number of additional IP addresses the mount is trunked across
+func (m *nfsMount) getTrunkCount() int {
+	n, err := strconv.Atoi(m.mountOptions.getOptionValue(MountOptionNfsMaxConnect))
+	if err != nil || n < 2 {
+		return 0
+	}
+	return n - 1
+}
+
+func (m *nfsMount) getTrunkMountPoint(ip string) string {
+	return filepath.Join(m.mounter.mountBaseDir, nfsTrunksDir, filepath.Base(m.getMountPoint())+"-"+ip)
+}
+
+// selectTrunkIps picks the additional IP addresses of a trunked mount. IP addresses are picked consistently per node,
+// skipping the primary and unhealthy IP addresses, and fewer are returned if the interface group has no more of them
+func (m *nfsMount) selectTrunkIps(ctx context.Context, apiClient *apiclient.ApiClient, count int) []string {
+	hints := &apiclient.NfsIpSelectionHints{Strategy: apiclient.NfsIpSelectionConsistentHash, Excluded: []string{m.mountIpAddress}}
+	if m.mounter.config != nil && m.mounter.config.GetDriver() != nil {
+		hints.NodeId = m.mounter.config.GetDriver().nodeID
+	}
+	if m.mounter.targetHealth != nil {
+		hints.Excluded = append(hints.Excluded, m.mounter.targetHealth.unhealthyIps()...)
+	}
+	var ret []string
+	for len(ret) < count {
+		ip, err := apiClient.SelectNfsMountIp(ctx, hints)
+		// once all IP addresses are excluded, an excluded one is returned
+		if err != nil || slices.Contains(hints.Excluded, ip) {
+			break
+		}
+		ret = append(ret, ip)
+		hints.Excluded = append(hints.Excluded, ip)
+	}
+	return ret
+}
+
+// mountTrunks mounts the filesystem from additional IP addresses of the interface group. The kernel detects those
+// belong to the same server and adds them as transports to the session of the primary mount.
+// Failures are not fatal, as the primary mount is usable with fewer transports
+func (m *nfsMount) mountTrunks(ctx context.Context, apiClient *apiclient.ApiClient, mountOptions MountOptions) {
+	count := m.getTrunkCount()
+	if count == 0 {
+		return
+	}
+	logger := log.Ctx(ctx).With().Str("mount_point", m.getMountPoint()).Str("filesystem", m.fsName).Logger()
+	if len(m.mounter.trunkTargets[m.getMountPoint()]) > 0 {
+		logger.Debug().Msg("NFS trunks are still held by publish targets, not adding new ones")
+		return
+	}
+	ips := m.selectTrunkIps(ctx, apiClient, count)
+	if len(ips) < count {
+		logger.Warn().Int("requested", count).Int("available", len(ips)).Msg("Not enough NFS target IP addresses for requested trunking")
+	}
+	for _, ip := range ips {
+		trunkMountPoint := m.getTrunkMountPoint(ip)
+		if err := os.MkdirAll(trunkMountPoint, DefaultVolumePermissions); err != nil {
+			logger.Warn().Err(err).Str("trunk_ip_address", ip).Msg("Failed to create trunk mount point")
+			continue
+		}
+		if err := m.kMounter.Mount(m.getMountTargetOf(ip), trunkMountPoint, "nfs", mountOptions.Strings()); err != nil {
+			logger.Warn().Err(err).Str("trunk_ip_address", ip).Msg("Failed to add NFS trunk")
+			_ = os.Remove(trunkMountPoint)
+			continue
+		}
+		logger.Debug().Str("trunk_ip_address", ip).Msg("Added NFS trunk")
+	}
+}
+
+// unmountTrunks unmounts the trunks of the mount unless publish targets still hold them. Must be called with the
+// mounter lock held
+func (m *nfsMount) unmountTrunks(ctx context.Context) {
+	if len(m.mounter.trunkTargets[m.getMountPoint()]) > 0 {
+		log.Ctx(ctx).Debug().Str("mount_point", m.getMountPoint()).Msg("NFS trunks are held by publish targets, leaving them mounted")
+		return
+	}
+	m.mounter.unmountTrunksOf(ctx, m.getMountPoint())
+}
+
+// unmountTrunksOf unmounts the trunks of a filesystem mount, which are found by their mount points since the mount
+// could have been made by a previous instance of the plugin
+func (m *nfsMounter) unmountTrunksOf(ctx context.Context, mountPoint string) {
+	logger := log.Ctx(ctx).With().Str("mount_point", mountPoint).Logger()
+	trunks, err := filepath.Glob(filepath.Join(m.mountBaseDir, nfsTrunksDir, filepath.Base(mountPoint)+"-*"))
+	if err != nil {
+		return
+	}
+	for _, trunkMountPoint := range trunks {
+		if err := unmountWithEscalation(ctx, m.kMounter, trunkMountPoint, dataTransportNfs, m.unmountTimeout); err != nil {
+			logger.Warn().Err(err).Str("trunk_mount_point", trunkMountPoint).Msg("Failed to unmount NFS trunk")
+			continue
+		}
+		_ = os.Remove(trunkMountPoint)
+	}
+}
+
+// hasTrunks returns true if trunk mount points of the filesystem mount exist
+func (m *nfsMounter) hasTrunks(mountPoint string) bool {
+	trunks, err := filepath.Glob(filepath.Join(m.mountBaseDir, nfsTrunksDir, filepath.Base(mountPoint)+"-*"))
+	return err == nil && len(trunks) > 0
+}
+
+// isMountReferenced returns true if an operation in progress holds a reference to the filesystem mount.
+// Must be called with the mounter lock held
+func (m *nfsMounter) isMountReferenced(mountPoint string) bool {
+	for refIndex, refCount := range m.mountMap {
+		if refCount > 0 && strings.Split(refIndex, "^")[0] == mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// holdPublishTarget keeps the trunks of a filesystem mount for as long as the publish target bind mounted from it
+// exists. NodePublishVolume releases the filesystem mount right after the bind mount, while the additional transports
+// of the NFS session are wanted for the I/O of the pod
+func (m *nfsMounter) holdPublishTarget(ctx context.Context, mountPoint, targetPath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.hasTrunks(mountPoint) {
+		return
+	}
+	if m.trunkTargets == nil {
+		m.trunkTargets = make(map[string]map[string]bool)
+	}
+	if m.trunkTargets[mountPoint] == nil {
+		m.trunkTargets[mountPoint] = make(map[string]bool)
+	}
+	m.trunkTargets[mountPoint][targetPath] = true
+	log.Ctx(ctx).Debug().Str("mount_point", mountPoint).Str("target_path", targetPath).Int("targets", len(m.trunkTargets[mountPoint])).Msg("Publish target holds NFS trunks")
+}
+
+// releasePublishTarget releases the trunks held by the publish target, unmounting them once neither a publish target
+// nor an operation in progress depends on the filesystem mount anymore
+func (m *nfsMounter) releasePublishTarget(ctx context.Context, targetPath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for mountPoint, targets := range m.trunkTargets {
+		if !targets[targetPath] {
+			continue
+		}
+		delete(targets, targetPath)
+		if len(targets) > 0 {
+			continue
+		}
+		delete(m.trunkTargets, mountPoint)
+		if m.isMountReferenced(mountPoint) {
+			continue
+		}
+		log.Ctx(ctx).Debug().Str("mount_point", mountPoint).Str("target_path", targetPath).Msg("Last publish target released, unmounting NFS trunks")
+		m.unmountTrunksOf(ctx, mountPoint)
+	}
+}
+
+// recoverTrunkTargets maps the trunk mounts found on plugin startup to the publish targets sharing their device,
+// i.e. the NFS superblock of the session they were added to. Returns the publish targets holding the trunks of each
+// filesystem mount, and the trunk mount points neither a publish target nor a filesystem mount depends on
+func recoverTrunkTargets(mountBaseDir string, mounts []mount.MountInfo) (map[string]map[string]bool, []string) {
+	trunksDir := filepath.Join(mountBaseDir, nfsTrunksDir)
+	mounted := make(map[string]bool)
+	targets := make(map[string][]string)
+	for _, m := range mounts {
+		if !isTransportFsType(dataTransportNfs, m.FsType) {
+			continue
+		}
+		mounted[m.MountPoint] = true
+		if isMountRecoveryTarget(m.MountPoint) {
+			device := fmt.Sprintf("%d:%d", m.Major, m.Minor)
+			targets[device] = append(targets[device], m.MountPoint)
+		}
+	}
+	ret := make(map[string]map[string]bool)
+	var orphans []string
+	for _, m := range mounts {
+		if filepath.Dir(m.MountPoint) != trunksDir || !isTransportFsType(dataTransportNfs, m.FsType) {
+			continue
+		}
+		// trunk mount points are named by the filesystem mount point and the trunk IP address, which has no "-"
+		name := filepath.Base(m.MountPoint)
+		sep := strings.LastIndex(name, "-")
+		if sep < 0 {
+			continue
+		}
+		mountPoint := filepath.Join(mountBaseDir, name[:sep])
+		holders := targets[fmt.Sprintf("%d:%d", m.Major, m.Minor)]
+		if len(holders) == 0 {
+			if !mounted[mountPoint] && !slices.Contains(orphans, m.MountPoint) {
+				orphans = append(orphans, m.MountPoint)
+			}
+			continue
+		}
+		if ret[mountPoint] == nil {
+			ret[mountPoint] = make(map[string]bool)
+		}
+		for _, target := range holders {
+			ret[mountPoint][target] = true
+		}
+	}
+	sort.Strings(orphans)
+	return ret, orphans
+}
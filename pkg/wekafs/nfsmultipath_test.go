@@ -0,0 +1,211 @@
+package wekafs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+)
+
+func TestParseNfsMultipathParams(t *testing.T) {
+	params, err := parseNfsMultipathParams(map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, params)
+
+	params, err = parseNfsMultipathParams(map[string]string{NfsNconnectParam: "4"})
+	assert.NoError(t, err)
+	assert.Equal(t, &nfsMultipathParams{nconnect: 4}, params)
+
+	params, err = parseNfsMultipathParams(map[string]string{NfsNconnectParam: "2", NfsTrunkingParam: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, &nfsMultipathParams{nconnect: 2, trunkIps: 3}, params)
+
+	for _, val := range []string{"0", "17", "many", ""} {
+		_, err = parseNfsMultipathParams(map[string]string{NfsTrunkingParam: val})
+		assert.Error(t, err, "value %q", val)
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	for release, expected := range map[string]kernelVersion{
+		"5.14.0-362.el9.x86_64\n": {major: 5, minor: 14},
+		"6.8.0-45-generic":        {major: 6, minor: 8},
+		"4.18.0":                  {major: 4, minor: 18},
+		"5.3":                     {major: 5, minor: 3},
+		"6.1rc2":                  {major: 6, minor: 1},
+	} {
+		v, err := parseKernelVersion(release)
+		assert.NoError(t, err, "release %q", release)
+		assert.Equal(t, expected, v, "release %q", release)
+	}
+	for _, release := range []string{"", "5", "linux"} {
+		_, err := parseKernelVersion(release)
+		assert.Error(t, err, "release %q", release)
+	}
+
+	assert.True(t, kernelVersion{major: 5, minor: 18}.atLeast(nfsTrunkingMinKernel))
+	assert.True(t, kernelVersion{major: 6, minor: 0}.atLeast(nfsTrunkingMinKernel))
+	assert.False(t, kernelVersion{major: 5, minor: 14}.atLeast(nfsTrunkingMinKernel))
+	assert.False(t, kernelVersion{}.atLeast(nfsNconnectMinKernel))
+}
+
+func TestNfsVersionSupportsTrunking(t *testing.T) {
+	for version, expected := range map[string]bool{"3": false, "4": false, "4.0": false, "4.1": true, "4.2": true, "": false} {
+		assert.Equal(t, expected, nfsVersionSupportsTrunking(version), "version %q", version)
+	}
+}
+
+func TestApplyNfsMultipath(t *testing.T) {
+	ctx := context.Background()
+	params := &nfsMultipathParams{nconnect: 4, trunkIps: 2}
+
+	m := &nfsMounter{kernelVersion: kernelVersion{major: 6, minor: 1}, nfsProtocolVersion: "4.1"}
+	opts := m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), params)
+	assert.Equal(t, "4", opts.getOptionValue(MountOptionNfsNconnect))
+	assert.Equal(t, "2", opts.getOptionValue(MountOptionNfsMaxConnect))
+
+	// single connection and no multipath parameters leave the options unchanged
+	opts = m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), &nfsMultipathParams{nconnect: 1})
+	assert.Equal(t, getDefaultMountOptions().AsNfs().String(), opts.String())
+	opts = m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), nil)
+	assert.Equal(t, getDefaultMountOptions().AsNfs().String(), opts.String())
+
+	// trunking requires NFSv4.1
+	m.nfsProtocolVersion = "4"
+	opts = m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), params)
+	assert.True(t, opts.hasOption(MountOptionNfsNconnect))
+	assert.False(t, opts.hasOption(MountOptionNfsMaxConnect))
+
+	// kernels older than 5.18 do not trunk, older than 5.3 have no nconnect either
+	m = &nfsMounter{kernelVersion: kernelVersion{major: 5, minor: 14}, nfsProtocolVersion: "4.1"}
+	opts = m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), params)
+	assert.True(t, opts.hasOption(MountOptionNfsNconnect))
+	assert.False(t, opts.hasOption(MountOptionNfsMaxConnect))
+
+	m.kernelVersion = kernelVersion{major: 4, minor: 18}
+	opts = m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), params)
+	assert.False(t, opts.hasOption(MountOptionNfsNconnect))
+	assert.False(t, opts.hasOption(MountOptionNfsMaxConnect))
+
+	// options set explicitly by mountOptions are subject to the same checks
+	opts = m.applyNfsMultipath(ctx, NewMountOptionsFromString("nconnect=8"), nil)
+	assert.False(t, opts.hasOption(MountOptionNfsNconnect))
+}
+
+func TestNfsMultipathMountSeparation(t *testing.T) {
+	m := &nfsMounter{mountBaseDir: "/run/weka-fs-mounts", mountMap: make(nfsMountsMap), nfsProtocolVersion: "4.1", kernelVersion: kernelVersion{major: 6}}
+	ctx := context.Background()
+
+	plain := m.NewMount("fs1", getDefaultMountOptions().AsNfs()).(*nfsMount)
+	multi := m.NewMount("fs1", m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), &nfsMultipathParams{nconnect: 4, trunkIps: 3})).(*nfsMount)
+	plain.mountIpAddress, multi.mountIpAddress = "10.0.0.1", "10.0.0.1"
+	assert.NotEqual(t, plain.getRefcountIdx(), multi.getRefcountIdx(), "mounts with different multipath settings must not be shared")
+	assert.NotEqual(t, plain.getMountPoint(), multi.getMountPoint())
+	assert.Contains(t, multi.getMountOptions().AsNfs().String(), "nconnect=4")
+
+	assert.Equal(t, 0, plain.getTrunkCount())
+	assert.Equal(t, 2, multi.getTrunkCount())
+	trunk := multi.getTrunkMountPoint("10.0.0.2")
+	assert.Equal(t, "/run/weka-fs-mounts/.nfs-trunks", trunk[:len("/run/weka-fs-mounts/.nfs-trunks")])
+	assert.NotEqual(t, trunk, multi.getTrunkMountPoint("10.0.0.3"))
+}
+
+func mountedPaths(fake *mount.FakeMounter) []string {
+	var ret []string
+	for _, mp := range fake.MountPoints {
+		ret = append(ret, mp.Path)
+	}
+	return ret
+}
+
+// TestNfsTrunksSurvivePublishCycle follows NodePublishVolume, which releases the filesystem mount right after
+// bind mounting the publish target: trunks must stay mounted until the last publish target is unpublished
+func TestNfsTrunksSurvivePublishCycle(t *testing.T) {
+	ctx := context.Background()
+	fake := mount.NewFakeMounter(nil)
+	m := &nfsMounter{mountBaseDir: t.TempDir(), mountMap: make(nfsMountsMap), kMounter: fake, unmountTimeout: time.Second, nfsProtocolVersion: "4.1", kernelVersion: kernelVersion{major: 6}}
+	mnt := m.NewMount("fs1", m.applyNfsMultipath(ctx, getDefaultMountOptions().AsNfs(), &nfsMultipathParams{trunkIps: 3})).(*nfsMount)
+	mnt.mountIpAddress = "10.0.0.1"
+	trunks := []string{mnt.getTrunkMountPoint("10.0.0.2"), mnt.getTrunkMountPoint("10.0.0.3")}
+	targetA := "/var/lib/kubelet/pods/pod-a/volumes/kubernetes.io~csi/pvc-1/mount"
+	targetB := "/var/lib/kubelet/pods/pod-b/volumes/kubernetes.io~csi/pvc-1/mount"
+
+	publish := func(target string) {
+		m.mountMap[mnt.getRefcountIdx()] = 1
+		require.NoError(t, fake.Mount(mnt.getMountTarget(), mnt.getMountPoint(), "nfs", nil))
+		// trunks are mounted along with the filesystem, unless publish targets hold them already
+		if len(m.trunkTargets[mnt.getMountPoint()]) > 0 {
+			mnt.mountTrunks(ctx, nil, mnt.getMountOptions())
+		} else {
+			for i, trunk := range trunks {
+				require.NoError(t, os.MkdirAll(trunk, DefaultVolumePermissions))
+				require.NoError(t, fake.Mount(mnt.getMountTargetOf([]string{"10.0.0.2", "10.0.0.3"}[i]), trunk, "nfs", nil))
+			}
+		}
+		m.holdPublishTarget(ctx, mnt.getMountPoint(), target)
+		require.NoError(t, mnt.doUnmount(ctx))
+		m.mountMap[mnt.getRefcountIdx()] = 0
+	}
+
+	publish(targetA)
+	assert.ElementsMatch(t, trunks, mountedPaths(fake), "trunks must outlive the filesystem mount released on publish")
+	publish(targetB)
+	assert.ElementsMatch(t, trunks, mountedPaths(fake), "held trunks must not be mounted again")
+
+	m.releasePublishTarget(ctx, targetA)
+	m.releasePublishTarget(ctx, targetA)
+	assert.ElementsMatch(t, trunks, mountedPaths(fake), "trunks must be kept while a publish target holds them")
+	m.releasePublishTarget(ctx, targetB)
+	assert.Empty(t, mountedPaths(fake))
+	assert.NoDirExists(t, trunks[0])
+	assert.Empty(t, m.trunkTargets)
+
+	// publish targets of mounts without trunks hold nothing
+	m.holdPublishTarget(ctx, filepath.Join(m.mountBaseDir, "fs2-aaa-10.0.0.1"), targetA)
+	assert.Empty(t, m.trunkTargets)
+}
+
+func TestNfsTrunksReleasedWhileMountReferenced(t *testing.T) {
+	ctx := context.Background()
+	fake := mount.NewFakeMounter(nil)
+	m := &nfsMounter{mountBaseDir: t.TempDir(), mountMap: make(nfsMountsMap), kMounter: fake, unmountTimeout: time.Second}
+	mountPoint := filepath.Join(m.mountBaseDir, "fs1-aaa-10.0.0.1")
+	trunk := filepath.Join(m.mountBaseDir, nfsTrunksDir, "fs1-aaa-10.0.0.1-10.0.0.2")
+	require.NoError(t, os.MkdirAll(trunk, DefaultVolumePermissions))
+	require.NoError(t, fake.Mount("10.0.0.2:/fs1", trunk, "nfs", nil))
+	m.mountMap[mountPoint+"^vers=4.1"] = 1
+	m.holdPublishTarget(ctx, mountPoint, "/target-a")
+
+	m.releasePublishTarget(ctx, "/target-a")
+	assert.Equal(t, []string{trunk}, mountedPaths(fake), "trunks of a filesystem mount in use must be left to its unmount")
+	assert.Empty(t, m.trunkTargets)
+}
+
+func TestRecoverTrunkTargets(t *testing.T) {
+	baseDir := "/run/weka-fs-mounts-node"
+	trunksDir := baseDir + "/" + nfsTrunksDir
+	published := baseDir + "/fs1-aaa-10.0.0.1"
+	inUse := baseDir + "/fs2-bbb-10.0.0.1"
+	target := func(pod string) string {
+		return "/var/lib/kubelet/pods/" + pod + "/volumes/kubernetes.io~csi/pvc-1/mount"
+	}
+	mounts := []mount.MountInfo{
+		{MountPoint: trunksDir + "/fs1-aaa-10.0.0.1-10.0.0.2", FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: trunksDir + "/fs1-aaa-10.0.0.1-10.0.0.3", FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: inUse, FsType: "nfs4", Major: 0, Minor: 62},
+		{MountPoint: trunksDir + "/fs2-bbb-10.0.0.1-10.0.0.2", FsType: "nfs4", Major: 0, Minor: 63},
+		{MountPoint: trunksDir + "/fs3-ccc-10.0.0.1-10.0.0.2", FsType: "nfs4", Major: 0, Minor: 64},
+		{MountPoint: target("pod-a"), FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: target("pod-b"), FsType: "nfs4", Major: 0, Minor: 61},
+		{MountPoint: target("pod-c"), FsType: "wekafs", Major: 0, Minor: 64},
+	}
+
+	trunkTargets, orphans := recoverTrunkTargets(baseDir, mounts)
+	assert.Equal(t, map[string]map[string]bool{published: {target("pod-a"): true, target("pod-b"): true}}, trunkTargets)
+	assert.Equal(t, []string{trunksDir + "/fs3-ccc-10.0.0.1-10.0.0.2"}, orphans, "trunks of mounted filesystems must be left to their unmount")
+}
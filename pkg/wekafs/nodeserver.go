@@ -32,6 +32,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -48,6 +49,8 @@ const (
 	TopologyLabelWekaLocalPattern = "topology.%s/accessible"
 	TopologyLabelNodePattern      = "topology.%s/node"
 	TopologyLabelTransportPattern = "topology.%s/transport"
+	// TopologyLabelTransportServedPattern is set on nodes able to serve volumes over a specific data transport
+	TopologyLabelTransportServedPattern = "topology.%s/transport-%s"
 
 	TopologyKeyZone   = "topology.kubernetes.io/zone"
 	TopologyKeyRegion = "topology.kubernetes.io/region"
@@ -65,6 +68,10 @@ type NodeServer struct {
 	api               *ApiStore
 	config            *DriverConfig
 	semaphores        map[string]*semaphore.Weighted
+	locks             *operationLocks
+	prober            *mountProber
+	watchdog          *mountWatchdog
+	optionProfiles    *mountOptionProfiles
 	zone   string
 	region string
 	sync.Mutex
@@ -116,6 +123,12 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		}
 	}
 
+	if message, abnormal := ns.watchdog.condition(volumePath); abnormal {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+		}, nil
+	}
+
 	// Check if the volume path exists
 	if ns.getConfig().isInDevMode() {
 		// In dev mode, we don't have the actual Weka mount, so we just check if the path exists
@@ -135,7 +148,15 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.InvalidArgument, "invalid volume ID %s: %v", volumeID, err)
 	}
 
-	stats, err := getVolumeStats(volumePath)
+	stats, err := ns.getVolumeStats(volumePath)
+	if isMountAbnormal(err) {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("mount is hung or stale: %s", err),
+			},
+		}, nil
+	}
 	if err != nil || stats == nil {
 		return &csi.NodeGetVolumeStatsResponse{
 			Usage: nil,
@@ -178,11 +199,9 @@ type VolumeStats struct {
 }
 
 // getVolumeStats fetches filesystem statistics for the mounted volume path.
-func getVolumeStats(volumePath string) (volumeStats *VolumeStats, err error) {
-	var stat syscall.Statfs_t
-
-	// Use Statfs to get filesystem statistics for the volume path
-	err = syscall.Statfs(volumePath, &stat)
+// Statfs is bounded by the mount probe timeout, so a hung mount does not block the request
+func (ns *NodeServer) getVolumeStats(volumePath string) (volumeStats *VolumeStats, err error) {
+	stat, err := ns.prober.probe(volumePath)
 	if err != nil {
 		return nil, err
 	}
@@ -213,6 +232,9 @@ func NewNodeServer(nodeId string, maxVolumesPerNode int64, api *ApiStore, mounte
 		api:               api,
 		config:            config,
 		semaphores:        make(map[string]*semaphore.Weighted),
+		locks:             newOperationLocks(),
+		prober:            newMountProber(config.mountWatchdogTimeout),
+		optionProfiles:    newMountOptionProfiles(config.mountOptionProfilesDir),
 	}
 }
 
@@ -225,6 +247,7 @@ func (ns *NodeServer) acquireSemaphore(ctx context.Context, op string) (error, r
 	start := time.Now()
 	err := sem.Acquire(ctx, 1)
 	elapsed := time.Since(start)
+	observeSemaphoreWait(op, err, elapsed)
 	if err == nil {
 		logger.Trace().Dur("acquire_duration", elapsed).Str("op", op).Msg("Successfully acquired semaphore")
 		return nil, func() {
@@ -319,6 +342,12 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	releaseLock, err := ns.locks.tryAcquire(ctx, op, publishLockKey(req.GetVolumeId(), req.GetTargetPath()))
+	defer releaseLock()
+	if err != nil {
+		return NodePublishVolumeError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, ns.config.grpcRequestTimeout)
 	err, dec := ns.acquireSemaphore(ctx, op)
 	defer dec()
@@ -326,6 +355,12 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if err != nil {
 		return NodePublishVolumeError(ctx, codes.Unavailable, "Too many concurrent requests, please retry")
 	}
+	ctx = apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{
+		CsiOperation: op,
+		VolumeId:     volumeID,
+		PvcNamespace: req.GetVolumeContext()[VolumeContextPvcNamespaceKey],
+		PvcName:      req.GetVolumeContext()[VolumeContextPvcNameKey],
+	})
 
 	client, err := ns.api.GetClientFromSecrets(ctx, req.Secrets)
 	if err != nil {
@@ -335,6 +370,7 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if err != nil {
 		return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
 	}
+	setVolumeSpanAttributes(ctx, volume)
 
 	// set volume mountOptions
 	params := req.GetVolumeContext()
@@ -344,6 +380,33 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			volume.setMountOptions(ctx, NewMountOptionsFromString(mountOptions))
 			volume.pruneUnsupportedMountOptions(ctx)
 		}
+		if val, ok := params[NfsIpSelectionParam]; ok {
+			strategy, err := apiclient.ParseNfsIpSelectionStrategy(val)
+			if err != nil {
+				return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+			}
+			volume.nfsIpSelection = strategy
+		}
+		nfsExport, err := parseNfsExportParams(params)
+		if err != nil {
+			return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+		}
+		volume.nfsExport = nfsExport
+		nfsMultipath, err := parseNfsMultipathParams(params)
+		if err != nil {
+			return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+		}
+		volume.nfsMultipath = nfsMultipath
+		transport, err := ParseDataTransport(params[TransportParam])
+		if err != nil {
+			return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+		}
+		volume.transport = transport
+		smbShareInnerPath, err := parseSmbShareInnerPath(params)
+		if err != nil {
+			return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+		}
+		volume.smbShareInnerPath = smbShareInnerPath
 	}
 
 	// Check volume capabitily arguments
@@ -360,6 +423,11 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return NodePublishVolumeError(ctx, codes.InvalidArgument, "block volume mount not supported")
 	}
 
+	// read-only volumes get a read-only NFS export when exported from their own directory
+	if volume.nfsExport != nil && isReadOnlyAccessMode(req.GetVolumeCapability()) {
+		volume.nfsExport.readOnly = true
+	}
+
 	// check targetPath
 	targetPath := filepath.Clean(req.GetTargetPath())
 	mounter := mount.New("")
@@ -377,10 +445,7 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	var innerMountOpts = []string{"bind"}
 
 	attrib := req.GetVolumeContext()
-	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-	volume.mountOptions.Merge(NewMountOptionsFromString(strings.Join(mountFlags, ",")), ns.getConfig().mutuallyExclusiveOptions)
 
-	// Apply per-pod mount option overrides from the weka.io/mount-options annotation.
 	// Use GetAPIReader (direct API calls) instead of the cached client: pods only have
 	// 'get' permission (no list/watch), so cache informers would fail at startup.
 	var apireader runtimeclient.Reader
@@ -389,6 +454,17 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		apireader = manager.GetAPIReader()
 	}
 
+	// the profile goes first, so options set explicitly by StorageClass and overrides take precedence over it
+	if params != nil {
+		if err := ns.applyMountOptionsProfileToVolume(ctx, params, volume, apireader); err != nil {
+			return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+		}
+	}
+
+	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	volume.mountOptions.Merge(NewMountOptionsFromString(strings.Join(mountFlags, ",")), ns.getConfig().mutuallyExclusiveOptions)
+
+	// Apply per-pod mount option overrides from the weka.io/mount-options annotation.
 	// Apply overrides only if we have an API reader and allowMountOptionOverrides is true.
 	if apireader != nil {
 		if ns.config.allowMountOptionOverrides && params != nil {
@@ -400,6 +476,22 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		logger.Debug().Msg("Cannot apply per-pod mount option overrides as Kubernetes client is not initialized")
 	}
 
+	// a PVC annotation overrides the data transport set by StorageClass
+	if apireader != nil && ns.config.allowPerVolumeTransport && params != nil {
+		pvcName, pvcNameOk := params[VolumeContextPvcNameKey]
+		pvcNamespace, pvcNamespaceOk := params[VolumeContextPvcNamespaceKey]
+		if pvcNameOk && pvcNamespaceOk {
+			transport, err := getPvcTransportOverride(ctx, apireader, pvcNamespace, pvcName)
+			if err != nil {
+				return NodePublishVolumeError(ctx, codes.InvalidArgument, err.Error())
+			}
+			if transport != "" {
+				logger.Debug().Str("transport", string(transport)).Msg("Applying PVC data transport override")
+				volume.transport = transport
+			}
+		}
+	}
+
 	readOnly := req.GetReadonly()
 	// create a readonly mount
 	if readOnly {
@@ -425,6 +517,9 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		if errors.Is(err, apiclient.MountPermissionDenied) {
 			return NodePublishVolumeError(ctx, codes.PermissionDenied, err.Error())
 		}
+		if errors.Is(err, apiclient.NfsRootExportConflict) {
+			return NodePublishVolumeError(ctx, codes.FailedPrecondition, err.Error())
+		}
 		return NodePublishVolumeError(ctx, codes.Internal, "Failed to mount a parent filesystem, check Authentication: "+err.Error())
 	}
 	// The parent wekafs mount lives in the container's private mount namespace and
@@ -457,6 +552,8 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 				if PathIsWekaMount(ctx, targetPath) {
 					log.Ctx(ctx).Trace().Str("target_path", targetPath).Bool("weka_mounted", true).Msg("Target path exists")
 					// Bind already exists — idempotent return. The defer releases the incRef.
+					ns.getMounter().holdPublishTarget(ctx, volume.mountPath, filepath.Clean(targetPath))
+					ns.watchdog.track(targetPath, &publishedVolume{volume: volume, innerMountOpts: innerMountOpts, pod: podReference(attrib[VolumeContextPodNamespaceKey], attrib[VolumeContextPodNameKey], attrib[VolumeContextPodUidKey])})
 					result = "SUCCESS"
 					return &csi.NodePublishVolumeResponse{}, nil
 				} else {
@@ -480,7 +577,9 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		logger.Error().Err(err).Str("full_path", fullPath).Str("target_path", targetPath).Msg("Failed to perform mount")
 		return NodePublishVolumeError(ctx, codes.Internal, fmt.Sprintf("failed to Mount device: %s at %s: %s", fullPath, targetPath, err.Error()))
 	}
-	// Bind mount is active. The defer above will release the parent mount.
+	// Bind mount is active. The defer above will release the parent mount, while the target keeps what outlives it
+	ns.getMounter().holdPublishTarget(ctx, volume.mountPath, filepath.Clean(targetPath))
+	ns.watchdog.track(targetPath, &publishedVolume{volume: volume, innerMountOpts: innerMountOpts, pod: podReference(attrib[VolumeContextPodNamespaceKey], attrib[VolumeContextPodNameKey], attrib[VolumeContextPodUidKey])})
 	result = "SUCCESS"
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -499,6 +598,8 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	defer span.End()
 	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
 
+	span.SetAttributes(attribute.String(SpanAttributeVolumeId, req.GetVolumeId()))
+
 	logger := log.Ctx(ctx)
 	logger.Info().Msg(">>>> Received request")
 	defer func() {
@@ -509,6 +610,12 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		logger.WithLevel(level).Str("result", result).Msg("<<<< Completed processing request")
 	}()
 
+	releaseLock, err := ns.locks.tryAcquire(ctx, op, publishLockKey(req.GetVolumeId(), req.GetTargetPath()))
+	defer releaseLock()
+	if err != nil {
+		return NodeUnpublishVolumeError(ctx, codes.Aborted, err.Error())
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, ns.config.grpcRequestTimeout)
 	err, dec := ns.acquireSemaphore(ctx, op)
 	defer dec()
@@ -525,10 +632,17 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	// TODO: Verify that targetPath is indeed equals to expected source of bind mount
 	//		 Which is not straightforward in case plugin was restarted, as in this case
 	//		 we lose information of source. Probably Context can be used
+	// stat of a target on an unreachable NFS server may hang, such target is unmounted right away
+	if _, err := ns.prober.probe(targetPath); errors.Is(err, ErrMountProbeTimeout) {
+		logger.Warn().Err(err).Str("target_path", targetPath).Msg("Target path is hung, unmounting it")
+		goto FORCEUMOUNT
+	}
 	logger.Debug().Str("target_path", targetPath).Msg("Checking if target path exists")
 	if _, err := os.Stat(targetPath); err != nil {
 		if os.IsNotExist(err) {
 			logger.Debug().Msg("Target path does not exist, assuming repeating unpublish request")
+			ns.getMounter().releasePublishTarget(ctx, filepath.Clean(targetPath))
+			ns.watchdog.untrack(filepath.Clean(targetPath))
 			result = "SUCCESS"
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		} else if pathErr, ok := err.(*os.PathError); ok && errors.Is(pathErr.Err, syscall.ESTALE) {
@@ -551,6 +665,9 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 				result = "FAILURE"
 				return NodeUnpublishVolumeError(ctx, codes.Internal, err.Error())
 			}
+			ns.getMounter().releaseRecoveredTarget(ctx, filepath.Clean(targetPath))
+			ns.getMounter().releasePublishTarget(ctx, filepath.Clean(targetPath))
+			ns.watchdog.untrack(filepath.Clean(targetPath))
 			result = "SUCCESS_WITH_WARNING"
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
@@ -559,7 +676,7 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 FORCEUMOUNT:
 	logger.Trace().Str("target_path", targetPath).Msg("Unmounting")
 	unmountStart := time.Now()
-	unmountErr := mount.New("").Unmount(targetPath)
+	unmountErr := unmountWithEscalation(ctx, mount.New(""), targetPath, ns.getMounter().getTransport(), ns.config.unmountTimeout)
 	unmountElapsed := time.Since(unmountStart).Seconds()
 	if unmountErr != nil {
 		logger.Warn().Float64("elapsed_seconds", unmountElapsed).Str("target_path", targetPath).Msg("Unmount failed")
@@ -567,6 +684,10 @@ FORCEUMOUNT:
 		return NodeUnpublishVolumeError(ctx, codes.Internal, unmountErr.Error())
 	}
 	logger.Trace().Float64("elapsed_seconds", unmountElapsed).Msg("Unmount succeeded")
+	// release the reference the target held on a mount recovered from before plugin restart, if any
+	ns.getMounter().releaseRecoveredTarget(ctx, filepath.Clean(targetPath))
+	ns.getMounter().releasePublishTarget(ctx, filepath.Clean(targetPath))
+	ns.watchdog.untrack(filepath.Clean(targetPath))
 	logger.Trace().Str("target_path", targetPath).Msg("Removing stale target path")
 	if err := os.Remove(targetPath); err != nil {
 		return NodeUnpublishVolumeError(ctx, codes.Internal, err.Error())
@@ -615,6 +736,9 @@ func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 		segments[fmt.Sprintf(TopologyLabelNodePattern, driverName)] = ns.nodeID
 		segments[fmt.Sprintf(TopologyLabelTransportPattern, driverName)] = string(ns.getMounter().getTransport())
 		segments[fmt.Sprintf(TopologyLabelWekaLocalPattern, driverName)] = "true"
+		for _, transport := range ns.getConfig().GetDriver().servedTransports(ctx) {
+			segments[fmt.Sprintf(TopologyLabelTransportServedPattern, driverName, transport)] = "true"
+		}
 	} else {
 		logger.Warn().Msg("Node topology labels management is disabled, using global label only")
 	}
@@ -0,0 +1,100 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// operationLock describes a CSI operation in flight holding a lock
+type operationLock struct {
+	op       string
+	traceId  string
+	acquired time.Time
+}
+
+func (l *operationLock) String() string {
+	return fmt.Sprintf("%s (running for %s, trace_id=%s)", l.op, time.Since(l.acquired).Round(time.Millisecond), l.traceId)
+}
+
+// operationLocks is a registry of CSI operations in flight keyed by volume or snapshot ID.
+// As recommended by CSI spec, an operation conflicting with another operation on the same object
+// is rejected immediately rather than waiting for the object to be released
+type operationLocks struct {
+	sync.Mutex
+	held map[string]*operationLock
+}
+
+func newOperationLocks() *operationLocks {
+	return &operationLocks{held: make(map[string]*operationLock)}
+}
+
+func volumeLockKey(volumeId string) string {
+	if volumeId == "" {
+		return ""
+	}
+	return "volume:" + volumeId
+}
+
+func snapshotLockKey(snapshotId string) string {
+	if snapshotId == "" {
+		return ""
+	}
+	return "snapshot:" + snapshotId
+}
+
+// publishLockKey returns the lock key of a volume published to a specific target path, since same volume
+// may be published concurrently for different pods
+func publishLockKey(volumeId, targetPath string) string {
+	if volumeId == "" && targetPath == "" {
+		return ""
+	}
+	return "volume:" + volumeId + "@" + targetPath
+}
+
+// tryAcquire locks all non-empty keys for op. If any of the keys is already held, nothing is locked and
+// an error describing the holder is returned. The returned function releases the locks
+func (l *operationLocks) tryAcquire(ctx context.Context, op string, keys ...string) (func(), error) {
+	logger := log.Ctx(ctx)
+	l.Lock()
+	defer l.Unlock()
+
+	var locked []string
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if holder, ok := l.held[key]; ok {
+			observeOperationLockConflict(op, holder.op)
+			logger.Warn().Str("lock", key).Str("holder_op", holder.op).Str("holder_trace_id", holder.traceId).
+				Time("holder_acquired", holder.acquired).Msg("Rejecting request, another operation is in progress for the same object")
+			return func() {}, fmt.Errorf("an operation is already in progress for %s: %s", key, holder.String())
+		}
+		locked = append(locked, key)
+	}
+
+	lock := &operationLock{
+		op:       op,
+		traceId:  trace.SpanContextFromContext(ctx).TraceID().String(),
+		acquired: time.Now(),
+	}
+	for _, key := range locked {
+		l.held[key] = lock
+	}
+	logger.Trace().Str("locks", strings.Join(locked, ",")).Msg("Acquired operation locks")
+	return func() {
+		l.Lock()
+		defer l.Unlock()
+		for _, key := range locked {
+			if l.held[key] == lock {
+				delete(l.held, key)
+			}
+		}
+		logger.Trace().Str("locks", strings.Join(locked, ",")).Msg("Released operation locks")
+	}, nil
+}
@@ -0,0 +1,43 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationLocks(t *testing.T) {
+	ctx := context.Background()
+	locks := newOperationLocks()
+
+	release, err := locks.tryAcquire(ctx, "ControllerExpandVolume", volumeLockKey("weka/v2/fs1"))
+	require.NoError(t, err)
+
+	_, err = locks.tryAcquire(ctx, "CreateSnapshot", volumeLockKey("weka/v2/fs1"), snapshotLockKey("wekasnap/v2/fs1:snap"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ControllerExpandVolume")
+	assert.Contains(t, err.Error(), "volume:weka/v2/fs1")
+
+	// failed acquisition must not leave partial locks behind
+	releaseSnap, err := locks.tryAcquire(ctx, "DeleteSnapshot", snapshotLockKey("wekasnap/v2/fs1:snap"))
+	require.NoError(t, err)
+	releaseSnap()
+
+	// empty keys are ignored
+	releaseEmpty, err := locks.tryAcquire(ctx, "DeleteVolume", volumeLockKey(""))
+	require.NoError(t, err)
+	releaseEmpty()
+
+	release()
+	release, err = locks.tryAcquire(ctx, "DeleteVolume", volumeLockKey("weka/v2/fs1"))
+	require.NoError(t, err)
+	release()
+	assert.Empty(t, locks.held)
+}
+
+func TestPublishLockKey(t *testing.T) {
+	assert.NotEqual(t, publishLockKey("weka/v2/fs1", "/pods/a/mount"), publishLockKey("weka/v2/fs1", "/pods/b/mount"))
+	assert.Equal(t, "", publishLockKey("", ""))
+}
@@ -0,0 +1,473 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"go.opentelemetry.io/otel"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	orphanKindFilesystem     = "filesystem"
+	orphanKindSnapshot       = "snapshot"
+	orphanKindVolumeSnapshot = "snapshot_volume"
+	orphanKindSeedSnapshot   = "seed_snapshot"
+	orphanKindDirectory      = "directory"
+
+	eventReasonOrphanDetected     = "OrphanedWekaObject"
+	eventReasonOrphanDeleted      = "OrphanedWekaObjectDeleted"
+	eventReasonOrphanDeleteFailed = "OrphanedWekaObjectDeleteFailed"
+
+	orphanReconcileOperationName = "ReconcileOrphans"
+)
+
+var (
+	orphanObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "orphans",
+		Name:      "objects",
+		Help:      "Number of Weka objects created by the driver that are not referenced by any PersistentVolume or VolumeSnapshotContent",
+	}, []string{"kind", "cluster"})
+
+	orphanDeletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "orphans",
+		Name:      "deletions_total",
+		Help:      "Total number of orphaned Weka objects deleted after grace period, dry_run result denotes deletions that were only reported",
+	}, []string{"kind", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(orphanObjects, orphanDeletionsTotal)
+}
+
+// orphanObject is a Weka object or a directory matching the naming of objects created by the driver
+type orphanObject struct {
+	kind       string
+	name       string
+	filesystem string
+	uid        uuid.UUID
+	client     *apiclient.ApiClient
+}
+
+func (o *orphanObject) key() string {
+	cluster := ""
+	if o.client != nil {
+		cluster = o.client.ClusterGuid.String()
+	}
+	return strings.Join([]string{cluster, o.kind, o.filesystem, o.name}, "/")
+}
+
+func (o *orphanObject) String() string {
+	if o.kind == orphanKindFilesystem {
+		return fmt.Sprintf("%s %s", o.kind, o.name)
+	}
+	return fmt.Sprintf("%s %s on filesystem %s", o.kind, o.name, o.filesystem)
+}
+
+// orphanReferences are Weka objects referenced by PersistentVolumes and VolumeSnapshotContents of the driver
+type orphanReferences struct {
+	filesystems map[string]bool
+	// access points of snapshot-backed volumes and snapshots, in form of <filesystem>:<access point>
+	accessPoints map[string]bool
+	// directories of directory-backed volumes, in form of <filesystem>/<inner path>
+	directories map[string]bool
+}
+
+func newOrphanReferences() *orphanReferences {
+	return &orphanReferences{
+		filesystems:  make(map[string]bool),
+		accessPoints: make(map[string]bool),
+		directories:  make(map[string]bool),
+	}
+}
+
+func (r *orphanReferences) addVolume(volumeId string) {
+	fs := sliceFilesystemNameFromVolumeId(volumeId)
+	if fs == "" {
+		return
+	}
+	r.filesystems[fs] = true
+	if ap := sliceSnapshotAccessPointFromVolumeId(volumeId); ap != "" {
+		r.accessPoints[fs+":"+ap] = true
+	} else if innerPath := sliceInnerPathFromVolumeId(volumeId); innerPath != "" {
+		r.directories[fs+"/"+strings.Trim(innerPath, "/")] = true
+	}
+}
+
+func (r *orphanReferences) addSnapshot(snapshotId string) {
+	fs := sliceFilesystemNameFromSnapshotId(snapshotId)
+	if fs == "" {
+		return
+	}
+	r.filesystems[fs] = true
+	if ap := sliceSnapshotIntegrityIdFromSnapshotId(snapshotId); ap != "" {
+		r.accessPoints[fs+":"+ap] = true
+	}
+}
+
+// addTombstones marks filesystems tombstoned upon deletion of their volume as referenced, together with their
+// snapshots, as they are deleted by tombstonePurger once their retention period expires
+func (r *orphanReferences) addTombstones(snapshots []apiclient.Snapshot, config *DriverConfig) {
+	for _, snap := range snapshots {
+		if isTombstoneSnapshot(config.SnapshotPrefix, snap.Name) {
+			r.filesystems[snap.Filesystem] = true
+			r.accessPoints[snap.Filesystem+":"+snap.AccessPoint] = true
+		}
+	}
+}
+
+// findOrphanFilesystems returns filesystems of filesystem-backed volumes that are not referenced
+func findOrphanFilesystems(refs *orphanReferences, filesystems []apiclient.FileSystem, config *DriverConfig) []*orphanObject {
+	var ret []*orphanObject
+	for _, fs := range filesystems {
+		if !strings.HasPrefix(fs.Name, config.VolumePrefix) || fs.IsRemoving || fs.IsCreating || refs.filesystems[fs.Name] {
+			continue
+		}
+		ret = append(ret, &orphanObject{kind: orphanKindFilesystem, name: fs.Name, filesystem: fs.Name, uid: fs.Uid})
+	}
+	return ret
+}
+
+// findOrphanSnapshots returns snapshots of snapshot-backed volumes, CSI snapshots and seed snapshots that are
+// not referenced. Seed snapshots are orphaned together with their filesystem
+func findOrphanSnapshots(refs *orphanReferences, snapshots []apiclient.Snapshot, config *DriverConfig) []*orphanObject {
+	var ret []*orphanObject
+	for _, snap := range snapshots {
+		if snap.IsRemoving || refs.accessPoints[snap.Filesystem+":"+snap.AccessPoint] {
+			continue
+		}
+		kind := ""
+		switch {
+		case config.SeedSnapshotPrefix != "" && strings.HasPrefix(snap.Name, config.SeedSnapshotPrefix):
+			if strings.HasPrefix(snap.Filesystem, config.VolumePrefix) && !refs.filesystems[snap.Filesystem] {
+				kind = orphanKindSeedSnapshot
+			}
+		case config.SnapshotPrefix != "" && strings.HasPrefix(snap.Name, config.SnapshotPrefix):
+			kind = orphanKindSnapshot
+		case config.VolumePrefix != "" && strings.HasPrefix(snap.Name, config.VolumePrefix):
+			kind = orphanKindVolumeSnapshot
+		}
+		if kind != "" {
+			ret = append(ret, &orphanObject{kind: kind, name: snap.Name, filesystem: snap.Filesystem, uid: snap.Uid})
+		}
+	}
+	return ret
+}
+
+// findOrphanDirectories returns directories under the dynamic volume path of a filesystem that are not referenced
+func findOrphanDirectories(refs *orphanReferences, fsName string, dirNames []string, config *DriverConfig) []*orphanObject {
+	var ret []*orphanObject
+	for _, name := range dirNames {
+		innerPath := strings.Trim(filepath.Join(config.DynamicVolPath, name), "/")
+		if refs.directories[fsName+"/"+innerPath] {
+			continue
+		}
+		ret = append(ret, &orphanObject{kind: orphanKindDirectory, name: innerPath, filesystem: fsName})
+	}
+	return ret
+}
+
+// orphanReconciler periodically looks for Weka objects following the naming of the driver that no PersistentVolume
+// or VolumeSnapshotContent refers to, e.g. leftovers of failed deletions or of PVs removed manually.
+// Orphans are reported by metrics and events, and deleted once they stay orphaned for the grace period,
+// unless the grace period is 0 or dry run is set. It is added as a leader election runnable to the manager
+type orphanReconciler struct {
+	cs          *ControllerServer
+	driverName  string
+	recorder    record.EventRecorder
+	eventTarget *v1.ObjectReference
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	firstSeen   map[string]time.Time
+}
+
+func newOrphanReconciler(cs *ControllerServer, driverName string, recorder record.EventRecorder) *orphanReconciler {
+	r := &orphanReconciler{
+		cs:          cs,
+		driverName:  driverName,
+		recorder:    recorder,
+		interval:    cs.config.orphanReconcileInterval,
+		gracePeriod: cs.config.orphanDeletionGracePeriod,
+		dryRun:      cs.config.orphanDeletionDryRun,
+		firstSeen:   make(map[string]time.Time),
+	}
+	// events are published on the controller pod, as orphans have no Kubernetes object of their own
+	namespace, err := getOwnNamespace()
+	if podName := os.Getenv("POD_NAME"); podName != "" && err == nil {
+		r.eventTarget = &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: podName}
+	}
+	return r
+}
+
+// Start implements manager.Runnable
+func (r *orphanReconciler) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "orphan-reconciler").Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Dur("interval", r.interval).Dur("grace_period", r.gracePeriod).Bool("dry_run", r.dryRun).Msg("Starting reconciliation of orphaned Weka objects")
+	for {
+		r.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Stopping reconciliation of orphaned Weka objects")
+			return nil
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *orphanReconciler) reconcile(ctx context.Context) {
+	op := orphanReconcileOperationName
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	refs, clients, dirFilesystems, err := r.collectReferences(ctx)
+	if err != nil {
+		// never classify objects as orphans unless all references are known
+		logger.Error().Err(err).Msg("Failed to collect references to Weka objects, skipping reconciliation")
+		return
+	}
+
+	var orphans []*orphanObject
+	for client := range clients {
+		found, err := r.findOrphans(ctx, client, refs, dirFilesystems[client])
+		if err != nil {
+			logger.Error().Err(err).Str("cluster", client.ClusterName).Msg("Failed to look for orphaned Weka objects")
+			continue
+		}
+		orphans = append(orphans, found...)
+	}
+
+	orphanObjects.Reset()
+	now := time.Now()
+	seen := make(map[string]time.Time)
+	for _, o := range orphans {
+		orphanObjects.WithLabelValues(o.kind, o.client.ClusterName).Inc()
+		first, ok := r.firstSeen[o.key()]
+		if !ok {
+			first = now
+			logger.Warn().Str("kind", o.kind).Str("name", o.name).Str("filesystem", o.filesystem).Msg("Detected orphaned Weka object")
+			r.event(v1.EventTypeWarning, eventReasonOrphanDetected, fmt.Sprintf("Weka %s is not referenced by any PersistentVolume or VolumeSnapshotContent", o))
+		}
+		seen[o.key()] = first
+	}
+	// objects no longer orphaned start their grace period from scratch
+	r.firstSeen = seen
+
+	if r.gracePeriod <= 0 {
+		return
+	}
+	// snapshots must go before their filesystems
+	for _, kinds := range [][]string{{orphanKindSnapshot, orphanKindVolumeSnapshot, orphanKindSeedSnapshot, orphanKindDirectory}, {orphanKindFilesystem}} {
+		for _, o := range orphans {
+			if !slices.Contains(kinds, o.kind) || now.Sub(r.firstSeen[o.key()]) < r.gracePeriod {
+				continue
+			}
+			r.deleteOrphan(ctx, o)
+		}
+	}
+}
+
+// collectReferences returns objects referenced by PVs and VolumeSnapshotContents of the driver, API clients of all
+// clusters they reside on, and filesystems per client that might hold directory-backed volumes
+func (r *orphanReconciler) collectReferences(ctx context.Context) (*orphanReferences, map[*apiclient.ApiClient]bool, map[*apiclient.ApiClient]map[string]bool, error) {
+	logger := log.Ctx(ctx)
+	reader := r.cs.manager.GetAPIReader()
+	refs := newOrphanReferences()
+	clients := make(map[*apiclient.ApiClient]bool)
+	dirFilesystems := make(map[*apiclient.ApiClient]map[string]bool)
+	addClient := func(ref *v1.SecretReference) *apiclient.ApiClient {
+		secrets := make(map[string]string)
+		if ref != nil {
+			var err error
+			if secrets, err = r.cs.getSecretsByRef(ctx, ref); err != nil {
+				logger.Warn().Err(err).Msg("Failed to fetch API secret")
+				return nil
+			}
+		}
+		client, err := r.cs.api.GetClientFromSecrets(ctx, secrets)
+		if err != nil || client == nil {
+			return nil
+		}
+		clients[client] = true
+		return client
+	}
+	addDirFilesystem := func(client *apiclient.ApiClient, fs string) {
+		if client == nil || fs == "" || strings.HasPrefix(fs, r.cs.config.VolumePrefix) {
+			return
+		}
+		if dirFilesystems[client] == nil {
+			dirFilesystems[client] = make(map[string]bool)
+		}
+		dirFilesystems[client][fs] = true
+	}
+
+	pvList := &v1.PersistentVolumeList{}
+	if err := reader.List(ctx, pvList); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list persistent volumes: %w", err)
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != r.driverName {
+			continue
+		}
+		volumeId := pv.Spec.CSI.VolumeHandle
+		refs.addVolume(volumeId)
+		client := addClient(secretRefOfPv(pv))
+		if sliceSnapshotAccessPointFromVolumeId(volumeId) == "" && sliceInnerPathFromVolumeId(volumeId) != "" {
+			addDirFilesystem(client, sliceFilesystemNameFromVolumeId(volumeId))
+		}
+	}
+
+	contents := &unstructured.UnstructuredList{}
+	contents.SetGroupVersionKind(volumeSnapshotContentGvk.GroupVersion().WithKind(volumeSnapshotContentGvk.Kind + "List"))
+	if err := reader.List(ctx, contents); err != nil && !meta.IsNoMatchError(err) {
+		return nil, nil, nil, fmt.Errorf("failed to list volume snapshot contents: %w", err)
+	}
+	for _, content := range contents.Items {
+		driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+		if driver != r.driverName {
+			continue
+		}
+		if handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle"); handle != "" {
+			refs.addSnapshot(handle)
+		}
+		if handle, _, _ := unstructured.NestedString(content.Object, "spec", "source", "snapshotHandle"); handle != "" {
+			refs.addSnapshot(handle)
+		}
+	}
+
+	// directories are looked up also on filesystems that storage classes provision into, even if no PV is left there
+	scList := &storagev1.StorageClassList{}
+	if err := reader.List(ctx, scList); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list storage classes: %w", err)
+	}
+	for _, sc := range scList.Items {
+		fs := sc.Parameters["filesystemName"]
+		if sc.Provisioner != r.driverName || fs == "" {
+			continue
+		}
+		name := sc.Parameters[storageClassProvisionerSecretName]
+		if strings.Contains(name, "${") {
+			// secret is resolved per PVC and cannot be determined here
+			continue
+		}
+		var ref *v1.SecretReference
+		if name != "" {
+			ref = &v1.SecretReference{Name: name, Namespace: sc.Parameters[storageClassProvisionerSecretNamespace]}
+		}
+		addDirFilesystem(addClient(ref), fs)
+	}
+	return refs, clients, dirFilesystems, nil
+}
+
+func (r *orphanReconciler) findOrphans(ctx context.Context, client *apiclient.ApiClient, refs *orphanReferences, dirFilesystems map[string]bool) ([]*orphanObject, error) {
+	var filesystems []apiclient.FileSystem
+	if err := client.FindFileSystemsByFilter(ctx, &apiclient.FileSystem{}, &filesystems); err != nil {
+		return nil, err
+	}
+	var snapshots []apiclient.Snapshot
+	if err := client.FindSnapshotsByFilter(ctx, &apiclient.Snapshot{}, &snapshots); err != nil {
+		return nil, err
+	}
+	refs.addTombstones(snapshots, r.cs.config)
+	orphans := append(findOrphanFilesystems(refs, filesystems, r.cs.config), findOrphanSnapshots(refs, snapshots, r.cs.config)...)
+	for fs := range dirFilesystems {
+		dirNames, err := r.listVolumeDirectories(ctx, client, fs)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("filesystem", fs).Msg("Failed to list directories of volumes")
+			continue
+		}
+		orphans = append(orphans, findOrphanDirectories(refs, fs, dirNames, r.cs.config)...)
+	}
+	for _, o := range orphans {
+		o.client = client
+	}
+	return orphans, nil
+}
+
+func (r *orphanReconciler) listVolumeDirectories(ctx context.Context, client *apiclient.ApiClient, fs string) (names []string, retErr error) {
+	path, err, unmount := r.cs.mounter.Mount(ctx, fs, client)
+	defer deferUmount(unmount, &retErr)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(path, r.cs.config.DynamicVolPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (r *orphanReconciler) deleteOrphan(ctx context.Context, o *orphanObject) {
+	logger := log.Ctx(ctx).With().Str("kind", o.kind).Str("name", o.name).Str("filesystem", o.filesystem).Bool("dry_run", r.dryRun).Logger()
+	if r.dryRun {
+		logger.Info().Msg("Orphaned Weka object would be deleted, skipping due to dry run")
+		orphanDeletionsTotal.WithLabelValues(o.kind, "dry_run").Inc()
+		return
+	}
+	err := r.doDeleteOrphan(ctx, o)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to delete orphaned Weka object")
+		orphanDeletionsTotal.WithLabelValues(o.kind, "failure").Inc()
+		r.event(v1.EventTypeWarning, eventReasonOrphanDeleteFailed, fmt.Sprintf("Failed to delete orphaned Weka %s: %s", o, err.Error()))
+		return
+	}
+	logger.Info().Msg("Deleted orphaned Weka object")
+	orphanDeletionsTotal.WithLabelValues(o.kind, "success").Inc()
+	r.event(v1.EventTypeNormal, eventReasonOrphanDeleted, fmt.Sprintf("Deleted orphaned Weka %s", o))
+	delete(r.firstSeen, o.key())
+}
+
+func (r *orphanReconciler) doDeleteOrphan(ctx context.Context, o *orphanObject) error {
+	switch o.kind {
+	case orphanKindSnapshot, orphanKindVolumeSnapshot, orphanKindSeedSnapshot:
+		return o.client.DeleteSnapshot(ctx, &apiclient.SnapshotDeleteRequest{Uid: o.uid})
+	}
+	volumeId := generateVolumeIdFromComponents(VolumeTypeUnified, o.filesystem, "", "")
+	if o.kind == orphanKindDirectory {
+		volumeId = generateVolumeIdFromComponents(VolumeTypeUnified, o.filesystem, "", o.name)
+	}
+	releaseLock, err := r.cs.locks.tryAcquire(ctx, orphanReconcileOperationName, volumeLockKey(volumeId))
+	defer releaseLock()
+	if err != nil {
+		return err
+	}
+	volume, err := NewVolumeFromId(ctx, volumeId, o.client, r.cs)
+	if err != nil {
+		return err
+	}
+	return volume.Trash(ctx)
+}
+
+func (r *orphanReconciler) event(eventType, reason, message string) {
+	if r.recorder == nil || r.eventTarget == nil {
+		return
+	}
+	r.recorder.Event(r.eventTarget, eventType, reason, message)
+}
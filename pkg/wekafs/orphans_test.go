@@ -0,0 +1,59 @@
+package wekafs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+func orphanNames(orphans []*orphanObject) map[string]string {
+	ret := make(map[string]string)
+	for _, o := range orphans {
+		ret[o.name] = o.kind
+	}
+	return ret
+}
+
+func TestFindOrphans(t *testing.T) {
+	config := &DriverConfig{DynamicVolPath: "csi-volumes", VolumePrefix: "csivol-", SnapshotPrefix: "csisnp-", SeedSnapshotPrefix: "csisnp-seed-"}
+	refs := newOrphanReferences()
+	refs.addVolume("weka/v2/csivol-used")
+	refs.addVolume("weka/v2/default:snapvol-used")
+	refs.addVolume("weka/v2/default/csi-volumes/dir-used")
+	refs.addSnapshot("wekasnap/v2/default:snap-hash:snap-used/csi-volumes/dir-gone")
+
+	refs.addTombstones([]apiclient.Snapshot{
+		{Name: "csisnp-tomb-202610180000-abcdefg", Filesystem: "csivol-tombstoned", AccessPoint: "tomb"},
+	}, config)
+
+	filesystems := []apiclient.FileSystem{
+		{Name: "csivol-used"},
+		{Name: "csivol-tombstoned"},
+		{Name: "csivol-gone"},
+		{Name: "csivol-creating", IsCreating: true},
+		{Name: "default"},
+	}
+	assert.Equal(t, map[string]string{"csivol-gone": orphanKindFilesystem}, orphanNames(findOrphanFilesystems(refs, filesystems, config)))
+
+	snapshots := []apiclient.Snapshot{
+		{Name: "csivol-snapvol-used", Filesystem: "default", AccessPoint: "snapvol-used"},
+		{Name: "csivol-snapvol-gone", Filesystem: "default", AccessPoint: "snapvol-gone"},
+		{Name: "csisnp-snap-hash", Filesystem: "default", AccessPoint: "snap-used"},
+		{Name: "csisnp-other-hash", Filesystem: "default", AccessPoint: "snap-gone"},
+		{Name: "csisnp-seed-used", Filesystem: "csivol-used", AccessPoint: "seed-used"},
+		{Name: "csisnp-seed-gone", Filesystem: "csivol-gone", AccessPoint: "seed-gone"},
+		{Name: "csisnp-removing", Filesystem: "default", AccessPoint: "removing", IsRemoving: true},
+		{Name: "manual", Filesystem: "default", AccessPoint: "manual"},
+		{Name: "csisnp-tomb-202610180000-abcdefg", Filesystem: "csivol-tombstoned", AccessPoint: "tomb"},
+		{Name: "csisnp-seed-tombstoned", Filesystem: "csivol-tombstoned", AccessPoint: "seed-tombstoned"},
+	}
+	assert.Equal(t, map[string]string{
+		"csivol-snapvol-gone": orphanKindVolumeSnapshot,
+		"csisnp-other-hash":   orphanKindSnapshot,
+		"csisnp-seed-gone":    orphanKindSeedSnapshot,
+	}, orphanNames(findOrphanSnapshots(refs, snapshots, config)))
+
+	assert.Equal(t, map[string]string{"csi-volumes/dir-gone": orphanKindDirectory},
+		orphanNames(findOrphanDirectories(refs, "default", []string{"dir-used", "dir-gone"}, config)))
+}
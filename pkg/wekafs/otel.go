@@ -2,15 +2,35 @@ package wekafs
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"time"
 
+	"github.com/rs/zerolog"
+	promBridge "go.opentelemetry.io/contrib/bridges/prometheus"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
 )
 
-func TracerProvider(version string, url string, csiRole CsiPluginMode) (*sdktrace.TracerProvider, error) {
+const (
+	SpanAttributeVolumeId    = "weka.csi.volume_id"
+	SpanAttributeSnapshotId  = "weka.csi.snapshot_id"
+	SpanAttributeFilesystem  = "weka.filesystem"
+	SpanAttributeClusterGuid = "weka.cluster.guid"
+
+	otlpMetricsExportInterval = 30 * time.Second
+)
+
+func otelResource(version string, csiRole CsiPluginMode) (*resource.Resource, error) {
 	// Ensure default SDK resources and the required service name are set.
 	hostname, _ := os.Hostname()
 	attributes := []attribute.KeyValue{
@@ -24,10 +44,14 @@ func TracerProvider(version string, url string, csiRole CsiPluginMode) (*sdktrac
 	if deploymentIdentifier != "" {
 		attributes = append(attributes, attribute.String("deployment_identifier", deploymentIdentifier))
 	}
-	r, err := resource.Merge(
+	return resource.Merge(
 		resource.Default(),
 		resource.NewSchemaless(attributes...),
 	)
+}
+
+func TracerProvider(version string, url string, csiRole CsiPluginMode) (*sdktrace.TracerProvider, error) {
+	r, err := otelResource(version, csiRole)
 	if err != nil {
 		return nil, err
 	}
@@ -49,3 +73,197 @@ func TracerProvider(version string, url string, csiRole CsiPluginMode) (*sdktrac
 		), nil
 	}
 }
+
+// MeterProvider returns a meter provider that periodically exports all metrics of the default Prometheus registry
+// to an OTLP endpoint
+func MeterProvider(version string, url string, csiRole CsiPluginMode) (*sdkmetric.MeterProvider, error) {
+	r, err := otelResource(version, csiRole)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := otlpmetricgrpc.New(context.Background(), otlpmetricgrpc.WithEndpoint(url))
+	if err != nil {
+		return nil, err
+	}
+	reader := sdkmetric.NewPeriodicReader(exp,
+		sdkmetric.WithInterval(otlpMetricsExportInterval),
+		sdkmetric.WithProducer(promBridge.NewMetricProducer()),
+	)
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(r),
+	), nil
+}
+
+// LoggerProvider returns a logger provider exporting log records to an OTLP endpoint
+func LoggerProvider(version string, url string, csiRole CsiPluginMode) (*sdklog.LoggerProvider, error) {
+	r, err := otelResource(version, csiRole)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := otlploggrpc.New(context.Background(), otlploggrpc.WithEndpoint(url))
+	if err != nil {
+		return nil, err
+	}
+	return sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exp)),
+		sdklog.WithResource(r),
+	), nil
+}
+
+// OtelLogWriter is a zerolog JSON writer forwarding log lines as OpenTelemetry log records.
+// Records are correlated with traces using the trace_id and span_id fields of the log line
+type OtelLogWriter struct {
+	logger otellog.Logger
+}
+
+func NewOtelLogWriter(provider otellog.LoggerProvider) *OtelLogWriter {
+	return &OtelLogWriter{logger: provider.Logger(TracerName)}
+}
+
+func (w *OtelLogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *OtelLogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(p, &fields); err != nil {
+		// not a JSON log line, e.g. produced by a console writer
+		return len(p), nil
+	}
+	ctx := context.Background()
+	record := otellog.Record{}
+	record.SetObservedTimestamp(time.Now())
+	record.SetTimestamp(time.Now())
+	if level == zerolog.NoLevel {
+		level, _ = zerolog.ParseLevel(stringField(fields, zerolog.LevelFieldName))
+	}
+	record.SetSeverity(otelSeverity(level))
+	record.SetSeverityText(level.String())
+
+	var traceId trace.TraceID
+	var spanId trace.SpanID
+	for k, v := range fields {
+		switch k {
+		case zerolog.LevelFieldName:
+		case zerolog.MessageFieldName:
+			record.SetBody(otellog.StringValue(stringField(fields, k)))
+		case zerolog.TimestampFieldName:
+			if t, ok := parseLogTimestamp(v); ok {
+				record.SetTimestamp(t)
+			}
+		case "trace_id":
+			traceId, _ = trace.TraceIDFromHex(stringField(fields, k))
+		case "span_id":
+			spanId, _ = trace.SpanIDFromHex(stringField(fields, k))
+		default:
+			record.AddAttributes(otellog.KeyValue{Key: k, Value: otelLogValue(v)})
+		}
+	}
+	if traceId.IsValid() && spanId.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceId, SpanID: spanId}))
+	}
+	w.logger.Emit(ctx, record)
+	return len(p), nil
+}
+
+// parseLogTimestamp parses timestamp of a log line according to zerolog.TimeFieldFormat
+func parseLogTimestamp(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(zerolog.TimeFieldFormat, v)
+		return t, err == nil
+	case float64:
+		switch zerolog.TimeFieldFormat {
+		case zerolog.TimeFormatUnix:
+			return time.Unix(int64(v), 0), true
+		case zerolog.TimeFormatUnixMs:
+			return time.UnixMilli(int64(v)), true
+		case zerolog.TimeFormatUnixMicro:
+			return time.UnixMicro(int64(v)), true
+		case zerolog.TimeFormatUnixNano:
+			return time.Unix(0, int64(v)), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func stringField(fields map[string]interface{}, key string) string {
+	if s, ok := fields[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+func otelLogValue(v interface{}) otellog.Value {
+	switch v := v.(type) {
+	case string:
+		return otellog.StringValue(v)
+	case bool:
+		return otellog.BoolValue(v)
+	case float64:
+		return otellog.Float64Value(v)
+	default:
+		data, _ := json.Marshal(v)
+		return otellog.StringValue(string(data))
+	}
+}
+
+func otelSeverity(level zerolog.Level) otellog.Severity {
+	switch level {
+	case zerolog.TraceLevel:
+		return otellog.SeverityTrace
+	case zerolog.DebugLevel:
+		return otellog.SeverityDebug
+	case zerolog.InfoLevel:
+		return otellog.SeverityInfo
+	case zerolog.WarnLevel:
+		return otellog.SeverityWarn
+	case zerolog.ErrorLevel:
+		return otellog.SeverityError
+	case zerolog.FatalLevel:
+		return otellog.SeverityFatal
+	case zerolog.PanicLevel:
+		return otellog.SeverityFatal4
+	default:
+		return otellog.SeverityUndefined
+	}
+}
+
+// grpcMetadataCarrier adapts incoming gRPC metadata to propagation.TextMapCarrier
+type grpcMetadataCarrier metadata.MD
+
+func (c grpcMetadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c grpcMetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c grpcMetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// setVolumeSpanAttributes annotates the current span with identifiers of a volume
+func setVolumeSpanAttributes(ctx context.Context, v *Volume) {
+	if v == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String(SpanAttributeVolumeId, v.GetId()),
+		attribute.String(SpanAttributeFilesystem, v.FilesystemName),
+	}
+	if v.apiClient != nil {
+		attrs = append(attrs, attribute.String(SpanAttributeClusterGuid, v.apiClient.ClusterGuid.String()))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
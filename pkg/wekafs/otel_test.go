@@ -0,0 +1,42 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestLogGRPCExtractsTraceContext(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", traceparent))
+	var handlerSpan trace.SpanContext
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return nil, nil
+	}
+	_, err := logGRPC(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerSpan.TraceID().String())
+	assert.NotEqual(t, "00f067aa0ba902b7", handlerSpan.SpanID().String(), "a child span must be started for the request")
+}
+
+func TestParseLogTimestamp(t *testing.T) {
+	defer func(format string) { zerolog.TimeFieldFormat = format }(zerolog.TimeFieldFormat)
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
+	ts, ok := parseLogTimestamp(float64(1700000000123))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1700000000123), ts.UnixMilli())
+	_, ok = parseLogTimestamp(nil)
+	assert.False(t, ok)
+}
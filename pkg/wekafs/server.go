@@ -23,11 +23,17 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 )
@@ -49,6 +55,7 @@ type nonBlockingGRPCServer struct {
 	wg       sync.WaitGroup
 	server   *grpc.Server
 	csiMmode CsiPluginMode
+	events   *failureEventRecorder
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -98,8 +105,12 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		Die(fmt.Sprintf("Failed to listen: %v", err.Error()))
 	}
 
+	interceptors := []grpc.UnaryServerInterceptor{logGRPC}
+	if s.events != nil {
+		interceptors = append(interceptors, s.events.intercept)
+	}
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(interceptors...),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -140,7 +151,14 @@ func parseEndpoint(ep string) (string, string, error) {
 }
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	ctx, span := otel.Tracer(TracerName).Start(ctx, "GrpcRequest")
+	// continue the trace of the caller (e.g. CSI sidecar) if it propagated W3C trace context in gRPC metadata
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, grpcMetadataCarrier(md))
+	}
+	ctx, span := otel.Tracer(TracerName).Start(ctx, "GrpcRequest",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", info.FullMethod)),
+	)
 	defer span.End()
 	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Logger().WithContext(ctx)
 	logger := log.Ctx(ctx)
@@ -148,8 +166,12 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 		// suppress annoying probe messages
 		logger.Trace().Str("method", info.FullMethod).Str("request", protosanitizer.StripSecrets(req).String()).Msg("GRPC request")
 	}
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	observeRpc(info.FullMethod, err, time.Since(start))
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, status.Code(err).String())
 		logger.Trace().Err(err).Msg("GRPC error")
 	} else {
 		if info.FullMethod != "/csi.v1.Identity/Probe" {
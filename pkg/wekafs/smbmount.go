@@ -0,0 +1,245 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"k8s.io/mount-utils"
+)
+
+var ErrSmbCredentialsMissing = errors.New("no SMB credentials in API secret, set smbUsername and smbPassword")
+
+type smbMount struct {
+	mounter        *smbMounter
+	fsName         string
+	mountPoint     string
+	kMounter       mount.Interface
+	debugPath      string
+	mountOptions   MountOptions
+	lastUsed       time.Time
+	mountIpAddress string
+	// sharePath is the path inside the filesystem the share is created for, shareName is only known once it is ensured
+	sharePath string
+	shareName string
+}
+
+func (m *smbMount) getMountPoint() string {
+	return fmt.Sprintf("%s-%s", m.mountPoint, m.mountIpAddress)
+}
+
+// setSharePath sets the path inside the filesystem that is mounted. Shares of inner paths get a mount point of their own
+func (m *smbMount) setSharePath(path string) {
+	if path == "" {
+		path = "/"
+	}
+	m.sharePath = path
+	if path != "/" {
+		m.mountPoint = m.mounter.mountBaseDir + "/" + getAsciiPart(m.fsName, 64) + "-" + getStringSha1AsB32(string(dataTransportSmb)+":"+m.fsName+":"+m.mountOptions.String()+":"+path)
+	}
+}
+
+func (m *smbMount) getMountTarget() string {
+	return "//" + m.mountIpAddress + "/" + m.shareName
+}
+
+func (m *smbMount) getRefCount() int {
+	return 0
+}
+
+func (m *smbMount) getMountOptions() MountOptions {
+	return m.mountOptions
+}
+
+func (m *smbMount) getLastUsed() time.Time {
+	return m.lastUsed
+}
+
+func (m *smbMount) isInDevMode() bool {
+	return m.debugPath != ""
+}
+
+func (m *smbMount) isMounted(ctx context.Context) bool {
+	return PathExists(m.getMountPoint()) && PathIsWekaMount(ctx, m.getMountPoint())
+}
+
+func (m *smbMount) getRefcountIdx() string {
+	return m.getMountPoint() + "^" + m.getMountOptions().String()
+}
+
+func (m *smbMount) incRef(ctx context.Context, apiClient *apiclient.ApiClient) error {
+	logger := log.Ctx(ctx)
+	if m.mounter == nil {
+		logger.Error().Msg("Mounter is nil")
+		return errors.New("mounter is nil")
+	}
+
+	m.mounter.lock.Lock()
+	defer m.mounter.lock.Unlock()
+	refCount := m.mounter.mountMap[m.getRefcountIdx()]
+	if refCount == 0 {
+		if err := m.doMount(ctx, apiClient, m.getMountOptions()); err != nil {
+			return err
+		}
+		m.recordMount(ctx)
+	}
+	if refCount > 0 && !m.isMounted(ctx) {
+		logger.Warn().Str("mount_point", m.getMountPoint()).Int("refcount", refCount).Msg("Mount not exists although should!")
+		if err := m.doMount(ctx, apiClient, m.getMountOptions()); err != nil {
+			return err
+		}
+	}
+	refCount++
+	m.mounter.mountMap[m.getRefcountIdx()] = refCount
+
+	logger.Trace().
+		Int("refcount", refCount).
+		Strs("mount_options", m.getMountOptions().Strings()).
+		Str("filesystem_name", m.fsName).
+		Str("mount_point", m.getMountPoint()).
+		Msg("RefCount increased")
+	return nil
+}
+
+func (m *smbMount) decRef(ctx context.Context) error {
+	logger := log.Ctx(ctx)
+	if m.mounter == nil {
+		logger.Error().Msg("Mounter is nil")
+		return errors.New("mounter is nil")
+	}
+	m.mounter.lock.Lock()
+	defer m.mounter.lock.Unlock()
+	refCount, ok := m.mounter.mountMap[m.getRefcountIdx()]
+	if !ok {
+		logger.Error().Int("refcount", refCount).Str("mount_options", m.getMountOptions().String()).Str("mount_point", m.getMountPoint()).Msg("During decRef refcount not found")
+	}
+	if refCount == 1 && m.isMounted(ctx) {
+		if err := m.doUnmount(ctx); err != nil {
+			return err
+		}
+	}
+	if refCount > 0 {
+		logger.Trace().Int("refcount", refCount-1).Strs("mount_options", m.getMountOptions().Strings()).Str("filesystem_name", m.fsName).Msg("RefCount decreased")
+		m.mounter.mountMap[m.getRefcountIdx()] = refCount - 1
+	}
+	return nil
+}
+
+// recordMount writes the refcount index of the SMB mount to the mount base directory for recovery on plugin restart
+func (m *smbMount) recordMount(ctx context.Context) {
+	if m.isInDevMode() {
+		return
+	}
+	if err := writeMountRecord(m.mounter.mountBaseDir, m.getMountPoint(), &mountRecord{Filesystem: m.fsName, RefcountIdx: m.getRefcountIdx(), Transport: dataTransportSmb}); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("mount_point", m.getMountPoint()).Msg("Failed to write mount record, mount references will not be recovered after restart")
+	}
+}
+
+func (m *smbMount) locateMountIP() error {
+	if m.mountIpAddress == "" {
+		ipAddr, err := GetMountIpFromActualMountPoint(m.mountPoint)
+		if err != nil {
+			return err
+		}
+		m.mountIpAddress = ipAddr
+	}
+	return nil
+}
+
+func (m *smbMount) ensureMountIpAddress(ctx context.Context, apiClient *apiclient.ApiClient) error {
+	if m.mountIpAddress != "" {
+		return nil
+	}
+	if apiClient == nil {
+		return errors.New("no API client for mount, cannot do SMB mount")
+	}
+	ip, err := apiClient.GetSmbMountIp(ctx)
+	if err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Str("filesystem", m.fsName).Str("mount_ip_address", ip).Msg("Selected SMB target IP address for mount")
+	m.mountIpAddress = ip
+	return nil
+}
+
+// getSmbSensitiveMountOptions returns the credentials of the mount, which are passed to mount separately so they are never logged
+func getSmbSensitiveMountOptions(credentials apiclient.Credentials) ([]string, error) {
+	if credentials.SmbUsername == "" || credentials.SmbPassword == "" {
+		return nil, ErrSmbCredentialsMissing
+	}
+	ret := []string{"username=" + credentials.SmbUsername, "password=" + credentials.SmbPassword}
+	if credentials.SmbDomain != "" {
+		ret = append(ret, "domain="+credentials.SmbDomain)
+	}
+	return ret, nil
+}
+
+func (m *smbMount) doUnmount(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("mount_point", m.getMountPoint()).Str("filesystem", m.fsName).Logger()
+	logger.Trace().Strs("mount_options", m.getMountOptions().Strings()).Msg("Performing umount via k8s native mounter")
+	err := unmountWithEscalation(ctx, m.kMounter, m.getMountPoint(), dataTransportSmb, m.mounter.unmountTimeout)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to unmount")
+		return err
+	}
+	logger.Trace().Msg("Unmounted successfully")
+	if err := removeMountRecord(m.mounter.mountBaseDir, m.getMountPoint()); err != nil {
+		logger.Warn().Err(err).Msg("Failed to remove mount record")
+	}
+	if err := os.Remove(m.getMountPoint()); err != nil {
+		logger.Warn().Err(err).Msg("Failed to remove mount point directory, will be cleaned up on next use")
+	} else {
+		logger.Trace().Msg("Removed mount point successfully")
+	}
+	return nil
+}
+
+func (m *smbMount) doMount(ctx context.Context, apiClient *apiclient.ApiClient, mountOptions MountOptions) error {
+	logger := log.Ctx(ctx).With().Str("mount_point", m.getMountPoint()).Str("filesystem", m.fsName).Logger()
+	if apiClient == nil {
+		logger.Trace().Msg("No API client for mount, cannot proceed")
+		return errors.New("no API client for mount, cannot do SMB mount")
+	}
+
+	if m.isInDevMode() {
+		fakePath := filepath.Join(m.debugPath, m.fsName)
+		if err := os.MkdirAll(fakePath, DefaultVolumePermissions); err != nil {
+			Die(fmt.Sprintf("Failed to create directory %s, while running in debug mode", fakePath))
+		}
+		logger.Trace().Strs("mount_options", m.getMountOptions().Strings()).Str("debug_path", m.debugPath).Msg("Performing mount")
+		return m.kMounter.Mount(fakePath, m.getMountPoint(), "", []string{"bind"})
+	}
+
+	sensitiveOptions, err := getSmbSensitiveMountOptions(apiClient.Credentials)
+	if err != nil {
+		logger.Error().Err(err).Msg("Cannot mount filesystem")
+		return err
+	}
+	share, err := apiClient.EnsureSmbShare(ctx, m.fsName, m.sharePath)
+	if err != nil {
+		logger.Error().Err(err).Str("path", m.sharePath).Msg("Failed to ensure SMB share")
+		return errors.New("failed to ensure SMB share")
+	}
+	m.shareName = share.ShareName
+
+	mountTarget := m.getMountTarget()
+	logger.Trace().
+		Strs("mount_options", mountOptions.Strings()).
+		Str("mount_target", mountTarget).
+		Str("mount_ip_address", m.mountIpAddress).
+		Msg("Performing mount")
+	if err := os.MkdirAll(m.getMountPoint(), DefaultVolumePermissions); err != nil {
+		return err
+	}
+	if err := m.kMounter.MountSensitive(mountTarget, m.getMountPoint(), "cifs", mountOptions.Strings(), sensitiveOptions); err != nil {
+		logger.Error().Err(err).Msg("Failed to mount")
+		return err
+	}
+	logger.Trace().Msg("Mounted successfully")
+	return nil
+}
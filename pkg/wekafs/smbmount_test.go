@@ -0,0 +1,66 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+func TestParseSmbShareInnerPath(t *testing.T) {
+	innerPath, err := parseSmbShareInnerPath(map[string]string{})
+	assert.NoError(t, err)
+	assert.False(t, innerPath)
+
+	innerPath, err = parseSmbShareInnerPath(map[string]string{SmbShareInnerPathParam: "true"})
+	assert.NoError(t, err)
+	assert.True(t, innerPath)
+
+	_, err = parseSmbShareInnerPath(map[string]string{SmbShareInnerPathParam: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestMountOptions_AsSmb(t *testing.T) {
+	opts := NewMountOptionsFromString("writecache,readcache,container_name=abc,ro")
+	assert.Equal(t, "ro,vers=3.0", opts.AsSmb().String())
+
+	opts = NewMountOptionsFromString("coherent")
+	assert.Equal(t, "cache=none,vers=3.0", opts.AsSmb().String())
+}
+
+func TestSmbSensitiveMountOptions(t *testing.T) {
+	_, err := getSmbSensitiveMountOptions(apiclient.Credentials{SmbUsername: "user"})
+	assert.ErrorIs(t, err, ErrSmbCredentialsMissing)
+
+	opts, err := getSmbSensitiveMountOptions(apiclient.Credentials{SmbUsername: "user", SmbPassword: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"username=user", "password=secret"}, opts)
+
+	opts, err = getSmbSensitiveMountOptions(apiclient.Credentials{SmbUsername: "user", SmbPassword: "secret", SmbDomain: "CORP"})
+	assert.NoError(t, err)
+	assert.Contains(t, opts, "domain=CORP")
+}
+
+func TestSmbMountSharePath(t *testing.T) {
+	mounter := &smbMounter{mountBaseDir: "/run/weka-fs-mounts", mountMap: make(smbMountsMap)}
+	ctx := context.Background()
+	assert.Equal(t, "/", smbSharePathFromContext(ctx))
+
+	root := mounter.NewMount("fs1", getDefaultMountOptions().AsSmb()).(*smbMount)
+	root.mountIpAddress = "10.0.0.1"
+	root.shareName = "csi-fs1"
+	root.setSharePath(smbSharePathFromContext(ctx))
+	assert.Equal(t, "//10.0.0.1/csi-fs1", root.getMountTarget())
+
+	narrowed := mounter.NewMount("fs1", getDefaultMountOptions().AsSmb()).(*smbMount)
+	narrowed.mountIpAddress = "10.0.0.1"
+	narrowed.setSharePath(smbSharePathFromContext(withSmbSharePath(ctx, "/csi-volumes/pvc-1")))
+	assert.Equal(t, "/csi-volumes/pvc-1", narrowed.sharePath)
+	assert.NotEqual(t, root.getMountPoint(), narrowed.getMountPoint(), "narrowed share must be mounted separately")
+	assert.NotEqual(t, root.getRefcountIdx(), narrowed.getRefcountIdx())
+
+	nfs := (&nfsMounter{mountBaseDir: "/run/weka-fs-mounts", mountMap: make(nfsMountsMap)}).NewMount("fs1", getDefaultMountOptions().AsSmb()).(*nfsMount)
+	nfs.mountIpAddress = "10.0.0.1"
+	assert.NotEqual(t, nfs.getMountPoint(), root.getMountPoint(), "SMB and NFS mounts of same filesystem must not share mount point")
+}
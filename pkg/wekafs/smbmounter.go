@@ -0,0 +1,232 @@
+package wekafs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"k8s.io/mount-utils"
+)
+
+// smbMounter mounts Weka filesystems over CIFS from the IP addresses of SMB interface groups
+type smbMounter struct {
+	mountMap              smbMountsMap
+	lock                  sync.Mutex
+	kMounter              mount.Interface
+	debugPath             string
+	selinuxSupport        *bool
+	gc                    *innerPathVolGc
+	exclusiveMountOptions []mutuallyExclusiveMountOptionSet
+	mountBaseDir          string
+	recoveredTargets      map[string]string
+	unmountTimeout        time.Duration
+	config                *DriverConfig
+}
+
+func (m *smbMounter) getGarbageCollector() *innerPathVolGc {
+	return m.gc
+}
+
+func newSmbMounter(ctx context.Context, driver *WekaFsDriver) *smbMounter {
+	var selinuxSupport *bool
+	if driver.selinuxSupport {
+		log.Debug().Msg("SELinux support is forced")
+		selinuxSupport = &[]bool{true}[0]
+	}
+	mounter := &smbMounter{mountMap: make(smbMountsMap), debugPath: driver.debugPath, selinuxSupport: selinuxSupport, exclusiveMountOptions: driver.config.mutuallyExclusiveOptions, mountBaseDir: mountBaseDirForRole(driver.csiMode), unmountTimeout: driver.config.unmountTimeout, config: driver.config}
+	mounter.gc = initInnerPathVolumeGc(mounter)
+	mounter.gc.config = driver.config
+	mounter.rebuildMountMap(ctx)
+	mounter.schedulePeriodicMountGc(ctx)
+	gcMetrics.setGc(mounter.getTransport(), mounter.gc)
+
+	return mounter
+}
+
+func (m *smbMounter) NewMount(fsName string, options MountOptions) AnyMount {
+	if m.kMounter == nil {
+		m.kMounter = mount.New("")
+	}
+	uniqueId := getStringSha1AsB32(string(dataTransportSmb) + ":" + fsName + ":" + options.String())
+	wMount := &smbMount{
+		mounter:      m,
+		kMounter:     m.kMounter,
+		fsName:       fsName,
+		debugPath:    m.debugPath,
+		mountPoint:   m.mountBaseDir + "/" + getAsciiPart(fsName, 64) + "-" + uniqueId,
+		mountOptions: options,
+		sharePath:    "/",
+	}
+	return wMount
+}
+
+func (m *smbMounter) getSelinuxStatus(ctx context.Context) bool {
+	if m.selinuxSupport != nil && *m.selinuxSupport {
+		return true
+	}
+	selinuxSupport := getSelinuxStatus(ctx)
+	m.selinuxSupport = &selinuxSupport
+	return *m.selinuxSupport
+}
+
+func (m *smbMounter) mountWithOptions(ctx context.Context, fsName string, mountOptions MountOptions, apiClient *apiclient.ApiClient) (string, error, UnmountFunc) {
+	mountOptions.setSelinux(m.getSelinuxStatus(ctx), MountProtocolSmb)
+	mountOptions = mountOptions.AsSmb()
+	mountOptions.Merge(mountOptions, m.exclusiveMountOptions)
+	mountObj := m.NewMount(fsName, mountOptions).(*smbMount)
+	mountObj.setSharePath(smbSharePathFromContext(ctx))
+
+	if err := mountObj.ensureMountIpAddress(ctx, apiClient); err != nil {
+		return "", err, NoOpUnmount
+	}
+
+	mountErr := mountObj.incRef(ctx, apiClient)
+
+	if mountErr != nil {
+		log.Ctx(ctx).Error().Err(mountErr).Msg("Failed mounting")
+		return "", mountErr, NoOpUnmount
+	}
+	return mountObj.getMountPoint(), nil, func() error {
+		if mountErr == nil {
+			return mountObj.decRef(ctx)
+		}
+		return nil
+	}
+}
+
+func (m *smbMounter) Mount(ctx context.Context, fs string, apiClient *apiclient.ApiClient) (string, error, UnmountFunc) {
+	return m.mountWithOptions(ctx, fs, getDefaultMountOptions(), apiClient)
+}
+
+func (m *smbMounter) unmountWithOptions(ctx context.Context, fsName string, options MountOptions) error {
+	options.setSelinux(m.getSelinuxStatus(ctx), MountProtocolSmb)
+	options = options.AsSmb()
+	options.Merge(options, m.exclusiveMountOptions)
+	log.Ctx(ctx).Trace().Strs("mount_options", options.Strings()).Str("filesystem", fsName).Msg("Received an unmount request")
+	mnt := m.NewMount(fsName, options).(*smbMount)
+	mnt.setSharePath(smbSharePathFromContext(ctx))
+	// same as for NFS, the IP address of the mount is only known from the actual mount point
+	if err := mnt.locateMountIP(); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to locate mount IP")
+		return err
+	}
+
+	return mnt.decRef(ctx)
+}
+
+func (m *smbMounter) LogActiveMounts(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.mountMap) > 0 {
+		count := 0
+		for refIndex, refCount := range m.mountMap {
+			parts := strings.Split(refIndex, "^")
+			logger := log.With().Str("mount_point", parts[0]).Str("mount_options", parts[1]).Str("ref_index", refIndex).Int("refcount", refCount).Logger()
+			if refCount > 0 {
+				logger.Trace().Msg("Mount is active")
+				count++
+			} else {
+				logger.Trace().Msg("Mount is not active")
+			}
+		}
+		log.Debug().Int("total", len(m.mountMap)).Int("active", count).Msg("Periodic checkup on mount map")
+	}
+}
+
+func (m *smbMounter) gcInactiveMounts(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for refIndex, refCount := range m.mountMap {
+		if refCount == 0 {
+			log.Trace().Str("ref_index", refIndex).Msg("Removing inactive mount from map")
+			delete(m.mountMap, refIndex)
+		}
+	}
+}
+
+func (m *smbMounter) schedulePeriodicMountGc(ctx context.Context) {
+	go func() {
+		log.Debug().Msg("Initializing periodic mount GC for smb transport")
+		for {
+			m.LogActiveMounts(ctx)
+			m.gcInactiveMounts(ctx)
+			select {
+			case <-ctx.Done():
+				log.Debug().Msg("Stopping periodic mount GC for smb transport")
+				return
+			case <-time.After(inactiveMountGcPeriod):
+			}
+		}
+	}()
+}
+
+func (m *smbMounter) getMountBaseDir() string {
+	return m.mountBaseDir
+}
+
+func (m *smbMounter) getTransport() DataTransport {
+	return dataTransportSmb
+}
+
+// resolveTransport returns SMB regardless of the requested transport, SMB mounter is only used as part of composite mounter
+//
+//goland:noinspection GoUnusedParameter
+func (m *smbMounter) resolveTransport(ctx context.Context, requested DataTransport) DataTransport {
+	return m.getTransport()
+}
+
+func (m *smbMounter) getMountStats() (mounts int, references int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, refCount := range m.mountMap {
+		if refCount > 0 {
+			mounts++
+			references += refCount
+		}
+	}
+	return mounts, references
+}
+
+func isSmbFsType(fsType string) bool {
+	return fsType == "cifs" || fsType == "smb3"
+}
+
+// rebuildMountMap restores refcounts of SMB mounts made before the plugin was restarted
+func (m *smbMounter) rebuildMountMap(ctx context.Context) {
+	if m.debugPath != "" {
+		return
+	}
+	if m.kMounter == nil {
+		m.kMounter = mount.New("")
+	}
+	refs, targets := rebuildMountRefs(ctx, m.getTransport(), m.mountBaseDir, m.kMounter, m.unmountTimeout)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for refIndex, refCount := range refs {
+		m.mountMap[refIndex] = refCount
+	}
+	m.recoveredTargets = targets
+}
+
+func (m *smbMounter) releaseRecoveredTarget(ctx context.Context, targetPath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	releaseRecoveredTarget(ctx, m.mountMap, m.recoveredTargets, m.kMounter, m.getTransport(), m.unmountTimeout, m.mountBaseDir, targetPath)
+}
+
+// holdPublishTarget does nothing, as publish targets depend on nothing but the filesystem mount they are bind mounted from
+//
+//goland:noinspection GoUnusedParameter
+func (m *smbMounter) holdPublishTarget(ctx context.Context, mountPoint, targetPath string) {}
+
+//goland:noinspection GoUnusedParameter
+func (m *smbMounter) releasePublishTarget(ctx context.Context, targetPath string) {}
+
+func (m *smbMounter) detachStaleMount(ctx context.Context, mountPoint string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return detachStaleMount(ctx, m.mountMap, m.recoveredTargets, m.mountBaseDir, mountPoint, lazyUnmount)
+}
@@ -0,0 +1,60 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// SmbShareInnerPathParam narrows the SMB share of directory-backed volumes to the volume directory
+const SmbShareInnerPathParam = "smbShareInnerPath"
+
+func parseSmbShareInnerPath(params map[string]string) (bool, error) {
+	val, ok := params[SmbShareInnerPathParam]
+	if !ok {
+		return false, nil
+	}
+	ret, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, must be true or false", SmbShareInnerPathParam, val)
+	}
+	return ret, nil
+}
+
+// isSmbShareNarrowed returns true if the volume is mounted over SMB from a share of its own directory,
+// rather than from the share of the filesystem root
+func (v *Volume) isSmbShareNarrowed(ctx context.Context) bool {
+	return v.smbShareInnerPath && v.hasInnerPath() && !v.isOnSnapshot() &&
+		v.server.getMounter().resolveTransport(ctx, v.transport) == dataTransportSmb
+}
+
+// getSmbSharePath returns the path inside the filesystem of the SMB share the volume is mounted from
+func (v *Volume) getSmbSharePath(ctx context.Context) string {
+	if v.isSmbShareNarrowed(ctx) {
+		return v.GetRelativePath(ctx)
+	}
+	return "/"
+}
+
+// deleteSmbShare removes the SMB share of the directory of a directory-backed volume, which is created on publish
+// with smbShareInnerPath. StorageClass parameters are not known on volume deletion, so the share is looked up by path
+func (v *Volume) deleteSmbShare(ctx context.Context) error {
+	if !v.requiresGc() || v.apiClient == nil || v.server.getMounter().resolveTransport(ctx, dataTransportSmb) != dataTransportSmb {
+		return nil
+	}
+	return v.apiClient.EnsureNoCsiSmbShareForPath(ctx, v.FilesystemName, v.GetRelativePath(ctx))
+}
+
+type smbSharePathCtxKey struct{}
+
+// withSmbSharePath passes the path of the SMB share of a volume down to the SMB mounter
+func withSmbSharePath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, smbSharePathCtxKey{}, path)
+}
+
+func smbSharePathFromContext(ctx context.Context) string {
+	if path, ok := ctx.Value(smbSharePathCtxKey{}).(string); ok {
+		return path
+	}
+	return "/"
+}
@@ -150,6 +150,7 @@ func (s *Snapshot) Create(ctx context.Context) error {
 	if err := s.apiClient.CreateSnapshot(ctx, sr, snap); err != nil {
 		return status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
 	}
+	recordJournalStep(ctx, journalStepSnapshotCreated)
 	logger.Info().Str("snapshot", s.SnapshotName).
 		Str("snapshot_uid", snap.Uid.String()).
 		Str("access_point", s.SnapshotIntegrityId).Msg("Snapshot was created successfully")
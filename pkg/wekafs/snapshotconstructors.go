@@ -20,7 +20,7 @@ func NewSnapshotFromVolumeCreate(ctx context.Context, name string, sourceVolume
 	snapIntegrityId := generateSnapshotIntegrityID(name, srcVolId)
 	snapName := generateWekaSnapNameForSnapshot(server.getConfig().SnapshotPrefix, name)
 	innerPath := sliceInnerPathFromVolumeId(srcVolId)
-	snapshotId := generateSnapshotIdFromComponents(SnapshotTypeUnifiedSnap, filesystemName, snapNameHash, snapIntegrityId, innerPath)
+	snapshotId := generateSnapshotIdForVolume(name, srcVolId)
 	var sourceSnapUid *uuid.UUID
 	if sourceVolume != nil && sourceVolume.isOnSnapshot() {
 		obj, err := sourceVolume.getSnapshotObj(ctx, false)
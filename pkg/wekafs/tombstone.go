@@ -0,0 +1,379 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// SnapshotBeforeDeleteParam is the StorageClass parameter enabling tombstoning of filesystem-backed volumes:
+	// "true" takes a final snapshot, "upload" also uploads it to the object store of the filesystem if attached
+	SnapshotBeforeDeleteParam = "snapshotBeforeDelete"
+	// SnapshotBeforeDeleteRetentionDaysParam is the number of days a tombstoned filesystem is kept before it is deleted
+	SnapshotBeforeDeleteRetentionDaysParam = "snapshotBeforeDeleteRetentionDays"
+	// DeferDeletionWithSnapshotsParam is the StorageClass parameter allowing deletion of filesystem-backed volumes whose
+	// filesystem has snapshots, by tombstoning the filesystem until its retention expires and its last snapshot is gone
+	DeferDeletionWithSnapshotsParam = "deferDeletionWithSnapshots"
+
+	snapshotBeforeDeleteUpload               = "upload"
+	defaultSnapshotBeforeDeleteRetentionDays = 7
+
+	// tombstone snapshots are named <snapshot prefix>tomb-<expiry>-<hash of filesystem>, expiry in UTC
+	tombstoneSnapshotInfix      = "tomb-"
+	tombstoneExpiryFormat       = "200601021504"
+	tombstoneSnapshotHashLength = 7
+
+	// stow status of a snapshot that was never uploaded to object store
+	snapshotStowStatusNone = "NONE"
+
+	tombstonePurgeInterval      = time.Hour
+	tombstonePurgeOperationName = "PurgeTombstones"
+)
+
+var tombstonePurgesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "tombstones",
+	Name:      "purges_total",
+	Help:      "Total number of tombstoned filesystems deleted after their retention period",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(tombstonePurgesTotal)
+}
+
+// generateWekaTombstoneSnapshotName returns the name of the final snapshot of a tombstoned filesystem,
+// which also records until when the filesystem is retained
+func generateWekaTombstoneSnapshotName(prefix, fsName string, expiry time.Time) string {
+	return prefix + tombstoneSnapshotInfix + expiry.UTC().Format(tombstoneExpiryFormat) + "-" + getStringSha1AsB32(fsName)[:tombstoneSnapshotHashLength]
+}
+
+func generateWekaTombstoneAccessPoint(fsName string) string {
+	return getStringSha1AsB32("tombstone:" + fsName)[:MaxHashLengthForObjectNames]
+}
+
+// parseTombstoneSnapshotName returns the expiry of a tombstone snapshot, or false if the snapshot is not a tombstone
+func parseTombstoneSnapshotName(prefix, name string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, prefix+tombstoneSnapshotInfix)
+	if !ok || len(rest) < len(tombstoneExpiryFormat) {
+		return time.Time{}, false
+	}
+	expiry, err := time.Parse(tombstoneExpiryFormat, rest[:len(tombstoneExpiryFormat)])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiry, true
+}
+
+func isTombstoneSnapshot(prefix, name string) bool {
+	_, ok := parseTombstoneSnapshotName(prefix, name)
+	return ok
+}
+
+// obtainSnapshotBeforeDeleteParams sets tombstoning of the volume from StorageClass parameters, which are also
+// present in the volume context of the PV upon deletion. The retention applies both to filesystems tombstoned by
+// snapshotBeforeDelete, and to filesystems whose deletion is deferred due to snapshots
+func (v *Volume) obtainSnapshotBeforeDeleteParams(params map[string]string) error {
+	if raw := params[DeferDeletionWithSnapshotsParam]; raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid value of %s: %s", DeferDeletionWithSnapshotsParam, raw)
+		}
+		v.deferDeletion = enabled
+	}
+	if val := params[SnapshotBeforeDeleteParam]; val == snapshotBeforeDeleteUpload {
+		v.snapshotBeforeDelete = true
+		v.uploadSnapshotBeforeDelete = true
+	} else if val != "" {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid value of %s: %s, must be true, false or %s", SnapshotBeforeDeleteParam, val, snapshotBeforeDeleteUpload)
+		}
+		v.snapshotBeforeDelete = enabled
+	}
+	if !v.snapshotBeforeDelete && !v.deferDeletion {
+		return nil
+	}
+	days := defaultSnapshotBeforeDeleteRetentionDays
+	if raw, ok := params[SnapshotBeforeDeleteRetentionDaysParam]; ok && raw != "" {
+		var err error
+		if days, err = strconv.Atoi(raw); err != nil || days < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid value of %s: %s", SnapshotBeforeDeleteRetentionDaysParam, raw)
+		}
+	}
+	v.tombstoneRetention = time.Duration(days) * 24 * time.Hour
+	return nil
+}
+
+// tombstoneFilesystem takes a final snapshot of the filesystem of the volume, and uploads it if requested and
+// the filesystem has an object store attached. The filesystem is left in place, to be deleted by tombstonePurger
+// once the retention period expires and no snapshots depend on it
+func (v *Volume) tombstoneFilesystem(ctx context.Context) error {
+	op := "tombstoneFilesystem"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx).With().Str("volume_id", v.GetId()).Str("filesystem", v.FilesystemName).Logger()
+
+	fsObj, err := v.getFilesystemObj(ctx, true)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to fetch filesystem for deletion: %s, %e", v.FilesystemName, err)
+	}
+	if fsObj == nil || fsObj.IsRemoving {
+		logger.Debug().Msg("Filesystem does not exist or is being removed, not tombstoning it")
+		return nil
+	}
+	snapshots, err := v.getUnderlyingSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := v.server.getConfig().SnapshotPrefix
+	var tombstone *apiclient.Snapshot
+	for i, s := range *snapshots {
+		if isTombstoneSnapshot(prefix, s.Name) {
+			logger.Debug().Str("snapshot", s.Name).Msg("Filesystem is already tombstoned")
+			tombstone = &(*snapshots)[i]
+			break
+		}
+	}
+	if tombstone == nil {
+		expiry := time.Now().Add(v.tombstoneRetention)
+		name := generateWekaTombstoneSnapshotName(prefix, v.FilesystemName, expiry)
+		sr, err := apiclient.NewSnapshotCreateRequest(name, generateWekaTombstoneAccessPoint(v.FilesystemName), fsObj.Uid, nil, false)
+		if err != nil {
+			return err
+		}
+		tombstone = &apiclient.Snapshot{}
+		if err := v.apiClient.CreateSnapshot(ctx, sr, tombstone); err != nil {
+			logger.Error().Err(err).Msg("Failed to create final snapshot of filesystem")
+			return status.Errorf(codes.Internal, "Failed to create final snapshot of filesystem %s: %s", v.FilesystemName, err)
+		}
+		logger.Info().Str("snapshot", name).Time("retained_until", expiry).Msg("Filesystem tombstoned, it will be deleted after retention period")
+	}
+
+	if !v.uploadSnapshotBeforeDelete {
+		return nil
+	}
+	if len(fsObj.ObsBuckets) == 0 && len(fsObj.ObjectStorages) == 0 {
+		logger.Debug().Msg("Filesystem has no object store attached, final snapshot is kept locally only")
+		return nil
+	}
+	if tombstone.StowStatus != "" && tombstone.StowStatus != snapshotStowStatusNone {
+		logger.Debug().Str("stow_status", tombstone.StowStatus).Msg("Final snapshot already uploaded to object store")
+		return nil
+	}
+	if err := v.apiClient.UploadSnapshot(ctx, &apiclient.SnapshotUploadRequest{Uid: tombstone.Uid}); err != nil {
+		logger.Error().Err(err).Str("snapshot", tombstone.Name).Msg("Failed to upload final snapshot to object store")
+		return status.Errorf(codes.Internal, "Failed to upload final snapshot of filesystem %s: %s", v.FilesystemName, err)
+	}
+	logger.Info().Str("snapshot", tombstone.Name).Msg("Final snapshot of filesystem is uploaded to object store")
+	return nil
+}
+
+// obtainDeletionParams sets tombstoning of a filesystem-backed volume about to be deleted from its PV.
+// Deletion of filesystems having snapshots is deferred only if requested and tombstoned filesystems are purged
+func (cs *ControllerServer) obtainDeletionParams(ctx context.Context, volume *Volume) error {
+	if cs.manager == nil || !volume.isFilesystem() {
+		return nil
+	}
+	pv, err := cs.getPvByVolumeHandle(ctx, volume.GetId())
+	if err != nil {
+		return err
+	}
+	if pv == nil || pv.Spec.CSI == nil {
+		return nil
+	}
+	if err := volume.obtainSnapshotBeforeDeleteParams(pv.Spec.CSI.VolumeAttributes); err != nil {
+		return err
+	}
+	volume.deferDeletion = volume.deferDeletion && cs.tombstones != nil
+	return nil
+}
+
+// tombstonePurger periodically deletes tombstoned filesystems whose retention period expired and that have no
+// snapshots depending on them anymore. It is added as a leader election runnable to the manager
+type tombstonePurger struct {
+	cs         *ControllerServer
+	driverName string
+	// clients of tombstoned filesystems since start, as their secrets may not be resolvable from storage classes
+	clients map[*apiclient.ApiClient]bool
+	// wakes the purger up once a snapshot that might prevent deletion of a tombstoned filesystem is deleted
+	wake chan struct{}
+	sync.Mutex
+}
+
+func newTombstonePurger(cs *ControllerServer, driverName string) *tombstonePurger {
+	return &tombstonePurger{cs: cs, driverName: driverName, clients: make(map[*apiclient.ApiClient]bool), wake: make(chan struct{}, 1)}
+}
+
+func (p *tombstonePurger) addClient(client *apiclient.ApiClient) {
+	if p == nil || client == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.clients[client] = true
+}
+
+// trigger starts purging right away, without waiting for the next interval
+func (p *tombstonePurger) trigger(client *apiclient.ApiClient) {
+	if p == nil {
+		return
+	}
+	p.addClient(client)
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start implements manager.Runnable
+func (p *tombstonePurger) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "tombstone-purger").Logger()
+	ctx = logger.WithContext(ctx)
+	for {
+		p.purge(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tombstonePurgeInterval):
+		case <-p.wake:
+		}
+	}
+}
+
+func (p *tombstonePurger) purge(ctx context.Context) {
+	op := tombstonePurgeOperationName
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	for client := range p.collectClients(ctx) {
+		var snapshots []apiclient.Snapshot
+		if err := client.FindSnapshotsByFilter(ctx, &apiclient.Snapshot{}, &snapshots); err != nil {
+			logger.Error().Err(err).Str("cluster", client.ClusterName).Msg("Failed to list snapshots")
+			continue
+		}
+		for _, fs := range findExpiredTombstones(snapshots, p.cs.config.SnapshotPrefix, time.Now()) {
+			err := p.deleteFilesystem(ctx, client, fs)
+			if errors.Is(err, ErrFilesystemHasUnderlyingSnapshots) {
+				logger.Debug().Str("filesystem", fs).Msg("Tombstoned filesystem still has snapshots, deferring its deletion")
+				continue
+			}
+			if err != nil {
+				logger.Error().Err(err).Str("filesystem", fs).Msg("Failed to delete tombstoned filesystem")
+				tombstonePurgesTotal.WithLabelValues("failure").Inc()
+				continue
+			}
+			logger.Info().Str("filesystem", fs).Msg("Deleted tombstoned filesystem after retention period")
+			tombstonePurgesTotal.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+// findExpiredTombstones returns filesystems whose tombstone snapshot expired
+func findExpiredTombstones(snapshots []apiclient.Snapshot, prefix string, now time.Time) []string {
+	var ret []string
+	for _, s := range snapshots {
+		expiry, ok := parseTombstoneSnapshotName(prefix, s.Name)
+		if ok && !s.IsRemoving && now.After(expiry) {
+			ret = append(ret, s.Filesystem)
+		}
+	}
+	return ret
+}
+
+func (p *tombstonePurger) deleteFilesystem(ctx context.Context, client *apiclient.ApiClient, fs string) error {
+	volumeId := string(VolumeTypeUnified) + "/" + fs
+	releaseLock, err := p.cs.locks.tryAcquire(ctx, tombstonePurgeOperationName, volumeLockKey(volumeId))
+	defer releaseLock()
+	if err != nil {
+		return err
+	}
+	volume, err := NewVolumeFromId(ctx, volumeId, client, p.cs)
+	if err != nil {
+		return err
+	}
+	if !volume.isFilesystem() {
+		return errors.New("tombstone snapshot is not located on a filesystem-backed volume")
+	}
+	if !volume.isAllowedForDeletion(ctx) {
+		return ErrFilesystemHasUnderlyingSnapshots
+	}
+	return volume.deleteFilesystem(ctx)
+}
+
+// collectClients returns API clients of storage classes and PVs of the driver, and of filesystems tombstoned since start
+func (p *tombstonePurger) collectClients(ctx context.Context) map[*apiclient.ApiClient]bool {
+	clients := p.cs.collectApiClients(ctx, p.driverName)
+	p.Lock()
+	defer p.Unlock()
+	for client := range p.clients {
+		clients[client] = true
+	}
+	return clients
+}
+
+// collectApiClients returns API clients of the secrets referenced by storage classes and PVs of the driver.
+// Secrets resolved per PVC are skipped, as they cannot be determined from the storage class
+func (cs *ControllerServer) collectApiClients(ctx context.Context, driverName string) map[*apiclient.ApiClient]bool {
+	logger := log.Ctx(ctx)
+	reader := cs.manager.GetAPIReader()
+	refs := make(map[v1.SecretReference]bool)
+
+	scList := &storagev1.StorageClassList{}
+	if err := reader.List(ctx, scList); err != nil {
+		logger.Error().Err(err).Msg("Failed to list storage classes")
+	}
+	for _, sc := range scList.Items {
+		name := sc.Parameters[storageClassProvisionerSecretName]
+		if sc.Provisioner != driverName || strings.Contains(name, "${") {
+			continue
+		}
+		refs[v1.SecretReference{Name: name, Namespace: sc.Parameters[storageClassProvisionerSecretNamespace]}] = true
+	}
+	pvList := &v1.PersistentVolumeList{}
+	if err := reader.List(ctx, pvList); err != nil {
+		logger.Error().Err(err).Msg("Failed to list persistent volumes")
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if ref := secretRefOfPv(pv); ref != nil {
+			refs[*ref] = true
+		}
+	}
+
+	clients := make(map[*apiclient.ApiClient]bool)
+	for ref := range refs {
+		secrets := make(map[string]string)
+		if ref.Name != "" {
+			var err error
+			if secrets, err = cs.getSecretsByRef(ctx, &ref); err != nil {
+				logger.Warn().Err(err).Msg("Failed to fetch API secret")
+				continue
+			}
+		}
+		client, err := cs.api.GetClientFromSecrets(ctx, secrets)
+		if err != nil || client == nil {
+			continue
+		}
+		clients[client] = true
+	}
+	return clients
+}
@@ -0,0 +1,73 @@
+package wekafs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+)
+
+func TestTombstoneSnapshotName(t *testing.T) {
+	expiry := time.Date(2026, 10, 25, 13, 45, 30, 0, time.UTC)
+	name := generateWekaTombstoneSnapshotName("csisnp-", "csivol-pvc-1234-abcdefabcdef", expiry)
+	assert.LessOrEqual(t, len(name), 32)
+	parsed, ok := parseTombstoneSnapshotName("csisnp-", name)
+	require.True(t, ok)
+	assert.Equal(t, expiry.Truncate(time.Minute), parsed)
+
+	for _, other := range []string{"csisnp-snapshot-1234-abcdef", "csisnp-seed-abcdef", "csisnp-tomb-notadate-abc", "manual"} {
+		assert.False(t, isTombstoneSnapshot("csisnp-", other), other)
+	}
+
+	snapshots := []apiclient.Snapshot{
+		{Name: generateWekaTombstoneSnapshotName("csisnp-", "csivol-expired", expiry.Add(-time.Hour)), Filesystem: "csivol-expired"},
+		{Name: generateWekaTombstoneSnapshotName("csisnp-", "csivol-retained", expiry.Add(time.Hour)), Filesystem: "csivol-retained"},
+		{Name: generateWekaTombstoneSnapshotName("csisnp-", "csivol-removing", expiry.Add(-time.Hour)), Filesystem: "csivol-removing", IsRemoving: true},
+		{Name: "csisnp-snapshot-1234-abcdef", Filesystem: "csivol-snap"},
+	}
+	assert.Equal(t, []string{"csivol-expired"}, findExpiredTombstones(snapshots, "csisnp-", expiry))
+}
+
+func TestObtainSnapshotBeforeDeleteParams(t *testing.T) {
+	v := &Volume{}
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{}))
+	assert.False(t, v.snapshotBeforeDelete)
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "false"}))
+	assert.False(t, v.snapshotBeforeDelete)
+
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "true"}))
+	assert.True(t, v.snapshotBeforeDelete)
+	assert.False(t, v.uploadSnapshotBeforeDelete)
+	assert.Equal(t, 7*24*time.Hour, v.tombstoneRetention)
+
+	v = &Volume{}
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "upload", SnapshotBeforeDeleteRetentionDaysParam: "30"}))
+	assert.True(t, v.uploadSnapshotBeforeDelete)
+	assert.Equal(t, 30*24*time.Hour, v.tombstoneRetention)
+
+	v = &Volume{}
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "false"}))
+	assert.False(t, v.deferDeletion, "deletion of filesystems with snapshots is deferred only on request")
+	require.NoError(t, v.obtainSnapshotBeforeDeleteParams(map[string]string{DeferDeletionWithSnapshotsParam: "true"}))
+	assert.True(t, v.deferDeletion)
+	assert.False(t, v.snapshotBeforeDelete)
+	assert.Equal(t, 7*24*time.Hour, v.tombstoneRetention, "deferred filesystems are retained as tombstoned ones")
+
+	assert.Error(t, (&Volume{}).obtainSnapshotBeforeDeleteParams(map[string]string{DeferDeletionWithSnapshotsParam: "later"}))
+	assert.Error(t, (&Volume{}).obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "always"}))
+	assert.Error(t, (&Volume{}).obtainSnapshotBeforeDeleteParams(map[string]string{SnapshotBeforeDeleteParam: "true", SnapshotBeforeDeleteRetentionDaysParam: "-1"}))
+}
+
+func TestTombstonePurgerTrigger(t *testing.T) {
+	var np *tombstonePurger
+	np.trigger(&apiclient.ApiClient{})
+
+	p := newTombstonePurger(&ControllerServer{}, "csi.weka.io")
+	client := &apiclient.ApiClient{}
+	p.trigger(client)
+	p.trigger(client)
+	assert.Len(t, p.clients, 1)
+	assert.Len(t, p.wake, 1, "triggers are coalesced until the purger wakes up")
+}
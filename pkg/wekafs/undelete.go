@@ -0,0 +1,379 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wekafs/csi-wekafs/pkg/wekafs/apiclient"
+	"go.opentelemetry.io/otel"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	volumeUndeletePhaseSucceeded = "Succeeded"
+	volumeUndeletePhaseFailed    = "Failed"
+
+	volumeUndeleteReconcileInterval = 30 * time.Second
+	volumeUndeleteOperationName     = "UndeleteVolume"
+
+	// trashSweepInterval is the longest interval between sweeps of trash for volumes whose retention expired
+	trashSweepInterval    = time.Hour
+	minTrashSweepInterval = time.Minute
+)
+
+var volumeUndeleteGvk = schema.GroupVersionKind{Group: "csi.weka.io", Version: "v1alpha1", Kind: "WekaVolumeUndelete"}
+
+var ErrVolumeNotInTrash = errors.New("volume was not found in trash")
+
+// volumeUndeleteSpec is the spec of a WekaVolumeUndelete request. The volume is looked up either by its original
+// volume ID, or by the PVC it was bound to on a specific filesystem, in which case the latest deleted one is taken
+type volumeUndeleteSpec struct {
+	VolumeId       string              `json:"volumeId,omitempty"`
+	FilesystemName string              `json:"filesystemName,omitempty"`
+	PvcNamespace   string              `json:"pvcNamespace,omitempty"`
+	PvcName        string              `json:"pvcName,omitempty"`
+	SecretRef      *v1.SecretReference `json:"secretRef,omitempty"`
+}
+
+type volumeUndeleteStatus struct {
+	Phase        string `json:"phase,omitempty"`
+	Message      string `json:"message,omitempty"`
+	VolumeId     string `json:"volumeId,omitempty"`
+	PvcNamespace string `json:"pvcNamespace,omitempty"`
+	PvcName      string `json:"pvcName,omitempty"`
+	Capacity     int64  `json:"capacity,omitempty"`
+	DeletedAt    string `json:"deletedAt,omitempty"`
+	CompletedAt  string `json:"completedAt,omitempty"`
+}
+
+// findTrashedVolume returns the name and info of the volume in trash matching the spec
+func findTrashedVolume(names []string, infos map[string]*trashInfo, spec *volumeUndeleteSpec) (string, *trashInfo) {
+	var name string
+	var found *trashInfo
+	for _, n := range names {
+		info := infos[n]
+		if info == nil {
+			continue
+		}
+		if spec.VolumeId != "" {
+			if info.VolumeId == spec.VolumeId {
+				return n, info
+			}
+			continue
+		}
+		if info.PvcName != spec.PvcName || info.PvcNamespace != spec.PvcNamespace {
+			continue
+		}
+		if found == nil || info.DeletedAt.After(found.DeletedAt) {
+			name, found = n, info
+		}
+	}
+	return name, found
+}
+
+// contextWithClaimOfVolume adds the PVC bound to the PV of the volume to the audit info of ctx,
+// so it is recorded for volumes retained in trash
+func (cs *ControllerServer) contextWithClaimOfVolume(ctx context.Context, volumeId string) context.Context {
+	if cs.manager == nil {
+		return ctx
+	}
+	pv, err := cs.getPvByVolumeHandle(ctx, volumeId)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to look up persistent volume, PVC will not be recorded in trash info")
+		return ctx
+	}
+	if pv == nil || pv.Spec.ClaimRef == nil {
+		return ctx
+	}
+	return apiclient.ContextWithAuditInfo(ctx, apiclient.AuditInfo{PvcNamespace: pv.Spec.ClaimRef.Namespace, PvcName: pv.Spec.ClaimRef.Name})
+}
+
+// volumeUndeleter processes WekaVolumeUndelete requests, moving directory volumes retained in trash back to their
+// original location and restoring their quota, so a statically provisioned PV can bind to them again.
+// It is added as a leader election runnable to the manager
+type volumeUndeleter struct {
+	cs *ControllerServer
+}
+
+func newVolumeUndeleter(cs *ControllerServer) *volumeUndeleter {
+	return &volumeUndeleter{cs: cs}
+}
+
+// Start implements manager.Runnable
+func (r *volumeUndeleter) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "volume-undeleter").Logger()
+	ctx = logger.WithContext(ctx)
+	for {
+		r.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(volumeUndeleteReconcileInterval):
+		}
+	}
+}
+
+func (r *volumeUndeleter) reconcile(ctx context.Context) {
+	logger := log.Ctx(ctx)
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(volumeUndeleteGvk.GroupVersion().WithKind(volumeUndeleteGvk.Kind + "List"))
+	if err := r.cs.manager.GetAPIReader().List(ctx, list); err != nil {
+		if meta.IsNoMatchError(err) {
+			logger.Trace().Msg("WekaVolumeUndelete resource is not installed, skipping")
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to list volume undelete requests")
+		return
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		if phase == volumeUndeletePhaseSucceeded || phase == volumeUndeletePhaseFailed {
+			continue
+		}
+		r.process(ctx, obj)
+	}
+}
+
+func (r *volumeUndeleter) process(ctx context.Context, obj *unstructured.Unstructured) {
+	op := volumeUndeleteOperationName
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Str("request", obj.GetName()).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	spec := &volumeUndeleteSpec{}
+	specObj, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(specObj, spec)
+	status := &volumeUndeleteStatus{}
+	var info *trashInfo
+	retry := false
+	if err == nil {
+		info, retry, err = r.undelete(ctx, spec)
+	}
+	if retry {
+		logger.Info().Err(err).Msg("Volume cannot be undeleted at the moment, will retry")
+		return
+	}
+	if info != nil {
+		status.VolumeId = info.VolumeId
+		status.PvcNamespace = info.PvcNamespace
+		status.PvcName = info.PvcName
+		status.Capacity = info.Capacity
+		status.DeletedAt = info.DeletedAt.Format(time.RFC3339)
+	}
+	status.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to undelete volume")
+		status.Phase = volumeUndeletePhaseFailed
+		status.Message = err.Error()
+	} else {
+		logger.Info().Str("volume_id", info.VolumeId).Msg("Volume undeleted")
+		status.Phase = volumeUndeletePhaseSucceeded
+		status.Message = fmt.Sprintf("volume restored to %s", info.InnerPath)
+	}
+
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err == nil {
+		err = unstructured.SetNestedMap(obj.Object, statusObj, "status")
+	}
+	if err == nil {
+		err = r.cs.manager.GetClient().Status().Update(ctx, obj)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to update status of volume undelete request")
+	}
+}
+
+// undelete moves the volume matching spec from trash back to its inner path and restores its quota.
+// Returns whether the request should be retried later, e.g. since trash of the filesystem is being purged
+func (r *volumeUndeleter) undelete(ctx context.Context, spec *volumeUndeleteSpec) (info *trashInfo, retry bool, retErr error) {
+	fs := spec.FilesystemName
+	if spec.VolumeId != "" {
+		fs = sliceFilesystemNameFromVolumeId(spec.VolumeId)
+	}
+	if fs == "" || (spec.VolumeId == "" && spec.PvcName == "") {
+		return nil, false, errors.New("either volumeId, or filesystemName and pvcName must be specified")
+	}
+	secrets := make(map[string]string)
+	if spec.SecretRef != nil {
+		var err error
+		if secrets, err = r.cs.getSecretsByRef(ctx, spec.SecretRef); err != nil {
+			return nil, true, err
+		}
+	}
+	client, err := r.cs.api.GetClientFromSecrets(ctx, secrets)
+	if err != nil {
+		return nil, true, err
+	}
+
+	resume, err := r.cs.mounter.getGarbageCollector().pausePurge(ctx, fs, client)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resume()
+	path, err, unmount := r.cs.mounter.Mount(ctx, fs, client)
+	defer deferUmount(unmount, &retErr)
+	if err != nil {
+		return nil, true, err
+	}
+	names, infos, err := listTrash(path)
+	if err != nil {
+		return nil, true, err
+	}
+	name, info := findTrashedVolume(names, infos, spec)
+	if info == nil {
+		return nil, false, ErrVolumeNotInTrash
+	}
+
+	releaseLock, err := r.cs.locks.tryAcquire(ctx, volumeUndeleteOperationName, volumeLockKey(info.VolumeId))
+	defer releaseLock()
+	if err != nil {
+		return info, true, err
+	}
+	target := filepath.Join(path, info.InnerPath)
+	if _, err := os.Lstat(target); err == nil {
+		return info, false, fmt.Errorf("original location %s of volume is occupied", info.InnerPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), DefaultVolumePermissions); err != nil {
+		return info, true, err
+	}
+	if err := os.Rename(filepath.Join(path, garbagePath, name), target); err != nil {
+		return info, true, err
+	}
+	if err := removeTrashInfo(path, name); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to remove trash info of undeleted volume")
+	}
+	if info.Capacity <= 0 {
+		return info, false, nil
+	}
+	volume, err := NewVolumeFromId(ctx, info.VolumeId, client, r.cs)
+	if err == nil {
+		enforceCapacity := info.EnforceCapacity
+		err = volume.UpdateCapacity(ctx, &enforceCapacity, info.Capacity)
+	}
+	if err != nil {
+		return info, false, fmt.Errorf("volume was restored to %s, but its quota could not be set: %w", info.InnerPath, err)
+	}
+	return info, false, nil
+}
+
+// trashSweeper starts garbage collection of filesystems holding directory-backed volumes upon start and periodically.
+// Expiry of volumes retained in trash is otherwise scheduled in memory of the plugin only, so it is lost on restart
+// or change of leader. It is added as a leader election runnable to the manager
+type trashSweeper struct {
+	cs         *ControllerServer
+	driverName string
+	interval   time.Duration
+}
+
+func newTrashSweeper(cs *ControllerServer, driverName string) *trashSweeper {
+	return &trashSweeper{
+		cs:         cs,
+		driverName: driverName,
+		interval:   max(min(cs.config.trashRetention, trashSweepInterval), minTrashSweepInterval),
+	}
+}
+
+// Start implements manager.Runnable
+func (s *trashSweeper) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "trash-sweeper").Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Dur("interval", s.interval).Msg("Starting sweeps of trash for volumes with expired retention")
+	for {
+		s.sweep(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Stopping sweeps of trash")
+			return nil
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *trashSweeper) sweep(ctx context.Context) {
+	logger := log.Ctx(ctx)
+	gc := s.cs.mounter.getGarbageCollector()
+	for ref, filesystems := range collectDirectoryFilesystems(ctx, s.cs.manager.GetAPIReader(), s.driverName) {
+		secrets := make(map[string]string)
+		if ref.Name != "" {
+			var err error
+			if secrets, err = s.cs.getSecretsByRef(ctx, &ref); err != nil {
+				logger.Warn().Err(err).Msg("Failed to fetch API secret, skipping sweep of its filesystems")
+				continue
+			}
+		}
+		client, err := s.cs.api.GetClientFromSecrets(ctx, secrets)
+		if err != nil || client == nil {
+			continue
+		}
+		for fs := range filesystems {
+			logger.Trace().Str("filesystem", fs).Msg("Sweeping trash of filesystem")
+			gc.initiateGarbageCollection(ctx, fs, client)
+		}
+	}
+}
+
+// collectDirectoryFilesystems returns filesystems that might hold directory-backed volumes of the driver, by the
+// secret of their API client: filesystems of directory-backed PVs, and filesystems storage classes provision into.
+// Secrets resolved per PVC are skipped, as they cannot be determined from the storage class
+func collectDirectoryFilesystems(ctx context.Context, reader runtimeclient.Reader, driverName string) map[v1.SecretReference]map[string]bool {
+	logger := log.Ctx(ctx)
+	ret := make(map[v1.SecretReference]map[string]bool)
+	add := func(ref v1.SecretReference, fs string) {
+		if ret[ref] == nil {
+			ret[ref] = make(map[string]bool)
+		}
+		ret[ref][fs] = true
+	}
+
+	pvList := &v1.PersistentVolumeList{}
+	if err := reader.List(ctx, pvList); err != nil {
+		logger.Error().Err(err).Msg("Failed to list persistent volumes")
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		volumeId := pv.Spec.CSI.VolumeHandle
+		if sliceSnapshotAccessPointFromVolumeId(volumeId) != "" || sliceInnerPathFromVolumeId(volumeId) == "" {
+			continue
+		}
+		var ref v1.SecretReference
+		if r := secretRefOfPv(pv); r != nil {
+			ref = *r
+		}
+		add(ref, sliceFilesystemNameFromVolumeId(volumeId))
+	}
+
+	scList := &storagev1.StorageClassList{}
+	if err := reader.List(ctx, scList); err != nil {
+		logger.Error().Err(err).Msg("Failed to list storage classes")
+	}
+	for _, sc := range scList.Items {
+		fs := sc.Parameters["filesystemName"]
+		name := sc.Parameters[storageClassProvisionerSecretName]
+		if sc.Provisioner != driverName || fs == "" || strings.Contains(name, "${") {
+			continue
+		}
+		var ref v1.SecretReference
+		if name != "" {
+			ref = v1.SecretReference{Name: name, Namespace: sc.Parameters[storageClassProvisionerSecretNamespace]}
+		}
+		add(ref, fs)
+	}
+	return ret
+}
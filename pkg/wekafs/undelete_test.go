@@ -0,0 +1,55 @@
+package wekafs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCollectDirectoryFilesystems(t *testing.T) {
+	pv := func(name, driver, handle string, secret *v1.SecretReference) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{
+				Driver: driver, VolumeHandle: handle, NodePublishSecretRef: secret,
+			}}},
+		}
+	}
+	secret := &v1.SecretReference{Name: "weka-api", Namespace: "csi-wekafs"}
+	sc := func(name string, params map[string]string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Provisioner: "csi.weka.io", Parameters: params}
+	}
+	c := fake.NewClientBuilder().WithObjects(
+		pv("dir", "csi.weka.io", "dir/v1/default/csi-volumes/pvc-1", secret),
+		pv("legacy", "csi.weka.io", "dir/v1/legacy/csi-volumes/pvc-2", nil),
+		pv("fs", "csi.weka.io", "weka/v2/csivol-1", secret),
+		pv("snap", "csi.weka.io", "weka/v2/default:snapvol-1", secret),
+		pv("other", "nfs.csi.k8s.io", "dir/v1/other/csi-volumes/pvc-3", secret),
+		sc("empty-fs", map[string]string{"filesystemName": "empty", storageClassProvisionerSecretName: "weka-api", storageClassProvisionerSecretNamespace: "csi-wekafs"}),
+		sc("per-pvc", map[string]string{"filesystemName": "tenant", storageClassProvisionerSecretName: "${pvc.name}"}),
+		sc("fs-backed", map[string]string{"volumeType": "weka/v2"}),
+	).Build()
+
+	ret := collectDirectoryFilesystems(context.Background(), c, "csi.weka.io")
+	assert.Equal(t, map[v1.SecretReference]map[string]bool{
+		*secret:              {"default": true, "empty": true},
+		v1.SecretReference{}: {"legacy": true},
+	}, ret)
+}
+
+func TestTrashSweepInterval(t *testing.T) {
+	for retention, expected := range map[time.Duration]time.Duration{
+		time.Second:        minTrashSweepInterval,
+		10 * time.Minute:   10 * time.Minute,
+		7 * 24 * time.Hour: trashSweepInterval,
+	} {
+		s := newTrashSweeper(&ControllerServer{config: &DriverConfig{trashRetention: retention}}, "csi.weka.io")
+		assert.Equal(t, expected, s.interval, "retention %s", retention)
+	}
+}
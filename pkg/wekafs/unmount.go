@@ -0,0 +1,102 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/mount-utils"
+)
+
+const (
+	unmountMethodNormal = "normal"
+	unmountMethodForce  = "force"
+	unmountMethodLazy   = "lazy"
+
+	defaultUnmountTimeout = 30 * time.Second
+)
+
+var ErrUnmountTimeout = errors.New("unmount timed out")
+
+// runWithTimeout runs fn and returns ErrUnmountTimeout if it does not complete within timeout.
+// An unmount stuck in kernel cannot be interrupted, so fn is left running in background in that case
+func runWithTimeout(fn func() error, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w after %s", ErrUnmountTimeout, timeout)
+	}
+}
+
+// isNotMountedErr returns true if an unmount failed because the path is not mounted (anymore)
+func isNotMountedErr(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOENT) || strings.Contains(err.Error(), "not mounted")
+}
+
+func isBusyErr(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || strings.Contains(err.Error(), "target is busy") || strings.Contains(err.Error(), "device is busy")
+}
+
+// isUnmountEscalated returns true if an unmount failed because the mount is hung or its server is gone,
+// as opposed to failing because it is still in use
+func isUnmountEscalated(err error) bool {
+	return errors.Is(err, ErrUnmountTimeout) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO) ||
+		strings.Contains(err.Error(), "Stale file handle") || strings.Contains(err.Error(), "Input/output error")
+}
+
+// unmountWithEscalation unmounts path, escalating from a normal unmount to a forced one, which aborts pending
+// requests of an unreachable NFS server, and finally to a lazy one, which detaches the mount and releases it once
+// it is not busy anymore. Each attempt is bounded by timeout, so a hung mount does not block the caller indefinitely.
+// Only hung or stale mounts are escalated. A path which is not mounted is considered unmounted, while a busy mount
+// fails with an error wrapping syscall.EBUSY
+func unmountWithEscalation(ctx context.Context, kMounter mount.Interface, path string, transport DataTransport, timeout time.Duration) error {
+	logger := log.Ctx(ctx).With().Str("mount_point", path).Logger()
+	if timeout <= 0 {
+		timeout = defaultUnmountTimeout
+	}
+	attempts := []struct {
+		method string
+		fn     func() error
+	}{
+		{unmountMethodNormal, func() error { return kMounter.Unmount(path) }},
+		{unmountMethodForce, func() error { return syscall.Unmount(path, syscall.MNT_FORCE) }},
+		{unmountMethodLazy, func() error { return lazyUnmount(path) }},
+	}
+	var err error
+	for _, attempt := range attempts {
+		start := time.Now()
+		err = runWithTimeout(attempt.fn, timeout)
+		if err != nil && isNotMountedErr(err) {
+			// an escalated attempt finds the path unmounted if a previous attempt completed in background
+			logger.Debug().Err(err).Str("method", attempt.method).Msg("Path is not mounted")
+			err = nil
+		}
+		observeUnmount(transport, attempt.method, err, time.Since(start))
+		if err == nil {
+			if attempt.method != unmountMethodNormal {
+				logger.Warn().Str("method", attempt.method).Msg("Unmounted after escalation")
+			}
+			return nil
+		}
+		logger.Warn().Err(err).Str("method", attempt.method).Dur("elapsed", time.Since(start)).Msg("Unmount attempt failed")
+		if isBusyErr(err) {
+			if errors.Is(err, syscall.EBUSY) {
+				return err
+			}
+			return fmt.Errorf("%w: %w", syscall.EBUSY, err)
+		}
+		if !isUnmountEscalated(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package wekafs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/mount-utils"
+)
+
+// hungMounter is a mounter whose unmount blocks until released
+type hungMounter struct {
+	*mount.FakeMounter
+	release chan struct{}
+}
+
+func (m *hungMounter) Unmount(target string) error {
+	<-m.release
+	return nil
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	assert.NoError(t, runWithTimeout(func() error { return nil }, time.Second))
+	failure := errors.New("device busy")
+	assert.ErrorIs(t, runWithTimeout(func() error { return failure }, time.Second), failure)
+
+	release := make(chan struct{})
+	defer close(release)
+	err := runWithTimeout(func() error { <-release; return nil }, 10*time.Millisecond)
+	assert.ErrorIs(t, err, ErrUnmountTimeout)
+}
+
+func TestUnmountWithEscalation(t *testing.T) {
+	fake := mount.NewFakeMounter([]mount.MountPoint{{Path: "/mnt/fs", Type: "wekafs"}})
+	assert.NoError(t, unmountWithEscalation(context.Background(), fake, "/mnt/fs", dataTransportWekafs, time.Second))
+	assert.Equal(t, []mount.FakeAction{{Action: mount.FakeActionUnmount, Target: "/mnt/fs"}}, fake.GetLog(), "no escalation when normal unmount succeeds")
+
+	hung := &hungMounter{FakeMounter: mount.NewFakeMounter(nil), release: make(chan struct{})}
+	defer close(hung.release)
+	// forced unmount of a path which is not mounted fails with EINVAL, meaning the hung unmount completed meanwhile
+	err := unmountWithEscalation(context.Background(), hung, t.TempDir(), dataTransportNfs, 10*time.Millisecond)
+	if err != nil {
+		assert.NotErrorIs(t, err, ErrUnmountTimeout, "hung normal unmount must be escalated")
+	}
+}
+
+// failingMounter is a mounter whose unmount fails with err
+type failingMounter struct {
+	*mount.FakeMounter
+	err error
+}
+
+func (m *failingMounter) Unmount(target string) error {
+	return m.err
+}
+
+func TestUnmountWithEscalationErrors(t *testing.T) {
+	unmount := func(err error) error {
+		return unmountWithEscalation(context.Background(), &failingMounter{FakeMounter: mount.NewFakeMounter(nil), err: err}, t.TempDir(), dataTransportWekafs, time.Second)
+	}
+	assert.NoError(t, unmount(errors.New("exit status 32\nOutput: umount: /mnt/fs: not mounted.")), "path which is not mounted is unmounted")
+	assert.NoError(t, unmount(syscall.EINVAL))
+
+	err := unmount(errors.New("exit status 32\nOutput: umount: /mnt/fs: target is busy."))
+	assert.ErrorIs(t, err, syscall.EBUSY, "busy mount must be reported rather than detached")
+	assert.Contains(t, err.Error(), "target is busy")
+	assert.ErrorIs(t, unmount(syscall.EBUSY), syscall.EBUSY)
+
+	failure := errors.New("exit status 1\nOutput: umount: /mnt/fs: must be superuser to unmount.")
+	assert.Equal(t, failure, unmount(failure), "unmount is escalated only for hung or stale mounts")
+
+	assert.True(t, isUnmountEscalated(syscall.ESTALE))
+	assert.True(t, isUnmountEscalated(errors.New("umount: /mnt/fs: Input/output error")))
+	assert.True(t, isUnmountEscalated(ErrUnmountTimeout))
+	assert.False(t, isUnmountEscalated(syscall.EPERM))
+}
@@ -0,0 +1,252 @@
+package wekafs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// annotations set by external-provisioner on PVs, pointing to the secret used for provisioning
+	pvAnnotationDeletionSecretName      = "volume.kubernetes.io/provisioner-deletion-secret-name"
+	pvAnnotationDeletionSecretNamespace = "volume.kubernetes.io/provisioner-deletion-secret-namespace"
+)
+
+var volumeUsageLabels = []string{"pv", "pvc", "namespace", "filesystem", "cluster"}
+
+var (
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "capacity_bytes",
+		Help:      "Capacity of a persistent volume as enforced on Weka cluster (quota hard limit or filesystem capacity)",
+	}, volumeUsageLabels)
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "used_bytes",
+		Help:      "Capacity used by a persistent volume on Weka cluster",
+	}, volumeUsageLabels)
+
+	volumeAvailableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "available_bytes",
+		Help:      "Capacity available to a filesystem-backed persistent volume on Weka cluster",
+	}, volumeUsageLabels)
+
+	volumeUsedSsdBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "used_ssd_bytes",
+		Help:      "SSD capacity used by a filesystem-backed persistent volume on Weka cluster",
+	}, volumeUsageLabels)
+
+	volumeUsageCollectionDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "usage_collection_duration_seconds",
+		Help:      "Duration of the last collection cycle of persistent volume usage",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(volumeCapacityBytes, volumeUsedBytes, volumeAvailableBytes, volumeUsedSsdBytes, volumeUsageCollectionDuration)
+}
+
+// volumeUsage is a single sample of persistent volume usage
+type volumeUsage struct {
+	labels    prometheus.Labels
+	capacity  int64
+	used      int64
+	available int64
+	usedSsd   int64
+	isFs      bool
+}
+
+// volumeUsageExporter periodically exports usage of persistent volumes provisioned by the driver.
+// It is added as a leader election runnable to the manager, so only the active controller polls Weka API
+type volumeUsageExporter struct {
+	cs         *ControllerServer
+	driverName string
+	interval   time.Duration
+}
+
+func newVolumeUsageExporter(cs *ControllerServer, driverName string, interval time.Duration) *volumeUsageExporter {
+	return &volumeUsageExporter{
+		cs:         cs,
+		driverName: driverName,
+		interval:   interval,
+	}
+}
+
+// Start implements manager.Runnable
+func (e *volumeUsageExporter) Start(ctx context.Context) error {
+	logger := log.Ctx(ctx).With().Str("component", "volume-usage-exporter").Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Dur("interval", e.interval).Msg("Starting export of persistent volume usage metrics")
+	for {
+		e.collect(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Stopping export of persistent volume usage metrics")
+			return nil
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+func (e *volumeUsageExporter) collect(ctx context.Context) {
+	op := "CollectVolumeUsage"
+	ctx, span := otel.Tracer(TracerName).Start(ctx, op)
+	defer span.End()
+	ctx = log.Ctx(ctx).With().Str("trace_id", span.SpanContext().TraceID().String()).Str("span_id", span.SpanContext().SpanID().String()).Str("op", op).Logger().WithContext(ctx)
+	logger := log.Ctx(ctx)
+
+	start := time.Now()
+	pvList := &v1.PersistentVolumeList{}
+	if err := e.cs.manager.GetAPIReader().List(ctx, pvList); err != nil {
+		logger.Error().Err(err).Msg("Failed to list persistent volumes")
+		return
+	}
+
+	var samples []volumeUsage
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if !isUsageExportedPv(pv, e.driverName) {
+			continue
+		}
+		sample, err := e.getVolumeUsage(ctx, pv)
+		if err != nil {
+			logger.Warn().Err(err).Str("pv", pv.Name).Str("volume_id", pv.Spec.CSI.VolumeHandle).Msg("Failed to collect volume usage")
+			continue
+		}
+		if sample != nil {
+			samples = append(samples, *sample)
+		}
+	}
+
+	exportVolumeUsage(samples)
+	volumeUsageCollectionDuration.Set(time.Since(start).Seconds())
+	logger.Debug().Int("volumes", len(samples)).Dur("duration", time.Since(start)).Msg("Collected persistent volume usage")
+}
+
+// isUsageExportedPv returns true for bound PVs provisioned by the driver
+func isUsageExportedPv(pv *v1.PersistentVolume, driverName string) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName && pv.Status.Phase == v1.VolumeBound
+}
+
+// exportVolumeUsage replaces all series at once so that deleted volumes do not linger
+func exportVolumeUsage(samples []volumeUsage) {
+	for _, g := range []*prometheus.GaugeVec{volumeCapacityBytes, volumeUsedBytes, volumeAvailableBytes, volumeUsedSsdBytes} {
+		g.Reset()
+	}
+	for _, s := range samples {
+		volumeCapacityBytes.With(s.labels).Set(float64(s.capacity))
+		volumeUsedBytes.With(s.labels).Set(float64(s.used))
+		if s.isFs {
+			volumeAvailableBytes.With(s.labels).Set(float64(s.available))
+			volumeUsedSsdBytes.With(s.labels).Set(float64(s.usedSsd))
+		}
+	}
+}
+
+func (e *volumeUsageExporter) getVolumeUsage(ctx context.Context, pv *v1.PersistentVolume) (*volumeUsage, error) {
+	secrets, err := e.cs.getSecretsForPv(ctx, pv)
+	if err != nil {
+		return nil, err
+	}
+	client, err := e.cs.api.GetClientFromSecrets(ctx, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		// legacy volumes without API client cannot report usage
+		return nil, nil
+	}
+	volume, err := NewVolumeFromId(ctx, pv.Spec.CSI.VolumeHandle, client, e.cs)
+	if err != nil {
+		return nil, err
+	}
+	sample := &volumeUsage{
+		labels: prometheus.Labels{
+			"pv":         pv.Name,
+			"pvc":        "",
+			"namespace":  "",
+			"filesystem": volume.FilesystemName,
+			"cluster":    client.ClusterName,
+		},
+	}
+	if pv.Spec.ClaimRef != nil {
+		sample.labels["pvc"] = pv.Spec.ClaimRef.Name
+		sample.labels["namespace"] = pv.Spec.ClaimRef.Namespace
+	}
+
+	if volume.isFilesystem() {
+		fsObj, err := volume.getFilesystemObj(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if fsObj == nil {
+			return nil, fmt.Errorf("filesystem %s not found", volume.FilesystemName)
+		}
+		sample.isFs = true
+		sample.capacity = fsObj.TotalCapacity
+		sample.used = fsObj.UsedTotal
+		sample.available = fsObj.AvailableTotal
+		sample.usedSsd = fsObj.UsedSsd
+		return sample, nil
+	}
+
+	quota, err := volume.getQuota(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if quota == nil {
+		return nil, fmt.Errorf("no quota set on volume %s", volume.GetId())
+	}
+	sample.capacity = int64(quota.GetCapacityLimit())
+	sample.used = int64(quota.TotalBytes)
+	return sample, nil
+}
+
+// getSecretsForPv returns the API secret a PV was provisioned with. Empty map is returned if PV refers to no secret
+func (cs *ControllerServer) getSecretsForPv(ctx context.Context, pv *v1.PersistentVolume) (map[string]string, error) {
+	ref := secretRefOfPv(pv)
+	if ref == nil {
+		return make(map[string]string), nil
+	}
+	return cs.getSecretsByRef(ctx, ref)
+}
+
+// secretRefOfPv returns the reference to API secret of a PV. The provisioner deletion secret is preferred,
+// falling back to controller expand and node publish secrets
+func secretRefOfPv(pv *v1.PersistentVolume) *v1.SecretReference {
+	if name, ok := pv.Annotations[pvAnnotationDeletionSecretName]; ok && name != "" {
+		return &v1.SecretReference{Name: name, Namespace: pv.Annotations[pvAnnotationDeletionSecretNamespace]}
+	} else if pv.Spec.CSI != nil && pv.Spec.CSI.ControllerExpandSecretRef != nil {
+		return pv.Spec.CSI.ControllerExpandSecretRef
+	} else if pv.Spec.CSI != nil && pv.Spec.CSI.NodePublishSecretRef != nil {
+		return pv.Spec.CSI.NodePublishSecretRef
+	}
+	return nil
+}
+
+func (cs *ControllerServer) getSecretsByRef(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	secret := &v1.Secret{}
+	if err := cs.manager.GetAPIReader().Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret); err != nil {
+		return nil, fmt.Errorf("failed to fetch secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+	secrets := make(map[string]string)
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	return secrets, nil
+}
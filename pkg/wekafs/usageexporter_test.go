@@ -0,0 +1,43 @@
+package wekafs
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsUsageExportedPv(t *testing.T) {
+	pv := func(driver string, phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+		ret := &v1.PersistentVolume{Status: v1.PersistentVolumeStatus{Phase: phase}}
+		if driver != "" {
+			ret.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver}
+		}
+		return ret
+	}
+	assert.True(t, isUsageExportedPv(pv("csi.weka.io", v1.VolumeBound), "csi.weka.io"))
+	assert.False(t, isUsageExportedPv(pv("csi.weka.io", v1.VolumeReleased), "csi.weka.io"))
+	assert.False(t, isUsageExportedPv(pv("ebs.csi.aws.com", v1.VolumeBound), "csi.weka.io"))
+	assert.False(t, isUsageExportedPv(pv("", v1.VolumeBound), "csi.weka.io"), "in-tree volumes are not exported")
+	assert.False(t, isUsageExportedPv(&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}}, "csi.weka.io"))
+}
+
+func TestExportVolumeUsage(t *testing.T) {
+	labels := func(pv string) prometheus.Labels {
+		return prometheus.Labels{"pv": pv, "pvc": "data", "namespace": "default", "filesystem": "fs1", "cluster": "weka"}
+	}
+	exportVolumeUsage([]volumeUsage{
+		{labels: labels("pv-dir"), capacity: 100, used: 40},
+		{labels: labels("pv-fs"), capacity: 1000, used: 300, available: 700, usedSsd: 200, isFs: true},
+	})
+	assert.Equal(t, map[string]float64{"weka,fs1,default,pv-dir,data": 100, "weka,fs1,default,pv-fs,data": 1000}, collectGauges(t, volumeCapacityBytes))
+	assert.Equal(t, map[string]float64{"weka,fs1,default,pv-dir,data": 40, "weka,fs1,default,pv-fs,data": 300}, collectGauges(t, volumeUsedBytes))
+	assert.Equal(t, map[string]float64{"weka,fs1,default,pv-fs,data": 700}, collectGauges(t, volumeAvailableBytes), "available capacity is exported for filesystems only")
+	assert.Equal(t, map[string]float64{"weka,fs1,default,pv-fs,data": 200}, collectGauges(t, volumeUsedSsdBytes))
+
+	// volumes deleted meanwhile must not linger
+	exportVolumeUsage([]volumeUsage{{labels: labels("pv-fs"), capacity: 1000, used: 500, available: 500, isFs: true}})
+	assert.Equal(t, map[string]float64{"weka,fs1,default,pv-fs,data": 500}, collectGauges(t, volumeUsedBytes))
+}
@@ -110,6 +110,12 @@ func generateSnapshotIdFromComponents(snapshotType, filesystemName, snapshotName
 	return volId
 }
 
+// generateSnapshotIdForVolume constructs the ID of a snapshot created with given CSI name from a source volume
+func generateSnapshotIdForVolume(csiSnapName, sourceVolumeId string) string {
+	return generateSnapshotIdFromComponents(SnapshotTypeUnifiedSnap, sliceFilesystemNameFromVolumeId(sourceVolumeId),
+		generateSnapshotNameHash(csiSnapName), generateSnapshotIntegrityID(csiSnapName, sourceVolumeId), sliceInnerPathFromVolumeId(sourceVolumeId))
+}
+
 // generateWekaSeedSnapshotName: for every new FS we create, we will create an empty seed snapshot right away,
 // that would allow creating empty Snap volume based on that filesystem.
 func generateWekaSeedSnapshotName(prefix, fsName string) string {
@@ -307,6 +313,9 @@ func PathIsWekaMount(ctx context.Context, path string) bool {
 		if len(fields) >= 3 && strings.HasPrefix(fields[2], "nfs") && fields[1] == path {
 			return true
 		}
+		if len(fields) >= 3 && isSmbFsType(fields[2]) && fields[1] == path {
+			return true
+		}
 	}
 
 	return false
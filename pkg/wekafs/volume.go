@@ -53,10 +53,20 @@ type Volume struct {
 	enforceCapacity       bool
 	initialFilesystemSize int64
 	mountOptions          MountOptions
+	nfsIpSelection        apiclient.NfsIpSelectionStrategy
+	nfsExport             *nfsExportParams
+	nfsMultipath          *nfsMultipathParams
+	transport             DataTransport
+	smbShareInnerPath     bool
 	encrypted             *bool // to support also encryption state fetched from actual filesystem when not set
 	manageEncryptionKeys  bool
 	encryptWithoutKms     bool
 
+	snapshotBeforeDelete       bool
+	uploadSnapshotBeforeDelete bool
+	tombstoneRetention         time.Duration
+	deferDeletion              bool // tombstone filesystem instead of failing deletion while it has snapshots
+
 	kmsVaultNamespace     string
 	kmsVaultKeyIdentifier string
 	kmsVaultRoleId        string
@@ -256,7 +266,7 @@ func (v *Volume) hasUnderlyingSnapshots(ctx context.Context) (bool, error) {
 	if len(*snapshots) > 0 {
 		seedSnapshotName := v.getSeedSnapshotName()
 		for _, s := range *snapshots {
-			if s.IsRemoving || s.Name == seedSnapshotName {
+			if s.IsRemoving || s.Name == seedSnapshotName || isTombstoneSnapshot(v.server.getConfig().SnapshotPrefix, s.Name) {
 				logger.Trace().Str("snapshot", s.Name).Msg("Existing snapshot does not prevent filesystem from deletion")
 				continue
 			}
@@ -768,6 +778,12 @@ func (v *Volume) updateCapacityXattr(ctx context.Context, enforceCapacity *bool,
 }
 
 func (v *Volume) Trash(ctx context.Context) error {
+	if err := v.deleteSmbShare(ctx); err != nil {
+		return err
+	}
+	if err := v.deleteNfsPermission(ctx); err != nil {
+		return err
+	}
 	if v.requiresGc() {
 		return v.server.getMounter().getGarbageCollector().triggerGcVolume(ctx, v)
 	}
@@ -780,6 +796,10 @@ func (v *Volume) getInnerPath() string {
 
 // GetFullPath returns a full path on which volume is accessible including OS mount point, snapshot subdir and inner path
 func (v *Volume) GetFullPath(ctx context.Context) string {
+	// the NFS export or SMB share of the volume directory is mounted rather than the filesystem root
+	if v.isNfsExportNarrowed(ctx) || v.isSmbShareNarrowed(ctx) {
+		return v.mountPath
+	}
 	mountParts := []string{v.mountPath, v.GetRelativePath(ctx)}
 	fullPath := filepath.Join(mountParts...)
 	return fullPath
@@ -1008,7 +1028,11 @@ func (v *Volume) MountUnderlyingFS(ctx context.Context) (error, UnmountFunc) {
 
 	mountOpts := v.server.getDefaultMountOptions().MergedWith(v.getMountOptions(ctx), v.server.getConfig().mutuallyExclusiveOptions)
 
-	mount, err, unmountFunc := v.server.getMounter().mountWithOptions(ctx, v.FilesystemName, mountOpts, v.apiClient)
+	// pin the transport, so the mount and the paths derived from it agree even if transport availability changes meanwhile
+	v.transport = v.server.getMounter().resolveTransport(ctx, v.transport)
+	mountCtx := withNfsExport(withNfsIpSelection(withDataTransport(ctx, v.transport), v.nfsIpSelection), v.getNfsExportOptions(ctx))
+	mountCtx = withNfsMultipath(withSmbSharePath(mountCtx, v.getSmbSharePath(ctx)), v.nfsMultipath)
+	mount, err, unmountFunc := v.server.getMounter().mountWithOptions(mountCtx, v.FilesystemName, mountOpts, v.apiClient)
 	retUmountFunc := NoOpUnmount
 	if err == nil {
 		v.mountPath = mount
@@ -1036,7 +1060,9 @@ func (v *Volume) UnmountUnderlyingFS(ctx context.Context) error {
 	}
 
 	mountOpts := v.getMountOptions(ctx)
-	err := v.server.getMounter().unmountWithOptions(ctx, v.FilesystemName, mountOpts)
+	unmountCtx := withSmbSharePath(withNfsExport(withDataTransport(ctx, v.transport), v.getNfsExportOptions(ctx)), v.getSmbSharePath(ctx))
+	unmountCtx = withNfsMultipath(unmountCtx, v.nfsMultipath)
+	err := v.server.getMounter().unmountWithOptions(unmountCtx, v.FilesystemName, mountOpts)
 
 	if err == nil {
 		v.mountPath = ""
@@ -1211,6 +1237,8 @@ func (v *Volume) createSeedSnapshot(ctx context.Context) (*apiclient.Snapshot, e
 	err = v.apiClient.CreateSnapshot(ctx, r, snapObj)
 	if err != nil {
 		log.Error().Err(err).Msg("")
+	} else {
+		recordJournalStep(ctx, journalStepSeedSnapshotCreated)
 	}
 	return snapObj, err
 }
@@ -1382,6 +1410,7 @@ func (v *Volume) Create(ctx context.Context, capacity int64) (retErr error) {
 		if err := v.apiClient.CreateFileSystem(ctx, cr, fsObj); err != nil {
 			return status.Error(codes.Internal, err.Error())
 		}
+		recordJournalStep(ctx, journalStepFilesystemCreated)
 	} else if v.isOnSnapshot() { // running on real CSI system and not in docker sanity
 		// this might be either blank or copy content volume
 		snapSrcUid, err := v.getUidOfSourceSnap(ctx)
@@ -1410,6 +1439,7 @@ func (v *Volume) Create(ctx context.Context, capacity int64) (retErr error) {
 		if err := v.apiClient.CreateSnapshot(ctx, sr, snapObj); err != nil {
 			return status.Error(codes.Internal, err.Error())
 		}
+		recordJournalStep(ctx, journalStepSnapshotCreated)
 		if v.server.isInDevMode() {
 			// here comes a workaround to enable running CSI sanity in detached mode, by mimicking the directory structure
 			// no actual data is copied, only directory structure is created as if it was a real snapshot.
@@ -1474,6 +1504,7 @@ func (v *Volume) Create(ctx context.Context, capacity int64) (retErr error) {
 			return err
 		}
 		logger.Debug().Msg("Successully created directory")
+		recordJournalStep(ctx, journalStepDirectoryCreated)
 	}
 
 	// Update volume capacity
@@ -1485,6 +1516,7 @@ func (v *Volume) Create(ctx context.Context, capacity int64) (retErr error) {
 			Err(err).Msg("Failed to update capacity on fresh created volume. Volume remains intact for troubleshooting. Contact support.")
 		return err
 	}
+	recordJournalStep(ctx, journalStepCapacitySet)
 
 	// Update volume parameters
 	if err := v.UpdateParams(ctx); err != nil {
@@ -1495,6 +1527,7 @@ func (v *Volume) Create(ctx context.Context, capacity int64) (retErr error) {
 			Err(err).Msg("Failed to update volume parameters on freshly created volume. Volume remains intact for troubleshooting. Contact support.")
 		return err
 	}
+	recordJournalStep(ctx, journalStepParamsSet)
 	logger.Info().Str("filesystem", v.FilesystemName).Msg("Created volume successfully")
 	return nil
 }
@@ -1663,9 +1696,17 @@ func (v *Volume) Delete(ctx context.Context) error {
 	logger.Debug().Msg("Starting deletion of volume")
 	if v.isFilesystem() {
 		if !v.isAllowedForDeletion(ctx) {
-			return ErrFilesystemHasUnderlyingSnapshots
+			if !v.deferDeletion {
+				return ErrFilesystemHasUnderlyingSnapshots
+			}
+			// the filesystem is deleted by tombstonePurger once its last snapshot is gone
+			logger.Info().Msg("Filesystem has snapshots that depend on it, deferring its deletion")
+			err = v.tombstoneFilesystem(ctx)
+		} else if v.snapshotBeforeDelete {
+			err = v.tombstoneFilesystem(ctx)
+		} else {
+			err = v.deleteFilesystem(ctx)
 		}
-		err = v.deleteFilesystem(ctx)
 	} else if v.isOnSnapshot() {
 		err = v.deleteSnapshot(ctx)
 	} else {
@@ -1714,7 +1755,8 @@ func (v *Volume) deleteFilesystem(ctx context.Context) error {
 		return nil
 	}
 	if !fsObj.IsRemoving { // if filesystem is already removing, just wait
-		if v.server.getMounter().getTransport() == dataTransportNfs {
+		// with per-volume transport, the filesystem could have been mounted over NFS even if not by default
+		if v.server.getMounter().resolveTransport(ctx, dataTransportNfs) == dataTransportNfs {
 			logger.Trace().Str("filesystem", v.FilesystemName).Msg("Ensuring no NFS permissions exist that could block filesystem deletion")
 			err := v.apiClient.EnsureNoNfsPermissionsForFilesystem(ctx, fsObj.Name)
 			if err != nil {
@@ -1722,6 +1764,10 @@ func (v *Volume) deleteFilesystem(ctx context.Context) error {
 				return err
 			}
 		}
+		// volumes of any StorageClass could have been mounted over SMB, while clusters without SMB configured fail listing shares
+		if err := v.apiClient.EnsureNoCsiSmbSharesForFilesystem(ctx, fsObj.Name); err != nil {
+			logger.Warn().Str("filesystem", v.FilesystemName).Err(err).Msg("Failed to remove SMB shares of filesystem, proceeding with deletion")
+		}
 		logger.Trace().Str("filesystem", v.FilesystemName).Msg("Attempting deletion of filesystem")
 		fsd := &apiclient.FileSystemDeleteRequest{Uid: fsObj.Uid}
 		v.fileSystemObject = nil
@@ -1865,6 +1911,35 @@ func (v *Volume) ObtainRequestParams(ctx context.Context, params map[string]stri
 		v.mountOptions.Merge(NewMountOptionsFromString(val), v.server.getConfig().mutuallyExclusiveOptions)
 	}
 
+	// NFS target IP selection strategy, applied on NodePublishVolume but validated upfront
+	if val, ok := params[NfsIpSelectionParam]; ok {
+		strategy, err := apiclient.ParseNfsIpSelectionStrategy(val)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		v.nfsIpSelection = strategy
+	}
+
+	// NFS export settings, applied on NodePublishVolume only but validated upfront
+	if _, err := parseNfsExportParams(params); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseSmbShareInnerPath(params); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseNfsMultipathParams(params); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// data transport, honored only by nodes allowing per-volume transport
+	if val, ok := params[TransportParam]; ok {
+		transport, err := ParseDataTransport(val)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		v.transport = transport
+	}
+
 	// filesystem group name, required for actually creating a raw FS
 	if val, ok := params["filesystemGroupName"]; ok {
 		v.filesystemGroupName = val
@@ -1904,6 +1979,10 @@ func (v *Volume) ObtainRequestParams(ctx context.Context, params map[string]stri
 	}
 	v.enforceCapacity = enforceCapacity
 
+	if err := v.obtainSnapshotBeforeDeleteParams(params); err != nil {
+		return err
+	}
+
 	// make sure to set min capacity if comes from request
 	if val, ok := params["initialFilesystemSizeGB"]; ok {
 		raw, err := strconv.Atoi(val)
@@ -14,12 +14,16 @@ func GetDriverForTest(t *testing.T) *WekaFsDriver {
 	ctx := context.Background()
 	nodeId := "localhost"
 	mutuallyExclusive := MutuallyExclusiveMountOptsStrings{"readcache,writecache,coherent,forcedirect", "sync,async", "ro,rw"}
-	driverConfig := NewDriverConfig("csi-volumes", "csi-vol-", "csi-snap-", "csi-seed-snap-",
+	driverConfig, err := NewDriverConfig("csi-volumes", "csi-vol-", "csi-snap-", "csi-seed-snap-",
 		"", true, true, true, true, true,
 		true, true, mutuallyExclusive,
 		1, 1, 1, 1, 1, 1, 1, 10, 5,
 		true, true, true, "", "", "4.1", "v1", false, false, true,
-		"", false, "", false, false, false, true)
+		"", false, "", false, false, false, true,
+		"", "", 0, 0, false, 0, false, 0, false, false, 0, 0, false, 0, 0, 0, false, 0, 0, 0, "", "", false, false, 0, 0, false, "")
+	if err != nil {
+		t.Fatalf("Failed to create driver config: %v", err)
+	}
 	driver, err := NewWekaFsDriver("csi.weka.io", nodeId, "unix://tmp/csi.sock", 10, "v1.0", "", CsiModeAll, false, driverConfig)
 	if err != nil {
 		t.Fatalf("Failed to create new driver: %v", err)
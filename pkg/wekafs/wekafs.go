@@ -42,6 +42,7 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
@@ -97,6 +98,8 @@ type ApiStore struct {
 	legacySecrets *map[string]string
 	config        *DriverConfig
 	Hostname      string
+	auditSink     apiclient.AuditSink
+	nfsClientIps  nfsClientIpsTracker
 }
 
 // Die used to intentionally panic and exit, while updating termination log
@@ -152,6 +155,15 @@ func (api *ApiStore) fromSecrets(ctx context.Context, secrets map[string]string,
 		}()
 	}
 
+	var nfsTargetIpZones map[string]string
+	if zones, ok := secrets["nfsTargetIpZones"]; ok {
+		nfsTargetIpZones = apiclient.ParseNfsTargetIpZones(strings.ReplaceAll(strings.TrimSpace(zones), "\n", ","))
+	}
+	nfsIpSelection := strings.TrimSpace(strings.TrimSuffix(secrets["nfsIpSelection"], "\n"))
+	if _, err := apiclient.ParseNfsIpSelectionStrategy(nfsIpSelection); err != nil {
+		return nil, err
+	}
+
 	localContainerName, ok := secrets["localContainerName"]
 	if ok {
 		localContainerName = strings.TrimSpace(strings.TrimSuffix(localContainerName, "\n"))
@@ -200,6 +212,11 @@ func (api *ApiStore) fromSecrets(ctx context.Context, secrets map[string]string,
 		AutoUpdateEndpoints: autoUpdateEndpoints,
 		CaCertificate:       caCertificate,
 		NfsTargetIPs:        nfsTargetIps,
+		NfsTargetIpZones:    nfsTargetIpZones,
+		NfsIpSelection:      nfsIpSelection,
+		SmbUsername:         strings.TrimSpace(strings.TrimSuffix(secrets["smbUsername"], "\n")),
+		SmbPassword:         strings.TrimSuffix(secrets["smbPassword"], "\n"),
+		SmbDomain:           strings.TrimSpace(strings.TrimSuffix(secrets["smbDomain"], "\n")),
 		KmsPreexistingCredentialsForVolumeEncryption: preexistingVaultCreds,
 	}
 	return api.fromCredentials(ctx, credentials, hostname)
@@ -215,6 +232,9 @@ func (api *ApiStore) fromCredentials(ctx context.Context, credentials apiclient.
 	if err != nil {
 		return nil, errors.New("could not create API client object from supplied params")
 	}
+	if api.auditSink != nil {
+		newClient.SetAuditSink(api.auditSink)
+	}
 	hash := newClient.Hash()
 
 	if existingApi := api.getByHash(hash); existingApi != nil {
@@ -244,6 +264,8 @@ func (api *ApiStore) fromCredentials(ctx context.Context, credentials apiclient.
 			logger.Error().Err(err).Msg("Failed to register NFS client group")
 			return nil, err
 		}
+		api.nfsClientIps.add(newClient.NfsClientIp)
+		api.nfsClientIps.publish(ctx, api.config.GetDriver())
 	}
 	api.apis[hash] = newClient
 
@@ -373,6 +395,45 @@ func (driver *WekaFsDriver) Run(ctx context.Context) {
 		}
 
 		driver.cs = NewControllerServer(driver.nodeID, driver.api, mounter, driver.config, driver.manager)
+
+		if driver.manager != nil && driver.config.enableVolumeUsageMetrics {
+			if err := driver.manager.Add(newVolumeUsageExporter(driver.cs, driver.name, driver.config.volumeUsageMetricsInterval)); err != nil {
+				log.Error().Err(err).Msg("Failed to add volume usage exporter to manager")
+			}
+		}
+		if driver.cs.journal != nil {
+			if err := driver.manager.Add(newJournalReplayer(driver.cs)); err != nil {
+				log.Error().Err(err).Msg("Failed to add operation journal replayer to manager")
+			}
+		}
+		if driver.manager != nil && driver.config.enableOrphanReconciler {
+			if err := driver.manager.Add(newOrphanReconciler(driver.cs, driver.name, driver.manager.GetEventRecorderFor(driver.name))); err != nil {
+				log.Error().Err(err).Msg("Failed to add orphan reconciler to manager")
+			}
+		}
+		if driver.manager != nil && driver.config.enableNfsClientRuleCleanup {
+			if r, err := newNfsClientRuleReconciler(driver.cs, driver.name); err != nil {
+				log.Error().Err(err).Msg("Failed to create NFS client rule reconciler")
+			} else if err := driver.manager.Add(r); err != nil {
+				log.Error().Err(err).Msg("Failed to add NFS client rule reconciler to manager")
+			}
+		}
+		if driver.manager != nil {
+			driver.cs.tombstones = newTombstonePurger(driver.cs, driver.name)
+			if err := driver.manager.Add(driver.cs.tombstones); err != nil {
+				log.Error().Err(err).Msg("Failed to add tombstone purger to manager")
+			}
+		}
+		if driver.manager != nil && driver.config.trashRetention > 0 {
+			if err := driver.manager.Add(newVolumeUndeleter(driver.cs)); err != nil {
+				log.Error().Err(err).Msg("Failed to add volume undeleter to manager")
+			}
+			if !driver.config.skipGarbageCollection {
+				if err := driver.manager.Add(newTrashSweeper(driver.cs, driver.name)); err != nil {
+					log.Error().Err(err).Msg("Failed to add trash sweeper to manager")
+				}
+			}
+		}
 	} else {
 		driver.cs = &ControllerServer{}
 	}
@@ -394,8 +455,22 @@ func (driver *WekaFsDriver) Run(ctx context.Context) {
 			}
 		}
 
+		if driver.servesNfsKerberos() {
+			if err := setupNfsKerberos(ctx, driver.config); err != nil {
+				log.Error().Err(err).Msg("Failed to install NFS Kerberos keytab, node will not report ready")
+			}
+		}
+
 		log.Info().Msg("Loading NodeServer")
 		driver.ns = NewNodeServer(driver.nodeID, driver.maxVolumesPerNode, driver.api, mounter, driver.config)
+		if driver.config.enableMountWatchdog && !driver.config.isInDevMode() {
+			var recorder record.EventRecorder
+			if driver.manager != nil {
+				recorder = driver.manager.GetEventRecorderFor(driver.name)
+			}
+			driver.ns.watchdog = newMountWatchdog(driver.ns, recorder, driver.config.mountWatchdogInterval)
+			go driver.ns.watchdog.run(ctx)
+		}
 
 		// Read zone/region from node labels at startup so they are available
 		// when NodeGetInfo is called during registration (e.g. after CSI upgrade).
@@ -406,7 +481,14 @@ func (driver *WekaFsDriver) Run(ctx context.Context) {
 		driver.ns = &NodeServer{}
 	}
 
+	if err := driver.initAuditSink(ctx); err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize audit trail of Weka API operations")
+	}
+
 	s := NewNonBlockingGRPCServer(driver.csiMode)
+	if driver.manager != nil && driver.config.enableFailureEvents {
+		s.events = newFailureEventRecorder(driver.manager.GetEventRecorderFor(driver.name), driver.manager.GetAPIReader(), driver.config.failureEventsInterval)
+	}
 
 	termContext, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer stop()
@@ -790,8 +872,24 @@ func (d *WekaFsDriver) SetNodeLabels(ctx context.Context) {
 	labelsToSet[fmt.Sprintf(TopologyLabelNodePattern, d.name)] = d.nodeID
 	labelsToSet[fmt.Sprintf(TopologyLabelWekaLocalPattern, d.name)] = "true"
 	labelsToSet[fmt.Sprintf(TopologyLabelTransportPattern, d.name)] = transport
+	for _, t := range d.servedTransports(ctx) {
+		labelsToSet[fmt.Sprintf(TopologyLabelTransportServedPattern, d.name, t)] = "true"
+	}
 	updateNeeded := false
 
+	// drop labels of transports the node no longer serves, e.g. after the Weka client was stopped
+	for _, t := range dataTransports {
+		label := fmt.Sprintf(TopologyLabelTransportServedPattern, d.name, t)
+		if _, ok := labelsToSet[label]; ok {
+			continue
+		}
+		if _, ok := node.Labels[label]; ok {
+			log.Info().Str("label", label).Str("node", node.Name).Msg("Removing label from node")
+			delete(node.Labels, label)
+			updateNeeded = true
+		}
+	}
+
 	for label, value := range labelsToSet {
 		existing, ok := node.Labels[label]
 		if !ok || existing != value {
@@ -823,6 +921,9 @@ func (d *WekaFsDriver) CleanupNodeLabels(ctx context.Context) {
 	for i, labelPattern := range nodeLabelPatternsToRemove {
 		nodeLabelPatternsToRemove[i] = fmt.Sprintf(labelPattern, d.name)
 	}
+	for _, t := range dataTransports {
+		nodeLabelPatternsToRemove = append(nodeLabelPatternsToRemove, fmt.Sprintf(TopologyLabelTransportServedPattern, d.name, t))
+	}
 	labelsToRemove := append(nodeLabelsToRemove, nodeLabelPatternsToRemove...)
 
 	config, err := rest.InClusterConfig()
@@ -893,7 +994,21 @@ func GetCsiPluginMode(mode *string) CsiPluginMode {
 }
 
 func (driver *WekaFsDriver) NewMounter(ctx context.Context) AnyMounter {
+	mounter := driver.newMounter(ctx)
+	if composite, ok := mounter.(*compositeMounter); ok {
+		mountsMetrics.setMounters(composite.mounters()...)
+	} else {
+		mountsMetrics.setMounters(mounter)
+	}
+	return mounter
+}
+
+func (driver *WekaFsDriver) newMounter(ctx context.Context) AnyMounter {
 	log.Info().Msg("Configuring Mounter")
+	if driver.config.allowPerVolumeTransport {
+		log.Info().Msg("Serving both WekaFS and NFS transports, choosing transport per volume")
+		return newCompositeMounter(ctx, driver)
+	}
 	if driver.config.useNfs {
 		log.Warn().Msg("Enforcing NFS transport due to configuration")
 		return newNfsMounter(ctx, driver)
@@ -75,6 +75,7 @@ func (m *wekafsMount) incRef(ctx context.Context, apiClient *apiclient.ApiClient
 		if err := m.doMount(ctx, apiClient, m.getMountOptions()); err != nil {
 			return err
 		}
+		m.recordMount(ctx)
 	}
 	if refCount > 0 && !m.isMounted(ctx) {
 		logger.Warn().Int("refcount", refCount).Msg("Mount not found in /proc/mounts despite positive refcount, remounting")
@@ -125,6 +126,16 @@ func (m *wekafsMount) decRef(ctx context.Context) error {
 	return nil
 }
 
+// recordMount persists the refcount index of the mount, so its references can be recovered after plugin restart
+func (m *wekafsMount) recordMount(ctx context.Context) {
+	if m.isInDevMode() {
+		return
+	}
+	if err := writeMountRecord(m.mounter.mountBaseDir, m.getMountPoint(), &mountRecord{Filesystem: m.fsName, RefcountIdx: m.getRefcountIdx(), Transport: dataTransportWekafs}); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("mount_point", m.getMountPoint()).Msg("Failed to write mount record, mount references will not be recovered after restart")
+	}
+}
+
 func (m *wekafsMount) locateContainerName() error {
 	if m.containerName == "" {
 		containerName, err := GetMountContainerNameFromActualMountPoint(m.mountPoint)
@@ -139,7 +150,7 @@ func (m *wekafsMount) locateContainerName() error {
 func (m *wekafsMount) doUnmount(ctx context.Context) error {
 	logger := log.Ctx(ctx).With().Str("mount_point", m.getMountPoint()).Str("filesystem", m.fsName).Logger()
 	logger.Trace().Strs("mount_options", m.getMountOptions().Strings()).Msg("Performing umount via k8s native mounter")
-	err := m.kMounter.Unmount(m.getMountPoint())
+	err := unmountWithEscalation(ctx, m.kMounter, m.getMountPoint(), dataTransportWekafs, m.mounter.unmountTimeout)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to unmount")
 		return err
@@ -154,6 +165,9 @@ func (m *wekafsMount) doUnmount(ctx context.Context) error {
 		return err
 	}
 	logger.Debug().Msg("Unmounted successfully")
+	if err := removeMountRecord(m.mounter.mountBaseDir, m.getMountPoint()); err != nil {
+		logger.Warn().Err(err).Msg("Failed to remove mount record")
+	}
 	if err := os.Remove(m.getMountPoint()); err != nil {
 		logger.Warn().Err(err).Msg("Failed to remove mount point directory, will be cleaned up on next use")
 	} else {
@@ -24,6 +24,8 @@ type wekafsMounter struct {
 	allowProtocolContainers bool
 	config                  *DriverConfig
 	mountBaseDir            string
+	recoveredTargets        map[string]string
+	unmountTimeout          time.Duration
 }
 
 func mountBaseDirForRole(mode CsiPluginMode) string {
@@ -47,10 +49,12 @@ func newWekafsMounter(ctx context.Context, driver *WekaFsDriver) *wekafsMounter
 		log.Debug().Msg("SELinux support is forced")
 		selinuxSupport = &[]bool{true}[0]
 	}
-	mounter := &wekafsMounter{mountMap: wekafsMountsMap{}, debugPath: driver.debugPath, selinuxSupport: selinuxSupport, config: driver.config, mountBaseDir: mountBaseDirForRole(driver.csiMode)}
+	mounter := &wekafsMounter{mountMap: wekafsMountsMap{}, debugPath: driver.debugPath, selinuxSupport: selinuxSupport, config: driver.config, mountBaseDir: mountBaseDirForRole(driver.csiMode), unmountTimeout: driver.config.unmountTimeout}
 	mounter.gc = initInnerPathVolumeGc(mounter)
 	mounter.gc.config = driver.config
+	mounter.rebuildMountMap(ctx)
 	mounter.schedulePeriodicMountGc(ctx)
+	gcMetrics.setGc(mounter.getTransport(), mounter.gc)
 
 	return mounter
 }
@@ -83,6 +87,8 @@ func (m *wekafsMounter) getSelinuxStatus(ctx context.Context) bool {
 
 func (m *wekafsMounter) mountWithOptions(ctx context.Context, fsName string, mountOptions MountOptions, apiClient *apiclient.ApiClient) (string, error, UnmountFunc) {
 	mountOptions.setSelinux(m.getSelinuxStatus(ctx), MountProtocolWekafs)
+	// NFS security flavor has no meaning for native WekaFS mounts
+	mountOptions = mountOptions.RemoveOption(MountOptionNfsSec)
 	mountObj := m.NewMount(fsName, mountOptions).(*wekafsMount)
 
 	if err := mountObj.ensureLocalContainerName(ctx, apiClient); err != nil {
@@ -109,6 +115,7 @@ func (m *wekafsMounter) Mount(ctx context.Context, fs string, apiClient *apiclie
 
 func (m *wekafsMounter) unmountWithOptions(ctx context.Context, fsName string, options MountOptions) error {
 	options.setSelinux(m.getSelinuxStatus(ctx), MountProtocolWekafs)
+	options = options.RemoveOption(MountOptionNfsSec)
 	log.Ctx(ctx).Trace().Strs("mount_options", options.Strings()).Str("filesystem", fsName).Msg("Received an unmount request")
 	mnt := m.NewMount(fsName, options).(*wekafsMount)
 
@@ -191,6 +198,66 @@ func (m *wekafsMounter) schedulePeriodicMountGc(ctx context.Context) {
 	}()
 }
 
+func (m *wekafsMounter) getMountBaseDir() string {
+	return m.mountBaseDir
+}
+
 func (m *wekafsMounter) getTransport() DataTransport {
 	return dataTransportWekafs
 }
+
+// resolveTransport returns WekaFS regardless of the requested transport, as the node serves only WekaFS
+//
+//goland:noinspection GoUnusedParameter
+func (m *wekafsMounter) resolveTransport(ctx context.Context, requested DataTransport) DataTransport {
+	return m.getTransport()
+}
+
+func (m *wekafsMounter) getMountStats() (mounts int, references int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, refCount := range m.mountMap {
+		if refCount > 0 {
+			mounts++
+			references += refCount
+		}
+	}
+	return mounts, references
+}
+
+// rebuildMountMap restores refcounts of wekafs mounts made before the plugin was restarted
+func (m *wekafsMounter) rebuildMountMap(ctx context.Context) {
+	if m.debugPath != "" {
+		return
+	}
+	if m.kMounter == nil {
+		m.kMounter = mount.New("")
+	}
+	refs, targets := rebuildMountRefs(ctx, m.getTransport(), m.mountBaseDir, m.kMounter, m.unmountTimeout)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for refIndex, refCount := range refs {
+		m.mountMap[refIndex] = refCount
+	}
+	m.recoveredTargets = targets
+}
+
+func (m *wekafsMounter) releaseRecoveredTarget(ctx context.Context, targetPath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	releaseRecoveredTarget(ctx, m.mountMap, m.recoveredTargets, m.kMounter, m.getTransport(), m.unmountTimeout, m.mountBaseDir, targetPath)
+}
+
+// holdPublishTarget does nothing, as publish targets depend on nothing but the filesystem mount they are bind mounted from
+//
+//goland:noinspection GoUnusedParameter
+func (m *wekafsMounter) holdPublishTarget(ctx context.Context, mountPoint, targetPath string) {}
+
+//goland:noinspection GoUnusedParameter
+func (m *wekafsMounter) releasePublishTarget(ctx context.Context, targetPath string) {}
+
+func (m *wekafsMounter) detachStaleMount(ctx context.Context, mountPoint string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return detachStaleMount(ctx, m.mountMap, m.recoveredTargets, m.mountBaseDir, mountPoint, lazyUnmount)
+}